@@ -0,0 +1,299 @@
+package assembler
+
+import (
+	"fmt"
+	"strings"
+
+	"pep9emulator/isa"
+)
+
+// Program is the result of assembling Pep/9 source. Object is loaded at
+// Origin, for a user program that is 0x0000 and can be handed directly to
+// Pep9Computer.LoadProgram.
+type Program struct {
+	Origin   uint16
+	Object   []byte
+	Symbols  SymbolTable
+	Lines    []Line
+	Warnings ErrorList // Trace tags that could not be used, see Tag
+}
+
+// Line is one line of source together with the address and object code the
+// assembler produced for it.
+type Line struct {
+	Number   int // 1 based source line number
+	Address  uint16
+	Code     []byte
+	Label    string
+	Mnemonic string
+	Operand  string // Operand and addressing mode as written, e.g. "0x000D,d"
+	Comment  string
+	Source   string
+	Tags     []Tag // Trace tags of the variables the line defines or allocates
+}
+
+type Symbol struct {
+	Name   string
+	Value  uint16
+	Line   int  // Line that defined the symbol
+	Equate bool // Defined by .EQUATE rather than by its address
+}
+
+type SymbolTable map[string]Symbol
+
+// Error reports a problem with a single line of source.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// ErrorList is every error found while assembling, in source order.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+type assembly struct {
+	statements []*statement
+	symbols    SymbolTable
+	errors     ErrorList
+	warnings   ErrorList
+	burn       *statement
+}
+
+func (a *assembly) errorf(line int, format string, args ...interface{}) {
+	a.errors = append(a.errors, &Error{Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Assemble translates Pep/9 assembly language source into object code.
+func Assemble(source string) (*Program, error) {
+	a := &assembly{symbols: SymbolTable{}}
+
+	a.firstPass(source)
+	if len(a.errors) == 0 {
+		a.secondPass()
+	}
+	if len(a.errors) > 0 {
+		return nil, a.errors
+	}
+
+	a.traceTags()
+	return a.program(), nil
+}
+
+// firstPass parses every line up to .END, then lays the statements out in
+// memory and defines their labels.
+func (a *assembly) firstPass(source string) {
+	ended := false
+	lines := strings.Split(source, "\n")
+
+	for i, text := range lines {
+		number := i + 1
+		text = strings.TrimRight(text, "\r")
+
+		s, err := parseLine(number, text)
+		if err != nil {
+			a.errorf(number, "%s", err)
+			continue
+		}
+		a.statements = append(a.statements, s)
+
+		if s.inst != nil {
+			err = checkInstruction(s)
+		} else if s.isDot() {
+			err = a.checkDot(s)
+		}
+		if err != nil {
+			a.errorf(number, "%s", err)
+		}
+		if s.mnemonic == ".END" {
+			ended = true
+			break
+		}
+	}
+
+	if !ended {
+		a.errorf(len(lines), "missing .END sentinel")
+	}
+	if len(a.errors) > 0 {
+		return
+	}
+
+	size := a.layout(0)
+	if a.burn == nil || len(a.errors) > 0 {
+		return
+	}
+
+	// .BURN places the image so its last byte lands on the burn address.
+	// Padding for .ALIGN is recomputed at the relocated addresses, which
+	// may move the last byte.
+	burn := int(a.burn.operand.value)
+	base := burn + 1 - size
+	if base < 0 {
+		a.errorf(a.burn.line, "object code does not fit below the burn address %s", a.burn.operand.text)
+		return
+	}
+	if last := base + a.layout(base) - 1; len(a.errors) == 0 && last != burn {
+		a.errorf(a.burn.line, ".ALIGN padding ends the object code at 0x%04X rather than the burn address %s", last, a.burn.operand.text)
+	}
+}
+
+// layout assigns an address to every statement starting at base, defines
+// labels, and returns the total number of bytes.
+func (a *assembly) layout(base int) int {
+	location := base
+	a.symbols = SymbolTable{}
+
+	for _, s := range a.statements {
+		s.address = uint16(location)
+
+		if s.label != "" {
+			if prev, ok := a.symbols[s.label]; ok {
+				a.errorf(s.line, "symbol %s was previously defined on line %d", s.label, prev.Line)
+			} else {
+				sym := Symbol{Name: s.label, Value: s.address, Line: s.line}
+				if s.mnemonic == ".EQUATE" {
+					sym.Value = uint16(s.operand.value)
+					sym.Equate = true
+				}
+				a.symbols[s.label] = sym
+			}
+		}
+
+		switch {
+		case s.inst != nil:
+			location += s.inst.Size()
+		case s.isDot():
+			location += dotSize(s, location)
+		}
+
+		if location > 0x10000 {
+			a.errorf(s.line, "object code exceeds the 64KiB address space")
+			break
+		}
+	}
+
+	return location - base
+}
+
+// checkInstruction validates the operand and addressing mode of an
+// instruction statement.
+func checkInstruction(s *statement) error {
+	if s.inst.IsUnary() {
+		if s.operand != nil {
+			return fmt.Errorf("%s is a unary instruction and takes no operand", s.mnemonic)
+		}
+		return nil
+	}
+	if s.operand == nil {
+		return fmt.Errorf("%s requires an operand", s.mnemonic)
+	}
+	if !s.hasMode {
+		if s.inst.Format != isa.ModeA {
+			return fmt.Errorf("%s requires an addressing mode", s.mnemonic)
+		}
+		s.mode = isa.Immediate // Branches and CALL default to immediate
+	}
+	if !s.inst.Modes.Has(s.mode) {
+		return fmt.Errorf("illegal addressing mode %s for %s", s.mode, s.mnemonic)
+	}
+	if s.operand.kind == stringOperand && (len(s.operand.bytes) < 1 || len(s.operand.bytes) > 2) {
+		return fmt.Errorf("string operand %s must be one or two characters", s.operand.text)
+	}
+	return nil
+}
+
+// secondPass resolves operands now that every symbol is known and produces
+// the object code for each statement.
+func (a *assembly) secondPass() {
+	for _, s := range a.statements {
+		var err error
+		switch {
+		case s.inst != nil:
+			err = a.emitInstruction(s)
+		case s.isDot():
+			err = a.emitDot(s)
+		}
+		if err != nil {
+			a.errorf(s.line, "%s", err)
+		}
+	}
+}
+
+func (a *assembly) emitInstruction(s *statement) error {
+	specifier := s.inst.Encode(s.mode)
+	if s.inst.IsUnary() {
+		s.code = []byte{specifier}
+		return nil
+	}
+
+	value, err := a.value(s.operand)
+	if err != nil {
+		return err
+	}
+	s.code = []byte{specifier, byte(value >> 8), byte(value)}
+	return nil
+}
+
+// value resolves an operand to the 16 bit value it represents.
+func (a *assembly) value(op *operand) (uint16, error) {
+	switch op.kind {
+	case numberOperand, charOperand, stringOperand:
+		return constantValue(op), nil
+	case symbolOperand:
+		sym, ok := a.symbols[op.text]
+		if !ok {
+			return 0, fmt.Errorf("undefined symbol %s", op.text)
+		}
+		return sym.Value, nil
+	}
+	return 0, fmt.Errorf("invalid operand %s", op.text)
+}
+
+func (a *assembly) program() *Program {
+	p := &Program{Symbols: a.symbols, Warnings: a.warnings}
+	burned := a.burn == nil
+
+	for _, s := range a.statements {
+		if burned {
+			if len(p.Object) == 0 {
+				p.Origin = s.address
+			}
+			p.Object = append(p.Object, s.code...)
+		}
+		if s == a.burn {
+			burned = true
+		}
+
+		line := Line{
+			Number:   s.line,
+			Address:  s.address,
+			Code:     s.code,
+			Label:    s.label,
+			Mnemonic: s.mnemonic,
+			Comment:  s.comment,
+			Source:   s.source,
+			Tags:     s.tags,
+		}
+		if s.operand != nil {
+			line.Operand = s.operand.text
+			if s.hasMode {
+				line.Operand += "," + s.mode.String()
+			}
+		}
+		p.Lines = append(p.Lines, line)
+	}
+
+	return p
+}
@@ -0,0 +1,374 @@
+package assembler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func assemble(t *testing.T, source string) *Program {
+	t.Helper()
+	p, err := Assemble(source)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return p
+}
+
+func TestAssembleInstructions(t *testing.T) {
+	p := assemble(t, `
+         LDWA    0x1234,i    ;Load a constant
+         ldba    'H',i
+         STBA    0xFC16,d
+         ADDA    -1,s
+         CPWX    10,sfx
+         BR      0x0003
+         CALL    5,x
+         ASLA
+         STOP
+         .END
+`)
+
+	expected := []byte{
+		0xC0, 0x12, 0x34,
+		0xD0, 0x00, 0x48,
+		0xF1, 0xFC, 0x16,
+		0x63, 0xFF, 0xFF,
+		0xAF, 0x00, 0x0A,
+		0x12, 0x00, 0x03,
+		0x25, 0x00, 0x05,
+		0x0A,
+		0x00,
+	}
+	if !bytes.Equal(p.Object, expected) {
+		t.Errorf("Expected % X got % X", expected, p.Object)
+	}
+}
+
+func TestAssembleLabels(t *testing.T) {
+	p := assemble(t, `
+main:    BR      start       ;Forward reference
+loop:    ADDA    1,i
+start:   CPWA    5,i
+         BRLT    loop
+done:    STOP
+         .END`)
+
+	expected := map[string]uint16{"main": 0x0000, "loop": 0x0003, "start": 0x0006, "done": 0x000C}
+	for name, value := range expected {
+		if sym, ok := p.Symbols[name]; !ok || sym.Value != value {
+			t.Errorf("Expected %s to be 0x%04X got 0x%04X", name, value, sym.Value)
+		}
+	}
+
+	if !bytes.Equal(p.Object[:3], []byte{0x12, 0x00, 0x06}) {
+		t.Errorf("Expected BR start to encode 12 00 06 got % X", p.Object[:3])
+	}
+	if !bytes.Equal(p.Object[9:12], []byte{0x16, 0x00, 0x03}) {
+		t.Errorf("Expected BRLT loop to encode 16 00 03 got % X", p.Object[9:12])
+	}
+}
+
+func TestAssembleLiterals(t *testing.T) {
+	tests := []struct {
+		operand  string
+		expected uint16
+	}{
+		{"65535", 0xFFFF},
+		{"-32768", 0x8000},
+		{"0x00ff", 0x00FF},
+		{"'\\n'", 0x000A},
+		{"'\\x41'", 0x0041},
+		{"';'", 0x003B},
+		{"\"AB\"", 0x4142},
+		{"\"\\\"\"", 0x0022},
+	}
+
+	for _, test := range tests {
+		p := assemble(t, "LDWA "+test.operand+",i ;comment\n.END")
+		value := uint16(p.Object[1])<<8 | uint16(p.Object[2])
+		if value != test.expected {
+			t.Errorf("Expected %s to be 0x%04X got 0x%04X", test.operand, test.expected, value)
+		}
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		line   int
+	}{
+		{"LDWA 1\n.END", 1},            // Missing addressing mode
+		{"STWA 1,i\n.END", 1},          // Can't store to immediate
+		{"BR 1,d\n.END", 1},            // Branches only allow i and x
+		{"NOP 1,d\n.END", 1},           // NOP only allows i
+		{"STOP\nFOO 1,i\n.END", 2},     // Invalid mnemonic
+		{"BR nowhere\n.END", 1},        // Undefined symbol
+		{"a: STOP\na: STOP\n.END", 2},  // Duplicate symbol
+		{"LDWA 65536,i\n.END", 1},      // Out of range
+		{"LDWA \"abc\",i\n.END", 1},    // String too long
+		{"toolongname: STOP\n.END", 1}, // Symbol too long
+		{"STOP 1,i\n.END", 1},          // Unary with an operand
+		{"STOP", 1},                    // Missing .END
+	}
+
+	for _, test := range tests {
+		_, err := Assemble(test.source)
+		var list ErrorList
+		if !errors.As(err, &list) {
+			t.Errorf("Expected an ErrorList for %q got %v", test.source, err)
+			continue
+		}
+		if list[0].Line != test.line {
+			t.Errorf("Expected %q to fail on line %d got %v", test.source, test.line, list[0])
+		}
+	}
+}
+
+func TestAssembleIgnoresAfterEnd(t *testing.T) {
+	p := assemble(t, "STOP\n.END\nthis is not assembled")
+
+	if !bytes.Equal(p.Object, []byte{0x00}) {
+		t.Errorf("Expected 00 got % X", p.Object)
+	}
+}
+
+func TestAssembleDotCommands(t *testing.T) {
+	p := assemble(t, `
+         BR      main
+ch:      .BLOCK  1
+         .ALIGN  8
+num:     .WORD   -2
+msg:     .ASCII  "Hi\n\x00"
+byte:    .BYTE   0xFF
+ptr:     .ADDRSS msg
+five:    .EQUATE 5
+main:    LDWA    five,i
+         STOP
+         .END`)
+
+	expected := []byte{
+		0x12, 0x00, 0x11,
+		0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0xFF, 0xFE,
+		'H', 'i', '\n', 0x00,
+		0xFF,
+		0x00, 0x0A,
+		0xC0, 0x00, 0x05,
+		0x00,
+	}
+	if !bytes.Equal(p.Object, expected) {
+		t.Errorf("Expected % X got % X", expected, p.Object)
+	}
+
+	if sym := p.Symbols["five"]; sym.Value != 5 || !sym.Equate {
+		t.Errorf("Expected five to be an equate of 5 got %+v", sym)
+	}
+	if sym := p.Symbols["num"]; sym.Value != 0x0008 || sym.Equate {
+		t.Errorf("Expected num to be at 0x0008 got %+v", sym)
+	}
+}
+
+func TestAssembleBurn(t *testing.T) {
+	p := assemble(t, `
+ram:     .BLOCK  2
+         .BURN   0xFFFF
+rom:     .WORD   0x1234
+         LDWA    ram,d
+         .END`)
+
+	if p.Origin != 0xFFFB {
+		t.Errorf("Expected origin 0xFFFB got 0x%04X", p.Origin)
+	}
+	if expected := []byte{0x12, 0x34, 0xC1, 0xFF, 0xF9}; !bytes.Equal(p.Object, expected) {
+		t.Errorf("Expected % X got % X", expected, p.Object)
+	}
+	if p.Symbols["ram"].Value != 0xFFF9 || p.Symbols["rom"].Value != 0xFFFB {
+		t.Errorf("Expected ram at 0xFFF9 and rom at 0xFFFB got %+v", p.Symbols)
+	}
+}
+
+func TestAssembleBurnAlign(t *testing.T) {
+	p := assemble(t, `
+         .BLOCK  1
+         .BURN   0xFFFF
+         .ALIGN  2
+rom:     .WORD   0x1234
+         .END`)
+
+	if p.Origin != 0xFFFD || p.Symbols["rom"].Value != 0xFFFE {
+		t.Errorf("Expected origin 0xFFFD and rom at 0xFFFE got 0x%04X and %+v", p.Origin, p.Symbols)
+	}
+	if expected := []byte{0x00, 0x12, 0x34}; !bytes.Equal(p.Object, expected) {
+		t.Errorf("Expected % X got % X", expected, p.Object)
+	}
+
+	// The padding laid out from 0 disappears at the burn address.
+	_, err := Assemble(`
+         .BLOCK  1
+         .BURN   0xFFFE
+         .ALIGN  2
+         .WORD   0x1234
+         .END`)
+	if err == nil || !strings.Contains(err.Error(), "ends the object code at 0xFFFD") {
+		t.Errorf("Expected the object code to end at 0xFFFD got %v", err)
+	}
+}
+
+func TestAssembleBurnDuplicateLabel(t *testing.T) {
+	_, err := Assemble(`
+here:    .BLOCK  1
+here:    .BLOCK  1
+         .BURN   0xFFFF
+         .END`)
+
+	if errs, ok := err.(ErrorList); !ok || len(errs) != 1 {
+		t.Errorf("Expected one error got %v", err)
+	}
+}
+
+func TestAssembleDotErrors(t *testing.T) {
+	tests := []string{
+		".ALIGN 3\n.END",
+		".BYTE 256\n.END",
+		".WORD sym\n.END",
+		".EQUATE 1\n.END",
+		".ADDRSS 1\n.END",
+		".BURN 0xFFFF\n.BURN 0xFFFF\n.END",
+		".BLOCK 2,d\n.END",
+		".FOO\n.END",
+	}
+
+	for _, source := range tests {
+		if _, err := Assemble(source); err == nil {
+			t.Errorf("Expected %q to fail", source)
+		}
+	}
+}
+
+func TestListing(t *testing.T) {
+	p := assemble(t, `;A short program
+         LDBA    ch,d        ;Load the character
+         STOP
+ch:      .ASCII  "abcd"
+one:     .EQUATE 1
+         .END`)
+
+	expected := `-------------------------------------------------------------------------------
+      Object
+Addr  code   Symbol   Mnemon  Operand     Comment
+-------------------------------------------------------------------------------
+             ;A short program
+0000  D10004          LDBA    ch,d        ;Load the character
+0003  00              STOP
+0004  616263 ch:      .ASCII  "abcd"
+0007  64
+             one:     .EQUATE 1
+                      .END
+-------------------------------------------------------------------------------
+
+
+Symbol table
+--------------------------------------
+Symbol    Value        Symbol    Value
+--------------------------------------
+ch        0004         one       0001
+--------------------------------------
+`
+	if got := p.Listing().String(); got != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestWriteObject(t *testing.T) {
+	p := assemble(t, `
+         .BLOCK  15
+         LDWA    0x1234,i
+         STOP
+         .END`)
+
+	var b strings.Builder
+	if err := p.WriteObject(&b); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := "00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 C0\n12 34 00 zz\n"
+	if b.String() != expected {
+		t.Errorf("Expected %q got %q", expected, b.String())
+	}
+}
+
+func TestTraceTags(t *testing.T) {
+	p := assemble(t, `
+         BR      main
+count:   .BLOCK  2           ;#2d
+name:    .BLOCK  4           ;#1c4a
+point:   .BLOCK  4           ;#x #y
+x:       .EQUATE 2           ;#2h
+y:       .EQUATE 0           ;#2d
+main:    SUBSP   4,i         ;push #x #y
+         CALL    new         ;#y
+         ADDSP   4,i         ;pop #y #x
+         STOP
+new:     RET                 ;#not a tag
+         .END
+`)
+	if len(p.Warnings) != 0 {
+		t.Errorf("Expected no warnings got %v", p.Warnings)
+	}
+
+	tags := map[string]string{}
+	for _, line := range p.Lines {
+		for _, tag := range line.Tags {
+			tags[line.Mnemonic+" "+tag.Name] += tag.String()
+		}
+	}
+	expected := map[string]string{
+		".BLOCK count":   "#2d",
+		".BLOCK name":    "#1c4a",
+		".BLOCK point.x": "#2h",
+		".BLOCK point.y": "#2d",
+		".EQUATE x":      "#2h",
+		".EQUATE y":      "#2d",
+		"SUBSP x":        "#2h",
+		"SUBSP y":        "#2d",
+		"CALL y":         "#2d",
+		"ADDSP x":        "#2h",
+		"ADDSP y":        "#2d",
+	}
+	if len(tags) != len(expected) {
+		t.Errorf("Expected %d tags got %v", len(expected), tags)
+	}
+	for name, tag := range expected {
+		if tags[name] != tag {
+			t.Errorf("Expected %s tagged %s got %q", name, tag, tags[name])
+		}
+	}
+}
+
+func TestTraceTagWarnings(t *testing.T) {
+	p := assemble(t, `
+x:       .EQUATE 2           ;#2d
+big:     .BLOCK  3           ;#2d
+         SUBSP   4,i         ;#x
+         ADDSP   2,i         ;#missing
+         SUBSP   2,s         ;#x
+chars:   .BLOCK  2           ;#2c
+         .END
+`)
+	var lines []int
+	for _, w := range p.Warnings {
+		lines = append(lines, w.Line)
+	}
+	if fmt.Sprint(lines) != "[3 4 5 6]" {
+		t.Errorf("Expected warnings on lines [3 4 5 6] got %v: %v", lines, p.Warnings)
+	}
+	for _, line := range p.Lines {
+		if len(line.Tags) > 0 && line.Mnemonic != ".EQUATE" {
+			t.Errorf("Expected line %d untagged got %v", line.Number, line.Tags)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package assembler
+
+import "fmt"
+
+// checkDot validates the operand of a dot command during the first pass.
+func (a *assembly) checkDot(s *statement) error {
+	op := s.operand
+
+	switch s.mnemonic {
+	case ".END":
+		if op != nil {
+			return fmt.Errorf(".END takes no operand")
+		}
+		return nil
+	case ".ADDRSS":
+		if op == nil || op.kind != symbolOperand {
+			return fmt.Errorf(".ADDRSS requires a symbol")
+		}
+	case ".ALIGN":
+		if op == nil || op.kind != numberOperand || (op.value != 2 && op.value != 4 && op.value != 8) {
+			return fmt.Errorf(".ALIGN requires 2, 4 or 8")
+		}
+	case ".ASCII":
+		if op == nil || op.kind != stringOperand {
+			return fmt.Errorf(".ASCII requires a string")
+		}
+	case ".BLOCK":
+		if op == nil || op.kind != numberOperand || op.value < 0 {
+			return fmt.Errorf(".BLOCK requires a number of bytes (0..65535)")
+		}
+	case ".BURN":
+		if op == nil || op.kind != numberOperand || op.value < 0 {
+			return fmt.Errorf(".BURN requires an address")
+		}
+		if a.burn != nil {
+			return fmt.Errorf("only one .BURN is allowed, the first is on line %d", a.burn.line)
+		}
+		a.burn = s
+	case ".BYTE":
+		if op == nil || op.kind == symbolOperand {
+			return fmt.Errorf(".BYTE requires a constant")
+		}
+		if err := checkByte(op); err != nil {
+			return err
+		}
+	case ".EQUATE":
+		if s.label == "" {
+			return fmt.Errorf(".EQUATE requires a label")
+		}
+		if err := checkConstant(s.mnemonic, op); err != nil {
+			return err
+		}
+		// Resolve now so the symbol has its value for the rest of the first pass.
+		op.value = int(constantValue(op))
+	case ".WORD":
+		if err := checkConstant(s.mnemonic, op); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid dot command %s", s.mnemonic)
+	}
+
+	if s.hasMode {
+		return fmt.Errorf("%s does not take an addressing mode", s.mnemonic)
+	}
+	return nil
+}
+
+func checkConstant(mnemonic string, op *operand) error {
+	if op == nil || op.kind == symbolOperand {
+		return fmt.Errorf("%s requires a constant", mnemonic)
+	}
+	if op.kind == stringOperand && (len(op.bytes) < 1 || len(op.bytes) > 2) {
+		return fmt.Errorf("string operand %s must be one or two characters", op.text)
+	}
+	return nil
+}
+
+func checkByte(op *operand) error {
+	switch op.kind {
+	case numberOperand:
+		if op.value < -128 || op.value > 255 {
+			return fmt.Errorf("byte value %s is out of range (-128..255)", op.text)
+		}
+	case stringOperand:
+		if len(op.bytes) != 1 {
+			return fmt.Errorf("string operand %s must be one character", op.text)
+		}
+	}
+	return nil
+}
+
+// constantValue returns the value of a number, char or short string.
+func constantValue(op *operand) uint16 {
+	if op.kind == stringOperand {
+		var v uint16
+		for _, b := range op.bytes {
+			v = v<<8 | uint16(b)
+		}
+		return v
+	}
+	return uint16(op.value)
+}
+
+// dotSize returns the number of bytes a dot command occupies when placed at
+// location.
+func dotSize(s *statement, location int) int {
+	switch s.mnemonic {
+	case ".ADDRSS", ".WORD":
+		return 2
+	case ".ALIGN":
+		n := s.operand.value
+		return (n - location%n) % n
+	case ".ASCII":
+		return len(s.operand.bytes)
+	case ".BLOCK":
+		return s.operand.value
+	case ".BYTE":
+		return 1
+	}
+	return 0
+}
+
+// emitDot produces the object code for a dot command.
+func (a *assembly) emitDot(s *statement) error {
+	switch s.mnemonic {
+	case ".ADDRSS":
+		value, err := a.value(s.operand)
+		if err != nil {
+			return err
+		}
+		s.code = []byte{byte(value >> 8), byte(value)}
+	case ".ALIGN", ".BLOCK":
+		s.code = make([]byte, dotSize(s, int(s.address)))
+	case ".ASCII":
+		s.code = append([]byte(nil), s.operand.bytes...)
+	case ".BYTE":
+		s.code = []byte{byte(constantValue(s.operand))}
+	case ".WORD":
+		value := constantValue(s.operand)
+		s.code = []byte{byte(value >> 8), byte(value)}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package assembler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const listingRule = "-------------------------------------------------------------------------------"
+
+// bytesPerRow is the most object code shown on one row of a listing, the
+// size of a non-unary instruction.
+const bytesPerRow = 3
+
+// Listing is the structured form of a Pep/9 assembler listing.
+type Listing struct {
+	Rows    []ListingRow
+	Symbols []Symbol // Sorted by name
+}
+
+// ListingRow is one row of a listing. Object code longer than three bytes
+// continues on following rows that only have an address and code.
+type ListingRow struct {
+	Line       int // Source line number, 0 for continuation rows
+	Address    uint16
+	HasAddress bool
+	Code       []byte
+	Label      string
+	Mnemonic   string
+	Operand    string
+	Comment    string
+}
+
+// Sorted returns the symbols ordered by name.
+func (t SymbolTable) Sorted() []Symbol {
+	symbols := make([]Symbol, 0, len(t))
+	for _, sym := range t {
+		symbols = append(symbols, sym)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[i].Name < symbols[j].Name
+	})
+	return symbols
+}
+
+// Listing builds the listing for an assembled program.
+func (p *Program) Listing() *Listing {
+	l := &Listing{Symbols: p.Symbols.Sorted()}
+
+	for _, line := range p.Lines {
+		row := ListingRow{
+			Line:     line.Number,
+			Address:  line.Address,
+			Label:    line.Label,
+			Mnemonic: line.Mnemonic,
+			Operand:  line.Operand,
+			Comment:  line.Comment,
+		}
+		row.HasAddress = line.Mnemonic != "" && line.Mnemonic != ".EQUATE" && line.Mnemonic != ".END"
+
+		code := line.Code
+		if len(code) > bytesPerRow {
+			row.Code = code[:bytesPerRow]
+		} else {
+			row.Code = code
+		}
+		l.Rows = append(l.Rows, row)
+
+		for i := bytesPerRow; i < len(code); i += bytesPerRow {
+			end := i + bytesPerRow
+			if end > len(code) {
+				end = len(code)
+			}
+			l.Rows = append(l.Rows, ListingRow{
+				Address:    line.Address + uint16(i),
+				HasAddress: true,
+				Code:       code[i:end],
+			})
+		}
+	}
+
+	return l
+}
+
+// WriteTo writes the listing as text in the layout of a Pep/9 .pepl file.
+func (l *Listing) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	fmt.Fprintln(cw, listingRule)
+	fmt.Fprintln(cw, "      Object")
+	fmt.Fprintln(cw, "Addr  code   Symbol   Mnemon  Operand     Comment")
+	fmt.Fprintln(cw, listingRule)
+
+	for _, row := range l.Rows {
+		fmt.Fprintln(cw, strings.TrimRight(row.String(), " "))
+	}
+	fmt.Fprintln(cw, listingRule)
+
+	if len(l.Symbols) > 0 {
+		rule := strings.Repeat("-", 38)
+		fmt.Fprintln(cw)
+		fmt.Fprintln(cw)
+		fmt.Fprintln(cw, "Symbol table")
+		fmt.Fprintln(cw, rule)
+		fmt.Fprintln(cw, "Symbol    Value        Symbol    Value")
+		fmt.Fprintln(cw, rule)
+		for i := 0; i < len(l.Symbols); i += 2 {
+			text := fmt.Sprintf("%-9s %04X", l.Symbols[i].Name, l.Symbols[i].Value)
+			if i+1 < len(l.Symbols) {
+				text += fmt.Sprintf("         %-9s %04X", l.Symbols[i+1].Name, l.Symbols[i+1].Value)
+			}
+			fmt.Fprintln(cw, text)
+		}
+		fmt.Fprintln(cw, rule)
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.(*bufio.Writer).Flush()
+}
+
+func (l *Listing) String() string {
+	var b strings.Builder
+	l.WriteTo(&b)
+	return b.String()
+}
+
+func (r ListingRow) String() string {
+	var address, label, comment string
+	if r.HasAddress {
+		address = fmt.Sprintf("%04X", r.Address)
+	}
+	if r.Line == 0 { // Continuation of the object code above
+		return fmt.Sprintf("%-4s  %X", address, r.Code)
+	}
+	if r.Comment != "" {
+		comment = ";" + r.Comment
+	}
+	if r.Mnemonic == "" && r.Label == "" { // Blank and comment only lines
+		return fmt.Sprintf("%-4s  %-6s %s", "", "", comment)
+	}
+	if r.Label != "" {
+		label = r.Label + ":"
+	}
+	return fmt.Sprintf("%-4s  %-6X %-9s%-8s%-12s%s", address, r.Code, label, r.Mnemonic, r.Operand, comment)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,29 @@
+package assembler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// objectBytesPerLine is how many hex pairs Pep/9 writes on each line of an
+// object file.
+const objectBytesPerLine = 16
+
+// WriteObject writes the object code in the Pep/9 .pepo format, space
+// separated hex pairs terminated by "zz".
+func (p *Program) WriteObject(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	for i, b := range p.Object {
+		fmt.Fprintf(bw, "%02X", b)
+		if (i+1)%objectBytesPerLine == 0 {
+			bw.WriteByte('\n')
+		} else {
+			bw.WriteByte(' ')
+		}
+	}
+	bw.WriteString("zz\n")
+
+	return bw.Flush()
+}
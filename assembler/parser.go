@@ -0,0 +1,289 @@
+package assembler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"pep9emulator/isa"
+)
+
+// maxSymbolLength matches the limit imposed by the reference Pep/9 assembler.
+const maxSymbolLength = 8
+
+type operandKind int
+
+const (
+	numberOperand operandKind = iota
+	charOperand
+	stringOperand
+	symbolOperand
+)
+
+type operand struct {
+	kind  operandKind
+	text  string // As written in the source
+	value int    // Numbers and chars
+	bytes []byte // Decoded strings
+}
+
+type statement struct {
+	line     int
+	source   string
+	label    string
+	mnemonic string // Upper case mnemonic or dot command, e.g. "LDWA" or ".WORD"
+	inst     *isa.Instruction
+	operand  *operand
+	mode     isa.Mode
+	hasMode  bool
+	comment  string
+	address  uint16
+	code     []byte
+	tags     []Tag
+}
+
+func (s *statement) isDot() bool {
+	return strings.HasPrefix(s.mnemonic, ".")
+}
+
+// parseLine splits one line of source into its label, mnemonic, operand,
+// addressing mode and comment.
+func parseLine(number int, source string) (*statement, error) {
+	s := &statement{line: number, source: source}
+	rest := source
+
+	if i := commentStart(rest); i >= 0 {
+		s.comment = strings.TrimRight(rest[i+1:], " \t\r")
+		rest = rest[:i]
+	}
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return s, nil
+	}
+
+	word, tail := nextWord(rest)
+	if strings.HasSuffix(word, ":") {
+		s.label = strings.TrimSuffix(word, ":")
+		if err := checkSymbol(s.label); err != nil {
+			return nil, err
+		}
+		word, tail = nextWord(tail)
+		if word == "" {
+			return nil, fmt.Errorf("missing mnemonic or dot command after label %s", s.label)
+		}
+	}
+
+	if strings.HasPrefix(word, ".") {
+		s.mnemonic = strings.ToUpper(word)
+	} else {
+		inst, ok := isa.Lookup(word)
+		if !ok {
+			return nil, fmt.Errorf("invalid mnemonic %q", word)
+		}
+		s.inst = inst
+		s.mnemonic = inst.Mnemonic
+	}
+
+	tail = strings.TrimSpace(tail)
+	if tail == "" {
+		return s, nil
+	}
+
+	text, modeText, hasMode, err := splitMode(tail)
+	if err != nil {
+		return nil, err
+	}
+	if s.operand, err = parseOperand(text); err != nil {
+		return nil, err
+	}
+	if hasMode {
+		mode, ok := isa.ParseMode(modeText)
+		if !ok {
+			return nil, fmt.Errorf("invalid addressing mode %q", modeText)
+		}
+		s.mode = mode
+		s.hasMode = true
+	}
+
+	return s, nil
+}
+
+// commentStart finds the ';' that starts a comment, skipping any inside
+// character or string literals.
+func commentStart(line string) int {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case quote == 0 && c == ';':
+			return i
+		}
+	}
+	return -1
+}
+
+func nextWord(s string) (string, string) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	end := strings.IndexFunc(s, unicode.IsSpace)
+	if i := strings.IndexByte(s, ':'); i >= 0 && (end < 0 || i < end) {
+		end = i + 1
+	}
+	if end < 0 {
+		return s, ""
+	}
+	return s[:end], s[end:]
+}
+
+// splitMode separates "operand,mode" keeping commas inside literals intact.
+func splitMode(s string) (string, string, bool, error) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case quote == 0 && c == ',':
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), true, nil
+		}
+	}
+	if quote != 0 {
+		return "", "", false, fmt.Errorf("unterminated literal %s", s)
+	}
+	return strings.TrimSpace(s), "", false, nil
+}
+
+func parseOperand(text string) (*operand, error) {
+	if text == "" {
+		return nil, fmt.Errorf("missing operand")
+	}
+	op := &operand{text: text}
+
+	switch c := text[0]; {
+	case c == '\'':
+		b, err := unquote(text, '\'')
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != 1 {
+			return nil, fmt.Errorf("character literal %s must contain exactly one character", text)
+		}
+		op.kind = charOperand
+		op.value = int(b[0])
+	case c == '"':
+		b, err := unquote(text, '"')
+		if err != nil {
+			return nil, err
+		}
+		op.kind = stringOperand
+		op.bytes = b
+	case strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X"):
+		v, err := strconv.ParseUint(text[2:], 16, 32)
+		if err != nil || len(text) == 2 {
+			return nil, fmt.Errorf("invalid hexadecimal constant %s", text)
+		}
+		if v > 0xFFFF {
+			return nil, fmt.Errorf("hexadecimal constant %s is out of range (0x0000..0xFFFF)", text)
+		}
+		op.kind = numberOperand
+		op.value = int(v)
+	case c == '-' || c == '+' || (c >= '0' && c <= '9'):
+		v, err := strconv.ParseInt(text, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid decimal constant %s", text)
+		}
+		if v < -32768 || v > 65535 {
+			return nil, fmt.Errorf("decimal constant %s is out of range (-32768..65535)", text)
+		}
+		op.kind = numberOperand
+		op.value = int(v)
+	default:
+		if err := checkSymbol(text); err != nil {
+			return nil, err
+		}
+		op.kind = symbolOperand
+	}
+
+	return op, nil
+}
+
+func checkSymbol(name string) error {
+	if name == "" {
+		return fmt.Errorf("missing symbol")
+	}
+	for i, r := range name {
+		if r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r)) {
+			continue
+		}
+		return fmt.Errorf("invalid symbol %q", name)
+	}
+	if len(name) > maxSymbolLength {
+		return fmt.Errorf("symbol %s is longer than %d characters", name, maxSymbolLength)
+	}
+	return nil
+}
+
+// unquote decodes a quoted character or string literal, including the
+// backslash escapes understood by the reference assembler.
+func unquote(text string, quote byte) ([]byte, error) {
+	if len(text) < 2 || text[len(text)-1] != quote {
+		return nil, fmt.Errorf("unterminated literal %s", text)
+	}
+	body := text[1 : len(text)-1]
+	var out []byte
+
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c == quote {
+			return nil, fmt.Errorf("unescaped %c in literal %s", quote, text)
+		}
+		if c != '\\' {
+			out = append(out, c)
+			continue
+		}
+		i++
+		if i >= len(body) {
+			return nil, fmt.Errorf("invalid escape sequence in %s", text)
+		}
+		switch body[i] {
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'v':
+			out = append(out, '\v')
+		case '\\', '\'', '"':
+			out = append(out, body[i])
+		case 'x', 'X':
+			if i+2 >= len(body) {
+				return nil, fmt.Errorf("invalid hexadecimal escape in %s", text)
+			}
+			v, err := strconv.ParseUint(body[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hexadecimal escape in %s", text)
+			}
+			out = append(out, byte(v))
+			i += 2
+		default:
+			return nil, fmt.Errorf("invalid escape sequence \\%c in %s", body[i], text)
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,160 @@
+package assembler
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"pep9emulator/isa"
+)
+
+// Tag is a trace tag, written in a comment to give memory a type the way
+// the reference Pep/9 tools display variables. A format tag such as #2d,
+// #1c or #2h4a types a global on a .BLOCK, .BYTE, .WORD, .ADDRSS or .ASCII,
+// or an .EQUATE symbol. A symbol tag such as #total on SUBSP, ADDSP or CALL
+// names an .EQUATE whose format tag types that variable:
+//
+//	total:   .EQUATE 2           ;#2d
+//	vector:  .BLOCK  8           ;#2d4a
+//	         SUBSP   2,i         ;push #total
+type Tag struct {
+	Name   string // The variable: the symbol of a symbol tag, or the label of a global
+	Size   int    // Bytes in one element, 1 or 2
+	Format byte   // 'c' for a character, 'd' for decimal or 'h' for hex
+	Count  int    // Elements of an array, 1 for a scalar
+}
+
+// Bytes is the memory the tagged variable takes.
+func (t Tag) Bytes() int {
+	return t.Size * t.Count
+}
+
+// String formats the tag's type as a format tag, such as #2d4a.
+func (t Tag) String() string {
+	s := fmt.Sprintf("#%d%c", t.Size, t.Format)
+	if t.Count != 1 {
+		s += fmt.Sprintf("%da", t.Count)
+	}
+	return s
+}
+
+var formatTag = regexp.MustCompile(`^#([12])([cdh])(?:([0-9]+)a)?$`)
+
+// parseFormatTag reads a format tag. Characters are only one byte.
+func parseFormatTag(word string) (Tag, bool) {
+	m := formatTag.FindStringSubmatch(word)
+	if m == nil || m[1] == "2" && m[2] == "c" {
+		return Tag{}, false
+	}
+	tag := Tag{Size: int(m[1][0] - '0'), Format: m[2][0], Count: 1}
+	if m[3] != "" {
+		count, err := strconv.Atoi(m[3])
+		if err != nil || count < 1 {
+			return Tag{}, false
+		}
+		tag.Count = count
+	}
+	return tag, true
+}
+
+// commentTags splits the trace tags of a comment into format tags and the
+// names of symbol tags. Other words starting with # are not tags.
+func commentTags(comment string) (formats []Tag, symbols []string) {
+	for _, word := range strings.Fields(comment) {
+		if !strings.HasPrefix(word, "#") {
+			continue
+		}
+		if tag, ok := parseFormatTag(word); ok {
+			formats = append(formats, tag)
+		} else if checkSymbol(word[1:]) == nil {
+			symbols = append(symbols, word[1:])
+		}
+	}
+	return formats, symbols
+}
+
+// warnf records a trace tag problem. Tags are only a debugging aid, so a
+// bad one leaves its line untagged rather than stopping assembly.
+func (a *assembly) warnf(line int, format string, args ...interface{}) {
+	a.warnings = append(a.warnings, &Error{Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// traceTags resolves the trace tags of every statement once the symbols
+// are known.
+func (a *assembly) traceTags() {
+	types := map[string]Tag{}
+	for _, s := range a.statements {
+		if formats, _ := commentTags(s.comment); s.mnemonic == ".EQUATE" && s.label != "" && len(formats) > 0 {
+			formats[0].Name = s.label
+			types[s.label] = formats[0]
+			s.tags = formats[:1]
+		}
+	}
+
+	// resolve types the symbol tags of a statement.
+	resolve := func(s *statement, names []string) ([]Tag, bool) {
+		var tags []Tag
+		for _, name := range names {
+			tag, ok := types[name]
+			if !ok {
+				a.warnf(s.line, "trace tag #%s is not an .EQUATE with a format tag", name)
+				return nil, false
+			}
+			tags = append(tags, tag)
+		}
+		return tags, true
+	}
+	size := func(tags []Tag) int {
+		total := 0
+		for _, tag := range tags {
+			total += tag.Bytes()
+		}
+		return total
+	}
+
+	for _, s := range a.statements {
+		formats, names := commentTags(s.comment)
+		switch s.mnemonic {
+		case ".BLOCK", ".BYTE", ".WORD", ".ADDRSS", ".ASCII":
+			var tags []Tag
+			var ok bool
+			switch {
+			case len(formats) > 0:
+				formats[0].Name = s.label
+				tags, ok = formats[:1], true
+			case len(names) > 0: // A global struct, its fields named after the label
+				if tags, ok = resolve(s, names); ok && s.label != "" {
+					for i := range tags {
+						tags[i].Name = s.label + "." + tags[i].Name
+					}
+				}
+			}
+			if !ok {
+				continue
+			}
+			if size(tags) != len(s.code) {
+				a.warnf(s.line, "trace tags take %d bytes but %s reserves %d", size(tags), s.mnemonic, len(s.code))
+				continue
+			}
+			s.tags = tags
+		case "SUBSP", "ADDSP":
+			if len(names) == 0 {
+				continue
+			}
+			tags, ok := resolve(s, names)
+			if !ok {
+				continue
+			}
+			if s.mode != isa.Immediate || size(tags) != int(uint16(s.code[1])<<8|uint16(s.code[2])) {
+				a.warnf(s.line, "trace tags take %d bytes but %s %s does not", size(tags), s.mnemonic, s.operand.text)
+				continue
+			}
+			s.tags = tags
+		case "CALL":
+			if len(names) > 0 {
+				s.tags, _ = resolve(s, names)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package computer
+
+import "fmt"
+
+// Call is a CALL that has not returned yet.
+type Call struct {
+	PC     uint16 // Address of the CALL
+	Target uint16 // The function called
+	Return uint16 // Address it returns to, pushed on the stack
+	SP     uint16 // Where the return address was pushed
+}
+
+// BadReturn is a RET that did not return from the innermost call the way
+// it was made: the return address was overwritten while the call ran, the
+// stack pointer matched no call, or inner calls were abandoned without
+// returning.
+type BadReturn struct {
+	PC      uint16 // Address of the RET
+	SP      uint16 // Where it read the return address
+	Return  uint16 // The address it returned to
+	Call    *Call  // The call it returned from, nil when SP matched none
+	Skipped int    // Inner calls abandoned
+}
+
+// Smashed reports whether the return address of the call was overwritten.
+func (b BadReturn) Smashed() bool {
+	return b.Call != nil && b.Return != b.Call.Return
+}
+
+func (b BadReturn) String() string {
+	switch {
+	case b.Call == nil:
+		return fmt.Sprintf("RET at 0x%04X returned to 0x%04X from 0x%04X on the stack, where no CALL pushed a return address",
+			b.PC, b.Return, b.SP)
+	case b.Smashed():
+		return fmt.Sprintf("stack smashed: RET at 0x%04X returned to 0x%04X but CALL at 0x%04X pushed 0x%04X at 0x%04X",
+			b.PC, b.Return, b.Call.PC, b.Call.Return, b.SP)
+	}
+	return fmt.Sprintf("RET at 0x%04X returned from CALL at 0x%04X past %d calls that did not return",
+		b.PC, b.Call.PC, b.Skipped)
+}
+
+// CallStack is a shadow of the calls on the run-time stack, kept from the
+// CALL and RET instructions executed rather than read from memory, so it
+// survives a program that overwrites its stack. A RET returns from the
+// innermost call whose return address it reads, and every RET that does
+// not simply return from the innermost call is recorded.
+type CallStack struct {
+	Calls      []Call      // Outermost first
+	BadReturns []BadReturn // Oldest first
+	Base       uint16      // SP when the program started, set by InitializeMode
+}
+
+// Reset empties the stack for a program starting with the stack at sp.
+func (s *CallStack) Reset(sp uint16) {
+	s.Calls = nil
+	s.BadReturns = nil
+	s.Base = sp
+}
+
+func (s *CallStack) call(c Call) {
+	s.Calls = append(s.Calls, c)
+}
+
+// ret pops the call whose return address a RET at pc read from sp.
+func (s *CallStack) ret(pc, sp, returnAddress uint16) {
+	for i := len(s.Calls) - 1; i >= 0; i-- {
+		if s.Calls[i].SP != sp {
+			continue
+		}
+		call := s.Calls[i]
+		skipped := len(s.Calls) - 1 - i
+		s.Calls = s.Calls[:i]
+		if skipped > 0 || call.Return != returnAddress {
+			s.BadReturns = append(s.BadReturns, BadReturn{PC: pc, SP: sp, Return: returnAddress, Call: &call, Skipped: skipped})
+		}
+		return
+	}
+	s.BadReturns = append(s.BadReturns, BadReturn{PC: pc, SP: sp, Return: returnAddress})
+}
+
+// CallFrame is a function on the call stack and the part of the stack it
+// uses, from the stack pointer up to and including its return address.
+type CallFrame struct {
+	PC        uint16 // Where it is executing, or resumes when its callee returns
+	Call      *Call  // The call that entered it, nil for the outermost frame
+	Low, High uint16
+}
+
+// Backtrace lists the frames on the stack, innermost first, for a computer
+// at pc with the stack at sp. The outermost frame reaches up to Base, and
+// is empty, with High just below Low, when nothing has been pushed.
+func (s *CallStack) Backtrace(pc, sp uint16) []CallFrame {
+	var frames []CallFrame
+	for i := len(s.Calls) - 1; i >= 0; i-- {
+		call := s.Calls[i]
+		frames = append(frames, CallFrame{PC: pc, Call: &call, Low: sp, High: call.SP + 1})
+		pc, sp = call.Return, call.SP+2
+	}
+	return append(frames, CallFrame{PC: pc, Low: sp, High: s.Base - 1})
+}
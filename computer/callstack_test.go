@@ -0,0 +1,110 @@
+package computer
+
+import (
+	"fmt"
+	"testing"
+
+	"pep9emulator/assembler"
+)
+
+func runWithCallStack(t *testing.T, source string) (*Pep9Computer, *CallStack) {
+	t.Helper()
+	p := &Pep9Computer{CallStack: &CallStack{}}
+	p.Initialize()
+	p.LoadProgram(assemble(t, source))
+	p.ExecuteVonNeumann()
+	return p, p.CallStack
+}
+
+func TestBacktrace(t *testing.T) {
+	program, err := assembler.Assemble(`
+main:    LDWA    3,i
+         CALL    down
+         STOP
+down:    SUBSP   2,i
+         STWA    0,s
+         CPWA    0,i
+         BREQ    bottom
+         SUBA    1,i
+         CALL    down
+back:    ADDSP   2,i
+         RET
+bottom:  ADDSP   2,i
+         RET
+         .END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbol := func(name string) uint16 { return program.Symbols[name].Value }
+
+	p := &Pep9Computer{CallStack: &CallStack{}}
+	p.Initialize()
+	p.LoadProgram(program.Object)
+	for p.PC != symbol("bottom") {
+		if _, err := p.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := p.CallStack
+	if len(s.Calls) != 4 || s.Calls[0].PC != 0x0003 || s.Calls[0].Return != 0x0006 || s.Calls[3].Target != symbol("down") || s.Calls[3].Return != symbol("back") {
+		t.Errorf("calls %+v", s.Calls)
+	}
+	var got string
+	for _, frame := range s.Backtrace(p.PC, p.SP) {
+		got += fmt.Sprintf("%04X %04X-%04X,", frame.PC, frame.Low, frame.High)
+	}
+	bottom, back := symbol("bottom"), symbol("back")
+	expected := fmt.Sprintf("%04X FB7F-FB82,%04X FB83-FB86,%04X FB87-FB8A,%04X FB8B-FB8E,0006 FB8F-FB8E,", bottom, back, back, back)
+	if got != expected {
+		t.Errorf("backtrace %s, expected %s", got, expected)
+	}
+
+	p.ExecuteVonNeumann()
+	if len(s.Calls) != 0 || len(s.BadReturns) != 0 {
+		t.Errorf("after returning %+v", s)
+	}
+	p.Initialize()
+	if s.Base != 0xFB8F {
+		t.Errorf("base 0x%04X", s.Base)
+	}
+}
+
+func TestBadReturns(t *testing.T) {
+	_, s := runWithCallStack(t, `
+         CALL    f
+         STOP
+f:       LDWA    0x1234,i
+         STWA    0,s
+         RET
+         .END`)
+	if len(s.BadReturns) != 1 || !s.BadReturns[0].Smashed() || s.BadReturns[0].Return != 0x1234 || s.BadReturns[0].Call.Return != 0x0003 {
+		t.Errorf("smashed return %+v", s.BadReturns)
+	} else if got := s.BadReturns[0].String(); got != "stack smashed: RET at 0x000A returned to 0x1234 but CALL at 0x0000 pushed 0x0003 at 0xFB8D" {
+		t.Errorf("got %s", got)
+	}
+
+	_, s = runWithCallStack(t, `
+         LDWA    after,i
+         STWA    -2,s
+         SUBSP   2,i
+         RET
+after:   STOP
+         .END`)
+	if len(s.BadReturns) != 1 || s.BadReturns[0].Call != nil || s.BadReturns[0].SP != 0xFB8D {
+		t.Errorf("return without a call %+v", s.BadReturns)
+	}
+
+	// inner drops its return address and returns from outer.
+	p, s := runWithCallStack(t, `
+         CALL    outer
+         STOP
+outer:   CALL    inner
+         STOP
+inner:   ADDSP   2,i
+         RET
+         .END`)
+	if len(s.BadReturns) != 1 || s.BadReturns[0].Skipped != 1 || s.BadReturns[0].Smashed() || len(s.Calls) != 0 || p.PC != 0x0004 {
+		t.Errorf("skipped return %+v", s.BadReturns)
+	}
+}
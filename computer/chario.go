@@ -0,0 +1,90 @@
+package computer
+
+import (
+	"errors"
+	"io"
+)
+
+// CharIn is the character input device, reading one byte from Reader for
+// each load. Once Reader is exhausted every load returns EOFValue, which is
+// NUL unless set otherwise, so a program can detect the end of its input
+// by comparing against it. A nil Reader is an empty input.
+type CharIn struct {
+	Reader   io.Reader
+	EOFValue uint8
+
+	eof bool
+	err error
+}
+
+func (d *CharIn) Load(uint16) uint8 {
+	if d.eof || d.Reader == nil {
+		d.eof = true
+		return d.EOFValue
+	}
+
+	var b [1]byte
+	for {
+		n, err := d.Reader.Read(b[:])
+		if n == 1 {
+			return b[0]
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				d.err = err
+			}
+			d.eof = true
+			return d.EOFValue
+		}
+	}
+}
+
+// Store does nothing, the input device is read only.
+func (d *CharIn) Store(uint16, uint8) {}
+
+// Reset clears the end of input so a new Reader can be read.
+func (d *CharIn) Reset() {
+	d.eof = false
+	d.err = nil
+}
+
+// EOF reports whether a load has gone past the end of the input.
+func (d *CharIn) EOF() bool {
+	return d.eof
+}
+
+// Err returns the error that ended the input, nil for a plain end of file.
+func (d *CharIn) Err() error {
+	return d.err
+}
+
+// CharOut is the character output device, writing each stored byte to
+// Writer. Output to a nil Writer is discarded.
+type CharOut struct {
+	Writer io.Writer
+
+	err error
+}
+
+// Load returns zero, the output device is write only.
+func (d *CharOut) Load(uint16) uint8 {
+	return 0
+}
+
+func (d *CharOut) Store(_ uint16, value uint8) {
+	if d.Writer == nil || d.err != nil {
+		return
+	}
+	if _, err := d.Writer.Write([]byte{value}); err != nil {
+		d.err = err
+	}
+}
+
+func (d *CharOut) Reset() {
+	d.err = nil
+}
+
+// Err returns the first error from Writer. Output stops after an error.
+func (d *CharOut) Err() error {
+	return d.err
+}
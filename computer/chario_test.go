@@ -0,0 +1,77 @@
+package computer
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+const echo = `
+loop:    LDBA    charIn,d
+         BREQ    done
+         STBA    charOut,d
+         BR      loop
+done:    STOP
+charIn:  .EQUATE 0xFC15
+charOut: .EQUATE 0xFC16
+         .END`
+
+func TestCharIOStreams(t *testing.T) {
+	input := strings.Repeat("The quick brown fox jumps over the lazy dog.\n", 100)
+	var output bytes.Buffer
+
+	p := Pep9Computer{}
+	p.CharIn.Reader = iotest.OneByteReader(strings.NewReader(input))
+	p.CharOut.Writer = &output
+	p.Initialize()
+	p.LoadProgram(assemble(t, echo))
+	p.ExecuteVonNeumann()
+
+	if output.String() != input {
+		t.Errorf("Expected %d bytes echoed but got %d", len(input), output.Len())
+	}
+	if !p.CharIn.EOF() || p.CharIn.Err() != nil {
+		t.Errorf("Expected a clean end of input but got EOF=%t err=%v", p.CharIn.EOF(), p.CharIn.Err())
+	}
+}
+
+func TestCharInEOFValue(t *testing.T) {
+	in := CharIn{Reader: strings.NewReader("a"), EOFValue: 0xFF}
+
+	if ch := in.Load(0); ch != 'a' || in.EOF() {
+		t.Errorf("Expected 'a' before the end of input but got 0x%02X", ch)
+	}
+	for i := 0; i < 2; i++ {
+		if ch := in.Load(0); ch != 0xFF || !in.EOF() {
+			t.Errorf("Expected 0xFF past the end of input but got 0x%02X", ch)
+		}
+	}
+
+	in.Reset()
+	in.Reader = strings.NewReader("b")
+	if ch := in.Load(0); ch != 'b' {
+		t.Errorf("Expected a reset to read the new input but got 0x%02X", ch)
+	}
+}
+
+func TestCharIOErrors(t *testing.T) {
+	failure := errors.New("failure")
+
+	in := CharIn{Reader: iotest.ErrReader(failure)}
+	in.Load(0)
+	if !in.EOF() || in.Err() != failure {
+		t.Errorf("Expected the read error but got EOF=%t err=%v", in.EOF(), in.Err())
+	}
+
+	out := CharOut{Writer: failingWriter{failure}}
+	out.Store(0, 'x')
+	if out.Err() != failure {
+		t.Errorf("Expected the write error but got %v", out.Err())
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) { return 0, w.err }
@@ -1,20 +1,90 @@
 package computer
 
-import "log"
+import (
+	"context"
+
+	"pep9emulator/isa"
+	"pep9emulator/pep9os"
+)
 
 type Pep9Computer struct {
 	Processor
 	Memory
 	HALT bool
+
+	// Trace, when set, is called after every instruction executed by Step
+	// or Run. Run without it does not build step results.
+	Trace func(r StepResult)
+
+	// Timing, when set, adds the cost of every instruction executed to
+	// Cycles.
+	Timing *Timing
+	Cycles uint64
+
+	// Variables, when set, follows the typed variables of the program as
+	// it runs.
+	Variables *Variables
+
+	// CallStack, when set, shadows the calls of the program as it runs.
+	CallStack *CallStack
+
+	instruction uint16 // Address of the instruction being executed
 }
 
+// StartMode selects how the computer starts after the operating system has
+// been burned into ROM.
+type StartMode int
+
+const (
+	// BareMetal runs a program already in memory from 0x0000 on the user
+	// stack.
+	BareMetal StartMode = iota
+	// OSLoader runs the operating system loader, which reads an object file
+	// from the input device into memory from 0x0000 and then stops.
+	OSLoader
+)
+
+// Initialize burns the operating system into ROM and prepares to run a
+// program from 0x0000.
 func (c *Pep9Computer) Initialize() {
-	// Default vectors for running a program starting at 0x0000
-	c.PC = 0x0000
+	c.InitializeMode(BareMetal)
+}
+
+// InitializeMode burns the operating system into ROM and sets SP and PC from
+// its machine vectors for the chosen start mode. CharIn and CharOut are
+// attached at the character I/O vectors unless other devices are already
+// there, then every device is reset.
+func (c *Pep9Computer) InitializeMode(mode StartMode) {
+	c.BurnOS()
+	c.AttachCharIO()
+	c.ResetDevices()
+
 	c.A = 0x0000
 	c.X = 0x0000
-	c.SP = 0xFB8F
 	c.HALT = false
+	if c.Variables != nil {
+		c.Variables.Reset()
+	}
+
+	switch mode {
+	case OSLoader:
+		c.SP = c.LoadWord(SystemStackVector)
+		c.PC = c.LoadWord(LoaderVector)
+	default:
+		c.SP = c.LoadWord(UserStackVector)
+		c.PC = 0x0000
+	}
+	if c.CallStack != nil {
+		c.CallStack.Reset(c.SP)
+	}
+}
+
+// BurnOS copies the bundled operating system into the top of memory and
+// write protects it.
+func (c *Memory) BurnOS() {
+	os := pep9os.Program()
+	copy(c.Ram[os.Origin:], os.Object)
+	c.ROMStart = os.Origin
 }
 
 func (c *Pep9Computer) LoadProgram(program []byte) {
@@ -23,36 +93,59 @@ func (c *Pep9Computer) LoadProgram(program []byte) {
 	}
 }
 
+// ExecuteVonNeumann runs until the computer halts.
 func (c *Pep9Computer) ExecuteVonNeumann() {
-	for !c.HALT && c.OpCode != 0x00 || c.PC == 0 {
-		c.fetch()
-		c.execute()
-	}
+	c.Run(context.Background(), 0)
+}
+
+// ExecuteLimit runs like ExecuteVonNeumann but gives up after limit
+// instructions, or never when limit is zero. It reports whether the program
+// ended with STOP.
+func (c *Pep9Computer) ExecuteLimit(limit int) bool {
+	return c.Run(context.Background(), limit) == nil
 }
 
 func (c *Pep9Computer) fetch() {
-	c.OpCode = uint8(c.LoadByte(c.PC))
+	c.fault = nil // Only faults and hits of this instruction are reported
+	c.hits = c.hits[:0]
+	c.instruction = c.PC
+	c.OpCode = uint8(c.loadByte(c.PC))
 	c.PC += 1
 
-	if c.OpCode >= 0x12 { // if OpCode requires an Operand, fetch it
-		c.Operand = c.LoadWord(c.PC)
+	if !isa.IsUnary(c.OpCode) { // if OpCode requires an Operand, fetch it
+		c.Operand = c.loadWord(c.PC)
 		c.PC += 2
 	}
+
+	if c.Timing != nil {
+		c.Cycles += uint64(c.instructionCycles(c.Timing))
+	}
 }
 
 func (c *Pep9Computer) execute() {
+	if inst, mode := isa.Decode(c.OpCode); !inst.IsUnary() && !isa.IsTrap(c.OpCode) && !inst.Modes.Has(mode) {
+		c.fail(ErrIllegalAddressingMode)
+		return
+	}
+
 	switch c.OpCode {
 	case 0x00: // HALT
-		break
-	case 0x01, 0x02, 0x24, 0x25:
+		c.HALT = true
+	case 0x01, 0x24, 0x25:
 		c.callAndReturn()
 		break
-	case 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x10, 0x11:
+	case 0x02:
+		c.returnFromTrap()
+	case 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10, 0x11:
 		c.unaryArithmetic()
 		break
 	case 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1A, 0x1B, 0x1c, 0x1D, 0x1E, 0x1F,
 		0x20, 0x21, 0x22, 0x23:
 		c.branch()
+	case 0x26, 0x27, 0x28, 0x29, 0x2A, 0x2B, 0x2C, 0x2D, 0x2E, 0x2F,
+		0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3A, 0x3B, 0x3C, 0x3D, 0x3E, 0x3F,
+		0x40, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49, 0x4A, 0x4B, 0x4C, 0x4D, 0x4E, 0x4F:
+		c.trap()
 	case 0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5A, 0x5B, 0x5C, 0x5D, 0x5E, 0x5F,
 		0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6A, 0x6B, 0x6C, 0x6D, 0x6E, 0x6F,
 		0x70, 0x71, 0x72, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7A, 0x7B, 0x7C, 0x7D, 0x7E, 0x7F,
@@ -73,14 +166,20 @@ func (c *Pep9Computer) execute() {
 		c.store()
 		break
 	default:
-		log.Printf("Unknown opcode")
-		c.HALT = true
+		c.fail(ErrIllegalOpcode)
 	}
 }
 
 func (c *Pep9Computer) load() {
 	result := c.loadWithMode()
 	destination := c.getRegisterBit3()
+
+	if c.OpCode&0x10 == 0x10 { // LDBr loads r<8..15> and clears N
+		*destination = *destination&0xFF00 | result
+		c.N = false
+		c.Z = result == 0
+		return
+	}
 	*destination = result
 
 	c.N = isNegative(result)
@@ -124,16 +223,15 @@ func (c *Pep9Computer) branch() {
 		toBranch = c.C
 		break
 	default:
-		log.Printf("Branch opcode %s not implemented", string(c.OpCode))
-		c.HALT = true
+		c.fail(ErrIllegalOpcode)
 	}
 
 	var location uint16
 
 	if c.OpCode&0x1 == 0 { // immediate
 		location = c.Operand
-	} else {
-		location = c.Operand + c.X
+	} else { // indexed, the target is read from a table in memory
+		location = c.LoadWord(c.Operand + c.X)
 	}
 
 	if toBranch {
@@ -141,17 +239,29 @@ func (c *Pep9Computer) branch() {
 	}
 }
 
+// compare sets the status bits from T ← r - Oprnd. CPWr sets N from the
+// sign of the true difference (N ⊕ V), and CPBr compares only the low byte
+// of r and clears V and C.
 func (c *Pep9Computer) compare() {
 	var left, right uint16
 
-	right = *c.getRegisterBit3()
-	left = c.loadWithMode()
+	left = *c.getRegisterBit3()
+	right = c.loadWithMode()
+
+	if c.OpCode&0x10 == 0x10 { // CPBr
+		result := uint8(left) - uint8(right)
+		c.N = result&0x80 != 0
+		c.Z = result == 0
+		c.V = false
+		c.C = false
+		return
+	}
 
 	result := left - right
-	c.N = isNegative(result)
+	c.V = isSubtractOverflow(left, right)
+	c.C = isSubtractCarry(left, right)
+	c.N = isNegative(result) != c.V
 	c.Z = result == 0
-	c.V = isOverflow(left, right)
-	c.C = isCarry(left, right)
 }
 
 func (c *Pep9Computer) callAndReturn() {
@@ -160,14 +270,26 @@ func (c *Pep9Computer) callAndReturn() {
 	if c.OpCode == 0x01 { // Return
 		c.PC = c.LoadWord(c.SP)
 		c.SP += 2
+		if c.CallStack != nil {
+			c.CallStack.ret(c.instruction, c.SP-2, c.PC)
+		}
+		if c.Variables != nil {
+			c.Variables.ret(c.PC, c.X)
+		}
 	} else { // Call
 		if c.OpCode&0x1 == 0 { // immediate
 			location = c.Operand
-		} else {
-			location = c.Operand + c.X
+		} else { // indexed, the target is read from a table in memory
+			location = c.LoadWord(c.Operand + c.X)
 		}
 		c.SP -= 2
 		c.StoreWord(c.PC, c.SP)
+		if c.CallStack != nil {
+			c.CallStack.call(Call{PC: c.instruction, Target: location, Return: c.PC, SP: c.SP})
+		}
+		if c.Variables != nil {
+			c.Variables.call(c.instruction, c.PC)
+		}
 		c.PC = location
 	}
 }
@@ -179,8 +301,8 @@ func (c *Pep9Computer) unaryArithmetic() {
 	switch c.OpCode {
 	case 0x03:
 		c.A = c.SP
-	case 0x04: // NZVC Flags to A<12..15> 15 is LSB
-		c.A = 0
+	case 0x04: // NZVC Flags to A<12..15> 15 is LSB, clearing A<8..11>
+		c.A &= 0xFF00
 		if c.C {
 			c.A |= 1
 		}
@@ -193,11 +315,11 @@ func (c *Pep9Computer) unaryArithmetic() {
 		if c.N {
 			c.A |= 1 << 3
 		}
-	case 0x05:
-		c.C = c.A&0x01 == 0x01
-		c.Z = c.A&0x02 == 0x02
-		c.V = c.A&0x03 == 0x03
-		c.N = c.A&0x04 == 0x04
+	case 0x05: // A<12..15> to NZVC
+		c.N = c.A&0x08 != 0
+		c.Z = c.A&0x04 != 0
+		c.V = c.A&0x02 != 0
+		c.C = c.A&0x01 != 0
 	case 0x06, 0x07: //Bitwise invert
 		*value = ^*value
 		c.N = isNegative(*value)
@@ -208,8 +330,7 @@ func (c *Pep9Computer) unaryArithmetic() {
 		*value = ^*value + 1
 		c.N = isNegative(*value)
 		c.Z = *value == 0
-		c.V = isNegative(prev) && !isNegative(*value) ||
-			!isNegative(prev) && isNegative(*value)
+		c.V = prev == 0x8000 // Only the minimum overflows
 		break
 	case 0x0A, 0x0B: // Arithmetic shift Left
 		prev := *value
@@ -229,69 +350,50 @@ func (c *Pep9Computer) unaryArithmetic() {
 		*value = (*value >> 1) | msb
 		c.N = isNegative(*value)
 		c.Z = *value == 0
-		c.V = isNegative(prev) && !isNegative(*value) ||
-			!isNegative(prev) && isNegative(*value)
 		c.C = prev&0x1 != 0 // The least significant bit is put into the carry flag.
 		break
-	case 0x0E, 0x0F: // Rotate Left with Carry (RLC)
+	case 0x0E, 0x0F: // Rotate Left through Carry (RLC)
 		prev := *value
 		*value = *value << 1
-
-		c.C = prev&0x8000 != 0 // The most significant bit is put into the carry flag.
 		if c.C {
-			*value = *value | 0x0001
+			*value = *value | 0x0001 // The original carry is put into bit 0.
 		}
-
-		c.N = isNegative(*value)
-		c.Z = *value == 0
-		c.V = isNegative(prev) && !isNegative(*value) ||
-			!isNegative(prev) && isNegative(*value)
+		c.C = prev&0x8000 != 0 // The most significant bit is put into the carry flag.
 		break
-	case 0x10, 0x11: // Rotate Right with Carry (RRC)
+	case 0x10, 0x11: // Rotate Right through Carry (RRC)
 		prev := *value
 		*value = *value >> 1
-
-		c.C = prev&0x1 != 0 // The least significant bit is put into the carry flag.
 		if c.C {
-			*value = *value | 0x8000 // If the original carry was set, it is put into bit 15.
+			*value = *value | 0x8000 // The original carry is put into bit 15.
 		}
-		c.N = isNegative(*value)
-		c.Z = *value == 0
-		c.V = isNegative(prev) && !isNegative(*value) ||
-			!isNegative(prev) && isNegative(*value)
+		c.C = prev&0x1 != 0 // The least significant bit is put into the carry flag.
 		break
 	default:
-		log.Printf("Opcode %s yet implemented", string(c.OpCode))
-		c.HALT = true
+		c.fail(ErrIllegalOpcode)
 	}
 
 }
 
 func (c *Pep9Computer) nonUnaryArithmetic() {
 	value := c.loadWithMode()
-	prev := value
 	dest := c.getRegisterBit3()
+	if c.OpCode < 0x60 { // ADDSP and SUBSP
+		dest = &c.SP
+	}
+	prev := *dest
 
 	switch c.OpCode {
-	case 0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57:
-		c.SP += value
-		c.V = isOverflow(prev, value)
-		c.C = isCarry(prev, value) // The least significant bit is put into the carry flag.
-		break
-	case 0x58, 0x59, 0x5A, 0x5B, 0x5C, 0x5D, 0x5E, 0x5F:
-		c.SP -= value
-		c.V = isOverflow(prev, value)
-		c.C = isCarry(prev, value) // The least significant bit is put into the carry flag.
-		break
-	case 0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6A, 0x6B, 0x6C, 0x6D, 0x6E, 0x6F:
+	case 0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57,
+		0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6A, 0x6B, 0x6C, 0x6D, 0x6E, 0x6F:
 		*dest += value
 		c.V = isOverflow(prev, value)
-		c.C = isCarry(prev, value) // The least significant bit is put into the carry flag.
+		c.C = isCarry(prev, value)
 		break
-	case 0x70, 0x71, 0x72, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7A, 0x7B, 0x7C, 0x7D, 0x7E, 0x7F:
+	case 0x58, 0x59, 0x5A, 0x5B, 0x5C, 0x5D, 0x5E, 0x5F,
+		0x70, 0x71, 0x72, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7A, 0x7B, 0x7C, 0x7D, 0x7E, 0x7F:
 		*dest -= value
-		c.V = isOverflow(prev, value)
-		c.C = isCarry(prev, value) // The least significant bit is put into the carry flag.
+		c.V = isSubtractOverflow(prev, value)
+		c.C = isSubtractCarry(prev, value)
 		break
 	case 0x80, 0x81, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89, 0x8A, 0x8B, 0x8C, 0x8D, 0x8E, 0x8F:
 		*dest &= value
@@ -300,12 +402,17 @@ func (c *Pep9Computer) nonUnaryArithmetic() {
 		*dest |= value
 		break
 	default:
-		log.Printf("Opcdoe %s yet implemented", string(c.OpCode))
-		c.HALT = true
+		c.fail(ErrIllegalOpcode)
 	}
 
-	c.N = isNegative(value)
-	c.Z = value == 0
+	c.N = isNegative(*dest)
+	c.Z = *dest == 0
+
+	if c.Variables != nil && c.OpCode < 0x58 {
+		c.Variables.addsp(int(value))
+	} else if c.Variables != nil && c.OpCode < 0x60 {
+		c.Variables.subsp(c.instruction, c.SP, int(value))
+	}
 }
 
 func (c *Pep9Computer) loadWithMode() uint16 {
@@ -348,8 +455,8 @@ func (c *Pep9Computer) loadWithMode() uint16 {
 	case 6: // Stack Indexed Mem[SP + Op + X]
 		result = loadFunc(c.SP + c.Operand + c.X)
 		break
-	case 7: // Stack-deferred Indexed Mem[Mem[SP + Op + X]]
-		location := loadFunc(c.SP + c.Operand + c.X)
+	case 7: // Stack-deferred Indexed Mem[Mem[SP + Op] + X]
+		location := c.LoadWord(c.SP+c.Operand) + c.X
 		result = loadFunc(location)
 	}
 
@@ -385,8 +492,7 @@ func (c *Pep9Computer) storeWithMode(value *uint16) {
 	switch c.OpCode & 0x07 {
 	case 0:
 		// Can't store to immediate value
-		log.Printf("Opcdoe %s is invalid :facepalm: Can't store to an immediate value", string(c.OpCode))
-		c.HALT = true
+		c.fail(ErrIllegalAddressingMode)
 	case 1: // Direct
 		writeFunc(*value, c.Operand)
 		break
@@ -407,8 +513,8 @@ func (c *Pep9Computer) storeWithMode(value *uint16) {
 	case 6: // Stack Indexed Mem[SP + Op + X]
 		writeFunc(*value, c.SP+c.Operand+c.X)
 		break
-	case 7: // Stack-deferred Indexed Mem[Mem[SP + Op + X]]
-		location := c.LoadWord(c.SP + c.Operand + c.X)
+	case 7: // Stack-deferred Indexed Mem[Mem[SP + Op] + X]
+		location := c.LoadWord(c.SP+c.Operand) + c.X
 		writeFunc(*value, location)
 	}
 }
@@ -421,6 +527,18 @@ func isCarry(a, b uint16) bool {
 	return uint32(a)+uint32(b) > 0xFFFF
 }
 
+// isSubtractOverflow reports signed overflow of a - b.
+func isSubtractOverflow(a, b uint16) bool {
+	result := a - b
+	return isNegative(a) != isNegative(b) && isNegative(result) != isNegative(a)
+}
+
+// isSubtractCarry is the carry out of a + ^b + 1, which is set when a - b
+// does not borrow.
+func isSubtractCarry(a, b uint16) bool {
+	return a >= b
+}
+
 func isOverflow(a, b uint16) bool {
 	result := a + b
 	return isNegative(a) && isNegative(b) && !isNegative(result) ||
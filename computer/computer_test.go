@@ -1,7 +1,9 @@
 package computer
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -44,6 +46,27 @@ func TestExecuteVonNeumann(t *testing.T) {
 	}
 }
 
+// STOP halts wherever it is, and a program may branch back to 0x0000.
+func TestStopHalts(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram(assemble(t, `
+         LDWA    count,d
+         ADDA    1,i
+         STWA    count,d
+         CPWA    3,i
+         BRNE    0x0000
+         STOP
+count:   .WORD   0
+         .END`))
+
+	p.ExecuteVonNeumann()
+
+	if !p.HALT || p.A != 3 {
+		t.Errorf("Expected a halt with A 3 got HALT %t A %d", p.HALT, p.A)
+	}
+}
+
 func TestCompare(t *testing.T) {
 	p := Pep9Computer{
 		Processor: Processor{},
@@ -69,8 +92,8 @@ func TestCompareNegative(t *testing.T) {
 	}
 
 	p.OpCode = 0xA0
-	p.Operand = 0x0001
-	p.A = 0x1234
+	p.Operand = 0x1234
+	p.A = 0x0001
 
 	p.compare()
 
@@ -87,8 +110,8 @@ func TestCompareOverflow(t *testing.T) {
 	}
 
 	p.OpCode = 0xA0
-	p.Operand = 0x7FFF
-	p.A = 0x7FFF
+	p.Operand = 0x0001
+	p.A = 0x8000
 
 	p.compare()
 
@@ -116,6 +139,90 @@ func TestCompareCarry(t *testing.T) {
 	}
 }
 
+// Compares take V and C from the subtraction of the register from the
+// operand, as SUBA does.
+func TestCompareSubtractFlags(t *testing.T) {
+	tests := []struct {
+		a, operand uint16
+		n, z, v, c bool
+	}{
+		{0x0001, 0x0002, true, false, false, false}, // Crosses zero, borrowing
+		{0x0002, 0x0001, false, false, false, true},
+		{0x0005, 0x0005, false, true, false, true},
+		{0x8000, 0x0001, true, false, true, true},   // Overflows to positive, N is still less than
+		{0x7FFF, 0xFFFF, false, false, true, false}, // Overflows to negative, N is still greater than
+		{0xFFFF, 0x0001, true, false, false, true},  // Negative less one
+		{0x0000, 0x8000, false, false, true, false}, // Zero less the minimum
+	}
+
+	for _, test := range tests {
+		p := Pep9Computer{}
+		p.OpCode = 0xA0 // CPWA
+		p.Operand = test.operand
+		p.A = test.a
+
+		p.compare()
+
+		if p.N != test.n || p.Z != test.z || p.V != test.v || p.C != test.c {
+			t.Errorf("CPWA 0x%04X with A=0x%04X: expected NZVC %t %t %t %t got %t %t %t %t",
+				test.operand, test.a, test.n, test.z, test.v, test.c, p.N, p.Z, p.V, p.C)
+		}
+	}
+}
+func TestCompareByte(t *testing.T) {
+	tests := []struct {
+		a, operand uint16
+		n, z       bool
+	}{
+		{0x0061, 'b', true, false}, // 'a' - 'b'
+		{0x0062, 'a', false, false},
+		{0xFF62, 'b', false, true}, // The high byte of A is not compared
+		{0x0000, 0x80, true, false},
+	}
+
+	for _, test := range tests {
+		p := Pep9Computer{}
+		p.OpCode = 0xB0 // CPBA
+		p.Operand = test.operand
+		p.A = test.a
+		p.V, p.C = true, true
+
+		p.compare()
+
+		if p.N != test.n || p.Z != test.z || p.V || p.C {
+			t.Errorf("CPBA 0x%02X with A=0x%04X: expected NZVC %t %t false false got %t %t %t %t",
+				test.operand, test.a, test.n, test.z, p.N, p.Z, p.V, p.C)
+		}
+	}
+}
+func TestCompareBranchLessThan(t *testing.T) {
+	for _, source := range []string{`
+         LDWA    3,i
+         CPWA    5,i
+         BRLT    less
+         STOP
+less:    LDWX    1,i
+         STOP
+         .END`, `
+         LDBA    'a',i
+         CPBA    'b',i
+         BRLT    less
+         STOP
+less:    LDWX    1,i
+         STOP
+         .END`} {
+		p := Pep9Computer{}
+		p.Initialize()
+		p.LoadProgram(assemble(t, source))
+
+		p.ExecuteVonNeumann()
+
+		if p.X != 1 {
+			t.Errorf("Expected BRLT to branch got X %d for%s", p.X, source)
+		}
+	}
+}
+
 func TestBranchUnconditionally(t *testing.T) {
 	expected := uint16(0xBEEF)
 
@@ -328,6 +435,21 @@ func TestBranchCarry(t *testing.T) {
 	}
 }
 
+func TestBranchIndexedReadsTable(t *testing.T) {
+	p := Pep9Computer{}
+
+	p.StoreWord(0xBEEF, 0x0102) // The second entry of a table at 0x0100
+	p.OpCode = 0x13             // BR 0x0100,x
+	p.Operand = 0x0100
+	p.X = 2
+
+	p.branch()
+
+	if p.PC != 0xBEEF {
+		t.Errorf("Expected PC 0xBEEF from the table got 0x%04X", p.PC)
+	}
+}
+
 func TestLoadByteImmediate(t *testing.T) {
 	expected := uint8(0xEF)
 
@@ -392,6 +514,21 @@ func TestLoadByteIndirect(t *testing.T) {
 	}
 }
 
+func TestLoadByteKeepsHighByte(t *testing.T) {
+	p := Pep9Computer{}
+
+	p.OpCode = 0xD0 // LDBA 0x80,i
+	p.Operand = 0x0080
+	p.A = 0x1234
+	p.N = true
+
+	p.load()
+
+	if p.A != 0x1280 || p.N || p.Z {
+		t.Errorf("Expected 0x1280 with N and Z clear got 0x%04X %t %t", p.A, p.N, p.Z)
+	}
+}
+
 func TestStoreByteDirect(t *testing.T) {
 	expected := uint8(0x0D)
 
@@ -556,6 +693,59 @@ func TestStoreWordIndirect(t *testing.T) {
 	}
 }
 
+func TestLoadWordStackDeferredIndexed(t *testing.T) {
+	p := Pep9Computer{
+		Processor: Processor{},
+		Memory:    Memory{},
+	}
+
+	p.SP = 0xFB00
+	p.Ram[0xFB04] = 0xF0 // Mem[SP + 4] points to an array at 0xF00D
+	p.Ram[0xFB05] = 0x0D
+	p.Ram[0xF011] = 0x12 // Its third word
+	p.Ram[0xF012] = 0x34
+	p.OpCode = 0xC7
+	p.Operand = 0x0004
+	p.X = 0x0004
+
+	p.load()
+
+	if p.A != 0x1234 {
+		t.Errorf("Expected %b got %b", 0x1234, p.A)
+	}
+}
+
+func TestStoreStackDeferredIndexed(t *testing.T) {
+	p := Pep9Computer{
+		Processor: Processor{},
+		Memory:    Memory{},
+	}
+
+	p.SP = 0xFB00
+	p.Ram[0xFB04] = 0xF0
+	p.Ram[0xFB05] = 0x0D
+	p.OpCode = 0xE7
+	p.Operand = 0x0004
+	p.X = 0x0004
+	p.A = 0x7788
+
+	p.store()
+
+	if p.Ram[0xF011] != 0x77 || p.Ram[0xF012] != 0x88 {
+		t.Errorf("Expected %b %b got %b %b", 0x77, 0x88, p.Ram[0xF011], p.Ram[0xF012])
+	}
+
+	p.OpCode = 0xF7 // STBA
+	p.X = 0x0001
+	p.A = 0x0099
+
+	p.store()
+
+	if p.Ram[0xF00E] != 0x99 {
+		t.Errorf("Expected %b got %b", 0x99, p.Ram[0xF00E])
+	}
+}
+
 func TestBitwiseInvert(t *testing.T) {
 	expected := uint16(0xF0F0)
 
@@ -592,6 +782,30 @@ func TestNegate(t *testing.T) {
 	}
 }
 
+func TestNegateOverflow(t *testing.T) {
+	tests := []struct {
+		a, expected uint16
+		v           bool
+	}{
+		{0x0001, 0xFFFF, false},
+		{0xFFFF, 0x0001, false},
+		{0x0000, 0x0000, false},
+		{0x8000, 0x8000, true}, // Only the minimum overflows
+	}
+
+	for _, test := range tests {
+		p := Pep9Computer{}
+		p.OpCode = 0x08 // NEGA
+		p.A = test.a
+
+		p.unaryArithmetic()
+
+		if p.A != test.expected || p.V != test.v {
+			t.Errorf("NEGA 0x%04X: expected 0x%04X V %t got 0x%04X V %t", test.a, test.expected, test.v, p.A, p.V)
+		}
+	}
+}
+
 func TestASL(t *testing.T) {
 	expected := uint16(0xAAAA)
 
@@ -646,6 +860,19 @@ func TestASRPositive(t *testing.T) {
 	}
 }
 
+func TestASRKeepsV(t *testing.T) {
+	p := Pep9Computer{}
+
+	p.OpCode = 0x0C
+	p.A = 0x0008
+	p.V = true
+	p.unaryArithmetic()
+
+	if !p.V {
+		t.Errorf("Expected ASRA to leave V set")
+	}
+}
+
 func TestROR(t *testing.T) {
 	expected := uint16(0x87FF)
 
@@ -656,10 +883,11 @@ func TestROR(t *testing.T) {
 
 	p.OpCode = 0x10
 	p.A = 0x0FFF
+	p.C = true // Rotated into bit 15
 	p.unaryArithmetic()
 
-	if p.A != expected {
-		t.Errorf("Expected %b got %b", expected, p.A)
+	if p.A != expected || !p.C {
+		t.Errorf("Expected %b true got %b %t", expected, p.A, p.C)
 	}
 }
 
@@ -670,17 +898,70 @@ func TestROL(t *testing.T) {
 	}
 
 	p.OpCode = 0x0E
-
-	values := []uint16{0x0F0F, 0x1E1E, 0x3C3C, 0x7878, 0xF0F0, 0xE1E1, 0xC3C3, 0x8787}
-	previous := values[len(values)-1]
+	p.A = 0x8787
 	p.C = false
 
+	// A and C rotate as 17 bits, so bit 15 comes back into bit 0 a step later.
+	values := []struct {
+		a uint16
+		c bool
+	}{
+		{0x0F0E, true}, {0x1E1D, false}, {0x3C3A, false}, {0x7874, false},
+		{0xF0E8, false}, {0xE1D0, true}, {0xC3A1, true}, {0x8743, true},
+	}
+
 	for _, expected := range values {
-		p.A = previous
 		p.unaryArithmetic()
-		previous = expected
-		if p.A != expected {
-			t.Errorf("Expected %b got %b", expected, p.A)
+		if p.A != expected.a || p.C != expected.c {
+			t.Errorf("Expected %b %t got %b %t", expected.a, expected.c, p.A, p.C)
+		}
+	}
+}
+
+func TestRotateSetsOnlyC(t *testing.T) {
+	for _, opcode := range []uint8{0x0E, 0x10} { // ROLA, RORA
+		p := Pep9Computer{}
+		p.OpCode = opcode
+		p.A = 0x0000
+		p.N, p.Z, p.V = true, false, true
+
+		p.unaryArithmetic()
+
+		if !p.N || p.Z || !p.V || p.C {
+			t.Errorf("Opcode 0x%02X: expected NZVC true false true false got %t %t %t %t", opcode, p.N, p.Z, p.V, p.C)
+		}
+	}
+}
+
+// The unary instructions 0x0A to 0x0F are dispatched by execute.
+func TestExecuteUnaryShifts(t *testing.T) {
+	tests := []struct {
+		opcode   uint8
+		a, x     uint16
+		expected uint16
+		onX      bool
+	}{
+		{0x0A, 0x0003, 0, 0x0006, false}, // ASLA
+		{0x0B, 0, 0x0003, 0x0006, true},  // ASLX
+		{0x0C, 0x8004, 0, 0xC002, false}, // ASRA
+		{0x0D, 0, 0x8004, 0xC002, true},  // ASRX
+		{0x0E, 0x4001, 0, 0x8002, false}, // ROLA
+		{0x0F, 0, 0x4001, 0x8002, true},  // ROLX
+	}
+
+	for _, test := range tests {
+		p := Pep9Computer{}
+		p.OpCode = test.opcode
+		p.A, p.X = test.a, test.x
+
+		p.execute()
+
+		got := p.A
+		if test.onX {
+			got = p.X
+		}
+		if got != test.expected || p.HALT {
+			t.Errorf("Opcode 0x%02X: expected 0x%04X got 0x%04X, halted %t", test.opcode, test.expected, got, p.HALT)
 		}
 	}
 }
@@ -789,6 +1070,68 @@ func TestIsOverflow(t *testing.T) {
 	}
 }
 
+func TestSubtractFlags(t *testing.T) {
+	p := Pep9Computer{}
+
+	p.A = 0x8000
+	p.OpCode = 0x70 // SUBA 1,i
+	p.Operand = 0x0001
+	p.nonUnaryArithmetic()
+
+	if p.A != 0x7FFF || !p.V || !p.C || p.N || p.Z {
+		t.Errorf("Expected 0x7FFF with V and C got 0x%04X NZVC %t %t %t %t", p.A, p.N, p.Z, p.V, p.C)
+	}
+
+	p.SP = 0x0000
+	p.OpCode = 0x58 // SUBSP 1,i borrows
+	p.nonUnaryArithmetic()
+
+	if p.SP != 0xFFFF || p.C || p.V {
+		t.Errorf("Expected SP 0xFFFF with a borrow got SP 0x%04X V %t C %t", p.SP, p.V, p.C)
+	}
+}
+
+func TestIsSubtractOverflow(t *testing.T) {
+	testsValues := []struct {
+		n1, n2   uint16
+		expected bool
+	}{
+		{0x8000, 0x0001, true},
+		{0x7FFF, 0xFFFF, true},
+		{0x0000, 0x8000, true},
+		{0x0001, 0x0002, false},
+		{0xFFFF, 0xFFFF, false},
+		{0x8000, 0x8000, false},
+		{0x7FFF, 0x7FFF, false},
+		{0xFFFF, 0x7FFF, false},
+	}
+
+	for _, v := range testsValues {
+		if v.expected != isSubtractOverflow(v.n1, v.n2) {
+			t.Errorf("left: %b, right: %b expected %t got %t", v.n1, v.n2, v.expected, isSubtractOverflow(v.n1, v.n2))
+		}
+	}
+}
+
+func TestIsSubtractCarry(t *testing.T) {
+	testsValues := []struct {
+		n1, n2   uint16
+		expected bool
+	}{
+		{0x0002, 0x0001, true},
+		{0x0001, 0x0001, true},
+		{0x0001, 0x0002, false},
+		{0x0000, 0xFFFF, false},
+		{0xFFFF, 0x8000, true},
+	}
+
+	for _, v := range testsValues {
+		if v.expected != isSubtractCarry(v.n1, v.n2) {
+			t.Errorf("left: %b, right: %b expected %t got %t", v.n1, v.n2, v.expected, isSubtractCarry(v.n1, v.n2))
+		}
+	}
+}
+
 func TestIsNegative(t *testing.T) {
 	testsValues := []struct {
 		n        uint16
@@ -868,6 +1211,26 @@ func TestCall(t *testing.T) {
 	}
 }
 
+func TestCallIndexedReadsTable(t *testing.T) {
+	p := Pep9Computer{}
+
+	p.StoreWord(0xF00D, 0x0104)
+	p.SP = 0x1000
+	p.PC = 0x0042
+	p.OpCode = 0x25 // CALL 0x0100,x
+	p.Operand = 0x0100
+	p.X = 4
+
+	p.callAndReturn()
+
+	if p.PC != 0xF00D {
+		t.Errorf("Expected PC 0xF00D from the table got 0x%04X", p.PC)
+	}
+	if p.SP != 0x0FFE || p.LoadWord(p.SP) != 0x0042 {
+		t.Errorf("Expected the return address 0x0042 at 0x0FFE got 0x%04X at 0x%04X", p.LoadWord(p.SP), p.SP)
+	}
+}
+
 func TestMVSPA(t *testing.T) {
 	//Initialize a new Pep9Computer
 	p := Pep9Computer{
@@ -914,6 +1277,19 @@ func TestLoadFlags(t *testing.T) {
 	}
 }
 
+func TestLoadFlagsKeepsHighByte(t *testing.T) {
+	p := Pep9Computer{}
+
+	p.A = 0xBEEF
+	p.Z = true
+	p.OpCode = 0x04
+	p.unaryArithmetic()
+
+	if p.A != 0xBE04 {
+		t.Errorf("Expected 0x%04X but got 0x%04X", 0xBE04, p.A)
+	}
+}
+
 func TestStoreFlags(t *testing.T) {
 	//Initialize a new Pep9Computer
 	p := Pep9Computer{
@@ -944,6 +1320,23 @@ func TestStoreFlags(t *testing.T) {
 
 }
 
+func TestStoreFlagsBits(t *testing.T) {
+	for bit, flag := range []string{"C", "V", "Z", "N"} {
+		p := Pep9Computer{}
+		p.A = 0xFFF0 | 1<<bit
+		p.OpCode = 0x05
+		p.unaryArithmetic()
+
+		got := map[string]bool{"N": p.N, "Z": p.Z, "V": p.V, "C": p.C}
+		for name, set := range got {
+			if set != (name == flag) {
+				t.Errorf("A 0x%04X: expected only %s set got NZVC %t %t %t %t", p.A, flag, p.N, p.Z, p.V, p.C)
+				break
+			}
+		}
+	}
+}
+
 func TestAddSubToSP(t *testing.T) {
 	//Initialize a new Pep9Computer
 	p := Pep9Computer{
@@ -972,6 +1365,48 @@ func TestAddSubToSP(t *testing.T) {
 	}
 }
 
+func TestAddSubToSPFlags(t *testing.T) {
+	p := Pep9Computer{}
+
+	p.SP = 0x0002
+	p.A = 0x1234
+	p.OpCode = 0x58 // SUBSP 2,i
+	p.Operand = 0x0002
+	p.nonUnaryArithmetic()
+
+	if p.SP != 0 || !p.Z || p.N || p.A != 0x1234 {
+		t.Errorf("Expected SP 0 with Z and A untouched got SP 0x%04X Z %t N %t A 0x%04X", p.SP, p.Z, p.N, p.A)
+	}
+
+	p.OpCode = 0x58 // SUBSP 1,i
+	p.Operand = 0x0001
+	p.nonUnaryArithmetic()
+
+	if p.SP != 0xFFFF || !p.N || p.Z {
+		t.Errorf("Expected SP 0xFFFF with N got SP 0x%04X N %t Z %t", p.SP, p.N, p.Z)
+	}
+
+	p.OpCode = 0x50 // ADDSP 1,i carries
+	p.nonUnaryArithmetic()
+
+	if p.SP != 0 || !p.Z || !p.C || p.N || p.V {
+		t.Errorf("Expected SP 0 with Z and C got SP 0x%04X NZVC %t %t %t %t", p.SP, p.N, p.Z, p.V, p.C)
+	}
+}
+
+func TestAddFlagsFromResult(t *testing.T) {
+	p := Pep9Computer{}
+
+	p.A = 0x0001
+	p.OpCode = 0x60 // ADDA -1,i
+	p.Operand = 0xFFFF
+	p.nonUnaryArithmetic()
+
+	if p.A != 0 || !p.Z || p.N {
+		t.Errorf("Expected A 0 with Z got A 0x%04X N %t Z %t", p.A, p.N, p.Z)
+	}
+}
+
 func TestAddSubToA(t *testing.T) {
 	//Initialize a new Pep9Computer
 	p := Pep9Computer{
@@ -1119,6 +1554,8 @@ func TestProgramStdOut(t *testing.T) {
 		Memory:    Memory{},
 	}
 
+	var output bytes.Buffer
+	p.CharOut.Writer = &output
 	p.Initialize()
 
 	p.LoadProgram([]byte{
@@ -1130,12 +1567,8 @@ func TestProgramStdOut(t *testing.T) {
 	})
 	p.ExecuteVonNeumann()
 
-	if p.Memory.StandardOutput[0] != 0x48 {
-		t.Errorf("Expected StandardOutput[0] to be [0x48] but got [0x%X]", p.Memory.StandardOutput[0])
-	}
-
-	if p.Memory.StandardOutput[1] != 0x69 {
-		t.Errorf("Expected StandardOutput[1] to be [0x69] but got [0x%X]", p.Memory.StandardOutput[1])
+	if output.String() != "Hi" {
+		t.Errorf("Expected output to be [Hi] but got [%s]", output.String())
 	}
 }
 
@@ -1148,7 +1581,7 @@ func TestProgramStdIn(t *testing.T) {
 	}
 
 	p.Initialize()
-	p.Memory.StandardInput[0] = expected
+	p.CharIn.Reader = bytes.NewReader([]byte{expected})
 	p.LoadProgram([]byte{
 		0xD1, 0xFC, 0x15,
 		0x00,
@@ -1160,7 +1593,7 @@ func TestProgramStdIn(t *testing.T) {
 	}
 }
 
-func memTest(mem [65535]uint8, start uint8, expected []uint8) error {
+func memTest(mem [65536]uint8, start uint8, expected []uint8) error {
 	for i, val := range expected {
 		if mem[start+uint8(i)] != val {
 			return fmt.Errorf("expected RAM location mem[0x%X] to be [0x%X] but got [0x%X]", start+uint8(i), val, mem[start+uint8(i)])
@@ -1169,3 +1602,67 @@ func memTest(mem [65535]uint8, start uint8, expected []uint8) error {
 
 	return nil
 }
+
+func TestInitializeReadsVectors(t *testing.T) {
+	p := Pep9Computer{}
+	p.InitializeMode(OSLoader)
+
+	if p.SP != p.LoadWord(SystemStackVector) || p.PC != p.LoadWord(LoaderVector) {
+		t.Errorf("Expected SP and PC from the vectors but got SP=0x%04X PC=0x%04X", p.SP, p.PC)
+	}
+
+	p.InitializeMode(BareMetal)
+	if p.SP != DefaultUserStack || p.PC != 0x0000 {
+		t.Errorf("Expected SP=0x%04X PC=0x0000 but got SP=0x%04X PC=0x%04X", DefaultUserStack, p.SP, p.PC)
+	}
+}
+
+func TestOSLoader(t *testing.T) {
+	p := Pep9Computer{}
+	p.InitializeMode(OSLoader)
+	p.CharIn.Reader = strings.NewReader("D1 00 07 F1\n00 08 00 41 zz")
+	p.ExecuteVonNeumann()
+
+	if err := memTest(p.Ram, 0, []uint8{0xD1, 0x00, 0x07, 0xF1, 0x00, 0x08, 0x00, 0x41}); err != nil {
+		t.Error(err)
+	}
+
+	p.Initialize()
+	p.ExecuteVonNeumann()
+
+	if p.Ram[0x08] != 0x41 {
+		t.Errorf("Expected the loaded program to copy 0x41 but got 0x%X", p.Ram[0x08])
+	}
+}
+
+func TestROMIsWriteProtected(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	before := p.LoadWord(TrapVector)
+
+	p.StoreWord(0x1234, TrapVector)
+	p.StoreWord(0x1234, 0x0000)
+
+	if p.LoadWord(TrapVector) != before {
+		t.Errorf("Expected the trap vector to stay 0x%04X but got 0x%04X", before, p.LoadWord(TrapVector))
+	}
+	if p.LoadWord(0x0000) != 0x1234 {
+		t.Errorf("Expected RAM to be writable")
+	}
+}
+
+func TestExecuteLimit(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram([]byte{0x12, 0x00, 0x00}) // BR 0x0000
+
+	if p.ExecuteLimit(100) {
+		t.Error("Expected an endless loop to reach the limit")
+	}
+
+	p.Initialize()
+	p.LoadProgram([]byte{0x12, 0x00, 0x03, 0x00}) // BR 0x0003 then STOP
+	if !p.ExecuteLimit(2) {
+		t.Error("Expected the program to halt within the limit")
+	}
+}
@@ -0,0 +1,77 @@
+package computer
+
+import "fmt"
+
+// Device is a peripheral mapped into the address space. Offsets are relative
+// to the start of the range the device is attached at.
+type Device interface {
+	Load(offset uint16) uint8
+	Store(offset uint16, value uint8)
+	Reset()
+}
+
+type mapping struct {
+	AddressRange
+	Device
+}
+
+// Attach maps a device over an inclusive range of addresses. Loads and
+// stores in the range go to the device instead of RAM.
+func (c *Memory) Attach(r AddressRange, d Device) error {
+	if r.End < r.Start {
+		return fmt.Errorf("invalid device range 0x%04X-0x%04X", r.Start, r.End)
+	}
+	for _, m := range c.devices {
+		if r.Start <= m.End && m.Start <= r.End {
+			return fmt.Errorf("device range 0x%04X-0x%04X overlaps 0x%04X-0x%04X", r.Start, r.End, m.Start, m.End)
+		}
+	}
+	c.devices = append(c.devices, mapping{r, d})
+	return nil
+}
+
+// Detach removes a device from every range it is attached at.
+func (c *Memory) Detach(d Device) {
+	kept := c.devices[:0]
+	for _, m := range c.devices {
+		if m.Device != d {
+			kept = append(kept, m)
+		}
+	}
+	c.devices = kept
+}
+
+// DeviceAt returns the device attached at location and the offset of the
+// location within it.
+func (c *Memory) DeviceAt(location uint16) (Device, uint16, bool) {
+	for _, m := range c.devices {
+		if m.Contains(location) {
+			return m.Device, location - m.Start, true
+		}
+	}
+	return nil, 0, false
+}
+
+// ResetDevices resets every attached device.
+func (c *Memory) ResetDevices() {
+	for _, m := range c.devices {
+		m.Reset()
+	}
+}
+
+// AttachCharIO attaches CharIn and CharOut at the locations held in the
+// character I/O vectors, so the operating system must already be in memory.
+func (c *Memory) AttachCharIO() {
+	c.attachCharIO(c.LoadWord(CharInVector), c.LoadWord(CharOutVector))
+}
+
+// attachCharIO attaches CharIn and CharOut at the character I/O locations
+// unless a device is already there.
+func (c *Memory) attachCharIO(charIn, charOut uint16) {
+	if _, _, ok := c.DeviceAt(charIn); !ok {
+		c.Attach(AddressRange{charIn, charIn}, &c.CharIn)
+	}
+	if _, _, ok := c.DeviceAt(charOut); !ok {
+		c.Attach(AddressRange{charOut, charOut}, &c.CharOut)
+	}
+}
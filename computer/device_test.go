@@ -0,0 +1,68 @@
+package computer
+
+import "testing"
+
+// registerFile is a device of eight byte registers that counts its resets.
+type registerFile struct {
+	regs   [8]uint8
+	resets int
+}
+
+func (d *registerFile) Load(offset uint16) uint8         { return d.regs[offset] }
+func (d *registerFile) Store(offset uint16, value uint8) { d.regs[offset] = value }
+func (d *registerFile) Reset()                           { d.resets++ }
+
+func TestDeviceLoadStore(t *testing.T) {
+	p := Pep9Computer{}
+	dev := &registerFile{}
+	if err := p.Attach(AddressRange{0x8000, 0x8007}, dev); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	p.Initialize()
+	if dev.resets != 1 {
+		t.Errorf("Expected Initialize to reset the device once but got %d", dev.resets)
+	}
+
+	dev.regs[7] = 0x42
+	p.LoadProgram(assemble(t, `
+         LDWA    0x1234,i
+         STWA    0x8002,d
+         LDBX    0x8007,d
+         STOP
+         .END`))
+	p.ExecuteVonNeumann()
+
+	if dev.regs[2] != 0x12 || dev.regs[3] != 0x34 {
+		t.Errorf("Expected the device to hold 12 34 but got % X", dev.regs[2:4])
+	}
+	if p.Ram[0x8002] != 0 {
+		t.Errorf("Expected RAM under the device to be untouched")
+	}
+	if p.X != 0x42 {
+		t.Errorf("Expected X to be 0x42 but got 0x%X", p.X)
+	}
+}
+
+func TestDeviceAttach(t *testing.T) {
+	m := Memory{}
+	dev := &registerFile{}
+
+	if err := m.Attach(AddressRange{0x10, 0x17}, dev); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := m.Attach(AddressRange{0x17, 0x20}, &registerFile{}); err == nil {
+		t.Error("Expected an error for an overlapping range")
+	}
+	if err := m.Attach(AddressRange{0x20, 0x10}, &registerFile{}); err == nil {
+		t.Error("Expected an error for an empty range")
+	}
+
+	if d, offset, ok := m.DeviceAt(0x13); !ok || d != dev || offset != 3 {
+		t.Errorf("Expected the device at offset 3 but got %v %d %t", d, offset, ok)
+	}
+
+	m.Detach(dev)
+	if _, _, ok := m.DeviceAt(0x13); ok {
+		t.Error("Expected the device to be detached")
+	}
+}
@@ -0,0 +1,45 @@
+package computer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Dump writes memory as a hex dump of 16 bytes per line with their ASCII
+// text. Devices are not read, so dumping has no side effects. With no
+// ranges all of memory is dumped.
+func (c *Memory) Dump(w io.Writer, ranges ...AddressRange) error {
+	if len(ranges) == 0 {
+		ranges = []AddressRange{{0x0000, 0xFFFF}}
+	}
+	bw := bufio.NewWriter(w)
+
+	for _, r := range ranges {
+		for line := int(r.Start) &^ 0xF; line <= int(r.End); line += 16 {
+			var text [16]byte
+			fmt.Fprintf(bw, "%04X ", line)
+			for i := 0; i < 16; i++ {
+				location := line + i
+				if i == 8 {
+					bw.WriteByte(' ')
+				}
+				if location < int(r.Start) || location > int(r.End) {
+					bw.WriteString("   ")
+					text[i] = ' '
+					continue
+				}
+				b := c.Ram[location]
+				fmt.Fprintf(bw, " %02X", b)
+				if b >= ' ' && b <= '~' {
+					text[i] = b
+				} else {
+					text[i] = '.'
+				}
+			}
+			fmt.Fprintf(bw, "  |%s|\n", text[:])
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,63 @@
+package computer
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrHalted is returned by Step once the computer has halted.
+	ErrHalted = errors.New("computer is halted")
+	// ErrStepLimit is returned by Run when the limit passes without a halt.
+	ErrStepLimit = errors.New("step limit reached")
+	// ErrIllegalOpcode is raised by an instruction specifier the processor
+	// cannot execute.
+	ErrIllegalOpcode = errors.New("illegal opcode")
+	// ErrIllegalAddressingMode is raised by an instruction used with an
+	// addressing mode it does not allow, such as a store in immediate mode.
+	ErrIllegalAddressingMode = errors.New("illegal addressing mode")
+	// ErrMemoryProtection is raised by a store into the operating system ROM.
+	ErrMemoryProtection = errors.New("store to read only memory")
+)
+
+// ExecutionError reports where execution went wrong. It wraps one of the
+// Err values above, so callers can test it with errors.Is.
+type ExecutionError struct {
+	Err     error
+	PC      uint16 // Address of the instruction
+	OpCode  uint8
+	Address uint16 // The location stored to for ErrMemoryProtection
+}
+
+func (e *ExecutionError) Error() string {
+	if e.Err == ErrMemoryProtection {
+		return fmt.Sprintf("%v at 0x%04X by opcode 0x%02X at 0x%04X", e.Err, e.Address, e.OpCode, e.PC)
+	}
+	return fmt.Sprintf("%v: opcode 0x%02X at 0x%04X", e.Err, e.OpCode, e.PC)
+}
+
+func (e *ExecutionError) Unwrap() error {
+	return e.Err
+}
+
+// fail stops the computer with an error about the current instruction. The
+// first failure of an instruction is the one reported.
+func (c *Pep9Computer) fail(err error) {
+	if c.fault == nil {
+		c.fault = &ExecutionError{Err: err}
+	}
+}
+
+// takeFault returns the error raised by the instruction just executed, if
+// any, halting the computer.
+func (c *Pep9Computer) takeFault() error {
+	if c.fault == nil {
+		return nil
+	}
+	err := c.fault
+	c.fault = nil
+	err.PC = c.instruction
+	err.OpCode = c.OpCode
+	c.HALT = true
+	return err
+}
@@ -0,0 +1,82 @@
+package computer
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestIllegalAddressingMode(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram([]byte{0xC0, 0x00, 0x01, 0xE0, 0x00, 0x10, 0x00}) // LDWA 1,i; STWA 0x10,i; STOP
+
+	p.Step()
+	r, err := p.Step()
+
+	var execErr *ExecutionError
+	if !errors.As(err, &execErr) || !errors.Is(err, ErrIllegalAddressingMode) {
+		t.Fatalf("Expected ErrIllegalAddressingMode but got %v", err)
+	}
+	if execErr.PC != 0x0003 || execErr.OpCode != 0xE0 {
+		t.Errorf("Expected the error at 0x0003 for 0xE0 but got 0x%04X for 0x%02X", execErr.PC, execErr.OpCode)
+	}
+	if !r.Halted || !p.HALT {
+		t.Error("Expected the error to halt the computer")
+	}
+	if _, err := p.Step(); err != ErrHalted {
+		t.Errorf("Expected ErrHalted but got %v", err)
+	}
+}
+
+func TestMemoryProtection(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram(assemble(t, `
+         LDWA    0,i
+         STWA    0xFFFE,d
+         STOP
+         .END`))
+
+	err := p.Run(context.Background(), 0)
+
+	var execErr *ExecutionError
+	if !errors.As(err, &execErr) || !errors.Is(err, ErrMemoryProtection) {
+		t.Fatalf("Expected ErrMemoryProtection but got %v", err)
+	}
+	if execErr.PC != 0x0003 || execErr.OpCode != 0xE1 || execErr.Address != 0xFFFE {
+		t.Errorf("Expected the store to 0xFFFE at 0x0003 but got %+v", execErr)
+	}
+	if p.LoadWord(TrapVector) == 0 {
+		t.Error("Expected the trap vector to survive")
+	}
+}
+
+func TestStepLimitError(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram([]byte{0x12, 0x00, 0x00}) // BR 0x0000
+
+	err := p.Run(context.Background(), 10)
+
+	var execErr *ExecutionError
+	if !errors.As(err, &execErr) || !errors.Is(err, ErrStepLimit) {
+		t.Fatalf("Expected ErrStepLimit but got %v", err)
+	}
+	if execErr.PC != 0x0000 || execErr.OpCode != 0x12 {
+		t.Errorf("Expected the next instruction BR at 0x0000 but got %+v", execErr)
+	}
+	if p.HALT {
+		t.Error("Expected the step limit to leave the computer runnable")
+	}
+}
+
+func TestNativeTrapIllegalMode(t *testing.T) {
+	p := Pep9Computer{}
+	p.SP = DefaultUserStack
+	p.LoadProgram([]byte{0x30, 0x00, 0x00, 0x00}) // DECI 0,i
+
+	if err := p.Run(context.Background(), 0); !errors.Is(err, ErrIllegalAddressingMode) {
+		t.Errorf("Expected ErrIllegalAddressingMode but got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package computer
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// hexRecordSize is the number of data bytes written per record.
+const hexRecordSize = 16
+
+// HexFileError locates a problem in an Intel HEX or S-record file.
+type HexFileError struct {
+	Format string
+	Line   int
+	Msg    string
+}
+
+func (e *HexFileError) Error() string {
+	return fmt.Sprintf("%s line %d: %s", e.Format, e.Line, e.Msg)
+}
+
+// LoadIntelHex stores the data records of an Intel HEX file in memory. Only
+// locations named by a record are changed, so sparse images overlay the
+// existing contents.
+func (c *Memory) LoadIntelHex(r io.Reader) error {
+	const format = "intel hex"
+	var upper uint32 // From extended segment and linear address records
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if text[0] != ':' {
+			return &HexFileError{format, line, "record does not start with ':'"}
+		}
+		record, err := hex.DecodeString(text[1:])
+		if err != nil || len(record) < 5 || len(record) != int(record[0])+5 {
+			return &HexFileError{format, line, "malformed record"}
+		}
+		if sum := checksum(record); sum != 0 {
+			return &HexFileError{format, line, "checksum mismatch"}
+		}
+
+		data := record[4 : len(record)-1]
+		switch record[3] {
+		case 0x00: // Data
+			location := upper + (uint32(record[1])<<8 | uint32(record[2]))
+			if location+uint32(len(data)) > uint32(len(c.Ram)) {
+				return &HexFileError{format, line, fmt.Sprintf("data at 0x%X is outside the 64KiB address space", location)}
+			}
+			copy(c.Ram[location:], data)
+		case 0x01: // End of file
+			return nil
+		case 0x02: // Extended segment address
+			if len(data) != 2 {
+				return &HexFileError{format, line, "malformed extended segment address"}
+			}
+			upper = (uint32(data[0])<<8 | uint32(data[1])) << 4
+		case 0x04: // Extended linear address
+			if len(data) != 2 {
+				return &HexFileError{format, line, "malformed extended linear address"}
+			}
+			upper = (uint32(data[0])<<8 | uint32(data[1])) << 16
+		case 0x03, 0x05: // Start address, Pep/9 always starts from its vectors
+		default:
+			return &HexFileError{format, line, fmt.Sprintf("unknown record type %02X", record[3])}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return &HexFileError{format, 0, "missing end of file record"}
+}
+
+// DumpIntelHex writes the given ranges of memory as an Intel HEX file. With
+// no ranges all of memory is written, skipping records that are entirely
+// zero.
+func (c *Memory) DumpIntelHex(w io.Writer, ranges ...AddressRange) error {
+	bw := bufio.NewWriter(w)
+
+	c.eachRecord(ranges, func(location uint16, data []byte) {
+		record := []byte{byte(len(data)), byte(location >> 8), byte(location), 0x00}
+		record = append(record, data...)
+		record = append(record, -checksum(record))
+		fmt.Fprintf(bw, ":%X\n", record)
+	})
+	fmt.Fprintln(bw, ":00000001FF")
+
+	return bw.Flush()
+}
+
+// LoadSRecord stores the data records of a Motorola S-record file in memory.
+func (c *Memory) LoadSRecord(r io.Reader) error {
+	const format = "s-record"
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if len(text) < 2 || text[0] != 'S' {
+			return &HexFileError{format, line, "record does not start with 'S'"}
+		}
+		record, err := hex.DecodeString(text[2:])
+		if err != nil || len(record) < 3 || len(record) != int(record[0])+1 {
+			return &HexFileError{format, line, "malformed record"}
+		}
+		if sum := checksum(record[:len(record)-1]); ^sum != record[len(record)-1] {
+			return &HexFileError{format, line, "checksum mismatch"}
+		}
+
+		var addressSize int
+		switch text[1] {
+		case '0', '5', '6': // Header and record counts carry no data
+			continue
+		case '1':
+			addressSize = 2
+		case '2':
+			addressSize = 3
+		case '3':
+			addressSize = 4
+		case '7', '8', '9': // Termination
+			return nil
+		default:
+			return &HexFileError{format, line, fmt.Sprintf("unknown record type S%c", text[1])}
+		}
+
+		if len(record) < addressSize+2 {
+			return &HexFileError{format, line, "malformed record"}
+		}
+		var location uint32
+		for _, b := range record[1 : 1+addressSize] {
+			location = location<<8 | uint32(b)
+		}
+		data := record[1+addressSize : len(record)-1]
+		if location+uint32(len(data)) > uint32(len(c.Ram)) {
+			return &HexFileError{format, line, fmt.Sprintf("data at 0x%X is outside the 64KiB address space", location)}
+		}
+		copy(c.Ram[location:], data)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return &HexFileError{format, 0, "missing termination record"}
+}
+
+// DumpSRecord writes the given ranges of memory as S1 records with an S9
+// termination record. With no ranges all of memory is written, skipping
+// records that are entirely zero.
+func (c *Memory) DumpSRecord(w io.Writer, ranges ...AddressRange) error {
+	bw := bufio.NewWriter(w)
+	srecord := func(kind byte, body []byte) {
+		record := append([]byte{byte(len(body) + 1)}, body...)
+		fmt.Fprintf(bw, "S%c%X%02X\n", kind, record, ^checksum(record))
+	}
+
+	srecord('0', []byte{0x00, 0x00, 'p', 'e', 'p', '9'})
+	count := 0
+	c.eachRecord(ranges, func(location uint16, data []byte) {
+		srecord('1', append([]byte{byte(location >> 8), byte(location)}, data...))
+		count++
+	})
+	if count <= 0xFFFF {
+		srecord('5', []byte{byte(count >> 8), byte(count)})
+	}
+	srecord('9', []byte{0x00, 0x00})
+
+	return bw.Flush()
+}
+
+// eachRecord splits the ranges into records of at most hexRecordSize bytes.
+func (c *Memory) eachRecord(ranges []AddressRange, record func(location uint16, data []byte)) {
+	sparse := len(ranges) == 0
+	if sparse {
+		ranges = []AddressRange{{0x0000, 0xFFFF}}
+	}
+
+	for _, r := range ranges {
+		for start := int(r.Start); start <= int(r.End); start += hexRecordSize {
+			end := start + hexRecordSize
+			if end > int(r.End)+1 {
+				end = int(r.End) + 1
+			}
+			data := c.Ram[start:end]
+			if sparse && isZero(data) {
+				continue
+			}
+			record(uint16(start), data)
+		}
+	}
+}
+
+func checksum(record []byte) byte {
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	return sum
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
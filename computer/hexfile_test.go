@@ -0,0 +1,127 @@
+package computer
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoadIntelHex(t *testing.T) {
+	m := Memory{}
+
+	err := m.LoadIntelHex(strings.NewReader(":0300300002337A1E\n:00000001FF\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := memTest(m.Ram, 0x30, []uint8{0x02, 0x33, 0x7A}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadIntelHexErrors(t *testing.T) {
+	tests := []string{
+		":0300300002337A1F\n:00000001FF\n", // Bad checksum
+		"0300300002337A1E\n:00000001FF\n",  // Missing colon
+		":0300300002337A1E\n",              // Missing EOF record
+		":02FFFF00010200\n:00000001FF\n",   // Past the end of memory
+	}
+
+	for _, test := range tests {
+		m := Memory{}
+		var hexErr *HexFileError
+		if err := m.LoadIntelHex(strings.NewReader(test)); !errors.As(err, &hexErr) {
+			t.Errorf("Expected a HexFileError for %q but got %v", test, err)
+		}
+	}
+}
+
+func TestLoadSRecord(t *testing.T) {
+	m := Memory{}
+
+	err := m.LoadSRecord(strings.NewReader("S00F000068656C6C6F202020202000003C\nS1137AF00A0A0D0000000000000000000000000061\nS9030000FC\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if m.Ram[0x7AF0] != 0x0A || m.Ram[0x7AF1] != 0x0A || m.Ram[0x7AF2] != 0x0D {
+		t.Errorf("Expected 0A 0A 0D at 0x7AF0 but got % X", m.Ram[0x7AF0:0x7AF3])
+	}
+}
+
+func TestLoadSRecordBadChecksum(t *testing.T) {
+	m := Memory{}
+
+	err := m.LoadSRecord(strings.NewReader("S1137AF00A0A0D0000000000000000000000000062\nS9030000FC\n"))
+	var hexErr *HexFileError
+	if !errors.As(err, &hexErr) || hexErr.Line != 1 {
+		t.Errorf("Expected a checksum error on line 1 but got %v", err)
+	}
+}
+
+func TestHexRoundTrip(t *testing.T) {
+	formats := []struct {
+		name string
+		dump func(*Memory, *bytes.Buffer, ...AddressRange) error
+		load func(*Memory, *bytes.Buffer) error
+	}{
+		{"intel hex",
+			func(m *Memory, b *bytes.Buffer, r ...AddressRange) error { return m.DumpIntelHex(b, r...) },
+			func(m *Memory, b *bytes.Buffer) error { return m.LoadIntelHex(b) }},
+		{"s-record",
+			func(m *Memory, b *bytes.Buffer, r ...AddressRange) error { return m.DumpSRecord(b, r...) },
+			func(m *Memory, b *bytes.Buffer) error { return m.LoadSRecord(b) }},
+	}
+
+	for _, format := range formats {
+		src := Memory{}
+		for i := 0; i < 40; i++ {
+			src.Ram[0x0100+i] = uint8(i + 1)
+		}
+		src.Ram[0xFFFF] = 0xAA
+
+		var sparse bytes.Buffer
+		if err := format.dump(&src, &sparse); err != nil {
+			t.Fatalf("%s: unexpected error: %v", format.name, err)
+		}
+		dst := Memory{}
+		if err := format.load(&dst, &sparse); err != nil {
+			t.Fatalf("%s: unexpected error: %v", format.name, err)
+		}
+		if dst.Ram != src.Ram {
+			t.Errorf("%s: expected the sparse image to round trip", format.name)
+		}
+
+		var ranged bytes.Buffer
+		if err := format.dump(&src, &ranged, AddressRange{0x0100, 0x0103}); err != nil {
+			t.Fatalf("%s: unexpected error: %v", format.name, err)
+		}
+		dst = Memory{}
+		if err := format.load(&dst, &ranged); err != nil {
+			t.Fatalf("%s: unexpected error: %v", format.name, err)
+		}
+		if err := memTest(dst.Ram, 0x00, []uint8{0, 0, 0}); err != nil {
+			t.Errorf("%s: %v", format.name, err)
+		}
+		if dst.Ram[0x0103] != 4 || dst.Ram[0x0104] != 0 || dst.Ram[0xFFFF] != 0 {
+			t.Errorf("%s: expected only 0x0100-0x0103 to be dumped", format.name)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	m := Memory{}
+	copy(m.Ram[0x12:], "Hello\x00")
+
+	var b strings.Builder
+	if err := m.Dump(&b, AddressRange{0x0012, 0x0021}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := "0010        48 65 6C 6C 6F 00  00 00 00 00 00 00 00 00  |  Hello.........|\n" +
+		"0020  00 00                                             |..              |\n"
+	if b.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, b.String())
+	}
+}
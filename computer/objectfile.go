@@ -0,0 +1,93 @@
+package computer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode"
+)
+
+// ObjectFileError locates a problem in a Pep/9 .pepo object file.
+type ObjectFileError struct {
+	Line, Column int
+	Msg          string
+}
+
+func (e *ObjectFileError) Error() string {
+	return fmt.Sprintf("object file %d:%d: %s", e.Line, e.Column, e.Msg)
+}
+
+// LoadObjectFile loads a Pep/9 object file into memory starting at 0x0000.
+// The file is whitespace separated pairs of hex digits terminated by "zz".
+func (c *Pep9Computer) LoadObjectFile(r io.Reader) error {
+	return c.LoadObjectFileAt(r, 0x0000)
+}
+
+// LoadObjectFileAt loads a Pep/9 object file into memory starting at base.
+// Nothing is stored unless the whole file is valid.
+func (c *Pep9Computer) LoadObjectFileAt(r io.Reader, base uint16) error {
+	program, err := ReadObjectFile(r)
+	if err != nil {
+		return err
+	}
+	if int(base)+len(program) > len(c.Ram) {
+		return fmt.Errorf("object file of %d bytes does not fit in memory at 0x%04X", len(program), base)
+	}
+
+	copy(c.Ram[base:], program)
+	return nil
+}
+
+// ReadObjectFile parses a Pep/9 object file into the bytes it contains.
+func ReadObjectFile(r io.Reader) ([]byte, error) {
+	var program []byte
+	br := bufio.NewReader(r)
+	line, column := 1, 0
+
+	var token []rune
+	var tokenLine, tokenColumn int
+
+	for {
+		ch, _, err := br.ReadRune()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if err == io.EOF || unicode.IsSpace(ch) {
+			if len(token) > 0 {
+				text := string(token)
+				token = token[:0]
+
+				if text == "zz" {
+					return program, nil
+				}
+				if len(text) != 2 {
+					return nil, &ObjectFileError{tokenLine, tokenColumn, fmt.Sprintf("expected a pair of hex digits but found %q", text)}
+				}
+				value, perr := strconv.ParseUint(text, 16, 8)
+				if perr != nil {
+					return nil, &ObjectFileError{tokenLine, tokenColumn, fmt.Sprintf("invalid hex pair %q", text)}
+				}
+				program = append(program, byte(value))
+			}
+
+			if err == io.EOF {
+				return nil, &ObjectFileError{line, column + 1, "missing zz terminator"}
+			}
+			if ch == '\n' {
+				line++
+				column = 0
+			} else {
+				column++
+			}
+			continue
+		}
+
+		column++
+		if len(token) == 0 {
+			tokenLine, tokenColumn = line, column
+		}
+		token = append(token, ch)
+	}
+}
@@ -0,0 +1,66 @@
+package computer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoadObjectFile(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+
+	err := p.LoadObjectFile(strings.NewReader("D1 00 04 00\n42 zz\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	p.ExecuteVonNeumann()
+
+	if p.A != 0x42 {
+		t.Errorf("Expected A to be [0x42] but got [0x%X]", p.A)
+	}
+}
+
+func TestLoadObjectFileAt(t *testing.T) {
+	p := Pep9Computer{}
+
+	if err := p.LoadObjectFileAt(strings.NewReader("be EF zz"), 0xFFFE); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if p.Ram[0xFFFE] != 0xBE || p.Ram[0xFFFF] != 0xEF {
+		t.Errorf("Expected BE EF at 0xFFFE but got %X %X", p.Ram[0xFFFE], p.Ram[0xFFFF])
+	}
+}
+
+func TestLoadObjectFileErrors(t *testing.T) {
+	tests := []struct {
+		object       string
+		line, column int
+	}{
+		{"00 11\n22 3 zz", 2, 4},
+		{"00 GG zz", 1, 4},
+		{"00 112 zz", 1, 4},
+		{"00 11\n22", 2, 3},
+	}
+
+	for _, test := range tests {
+		_, err := ReadObjectFile(strings.NewReader(test.object))
+		var objErr *ObjectFileError
+		if !errors.As(err, &objErr) {
+			t.Errorf("Expected an ObjectFileError for %q but got %v", test.object, err)
+			continue
+		}
+		if objErr.Line != test.line || objErr.Column != test.column {
+			t.Errorf("Expected %q to fail at %d:%d but got %v", test.object, test.line, test.column, err)
+		}
+	}
+}
+
+func TestLoadObjectFileTooLarge(t *testing.T) {
+	p := Pep9Computer{}
+
+	if err := p.LoadObjectFileAt(strings.NewReader("00 00 zz"), 0xFFFF); err == nil {
+		t.Error("Expected an error loading past the end of memory")
+	}
+}
@@ -16,43 +16,93 @@ type Registers struct {
 	Operand uint16 // Applicable Operand a parameter to the OpCode
 }
 
+// AddressRange is an inclusive range of memory addresses.
+type AddressRange struct {
+	Start, End uint16
+}
+
+func (r AddressRange) Contains(location uint16) bool {
+	return location >= r.Start && location <= r.End
+}
+
 type Memory struct {
-	Ram                                 [65535]uint8
-	StandardInput, StandardOutput       [256]uint8
-	StandardInputLoc, StandardOutputLoc int
+	Ram      [65536]uint8
+	CharIn   CharIn
+	CharOut  CharOut
+	ROMStart uint16 // Stores from here up fault, 0 when there is no ROM
+	devices  []mapping
+
+	recording bool // Set by Step to collect reads and writes
+	reads     []MemoryRead
+	writes    []MemoryWrite
+	fault     *ExecutionError // Raised by the instruction being executed
+
+	watchpoints []*Watchpoint
+	hits        []WatchHit // Triggered by the instruction being executed
 }
 
 func (c *Memory) LoadByte(location uint16) uint16 {
-	if location == 0xFC15 { //Standard input (byte stream)
-		value := uint16(c.StandardInput[c.StandardInputLoc])
-		c.StandardInputLoc = +1
-		if c.StandardInputLoc > 255 {
-			c.StandardInputLoc = 0
-		}
-		return value
+	value := c.loadByte(location)
+	if len(c.watchpoints) > 0 {
+		c.watch(location, 1, WatchRead, value, value)
 	}
-	return uint16(c.Ram[location])
+	return value
 }
 
 func (c *Memory) LoadWord(location uint16) uint16 {
-	word := c.LoadByte(location) << 8
-	word |= c.LoadByte(location + 1)
+	word := c.loadWord(location)
+	if len(c.watchpoints) > 0 {
+		c.watch(location, 2, WatchRead, word, word)
+	}
 	return word
 }
 
 func (c *Memory) StoreByte(value uint16, location uint16) {
-	if location == 0xFC16 { //Standard input (byte stream)
-		c.StandardOutput[c.StandardOutputLoc] = uint8(value)
-		c.StandardOutputLoc = +1
-		if c.StandardOutputLoc > 255 {
-			c.StandardOutputLoc = 0
-		}
-	} else {
-		c.Ram[location] = uint8(value)
+	if len(c.watchpoints) > 0 {
+		c.watch(location, 1, WatchWrite, uint16(c.Ram[location]), uint16(uint8(value)))
 	}
+	c.storeByte(value, location)
 }
 
 func (c *Memory) StoreWord(value uint16, location uint16) {
-	c.StoreByte(uint16(uint8(value>>8)), location)
-	c.StoreByte(uint16(uint8(value)), location+1)
+	if len(c.watchpoints) > 0 {
+		c.watch(location, 2, WatchWrite, c.peekWord(location), value)
+	}
+	c.storeByte(uint16(uint8(value>>8)), location)
+	c.storeByte(uint16(uint8(value)), location+1)
+}
+
+// loadByte, loadWord and storeByte access memory without triggering
+// watchpoints, for instruction fetch and for the exported methods above.
+
+func (c *Memory) loadByte(location uint16) uint16 {
+	var value uint8
+	if d, offset, ok := c.DeviceAt(location); ok {
+		value = d.Load(offset)
+	} else {
+		value = c.Ram[location]
+	}
+	if c.recording {
+		c.reads = append(c.reads, MemoryRead{location, value})
+	}
+	return uint16(value)
+}
+
+func (c *Memory) loadWord(location uint16) uint16 {
+	word := c.loadByte(location) << 8
+	word |= c.loadByte(location + 1)
+	return word
+}
+
+func (c *Memory) storeByte(value uint16, location uint16) {
+	if c.recording {
+		c.writes = append(c.writes, MemoryWrite{location, c.Ram[location], uint8(value)})
+	}
+	if d, offset, ok := c.DeviceAt(location); ok {
+		d.Store(offset, uint8(value))
+	} else if c.ROMStart == 0 || location < c.ROMStart {
+		c.Ram[location] = uint8(value)
+	} else if c.fault == nil {
+		c.fault = &ExecutionError{Err: ErrMemoryProtection, Address: location}
+	}
 }
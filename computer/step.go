@@ -0,0 +1,152 @@
+package computer
+
+import (
+	"context"
+
+	"pep9emulator/isa"
+)
+
+// contextCheckInterval is how many instructions Run executes between checks
+// for a cancelled context.
+const contextCheckInterval = 1024
+
+// StepResult describes one executed instruction.
+type StepResult struct {
+	Address     uint16 // Address of the instruction specifier
+	OpCode      uint8
+	Instruction *isa.Instruction
+	Mode        isa.Mode
+	Operand     uint16 // Operand specifier, zero for unary instructions
+
+	// EffectiveAddress is the memory address the operand was read from or
+	// written to, or the branch table entry for indexed branches. Immediate
+	// and unary instructions have none.
+	EffectiveAddress    uint16
+	HasEffectiveAddress bool
+
+	Before, After Processor
+	Reads         []MemoryRead  // Every byte loaded after the fetch, in order
+	Writes        []MemoryWrite // Every byte stored, in order
+	Watches       []WatchHit    // Watchpoints triggered
+	Halted        bool
+}
+
+// MemoryRead is one byte loaded by an instruction.
+type MemoryRead struct {
+	Address uint16
+	Value   uint8
+}
+
+// MemoryWrite is one byte stored by an instruction. Old is the RAM contents
+// before the store, which for a device address is not what the device held.
+type MemoryWrite struct {
+	Address    uint16
+	Old, Value uint8
+}
+
+// Step executes exactly one instruction and reports what it did, passing
+// the result to Trace if it is set. An instruction that fails halts the
+// computer and returns an ExecutionError along with its result.
+func (c *Pep9Computer) Step() (StepResult, error) {
+	if c.HALT {
+		return StepResult{}, ErrHalted
+	}
+
+	r := StepResult{Address: c.PC, Before: c.Processor}
+
+	c.fetch()
+	c.recording = true
+	c.reads, c.writes = nil, nil
+	defer func() { c.recording = false }()
+
+	r.OpCode = c.OpCode
+	r.Instruction, r.Mode = isa.Decode(c.OpCode)
+	if !r.Instruction.IsUnary() {
+		r.Operand = c.Operand
+	}
+	r.EffectiveAddress, r.HasEffectiveAddress = c.effectiveAddress(r.Instruction, r.Mode)
+
+	c.execute()
+	err := c.takeFault()
+
+	r.After = c.Processor
+	r.Reads = c.reads
+	r.Writes = c.writes
+	r.Watches = c.takeHits()
+	r.Halted = c.HALT
+	if c.Trace != nil {
+		c.Trace(r)
+	}
+	return r, err
+}
+
+// Run executes instructions until the computer halts, limit instructions
+// have executed, a watchpoint triggers or ctx is cancelled. A limit of zero
+// is no limit. It returns nil after a STOP, an ExecutionError when an
+// instruction fails or the limit is reached, a WatchError, or the context's
+// error.
+func (c *Pep9Computer) Run(ctx context.Context, limit int) error {
+	if c.Trace != nil {
+		return c.runTraced(ctx, limit)
+	}
+
+	for steps := 0; !c.HALT; steps++ {
+		if limit > 0 && steps == limit {
+			return &ExecutionError{Err: ErrStepLimit, PC: c.PC, OpCode: c.Ram[c.PC]}
+		}
+		if steps%contextCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		c.fetch()
+		c.execute()
+		if err := c.takeFault(); err != nil {
+			return err
+		}
+		if len(c.hits) > 0 {
+			return &WatchError{c.takeHits()}
+		}
+	}
+	return nil
+}
+
+// runTraced is Run for a computer with a Trace hook. It goes through Step,
+// which the untraced loop avoids for speed.
+func (c *Pep9Computer) runTraced(ctx context.Context, limit int) error {
+	for steps := 0; !c.HALT; steps++ {
+		if limit > 0 && steps == limit {
+			return &ExecutionError{Err: ErrStepLimit, PC: c.PC, OpCode: c.Ram[c.PC]}
+		}
+		if steps%contextCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		r, err := c.Step()
+		if err != nil {
+			return err
+		}
+		if len(r.Watches) > 0 {
+			return &WatchError{r.Watches}
+		}
+	}
+	return nil
+}
+
+// effectiveAddress finds the operand address of the instruction just
+// fetched without touching devices, so it is safe to call before execute.
+func (c *Pep9Computer) effectiveAddress(inst *isa.Instruction, mode isa.Mode) (uint16, bool) {
+	switch {
+	case inst.IsUnary() || mode == isa.Immediate:
+		return 0, false
+	case inst.Format == isa.ModeA: // Indexed branches read their target from a table
+		return c.Operand + c.X, true
+	}
+	return effectiveAddress(mode, c.Operand, c.SP, c.X, c.peekWord), true
+}
+
+// peekWord reads a word from RAM, bypassing devices.
+func (c *Memory) peekWord(location uint16) uint16 {
+	return uint16(c.Ram[location])<<8 | uint16(c.Ram[location+1])
+}
@@ -0,0 +1,141 @@
+package computer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"pep9emulator/isa"
+)
+
+func TestStep(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram(assemble(t, `
+         LDWA    0x1234,i
+         STWA    num,d
+         STOP
+num:     .BLOCK  2
+         .END`))
+
+	r, err := p.Step()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if r.Address != 0x0000 || r.OpCode != 0xC0 || r.Instruction.Mnemonic != "LDWA" || r.Mode != isa.Immediate || r.Operand != 0x1234 {
+		t.Errorf("Expected LDWA 0x1234,i at 0x0000 but got %+v", r)
+	}
+	if r.HasEffectiveAddress {
+		t.Error("Expected no effective address for immediate mode")
+	}
+	if r.Before.A != 0 || r.After.A != 0x1234 || r.After.PC != 0x0003 {
+		t.Errorf("Expected A to go from 0 to 0x1234 but got %+v", r)
+	}
+
+	r, _ = p.Step()
+	if !r.HasEffectiveAddress || r.EffectiveAddress != 0x0007 {
+		t.Errorf("Expected the effective address 0x0007 but got 0x%04X", r.EffectiveAddress)
+	}
+	expected := []MemoryWrite{{0x0007, 0, 0x12}, {0x0008, 0, 0x34}}
+	if len(r.Writes) != 2 || r.Writes[0] != expected[0] || r.Writes[1] != expected[1] {
+		t.Errorf("Expected writes %v but got %v", expected, r.Writes)
+	}
+
+	r, _ = p.Step()
+	if !r.Halted || len(r.Writes) != 0 {
+		t.Errorf("Expected STOP to halt without writes but got %+v", r)
+	}
+	if _, err := p.Step(); err != ErrHalted {
+		t.Errorf("Expected ErrHalted but got %v", err)
+	}
+}
+
+func TestStepEffectiveAddress(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram(assemble(t, `
+         LDWX    2,i
+         BR      table,x
+done:    STOP
+table:   .ADDRSS done
+         .ADDRSS done
+         .END`))
+	p.Step()
+
+	r, _ := p.Step()
+	if !r.HasEffectiveAddress || r.EffectiveAddress != 0x0009 || r.After.PC != 0x0006 {
+		t.Errorf("Expected the table entry at 0x0009 and PC 0x0006 but got 0x%04X and 0x%04X", r.EffectiveAddress, r.After.PC)
+	}
+	expected := []MemoryRead{{0x0009, 0x00}, {0x000A, 0x06}}
+	if len(r.Reads) != 2 || r.Reads[0] != expected[0] || r.Reads[1] != expected[1] {
+		t.Errorf("Expected reads %v but got %v", expected, r.Reads)
+	}
+}
+
+func TestStackDeferredIndexed(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram(assemble(t, `
+         LDWA    array,i
+         STWA    -2,s
+         SUBSP   2,i
+         LDWX    2,i
+         LDWA    0,sfx       ;A := array[1]
+         LDWX    4,i
+         STWA    0,sfx       ;array[2] := A
+         STOP
+array:   .WORD   0x1111
+         .WORD   0x2222
+         .WORD   0x3333
+         .END`))
+	p.ExecuteVonNeumann()
+
+	if p.A != 0x2222 {
+		t.Errorf("Expected A to be 0x2222 but got 0x%04X", p.A)
+	}
+	if word := p.LoadWord(0x001A); word != 0x2222 {
+		t.Errorf("Expected array[2] to be 0x2222 but got 0x%04X", word)
+	}
+}
+
+func TestRun(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram([]byte{0x12, 0x00, 0x00}) // BR 0x0000
+
+	if err := p.Run(context.Background(), 5000); !errors.Is(err, ErrStepLimit) {
+		t.Errorf("Expected ErrStepLimit but got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Run(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the context to be cancelled but got %v", err)
+	}
+
+	p.Initialize()
+	p.LoadProgram([]byte{0x00})
+	if err := p.Run(context.Background(), 0); err != nil || !p.HALT {
+		t.Errorf("Expected a halt but got %v", err)
+	}
+}
+
+func TestTraceHook(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram(assemble(t, `
+         LDWA    0x1234,i
+         STWA    num,d
+         STOP
+num:     .BLOCK  2
+         .END`))
+
+	var traced []StepResult
+	p.Trace = func(r StepResult) { traced = append(traced, r) }
+	if err := p.Run(context.Background(), 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(traced) != 3 || traced[1].OpCode != 0xE1 || len(traced[1].Writes) != 2 || !traced[2].Halted {
+		t.Errorf("Expected three traced instructions ending in STOP but got %+v", traced)
+	}
+}
@@ -0,0 +1,225 @@
+package computer
+
+import "pep9emulator/isa"
+
+// Timing is a cycle cost model. An instruction costs the cycles to fetch
+// it, to form its operand address, for each memory access it makes, and for
+// its own work in Execute. Indirect modes (n, sf and sfx) read a pointer
+// word before the operand, so each level of indirection costs a WordRead.
+type Timing struct {
+	Name string
+
+	Fetch      [2]int // A unary and a nonunary instruction
+	SplitFetch int    // Extra for a nonunary instruction at an even address
+	Address    [8]int // Forming the address for each isa.Mode, without memory reads
+
+	ByteRead, ByteWrite           int
+	WordRead, WordWrite           int
+	UnalignedRead, UnalignedWrite int // Extra for a word access at an odd address
+
+	// Execute is the work of each mnemonic apart from memory accesses.
+	// Mnemonics that are missing cost DefaultExecute. A conditional branch
+	// instead costs Test for each status bit it tests, and for the jump
+	// ending the tests of a branch that fails them all, then Execute["BR"]
+	// when it is taken and NotTaken when it is not. SharedTest is saved
+	// when the first test shares the read of an indexed target.
+	Execute                    map[string]int
+	DefaultExecute             int
+	Test, NotTaken, SharedTest int
+
+	// Trap is the cost of a trap, after its fetch, up to the first
+	// instruction of the handler.
+	Trap int
+}
+
+// The built-in models are the microcode of the two CPU designs in chapter
+// 12 of the textbook, as package microcode runs it. With a one-byte data
+// bus every byte is a separate access and the ALU adds 16-bit addresses a
+// byte at a time. With a two-byte bus a word at an even address is one
+// access, and a nonunary instruction at an even address has an operand
+// specifier straddling two words.
+var (
+	OneByteBus = &Timing{
+		Name:           "one-byte bus",
+		Fetch:          [2]int{4, 10},
+		Address:        datapathAddress,
+		ByteRead:       3,
+		ByteWrite:      3,
+		WordRead:       6,
+		WordWrite:      7,
+		Execute:        datapathExecute,
+		DefaultExecute: 2,
+		Test:           1,
+		NotTaken:       1,
+		SharedTest:     1,
+		Trap:           59,
+	}
+	TwoByteBus = &Timing{
+		Name:           "two-byte bus",
+		Fetch:          [2]int{4, 8},
+		SplitFetch:     1,
+		Address:        datapathAddress,
+		ByteRead:       3,
+		ByteWrite:      3,
+		WordRead:       4,
+		WordWrite:      4,
+		UnalignedRead:  2,
+		UnalignedWrite: 4,
+		Execute:        datapathExecute,
+		DefaultExecute: 2,
+		Test:           1,
+		NotTaken:       1,
+		Trap:           44,
+	}
+
+	// The ALU work of the built-in models, which is the same on either bus.
+	datapathAddress = [8]int{isa.Direct: 2, isa.StackRelative: 2, isa.StackDeferred: 2, isa.Indexed: 2, isa.StackIndexed: 4, isa.StackDeferredIndexed: 4}
+	datapathExecute = map[string]int{
+		"STOP": 1, "RETTR": 9, "MOVFLGA": 1, "MOVAFLG": 1, "CPWA": 7, "CPWX": 7,
+		"CALL": 4, "STBA": 0, "STBX": 0, "STWA": 0, "STWX": 0,
+	}
+)
+
+// Timings lists the built-in models.
+var Timings = []*Timing{OneByteBus, TwoByteBus}
+
+func (t *Timing) execute(mnemonic string) int {
+	if cycles, ok := t.Execute[mnemonic]; ok {
+		return cycles
+	}
+	return t.DefaultExecute
+}
+
+func (t *Timing) wordRead(address uint16) int {
+	if address&1 != 0 {
+		return t.WordRead + t.UnalignedRead
+	}
+	return t.WordRead
+}
+
+func (t *Timing) wordWrite(address uint16) int {
+	if address&1 != 0 {
+		return t.WordWrite + t.UnalignedWrite
+	}
+	return t.WordWrite
+}
+
+// branchTests is the number of tests a conditional branch makes, in the
+// order the microcode makes them, and whether it is taken.
+func branchTests(mnemonic string, n, z, v, c bool) (int, bool) {
+	switch mnemonic {
+	case "BRLE":
+		switch {
+		case n:
+			return 1, true
+		case z:
+			return 2, true
+		}
+		return 3, false
+	case "BRLT":
+		if n {
+			return 1, true
+		}
+		return 2, false
+	case "BREQ":
+		if z {
+			return 1, true
+		}
+		return 2, false
+	case "BRNE":
+		return 1, !z
+	case "BRGE":
+		return 1, !n
+	case "BRGT":
+		if n {
+			return 1, false
+		}
+		return 2, !z
+	case "BRV":
+		if v {
+			return 1, true
+		}
+		return 2, false
+	case "BRC":
+		if c {
+			return 1, true
+		}
+		return 2, false
+	}
+	return 0, true
+}
+
+// instructionCycles is the cost of the instruction just fetched, found
+// before it executes so the registers are those it starts with.
+func (c *Pep9Computer) instructionCycles(t *Timing) int {
+	inst, mode := isa.Decode(c.OpCode)
+	cycles := t.Fetch[0]
+	if !isa.IsUnary(c.OpCode) {
+		cycles = t.Fetch[1]
+		if c.instruction&1 == 0 {
+			cycles += t.SplitFetch
+		}
+	}
+	switch {
+	case isa.IsTrap(c.OpCode):
+		return cycles + t.Trap
+	case inst.IsUnary():
+		cycles += t.execute(inst.Mnemonic)
+		switch c.OpCode {
+		case 0x01: // RET pops the return address
+			cycles += t.wordRead(c.SP)
+		case 0x02: // RETTR pops the status bits and four registers
+			cycles += t.ByteRead + 4*t.wordRead(c.SP+1)
+		}
+		return cycles
+	case !inst.Modes.Has(mode): // Decoding fails
+		return cycles
+	}
+
+	if inst.Format == isa.ModeA {
+		if mode == isa.Indexed { // The target comes from a table
+			cycles += t.Address[mode] + t.wordRead(c.Operand+c.X)
+		}
+		if c.OpCode >= 0x24 { // CALL pushes the return address
+			cycles += t.wordWrite(c.SP - 2)
+		}
+		if c.OpCode < 0x14 || c.OpCode >= 0x24 {
+			return cycles + t.execute(inst.Mnemonic)
+		}
+		tests, taken := branchTests(inst.Mnemonic, c.N, c.Z, c.V, c.C)
+		cycles += tests * t.Test
+		if mode == isa.Indexed {
+			cycles -= t.SharedTest
+		}
+		if taken {
+			return cycles + t.execute("BR")
+		}
+		return cycles + t.NotTaken
+	}
+
+	cycles += t.execute(inst.Mnemonic)
+	if mode == isa.Immediate {
+		return cycles
+	}
+	cycles += t.Address[mode]
+	switch mode {
+	case isa.Indirect:
+		cycles += t.wordRead(c.Operand)
+	case isa.StackDeferred, isa.StackDeferredIndexed:
+		cycles += t.wordRead(c.SP + c.Operand)
+	}
+
+	address := effectiveAddress(mode, c.Operand, c.SP, c.X, c.peekWord)
+	byteOperand := c.OpCode >= 0xB0 && c.OpCode < 0xC0 || c.OpCode >= 0xD0 && c.OpCode < 0xE0 || c.OpCode >= 0xF0
+	switch {
+	case c.OpCode >= 0xE0 && byteOperand:
+		cycles += t.ByteWrite
+	case c.OpCode >= 0xE0:
+		cycles += t.wordWrite(address)
+	case byteOperand:
+		cycles += t.ByteRead
+	default:
+		cycles += t.wordRead(address)
+	}
+	return cycles
+}
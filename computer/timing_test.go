@@ -0,0 +1,92 @@
+package computer
+
+import (
+	"testing"
+
+	"pep9emulator/isa"
+)
+
+// countingTiming gives each part of an instruction's cost a different
+// power of ten so the parts can be read off the total.
+var countingTiming = &Timing{
+	Name:           "counting",
+	Fetch:          [2]int{1, 2},
+	Address:        [8]int{isa.StackRelative: 10, isa.StackDeferred: 10, isa.Indexed: 10, isa.StackIndexed: 20, isa.StackDeferredIndexed: 20},
+	ByteRead:       100,
+	ByteWrite:      1000,
+	WordRead:       10000,
+	WordWrite:      100000,
+	UnalignedRead:  1000000,
+	UnalignedWrite: 3000000,
+	Execute:        map[string]int{"STOP": 0},
+	DefaultExecute: 0,
+	Trap:           10000000,
+}
+
+func TestInstructionCycles(t *testing.T) {
+	tests := []struct {
+		source string
+		cycles uint64
+	}{
+		{"LDWA 5,i", 2},
+		{"LDWA 0x0100,d", 2 + 10000},
+		{"LDWA 0x0101,d", 2 + 10000 + 1000000},
+		{"LDBA 0x0101,d", 2 + 100},
+		{"LDWA 0x0100,n", 2 + 2*10000},                  // The pointer, then the operand
+		{"LDWA 0,sf", 2 + 10 + 10000 + 10000 + 1000000}, // SP is odd, the pointer is zero
+		{"STWA 0x0100,d", 2 + 100000},
+		{"STBA -1,s", 2 + 10 + 1000},
+		{"ADDA 2,sx", 2 + 20 + 10000 + 1000000},
+		{"BR 0x0100,x", 2 + 10 + 10000},
+		{"CALL 0x0100", 2 + 100000 + 3000000},
+		{"RET", 1 + 10000 + 1000000},
+		{"NOTA", 1},
+		{"DECO 5,i", 2 + 10000000},
+		{"NOP0", 1 + 10000000},
+	}
+
+	for _, tc := range tests {
+		p := Pep9Computer{}
+		p.Initialize()
+		p.LoadProgram(assemble(t, tc.source+"\n .END"))
+		p.SP = 0xFB8F
+		p.Timing = countingTiming
+		p.Step()
+		if p.Cycles != tc.cycles {
+			t.Errorf("%s: expected %d cycles but got %d", tc.source, tc.cycles, p.Cycles)
+		}
+	}
+}
+
+func TestBusTimings(t *testing.T) {
+	source := `
+         LDWX    0,i
+loop:    LDWA    array,x
+         ADDA    sum,d
+         STWA    sum,d
+         ADDX    2,i
+         CPWX    8,i
+         BRNE    loop
+         STOP
+array:   .WORD   1
+         .WORD   2
+         .WORD   3
+         .WORD   4
+sum:     .WORD   0
+         .END`
+
+	var cycles []uint64
+	for _, timing := range Timings {
+		p := Pep9Computer{}
+		p.Initialize()
+		p.LoadProgram(assemble(t, source))
+		p.Timing = timing
+		if !p.ExecuteLimit(1000) || p.LoadWord(0x001E) != 10 {
+			t.Fatalf("%s: expected the sum 10", timing.Name)
+		}
+		cycles = append(cycles, p.Cycles)
+	}
+	if cycles[0] == 0 || cycles[1] >= cycles[0] {
+		t.Errorf("Expected the two-byte bus to be faster but got %v", cycles)
+	}
+}
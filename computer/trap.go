@@ -0,0 +1,242 @@
+package computer
+
+import (
+	"fmt"
+
+	"pep9emulator/isa"
+)
+
+// Machine vectors at the top of memory, each holding a word written by the
+// operating system.
+const (
+	UserStackVector   = 0xFFF4
+	SystemStackVector = 0xFFF6
+	CharInVector      = 0xFFF8
+	CharOutVector     = 0xFFFA
+	LoaderVector      = 0xFFFC
+	TrapVector        = 0xFFFE
+)
+
+// Locations of the standard Pep/9 memory map, used when no operating system
+// has filled in the machine vectors.
+const (
+	DefaultUserStack   = 0xFB8F
+	DefaultSystemStack = 0xFC0F
+	DefaultCharIn      = 0xFC15
+	DefaultCharOut     = 0xFC16
+)
+
+// trap saves the processor state on the system stack and jumps to the
+// operating system trap handler, as described for the Pep/9 trap mechanism:
+//
+//	T ← Mem[FFF6]; Mem[T-1] ← IR<0..7>; Mem[T-3] ← SP; Mem[T-5] ← PC;
+//	Mem[T-7] ← X; Mem[T-9] ← A; Mem[T-10]<4..7> ← NZVC; SP ← T-10;
+//	PC ← Mem[FFFE]
+//
+// When no operating system is installed the trap vector is zero and the
+// trap is serviced natively before returning with RETTR.
+func (c *Pep9Computer) trap() {
+	t := c.vector(SystemStackVector, DefaultSystemStack)
+
+	c.StoreByte(uint16(c.OpCode), t-1)
+	c.StoreWord(c.SP, t-3)
+	c.StoreWord(c.PC, t-5)
+	c.StoreWord(c.X, t-7)
+	c.StoreWord(c.A, t-9)
+	c.StoreByte(c.flags(), t-10)
+	c.SP = t - 10
+
+	if handler := c.LoadWord(TrapVector); handler != 0 {
+		c.PC = handler
+		return
+	}
+
+	c.serviceTrap()
+	if !c.HALT {
+		c.returnFromTrap()
+	}
+}
+
+// returnFromTrap restores the state saved by trap (RETTR):
+//
+//	NZVC ← Mem[SP]<4..7>; A ← Mem[SP+1]; X ← Mem[SP+3]; PC ← Mem[SP+5];
+//	SP ← Mem[SP+7]
+func (c *Pep9Computer) returnFromTrap() {
+	sp := c.SP
+	c.setFlags(uint8(c.LoadByte(sp)))
+	c.A = c.LoadWord(sp + 1)
+	c.X = c.LoadWord(sp + 3)
+	c.PC = c.LoadWord(sp + 5)
+	c.SP = c.LoadWord(sp + 7)
+}
+
+// vector reads a machine vector, falling back to the standard memory map
+// when it has not been set.
+func (c *Pep9Computer) vector(location uint16, fallback uint16) uint16 {
+	if value := c.LoadWord(location); value != 0 {
+		return value
+	}
+	return fallback
+}
+
+// flags packs NZVC into the low nibble of a byte.
+func (c *Pep9Computer) flags() uint16 {
+	var nzvc uint16
+	if c.N {
+		nzvc |= 0x08
+	}
+	if c.Z {
+		nzvc |= 0x04
+	}
+	if c.V {
+		nzvc |= 0x02
+	}
+	if c.C {
+		nzvc |= 0x01
+	}
+	return nzvc
+}
+
+func (c *Pep9Computer) setFlags(nzvc uint8) {
+	c.N = nzvc&0x08 != 0
+	c.Z = nzvc&0x04 != 0
+	c.V = nzvc&0x02 != 0
+	c.C = nzvc&0x01 != 0
+}
+
+// serviceTrap does the work of the operating system trap handler using the
+// state saved in the trap frame at SP.
+func (c *Pep9Computer) serviceTrap() {
+	frame := c.SP
+	opcode := uint8(c.LoadByte(frame + 9))
+
+	if isa.IsUnary(opcode) { // NOP0 and NOP1 do nothing
+		return
+	}
+
+	inst, mode := isa.Decode(opcode)
+	if !inst.Modes.Has(mode) {
+		c.writeString("ERROR: Invalid trap addressing mode.")
+		c.fail(ErrIllegalAddressingMode)
+		c.HALT = true
+		return
+	}
+
+	// The operand specifier is the word before the saved PC.
+	pc := c.LoadWord(frame + 5)
+	operand := c.LoadWord(pc - 2)
+	address := effectiveAddress(mode, operand, c.LoadWord(frame+7), c.LoadWord(frame+3), c.LoadWord)
+
+	switch opcode & 0xF8 {
+	case 0x28: // NOP
+	case 0x30: // DECI
+		value, v, ok := c.readDecimal()
+		if !ok {
+			c.writeString("ERROR: Invalid DECI input")
+			c.HALT = true
+			return
+		}
+		c.StoreWord(value, address)
+
+		nzvc := uint8(c.LoadByte(frame)) & 0x01 // DECI leaves C alone
+		if isNegative(value) {
+			nzvc |= 0x08
+		}
+		if value == 0 {
+			nzvc |= 0x04
+		}
+		if v {
+			nzvc |= 0x02
+		}
+		c.StoreByte(uint16(nzvc), frame)
+	case 0x38: // DECO
+		c.writeString(fmt.Sprintf("%d", int16(c.trapOperand(mode, operand, address))))
+	case 0x40: // HEXO
+		c.writeString(fmt.Sprintf("%04X", c.trapOperand(mode, operand, address)))
+	case 0x48: // STRO
+		charOut := c.vector(CharOutVector, DefaultCharOut)
+		for location := address; ; location++ {
+			ch := c.LoadByte(location)
+			if ch == 0 {
+				break
+			}
+			c.StoreByte(ch, charOut)
+		}
+	}
+}
+
+// trapOperand is the word a trap reads, the operand itself when immediate.
+func (c *Pep9Computer) trapOperand(mode isa.Mode, operand, address uint16) uint16 {
+	if mode == isa.Immediate {
+		return operand
+	}
+	return c.LoadWord(address)
+}
+
+// effectiveAddress computes the address of an operand from its specifier.
+func effectiveAddress(mode isa.Mode, operand, sp, x uint16, loadWord func(uint16) uint16) uint16 {
+	switch mode {
+	case isa.Direct:
+		return operand
+	case isa.Indirect:
+		return loadWord(operand)
+	case isa.StackRelative:
+		return sp + operand
+	case isa.StackDeferred:
+		return loadWord(sp + operand)
+	case isa.Indexed:
+		return operand + x
+	case isa.StackIndexed:
+		return sp + operand + x
+	case isa.StackDeferredIndexed:
+		return loadWord(sp+operand) + x
+	}
+	return operand
+}
+
+// readDecimal reads a signed decimal number from the input device the way
+// the DECI trap does: leading white space is skipped, an optional sign is
+// accepted and the number ends at the first non digit, which is consumed.
+// v reports whether the value overflowed 16 bits.
+func (c *Pep9Computer) readDecimal() (value uint16, v bool, ok bool) {
+	charIn := c.vector(CharInVector, DefaultCharIn)
+
+	ch := uint8(c.LoadByte(charIn))
+	for ch == ' ' || ch == '\n' || ch == '\t' || ch == '\r' {
+		ch = uint8(c.LoadByte(charIn))
+	}
+
+	negative := false
+	if ch == '+' || ch == '-' {
+		negative = ch == '-'
+		ch = uint8(c.LoadByte(charIn))
+	}
+
+	var result int
+	for ch >= '0' && ch <= '9' {
+		ok = true
+		result = result*10 + int(ch-'0')
+		if result > 0xFFFF {
+			v = true
+			result &= 0xFFFF
+		}
+		ch = uint8(c.LoadByte(charIn))
+	}
+	if negative {
+		if result > 32768 {
+			v = true
+		}
+		result = -result
+	} else if result > 32767 {
+		v = true
+	}
+
+	return uint16(result), v, ok
+}
+
+func (c *Pep9Computer) writeString(s string) {
+	charOut := c.vector(CharOutVector, DefaultCharOut)
+	for i := 0; i < len(s); i++ {
+		c.StoreByte(uint16(s[i]), charOut)
+	}
+}
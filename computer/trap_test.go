@@ -0,0 +1,174 @@
+package computer
+
+import (
+	"strings"
+	"testing"
+
+	"pep9emulator/assembler"
+)
+
+func assemble(t *testing.T, source string) []byte {
+	t.Helper()
+	program, err := assembler.Assemble(source)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return program.Object
+}
+
+func TestTrapOutput(t *testing.T) {
+	var output strings.Builder
+	p := Pep9Computer{}
+	p.CharOut.Writer = &output
+	p.Initialize()
+	p.LoadProgram(assemble(t, `
+         DECO    -42,i
+         HEXO    0xBEEF,i
+         STRO    msg,d
+         LDWX    2,i
+         DECO    nums,x
+         STOP
+msg:     .ASCII  "Hi\x00"
+nums:    .WORD   1
+         .WORD   99
+         .END`))
+	p.ExecuteVonNeumann()
+
+	expected := "-42BEEFHi99"
+	if got := output.String(); got != expected {
+		t.Errorf("Expected output %q but got %q", expected, got)
+	}
+}
+
+func TestTrapDECI(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.CharIn.Reader = strings.NewReader(" \n-123x")
+	p.LoadProgram(assemble(t, `
+         LDWA    0x1111,i
+         LDWX    0x2222,i
+         DECI    num,d
+         STOP
+num:     .BLOCK  2
+         .END`))
+	p.ExecuteVonNeumann()
+
+	if num := uint16(p.Ram[10])<<8 | uint16(p.Ram[11]); num != 0xFF85 {
+		t.Errorf("Expected num to be -123 but got %d", int16(num))
+	}
+	if !p.N || p.Z || p.V {
+		t.Errorf("Expected NZV to be true,false,false got %t,%t,%t", p.N, p.Z, p.V)
+	}
+	if p.A != 0x1111 || p.X != 0x2222 || p.SP != DefaultUserStack {
+		t.Errorf("Expected registers to be restored but got A=0x%04X X=0x%04X SP=0x%04X", p.A, p.X, p.SP)
+	}
+}
+
+func TestTrapDECIOverflow(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.CharIn.Reader = strings.NewReader("40000 ")
+	p.LoadProgram(assemble(t, `
+         DECI    0,s
+         STOP
+         .END`))
+	p.ExecuteVonNeumann()
+
+	if !p.V {
+		t.Error("Expected V to be set")
+	}
+}
+
+func TestTrapDECILimits(t *testing.T) {
+	tests := []struct {
+		input string
+		num   uint16
+		v     bool
+	}{
+		{"32767 ", 0x7FFF, false},
+		{"-32768 ", 0x8000, false},
+		{"32768 ", 0x8000, true},
+		{"-32769 ", 0x7FFF, true},
+		{"32770 ", 0x8002, true},
+	}
+
+	for _, test := range tests {
+		p := Pep9Computer{}
+		p.Initialize()
+		p.CharIn.Reader = strings.NewReader(test.input)
+		p.LoadProgram(assemble(t, `
+         DECI    num,d
+         STOP
+num:     .BLOCK  2
+         .END`))
+		p.ExecuteVonNeumann()
+
+		if num := uint16(p.Ram[4])<<8 | uint16(p.Ram[5]); num != test.num || p.V != test.v {
+			t.Errorf("DECI %q: expected 0x%04X and V %t but got 0x%04X and V %t", test.input, test.num, test.v, num, p.V)
+		}
+	}
+}
+
+func TestTrapVectorsToHandler(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram(assemble(t, `
+         LDWA    1,i
+         NOP0
+         STOP
+         .END`))
+	p.Ram[TrapVector] = 0x01
+	p.Ram[TrapVector+1] = 0x00
+
+	// A handler that replaces the saved A register before returning.
+	copy(p.Ram[0x0100:], assemble(t, `
+         LDWA    7,i
+         STWA    1,s
+         RETTR
+         .END`))
+	p.ExecuteVonNeumann()
+
+	if p.A != 7 {
+		t.Errorf("Expected A to be 7 but got %d", p.A)
+	}
+	if p.SP != DefaultUserStack {
+		t.Errorf("Expected SP to be restored to 0x%04X but got 0x%04X", DefaultUserStack, p.SP)
+	}
+	if p.PC != 0x0005 {
+		t.Errorf("Expected PC to be 0x0005 but got 0x%04X", p.PC)
+	}
+	if p.Ram[DefaultSystemStack-1] != 0x26 {
+		t.Errorf("Expected the trap frame to hold the NOP0 specifier but got 0x%02X", p.Ram[DefaultSystemStack-1])
+	}
+}
+
+func TestTrapInvalidMode(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram([]byte{0x29, 0x00, 0x00, 0xC0, 0x00, 0x01, 0x00}) // NOP 0,d
+
+	p.ExecuteVonNeumann()
+
+	if !p.HALT || p.A != 0 {
+		t.Errorf("Expected the trap to halt before LDWA")
+	}
+}
+
+func TestTrapWithoutOS(t *testing.T) {
+	var output strings.Builder
+	p := Pep9Computer{}
+	p.SP = DefaultUserStack
+	p.CharOut.Writer = &output
+	p.attachCharIO(DefaultCharIn, DefaultCharOut)
+	p.LoadProgram(assemble(t, `
+         DECO    -42,i
+         HEXO    0xBEEF,i
+         STOP
+         .END`))
+	p.ExecuteVonNeumann()
+
+	expected := "-42BEEF"
+	if got := output.String(); got != expected {
+		t.Errorf("Expected output %q but got %q", expected, got)
+	}
+}
@@ -0,0 +1,173 @@
+package computer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"pep9emulator/assembler"
+)
+
+// Variable is a typed variable in memory, from the trace tags of a program.
+type Variable struct {
+	assembler.Tag
+	Address uint16
+}
+
+// Value formats the variable as its tag asks: characters quoted, decimal
+// words signed and bytes unsigned, hex with every digit. Arrays are
+// written as [a, b, c].
+func (v Variable) Value(m *Memory) string {
+	elements := make([]string, v.Count)
+	for i := range elements {
+		address := v.Address + uint16(i*v.Size)
+		value := uint16(m.Ram[address])
+		if v.Size == 2 {
+			value = m.peekWord(address)
+		}
+		switch {
+		case v.Format == 'c':
+			elements[i] = strconv.QuoteRune(rune(value))
+		case v.Format == 'h':
+			elements[i] = fmt.Sprintf("0x%0*X", 2*v.Size, value)
+		case v.Size == 2:
+			elements[i] = strconv.Itoa(int(int16(value)))
+		default:
+			elements[i] = strconv.Itoa(int(value))
+		}
+	}
+	if v.Count == 1 {
+		return elements[0]
+	}
+	return "[" + strings.Join(elements, ", ") + "]"
+}
+
+// Frame is the memory one SUBSP allocated on the run-time stack, typed by
+// its trace tags. A frame without tags has no variables.
+type Frame struct {
+	PC        uint16 // Address of the SUBSP
+	SP        uint16 // Lowest address still allocated
+	Size      int    // Bytes still allocated
+	Variables []Variable
+}
+
+// Allocation is the memory a CALL with trace tags allocated on the heap,
+// found at the address in X when the call returns.
+type Allocation struct {
+	PC        uint16 // Address of the CALL
+	Variables []Variable
+}
+
+// Variables is a live view of the typed variables of a program: its
+// globals, the frames SUBSP pushes on the run-time stack and ADDSP pops,
+// and the heap allocations of tagged calls, such as
+//
+//	LDWA    4,i
+//	CALL    malloc      ;#value #next
+//
+// Frames are tracked by size, SUBSP pushing and ADDSP popping bytes from
+// the top frame, so the operating system's stack and the user's do not
+// disturb each other. Stack variables are laid out with the first tag
+// deepest, at the highest address, the way the textbook lists them;
+// globals and heap fields with the first tag at the lowest.
+type Variables struct {
+	Globals []Variable
+	Frames  []Frame // Bottom of the stack first
+	Heap    []Allocation
+
+	push    map[uint16][]assembler.Tag // SUBSP by address
+	alloc   map[uint16][]assembler.Tag // CALL by address
+	pending []pendingCall              // Tagged calls yet to return
+}
+
+type pendingCall struct {
+	pc, returnAddress uint16
+	tags              []assembler.Tag
+}
+
+// NewVariables reads the trace tags of an assembled program.
+func NewVariables(p *assembler.Program) *Variables {
+	v := &Variables{push: map[uint16][]assembler.Tag{}, alloc: map[uint16][]assembler.Tag{}}
+	for _, line := range p.Lines {
+		if len(line.Tags) == 0 {
+			continue
+		}
+		switch line.Mnemonic {
+		case ".BLOCK", ".BYTE", ".WORD", ".ADDRSS", ".ASCII":
+			v.Globals = append(v.Globals, layout(line.Address, line.Tags)...)
+		case "SUBSP":
+			v.push[line.Address] = line.Tags
+		case "CALL":
+			v.alloc[line.Address] = line.Tags
+		}
+	}
+	return v
+}
+
+// Reset forgets the stack and the heap, for a program started again.
+func (v *Variables) Reset() {
+	v.Frames = nil
+	v.Heap = nil
+	v.pending = nil
+}
+
+// layout places tagged variables one after another from address.
+func layout(address uint16, tags []assembler.Tag) []Variable {
+	var variables []Variable
+	for _, tag := range tags {
+		variables = append(variables, Variable{Tag: tag, Address: address})
+		address += uint16(tag.Bytes())
+	}
+	return variables
+}
+
+// subsp pushes a frame of size bytes at sp for the SUBSP at pc.
+func (v *Variables) subsp(pc, sp uint16, size int) {
+	frame := Frame{PC: pc, SP: sp, Size: size}
+	tags := v.push[pc]
+	for i := len(tags) - 1; i >= 0; i-- { // Deepest first, at the top of the frame
+		frame.Variables = append(frame.Variables, Variable{Tag: tags[i], Address: sp})
+		sp += uint16(tags[i].Bytes())
+	}
+	v.Frames = append(v.Frames, frame)
+}
+
+// addsp pops size bytes from the top of the stack.
+func (v *Variables) addsp(size int) {
+	for size > 0 && len(v.Frames) > 0 {
+		top := &v.Frames[len(v.Frames)-1]
+		n := min(size, top.Size)
+		popped := top.SP
+		top.SP += uint16(n)
+		top.Size -= n
+		size -= n
+		if top.Size == 0 {
+			v.Frames = v.Frames[:len(v.Frames)-1]
+			continue
+		}
+		kept := top.Variables[:0]
+		for _, variable := range top.Variables {
+			if variable.Address-popped >= uint16(n) {
+				kept = append(kept, variable)
+			}
+		}
+		top.Variables = kept
+	}
+}
+
+// call notes a tagged CALL at pc that returns to returnAddress.
+func (v *Variables) call(pc, returnAddress uint16) {
+	if tags, ok := v.alloc[pc]; ok {
+		v.pending = append(v.pending, pendingCall{pc, returnAddress, tags})
+	}
+}
+
+// ret records the allocation of a tagged call when it returns to pc with
+// the address allocated in x.
+func (v *Variables) ret(pc, x uint16) {
+	if n := len(v.pending); n > 0 && v.pending[n-1].returnAddress == pc {
+		call := v.pending[n-1]
+		v.pending = v.pending[:n-1]
+		v.Heap = append(v.Heap, Allocation{PC: call.pc, Variables: layout(x, call.tags)})
+	}
+}
@@ -0,0 +1,102 @@
+package computer
+
+import (
+	"fmt"
+	"testing"
+
+	"pep9emulator/assembler"
+)
+
+const tagged = `
+         BR      main
+count:   .WORD   -3          ;#2d
+name:    .ASCII  "hi"        ;#1c2a
+hp:      .ADDRSS heap        ;#2h
+value:   .EQUATE 0           ;#2d
+next:    .EQUATE 2           ;#2h
+local:   .EQUATE 0           ;#2d
+flag:    .EQUATE 2           ;#1h
+main:    SUBSP   3,i         ;push #flag #local
+         LDWA    7,i
+         STWA    local,s
+         LDBA    0xAB,i
+         STBA    flag,s
+         LDWA    4,i
+         CALL    malloc      ;#value #next
+         DECO    count,d
+         LDWA    42,i
+         STWA    value,x
+full:    ADDSP   2,i         ;pop #local
+half:    ADDSP   1,i         ;pop #flag
+         STOP
+malloc:  LDWX    hp,d
+         ADDA    hp,d
+         STWA    hp,d
+         RET
+heap:    .BLOCK  1
+         .END`
+
+// describe lists variables as name=value@address.
+func describe(m *Memory, variables []Variable) string {
+	s := ""
+	for _, v := range variables {
+		s += fmt.Sprintf("%s=%s@%04X ", v.Name, v.Value(m), v.Address)
+	}
+	return s
+}
+
+func TestVariables(t *testing.T) {
+	program, err := assembler.Assemble(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbol := func(name string) uint16 { return program.Symbols[name].Value }
+
+	p := Pep9Computer{}
+	p.Variables = NewVariables(program)
+	p.Initialize()
+	p.LoadProgram(program.Object)
+	runTo := func(address uint16) {
+		t.Helper()
+		for p.PC != address {
+			if _, err := p.Step(); err != nil {
+				t.Fatalf("at 0x%04X: %v", p.PC, err)
+			}
+		}
+	}
+
+	v := p.Variables
+	if got, expected := describe(&p.Memory, v.Globals), fmt.Sprintf("count=-3@0003 name=['h', 'i']@0005 hp=0x%04X@0007 ", symbol("heap")); got != expected {
+		t.Errorf("globals %s, expected %s", got, expected)
+	}
+
+	runTo(symbol("full"))
+	sp := p.SP
+	if len(v.Frames) != 1 || v.Frames[0].PC != symbol("main") || v.Frames[0].SP != sp || v.Frames[0].Size != 3 {
+		t.Fatalf("frames %+v", v.Frames)
+	}
+	if got, expected := describe(&p.Memory, v.Frames[0].Variables), fmt.Sprintf("local=7@%04X flag=0xAB@%04X ", sp, sp+2); got != expected {
+		t.Errorf("frame %s, expected %s", got, expected)
+	}
+	if len(v.Heap) != 1 {
+		t.Fatalf("heap %+v", v.Heap)
+	}
+	heap := symbol("heap")
+	if got, expected := describe(&p.Memory, v.Heap[0].Variables), fmt.Sprintf("value=42@%04X next=0x0000@%04X ", heap, heap+2); got != expected {
+		t.Errorf("heap %s, expected %s", got, expected)
+	}
+
+	runTo(symbol("half"))
+	if len(v.Frames) != 1 || v.Frames[0].Size != 1 || describe(&p.Memory, v.Frames[0].Variables) != fmt.Sprintf("flag=0xAB@%04X ", sp+2) {
+		t.Errorf("after popping local %+v", v.Frames)
+	}
+	p.ExecuteVonNeumann()
+	if len(v.Frames) != 0 {
+		t.Errorf("after popping flag %+v", v.Frames)
+	}
+
+	p.Initialize()
+	if len(v.Frames) != 0 || len(v.Heap) != 0 || len(v.Globals) != 3 {
+		t.Errorf("after reset %+v", v)
+	}
+}
@@ -0,0 +1,126 @@
+package computer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrWatchpoint is wrapped by the WatchError Run returns when an
+// instruction triggers a watchpoint.
+var ErrWatchpoint = errors.New("watchpoint")
+
+// WatchKind selects the accesses a watchpoint triggers on.
+type WatchKind int
+
+const (
+	WatchRead   WatchKind = 1 << iota // Loads
+	WatchWrite                        // Stores
+	WatchAccess = WatchRead | WatchWrite
+)
+
+func (k WatchKind) String() string {
+	switch k {
+	case WatchRead:
+		return "read"
+	case WatchWrite:
+		return "write"
+	case WatchAccess:
+		return "access"
+	}
+	return fmt.Sprintf("WatchKind(%d)", int(k))
+}
+
+// Watchpoint pauses execution after an instruction loads or stores any byte
+// in Range. Instruction fetches do not trigger watchpoints.
+type Watchpoint struct {
+	Range AddressRange
+	Kind  WatchKind
+}
+
+// WatchHit is one access that triggered a watchpoint. Word accesses are
+// reported once with Size 2. For a load Old and Value are both the value
+// read; for a store Old is the RAM contents before it.
+type WatchHit struct {
+	Watchpoint *Watchpoint
+	PC         uint16 // Address of the instruction responsible
+	OpCode     uint8
+	Address    uint16
+	Size       int
+	Kind       WatchKind // WatchRead or WatchWrite
+	Old, Value uint16
+}
+
+func (h WatchHit) String() string {
+	if h.Kind == WatchWrite {
+		return fmt.Sprintf("write of 0x%0*X over 0x%0*X at 0x%04X by opcode 0x%02X at 0x%04X",
+			h.Size*2, h.Value, h.Size*2, h.Old, h.Address, h.OpCode, h.PC)
+	}
+	return fmt.Sprintf("read of 0x%0*X at 0x%04X by opcode 0x%02X at 0x%04X",
+		h.Size*2, h.Value, h.Address, h.OpCode, h.PC)
+}
+
+// WatchError reports the watchpoints triggered by the last instruction Run
+// executed. The computer is left ready to continue.
+type WatchError struct {
+	Hits []WatchHit
+}
+
+func (e *WatchError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrWatchpoint, e.Hits[0])
+}
+
+func (e *WatchError) Unwrap() error {
+	return ErrWatchpoint
+}
+
+// Watch adds a watchpoint over an inclusive range of addresses.
+func (c *Memory) Watch(r AddressRange, kind WatchKind) *Watchpoint {
+	w := &Watchpoint{r, kind}
+	c.watchpoints = append(c.watchpoints, w)
+	return w
+}
+
+// Unwatch removes a watchpoint, reporting whether it was set.
+func (c *Memory) Unwatch(w *Watchpoint) bool {
+	for i, x := range c.watchpoints {
+		if x == w {
+			c.watchpoints = append(c.watchpoints[:i], c.watchpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SetWatchpoints replaces every watchpoint with those in ws.
+func (c *Memory) SetWatchpoints(ws []*Watchpoint) {
+	c.watchpoints = append([]*Watchpoint(nil), ws...)
+}
+
+// watch records a hit for every watchpoint overlapping an access of size
+// bytes at location.
+func (c *Memory) watch(location uint16, size int, kind WatchKind, old, value uint16) {
+	start, end := int(location), int(location)+size-1
+	for _, w := range c.watchpoints {
+		if w.Kind&kind == 0 {
+			continue
+		}
+		if start <= int(w.Range.End) && int(w.Range.Start) <= end {
+			c.hits = append(c.hits, WatchHit{Watchpoint: w, Address: location, Size: size, Kind: kind, Old: old, Value: value})
+		}
+	}
+}
+
+// takeHits returns the watchpoint hits of the instruction just executed.
+func (c *Pep9Computer) takeHits() []WatchHit {
+	if len(c.hits) == 0 {
+		return nil
+	}
+	hits := make([]WatchHit, len(c.hits))
+	copy(hits, c.hits)
+	for i := range hits {
+		hits[i].PC = c.instruction
+		hits[i].OpCode = c.OpCode
+	}
+	c.hits = c.hits[:0]
+	return hits
+}
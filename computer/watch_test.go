@@ -0,0 +1,104 @@
+package computer
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestWatchWrite(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram(assemble(t, `
+         LDWA    num,d
+         ADDA    1,i
+         STWA    num,d
+         STOP
+num:     .WORD   41
+         .END`))
+	w := p.Watch(AddressRange{0x000B, 0x000B}, WatchWrite)
+
+	err := p.Run(context.Background(), 0)
+
+	var watchErr *WatchError
+	if !errors.As(err, &watchErr) || !errors.Is(err, ErrWatchpoint) {
+		t.Fatalf("Expected a WatchError but got %v", err)
+	}
+	hit := watchErr.Hits[0]
+	expected := WatchHit{Watchpoint: w, PC: 0x0006, OpCode: 0xE1, Address: 0x000A, Size: 2, Kind: WatchWrite, Old: 41, Value: 42}
+	if len(watchErr.Hits) != 1 || hit != expected {
+		t.Errorf("Expected %+v but got %+v", expected, watchErr.Hits)
+	}
+	if p.HALT || p.PC != 0x0009 {
+		t.Errorf("Expected to pause before STOP but got PC=0x%04X", p.PC)
+	}
+
+	if err := p.Run(context.Background(), 0); err != nil || !p.HALT {
+		t.Errorf("Expected to continue to STOP but got %v", err)
+	}
+}
+
+func TestWatchRead(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram(assemble(t, `
+         LDBA    'x',i
+         STBA    ch,d
+         LDBX    ch,d
+         STOP
+ch:      .BLOCK  1
+         .END`))
+	p.Watch(AddressRange{0x000A, 0x000A}, WatchRead)
+
+	var hits []WatchHit
+	for !p.HALT {
+		r, err := p.Step()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		hits = append(hits, r.Watches...)
+	}
+
+	if len(hits) != 1 || hits[0].PC != 0x0006 || hits[0].Kind != WatchRead || hits[0].Value != 'x' {
+		t.Errorf("Expected one read of 'x' by LDBX but got %+v", hits)
+	}
+}
+
+func TestWatchAccessAndUnwatch(t *testing.T) {
+	p := Pep9Computer{}
+	p.Initialize()
+	p.LoadProgram(assemble(t, `
+         LDWA    0x1234,i
+         STWA    0x0100,d
+         LDWX    0x00FF,d
+         STOP
+         .END`))
+	w := p.Watch(AddressRange{0x0100, 0x0101}, WatchAccess)
+	instructionFetch := p.Watch(AddressRange{0x0000, 0x0000}, WatchAccess)
+
+	p.Step()
+	if r, _ := p.Step(); len(r.Watches) != 1 || r.Watches[0].Kind != WatchWrite {
+		t.Errorf("Expected a write hit but got %+v", r.Watches)
+	}
+	if r, _ := p.Step(); len(r.Watches) != 1 || r.Watches[0].Kind != WatchRead || r.Watches[0].Address != 0x00FF {
+		t.Errorf("Expected an overlapping read hit but got %+v", r.Watches)
+	}
+
+	if !p.Unwatch(w) || p.Unwatch(w) || !p.Unwatch(instructionFetch) {
+		t.Error("Expected the watchpoints to be removed once")
+	}
+}
+
+func TestSetWatchpoints(t *testing.T) {
+	p := Pep9Computer{}
+	old := p.Watch(AddressRange{0x0100, 0x0100}, WatchWrite)
+	w := &Watchpoint{AddressRange{0x0200, 0x0200}, WatchWrite}
+
+	p.SetWatchpoints([]*Watchpoint{w})
+	p.StoreByte(1, 0x0100)
+	p.StoreByte(1, 0x0200)
+
+	if len(p.hits) != 1 || p.hits[0].Watchpoint != w || p.Unwatch(old) {
+		t.Errorf("Expected only the new watchpoint to be set but got %+v", p.hits)
+	}
+}
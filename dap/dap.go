@@ -0,0 +1,634 @@
+// Package dap serves the Debug Adapter Protocol so editors such as VS Code
+// can debug Pep/9 programs.
+//
+// A launch request names a .pep or .pepo file in "program", with an optional
+// "input" file for charIn and "stopOnEntry". An attach request debugs the
+// program given to Attach instead. Breakpoints are set on source lines,
+// which the assembler's line table maps to instructions. Step over and out
+// use CALL (0x24, 0x25) and RET (0x01) to find where a call returns.
+package dap
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"pep9emulator/assembler"
+	"pep9emulator/computer"
+	"pep9emulator/debugger"
+)
+
+// threadID is the one thread every stop is reported on.
+const threadID = 1
+
+// Variable references for the scopes.
+const (
+	registersReference = 1 + iota
+	statusBitsReference
+)
+
+var (
+	errNoProgram = errors.New("no program is loaded")
+	errRunning   = errors.New("the program is running")
+)
+
+// Server is a debug session over one connection, usually standard input
+// and output.
+type Server struct {
+	r *bufio.Reader
+
+	mu  sync.Mutex // Held while writing, output events come from the program
+	w   io.Writer
+	seq int
+
+	debugger    *debugger.Debugger // nil until launch or attach
+	program     *assembler.Program // nil for object code without source
+	path        string
+	breakpoints []*debugger.Breakpoint
+	stopOnEntry bool
+	attach      *debugger.Debugger // The program for an attach request
+
+	cancel  context.CancelFunc // Set while the program runs
+	stopped chan debugger.Stop
+	output  *outputWriter
+
+	queued []event                                 // Sent after the current response
+	resume func(ctx context.Context) debugger.Stop // Started after it
+}
+
+// New creates a server reading requests from r and writing to w.
+func New(r io.Reader, w io.Writer) *Server {
+	s := &Server{r: bufio.NewReader(r), w: w, stopped: make(chan debugger.Stop, 1)}
+	s.output = &outputWriter{s: s}
+	return s
+}
+
+// Attach makes a loaded computer the program for attach requests. Program
+// may be nil when there is no source, and path is the source file
+// breakpoints are set in. The computer's charOut is sent to the editor as
+// output events.
+func (s *Server) Attach(c *computer.Pep9Computer, program *assembler.Program, path string) {
+	c.CharOut.Writer = s.output
+	s.attach = s.load(c, program, path)
+}
+
+// load makes a debugger for a computer, remembering its program so source
+// lines can be mapped. It returns the debugger without starting a session.
+func (s *Server) load(c *computer.Pep9Computer, program *assembler.Program, path string) *debugger.Debugger {
+	var symbols assembler.SymbolTable
+	if program != nil {
+		symbols = program.Symbols
+	}
+	s.program, s.path = program, path
+	return debugger.New(c, symbols)
+}
+
+// Serve handles requests until a disconnect request or the end of the
+// input.
+func (s *Server) Serve() error {
+	requests, done := make(chan request), make(chan struct{})
+	errs := make(chan error, 1)
+	defer close(done)
+	go s.readRequests(requests, errs, done)
+
+	for {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				s.interrupt()
+				if err := <-errs; !errors.Is(err, io.EOF) {
+					return err
+				}
+				return nil
+			}
+			if s.handle(req) {
+				return nil
+			}
+		case stop := <-s.stopped:
+			s.cancel = nil
+			s.report(stop)
+		}
+	}
+}
+
+func (s *Server) readRequests(requests chan<- request, errs chan<- error, done <-chan struct{}) {
+	defer close(requests)
+	for {
+		message, err := readMessage(s.r)
+		if err != nil {
+			errs <- err
+			return
+		}
+		var req request
+		if err := json.Unmarshal(message, &req); err != nil {
+			errs <- fmt.Errorf("invalid message: %w", err)
+			return
+		}
+		select {
+		case requests <- req:
+		case <-done:
+			return
+		}
+	}
+}
+
+// handle answers a request, reporting whether the session is over.
+func (s *Server) handle(req request) bool {
+	body, err := s.dispatch(req)
+	s.respond(req, body, err)
+
+	for _, e := range s.queued {
+		s.send(&e)
+	}
+	s.queued = nil
+	if s.resume != nil {
+		s.start(s.resume)
+		s.resume = nil
+	}
+
+	if req.Command == "disconnect" {
+		s.interrupt()
+		return true
+	}
+	return false
+}
+
+func (s *Server) dispatch(req request) (interface{}, error) {
+	switch req.Command {
+	case "initialize":
+		return map[string]bool{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+			"supportsReadMemoryRequest":        true,
+			"supportsWriteMemoryRequest":       true,
+			"supportsTerminateRequest":         true,
+		}, nil
+	case "launch":
+		var args launchArguments
+		if err := unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return nil, s.launch(args)
+	case "attach":
+		var args attachArguments
+		if err := unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		if s.attach == nil {
+			return nil, errors.New("there is no program to attach to")
+		}
+		s.debugger, s.stopOnEntry = s.attach, args.StopOnEntry
+		s.queue("initialized", nil)
+		return nil, nil
+	case "setBreakpoints":
+		var args setBreakpointsArguments
+		if err := unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return s.setBreakpoints(args)
+	case "configurationDone":
+		if s.debugger == nil {
+			return nil, errNoProgram
+		}
+		if s.stopOnEntry {
+			s.queue("stopped", map[string]interface{}{"reason": "entry", "threadId": threadID, "allThreadsStopped": true})
+		} else {
+			s.resume = s.debugger.Continue
+		}
+		return nil, nil
+	case "threads":
+		return map[string]interface{}{"threads": []map[string]interface{}{{"id": threadID, "name": "Pep/9"}}}, nil
+	case "continue", "next", "stepIn", "stepOut":
+		return s.run(req.Command)
+	case "pause":
+		if s.cancel != nil {
+			s.cancel()
+		}
+		return nil, nil
+	case "disconnect":
+		return nil, nil
+	case "terminate":
+		s.interrupt()
+		s.queue("terminated", nil)
+		return nil, nil
+	}
+
+	// The rest inspect a stopped program.
+	switch {
+	case s.debugger == nil:
+		return nil, errNoProgram
+	case s.cancel != nil:
+		return nil, errRunning
+	}
+	switch req.Command {
+	case "stackTrace":
+		return s.stackTrace(), nil
+	case "scopes":
+		return map[string]interface{}{"scopes": []scope{
+			{Name: "Registers", VariablesReference: registersReference},
+			{Name: "Status bits", VariablesReference: statusBitsReference},
+		}}, nil
+	case "variables":
+		var args variablesArguments
+		if err := unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"variables": s.variables(args.VariablesReference)}, nil
+	case "readMemory":
+		var args readMemoryArguments
+		if err := unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return s.readMemory(args)
+	case "writeMemory":
+		var args writeMemoryArguments
+		if err := unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return s.writeMemory(args)
+	case "evaluate":
+		var args evaluateArguments
+		if err := unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return s.evaluate(args)
+	}
+	return nil, fmt.Errorf("unsupported request %q", req.Command)
+}
+
+func unmarshal(arguments json.RawMessage, v interface{}) error {
+	if len(arguments) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(arguments, v); err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) respond(req request, body interface{}, err error) {
+	r := &response{Type: "response", RequestSeq: req.Seq, Success: err == nil, Command: req.Command, Body: body}
+	if err != nil {
+		r.Message = err.Error()
+	}
+	s.send(r)
+}
+
+// queue adds an event to send after the current response.
+func (s *Server) queue(name string, body interface{}) {
+	s.queued = append(s.queued, event{Type: "event", Event: name, Body: body})
+}
+
+// send writes a response or event, numbering it. Errors writing are
+// noticed by the editor, which ends the session.
+func (s *Server) send(message interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	switch m := message.(type) {
+	case *response:
+		m.Seq = s.seq
+	case *event:
+		m.Seq = s.seq
+	}
+	writeMessage(s.w, message)
+}
+
+func (s *Server) launch(args launchArguments) error {
+	if args.Program == "" {
+		return errors.New("launch needs a program")
+	}
+
+	var program *assembler.Program
+	var object []byte
+	var origin uint16
+	if filepath.Ext(args.Program) == ".pep" {
+		text, err := os.ReadFile(args.Program)
+		if err != nil {
+			return err
+		}
+		if program, err = assembler.Assemble(string(text)); err != nil {
+			return fmt.Errorf("%s: %w", args.Program, err)
+		}
+		object, origin = program.Object, program.Origin
+	} else {
+		f, err := os.Open(args.Program)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if object, err = computer.ReadObjectFile(f); err != nil {
+			return fmt.Errorf("%s: %w", args.Program, err)
+		}
+	}
+
+	c := &computer.Pep9Computer{}
+	if args.Input != "" {
+		input, err := os.ReadFile(args.Input)
+		if err != nil {
+			return err
+		}
+		c.CharIn.Reader = strings.NewReader(string(input))
+	}
+	c.CharOut.Writer = s.output
+	c.Initialize()
+	copy(c.Ram[origin:], object)
+
+	s.debugger = s.load(c, program, args.Program)
+	s.stopOnEntry = args.StopOnEntry && !args.NoDebug
+	s.queue("initialized", nil)
+	return nil
+}
+
+// setBreakpoints replaces the breakpoints in the program's source. A line
+// without an instruction gets its breakpoint on the next instruction.
+func (s *Server) setBreakpoints(args setBreakpointsArguments) (interface{}, error) {
+	if s.debugger == nil {
+		return nil, errNoProgram
+	}
+	for _, bp := range s.breakpoints {
+		s.debugger.Delete(bp.ID)
+	}
+	s.breakpoints = nil
+
+	ours := s.program != nil && sameFile(args.Source.Path, s.path)
+	result := []breakpoint{}
+	for _, requested := range args.Breakpoints {
+		b := breakpoint{Line: requested.Line}
+		line, address, ok := s.instructionAtLine(requested.Line)
+		switch {
+		case !ours:
+			b.Message = "not the program being debugged"
+		case !ok:
+			b.Message = "no instruction at or after this line"
+		default:
+			bp := s.debugger.Break(address)
+			s.breakpoints = append(s.breakpoints, bp)
+			b = breakpoint{ID: bp.ID, Verified: true, Line: line, InstructionReference: reference(address)}
+		}
+		result = append(result, b)
+	}
+	return map[string]interface{}{"breakpoints": result}, nil
+}
+
+func sameFile(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	if x, err := filepath.Abs(a); err == nil {
+		a = x
+	}
+	if x, err := filepath.Abs(b); err == nil {
+		b = x
+	}
+	return a == b
+}
+
+// instructionAtLine finds the first instruction on or after a source line.
+func (s *Server) instructionAtLine(number int) (line int, address uint16, ok bool) {
+	if s.program == nil {
+		return 0, 0, false
+	}
+	lines := s.program.Lines
+	i := sort.Search(len(lines), func(i int) bool { return lines[i].Number >= number })
+	for ; i < len(lines); i++ {
+		if isInstruction(lines[i]) {
+			return lines[i].Number, lines[i].Address, true
+		}
+	}
+	return 0, 0, false
+}
+
+// lineAt finds the source line of the instruction at an address.
+func (s *Server) lineAt(address uint16) (int, bool) {
+	if s.program == nil {
+		return 0, false
+	}
+	for _, l := range s.program.Lines {
+		if isInstruction(l) && l.Address == address {
+			return l.Number, true
+		}
+	}
+	return 0, false
+}
+
+func isInstruction(l assembler.Line) bool {
+	return len(l.Code) > 0 && !strings.HasPrefix(l.Mnemonic, ".")
+}
+
+func reference(address uint16) string {
+	return fmt.Sprintf("0x%04X", address)
+}
+
+// run starts a command that executes the program once the response is
+// sent.
+func (s *Server) run(command string) (interface{}, error) {
+	switch {
+	case s.debugger == nil:
+		return nil, errNoProgram
+	case s.cancel != nil:
+		return nil, errRunning
+	}
+
+	d := s.debugger
+	switch command {
+	case "continue":
+		s.resume = d.Continue
+		return map[string]bool{"allThreadsContinued": true}, nil
+	case "next":
+		s.resume = d.Next
+	case "stepIn":
+		s.resume = func(ctx context.Context) debugger.Stop { return d.Step(ctx, 1) }
+	case "stepOut":
+		s.resume = d.Finish
+	}
+	return nil, nil
+}
+
+// start runs the program in the background. Serve reports the stop.
+func (s *Server) start(run func(ctx context.Context) debugger.Stop) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go func() {
+		stop := run(ctx)
+		cancel()
+		s.stopped <- stop
+	}()
+}
+
+// interrupt stops the program if it is running and waits for it.
+func (s *Server) interrupt() {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.stopped
+		s.cancel = nil
+	}
+}
+
+// report sends the events for why the program stopped.
+func (s *Server) report(stop debugger.Stop) {
+	s.output.flush()
+
+	body := map[string]interface{}{"threadId": threadID, "allThreadsStopped": true}
+	switch stop.Reason {
+	case debugger.StopHalt:
+		s.send(&event{Type: "event", Event: "exited", Body: map[string]int{"exitCode": 0}})
+		s.send(&event{Type: "event", Event: "terminated"})
+		return
+	case debugger.StopBreakpoint:
+		body["reason"] = "breakpoint"
+		body["hitBreakpointIds"] = []int{stop.Breakpoint.ID}
+	case debugger.StopWatchpoint:
+		body["reason"] = "data breakpoint"
+	case debugger.StopInterrupted:
+		body["reason"] = "pause"
+	case debugger.StopError:
+		body["reason"] = "exception"
+		body["text"] = stop.Err.Error()
+	default:
+		body["reason"] = "step"
+	}
+	s.send(&event{Type: "event", Event: "stopped", Body: body})
+}
+
+func (s *Server) stackTrace() interface{} {
+	pc := s.debugger.Computer.PC
+	frame := stackFrame{ID: 1, Name: reference(pc), Column: 1, InstructionPointerReference: reference(pc)}
+	if name := s.debugger.Symbolize(pc); name != "" {
+		frame.Name = name
+	}
+	if line, ok := s.lineAt(pc); ok {
+		frame.Line = line
+		frame.Source = &source{Name: filepath.Base(s.path), Path: s.path}
+	}
+	return map[string]interface{}{"stackFrames": []stackFrame{frame}, "totalFrames": 1}
+}
+
+func (s *Server) variables(ref int) []variable {
+	c := s.debugger.Computer
+	switch ref {
+	case registersReference:
+		return []variable{
+			{Name: "A", Value: fmt.Sprintf("0x%04X (%d)", c.A, int16(c.A)), MemoryReference: reference(c.A)},
+			{Name: "X", Value: fmt.Sprintf("0x%04X (%d)", c.X, int16(c.X)), MemoryReference: reference(c.X)},
+			{Name: "SP", Value: reference(c.SP), MemoryReference: reference(c.SP)},
+			{Name: "PC", Value: reference(c.PC), MemoryReference: reference(c.PC)},
+		}
+	case statusBitsReference:
+		bit := func(name string, set bool) variable {
+			if set {
+				return variable{Name: name, Value: "1"}
+			}
+			return variable{Name: name, Value: "0"}
+		}
+		return []variable{bit("N", c.N), bit("Z", c.Z), bit("V", c.V), bit("C", c.C)}
+	}
+	return []variable{}
+}
+
+// memoryAddress resolves a memory reference, a number or a symbol, plus an
+// offset.
+func (s *Server) memoryAddress(ref string, offset int) (int, error) {
+	address, err := strconv.ParseUint(ref, 0, 16)
+	if err != nil {
+		value, err := s.debugger.Value(ref)
+		if err != nil {
+			return 0, fmt.Errorf("invalid memory reference %q", ref)
+		}
+		address = uint64(value)
+	}
+	return int(address) + offset, nil
+}
+
+// readMemory reads RAM directly, so looking at memory never consumes
+// device input.
+func (s *Server) readMemory(args readMemoryArguments) (interface{}, error) {
+	start, err := s.memoryAddress(args.MemoryReference, args.Offset)
+	if err != nil {
+		return nil, err
+	}
+	ram := s.debugger.Computer.Ram[:]
+	end := start + args.Count
+	if start < 0 || start >= len(ram) || args.Count < 0 {
+		return map[string]interface{}{"address": reference(uint16(start)), "unreadableBytes": args.Count}, nil
+	}
+	unreadable := 0
+	if end > len(ram) {
+		end, unreadable = len(ram), end-len(ram)
+	}
+	return map[string]interface{}{
+		"address":         reference(uint16(start)),
+		"data":            base64.StdEncoding.EncodeToString(ram[start:end]),
+		"unreadableBytes": unreadable,
+	}, nil
+}
+
+func (s *Server) writeMemory(args writeMemoryArguments) (interface{}, error) {
+	start, err := s.memoryAddress(args.MemoryReference, args.Offset)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(args.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data: %w", err)
+	}
+	ram := s.debugger.Computer.Ram[:]
+	if start < 0 || start+len(data) > len(ram) {
+		return nil, fmt.Errorf("%d bytes at 0x%X are outside memory", len(data), start)
+	}
+	copy(ram[start:], data)
+	return map[string]int{"offset": 0, "bytesWritten": len(data)}, nil
+}
+
+// evaluate evaluates a debugger expression, such as mem.w[SP+2].
+func (s *Server) evaluate(args evaluateArguments) (interface{}, error) {
+	expr, err := s.debugger.Compile(args.Expression)
+	if err != nil {
+		return nil, err
+	}
+	value, err := expr.Eval(s.debugger.Computer)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"result":             fmt.Sprintf("%d (0x%04X)", value, uint16(value)),
+		"variablesReference": 0,
+	}, nil
+}
+
+// outputWriter sends the program's charOut to the editor a line at a time.
+type outputWriter struct {
+	s   *Server
+	buf []byte
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if i := strings.LastIndexByte(string(w.buf), '\n'); i >= 0 {
+		w.send(w.buf[:i+1])
+		w.buf = append(w.buf[:0], w.buf[i+1:]...)
+	}
+	return len(p), nil
+}
+
+// flush sends output that does not end in a newline.
+func (w *outputWriter) flush() {
+	if len(w.buf) > 0 {
+		w.send(w.buf)
+		w.buf = w.buf[:0]
+	}
+}
+
+func (w *outputWriter) send(text []byte) {
+	w.s.send(&event{Type: "event", Event: "output", Body: map[string]string{"category": "stdout", "output": string(text)}})
+}
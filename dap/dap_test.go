@@ -0,0 +1,306 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"pep9emulator/assembler"
+	"pep9emulator/computer"
+)
+
+const program = `;Print H then double 3
+main:    LDBA    'H',i
+         STBA    0xFC16,d
+         LDWA    3,i
+         STWA    -2,s
+         SUBSP   2,i
+         CALL    double
+         ADDSP   2,i
+         STWA    result,d
+         STOP
+;double returns twice its argument in A
+double:  LDWA    2,s
+         ASLA
+         RET
+result:  .BLOCK  2
+         .END
+`
+
+type message = map[string]interface{}
+
+// client is the editor end of a session.
+type client struct {
+	t        *testing.T
+	w        io.Writer
+	seq      int
+	messages chan message
+	done     chan error
+}
+
+func connect(t *testing.T, s func(r io.Reader, w io.Writer) *Server) *client {
+	requests, requestWriter := io.Pipe()
+	replies, replyWriter := io.Pipe()
+	c := &client{t: t, w: requestWriter, messages: make(chan message, 100), done: make(chan error, 1)}
+
+	go func() { c.done <- s(requests, replyWriter).Serve() }()
+	go func() {
+		r := bufio.NewReader(replies)
+		for {
+			body, err := readMessage(r)
+			if err != nil {
+				close(c.messages)
+				return
+			}
+			var m message
+			json.Unmarshal(body, &m)
+			c.messages <- m
+		}
+	}()
+	t.Cleanup(func() { requestWriter.Close(); replyWriter.Close() })
+	return c
+}
+
+func (c *client) next() message {
+	c.t.Helper()
+	select {
+	case m, ok := <-c.messages:
+		if !ok {
+			c.t.Fatal("The server closed the connection")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("Timed out waiting for the server")
+	}
+	return nil
+}
+
+// request sends a request and returns its response, after any events
+// before it.
+func (c *client) request(command string, arguments interface{}) message {
+	c.t.Helper()
+	c.seq++
+	if err := writeMessage(c.w, request{Seq: c.seq, Type: "request", Command: command, Arguments: marshal(arguments)}); err != nil {
+		c.t.Fatalf("Unexpected error: %v", err)
+	}
+	for {
+		m := c.next()
+		if m["type"] == "response" {
+			if m["command"] != command || int(m["request_seq"].(float64)) != c.seq {
+				c.t.Fatalf("Expected the response to %s but got %v", command, m)
+			}
+			return m
+		}
+		c.t.Logf("Skipped %v", m)
+	}
+}
+
+// ok sends a request that must succeed and returns the response body.
+func (c *client) ok(command string, arguments interface{}) message {
+	c.t.Helper()
+	m := c.request(command, arguments)
+	if m["success"] != true {
+		c.t.Fatalf("%s failed: %v", command, m["message"])
+	}
+	body, _ := m["body"].(message)
+	return body
+}
+
+// event waits for an event, returning its body.
+func (c *client) event(name string) message {
+	c.t.Helper()
+	for {
+		m := c.next()
+		if m["type"] == "event" && m["event"] == name {
+			body, _ := m["body"].(message)
+			return body
+		}
+		if m["type"] == "response" {
+			c.t.Fatalf("Expected a %s event but got %v", name, m)
+		}
+	}
+}
+
+func marshal(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// lineOf returns the source line containing text.
+func lineOf(text string) int {
+	for i, line := range strings.Split(program, "\n") {
+		if strings.Contains(line, text) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func TestLaunch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "double.pep")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := connect(t, New)
+
+	if caps := c.ok("initialize", message{"adapterID": "pep9"}); caps["supportsReadMemoryRequest"] != true {
+		t.Errorf("Expected memory to be readable but got %v", caps)
+	}
+	c.ok("launch", message{"program": path})
+	c.event("initialized")
+
+	// A breakpoint on a comment moves to the next instruction.
+	bps := c.ok("setBreakpoints", message{
+		"source":      message{"path": path},
+		"breakpoints": []message{{"line": lineOf(";double")}, {"line": lineOf(".BLOCK")}},
+	})["breakpoints"].([]interface{})
+	if bp := bps[0].(message); bp["verified"] != true || int(bp["line"].(float64)) != lineOf("double:") {
+		t.Errorf("Expected a breakpoint at double but got %v", bp)
+	}
+	if bp := bps[1].(message); bp["verified"] != false {
+		t.Errorf("Expected no breakpoint on .BLOCK but got %v", bp)
+	}
+
+	c.ok("configurationDone", nil)
+	if out := c.event("output"); out["output"] != "H" {
+		t.Errorf("Expected the output H but got %v", out)
+	}
+	if stop := c.event("stopped"); stop["reason"] != "breakpoint" {
+		t.Errorf("Expected to stop at the breakpoint but got %v", stop)
+	}
+
+	frames := c.ok("stackTrace", message{"threadId": 1})["stackFrames"].([]interface{})
+	frame := frames[0].(message)
+	if frame["name"] != "double" || int(frame["line"].(float64)) != lineOf("double:") {
+		t.Errorf("Expected to be in double but got %v", frame)
+	}
+
+	c.ok("next", message{"threadId": 1})
+	c.event("stopped")
+	vars := c.ok("variables", message{"variablesReference": registersReference})["variables"].([]interface{})
+	if a := vars[0].(message); a["name"] != "A" || a["value"] != "0x0003 (3)" {
+		t.Errorf("Expected A=3 but got %v", a)
+	}
+	bits := c.ok("variables", message{"variablesReference": statusBitsReference})["variables"].([]interface{})
+	if len(bits) != 4 || bits[0].(message)["name"] != "N" {
+		t.Errorf("Expected the status bits but got %v", bits)
+	}
+
+	c.ok("stepOut", message{"threadId": 1})
+	c.event("stopped")
+	frame = c.ok("stackTrace", message{"threadId": 1})["stackFrames"].([]interface{})[0].(message)
+	if int(frame["line"].(float64)) != lineOf("ADDSP") {
+		t.Errorf("Expected to return to ADDSP but got %v", frame)
+	}
+	if r := c.ok("evaluate", message{"expression": "A == 6 && mem.w[SP] == 3"}); r["result"] != "1 (0x0001)" {
+		t.Errorf("Expected the expression to hold but got %v", r)
+	}
+
+	c.ok("writeMemory", message{"memoryReference": "result", "data": base64.StdEncoding.EncodeToString([]byte{1, 2})})
+	mem := c.ok("readMemory", message{"memoryReference": "result", "offset": -1, "count": 3})
+	if data, _ := base64.StdEncoding.DecodeString(mem["data"].(string)); string(data) != "\x01\x01\x02" || mem["address"] != "0x001D" {
+		t.Errorf("Expected RET and the written bytes but got %v", mem)
+	}
+
+	c.ok("continue", message{"threadId": 1})
+	if exit := c.event("exited"); exit["exitCode"] != 0.0 {
+		t.Errorf("Expected exit code 0 but got %v", exit)
+	}
+	c.event("terminated")
+	c.ok("disconnect", nil)
+	if err := <-c.done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestAttachAndPause(t *testing.T) {
+	p, err := assembler.Assemble("loop: BR loop\n .END")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pc := &computer.Pep9Computer{}
+	pc.Initialize()
+	pc.LoadProgram(p.Object)
+
+	c := connect(t, func(r io.Reader, w io.Writer) *Server {
+		s := New(r, w)
+		s.Attach(pc, p, "loop.pep")
+		return s
+	})
+	c.ok("initialize", nil)
+	c.ok("attach", message{"stopOnEntry": true})
+	c.event("initialized")
+	c.ok("configurationDone", nil)
+	if stop := c.event("stopped"); stop["reason"] != "entry" {
+		t.Errorf("Expected to stop on entry but got %v", stop)
+	}
+
+	c.ok("continue", nil)
+	if m := c.request("stackTrace", nil); m["success"] != false {
+		t.Errorf("Expected a running program not to be inspected but got %v", m)
+	}
+	c.ok("pause", nil)
+	if stop := c.event("stopped"); stop["reason"] != "pause" {
+		t.Errorf("Expected a pause but got %v", stop)
+	}
+	c.ok("disconnect", nil)
+}
+
+func TestSetBreakpointsWhileRunning(t *testing.T) {
+	p, err := assembler.Assemble("loop:    LDWA    1,i\n         BR      loop\n         .END")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pc := &computer.Pep9Computer{}
+	pc.Initialize()
+	pc.LoadProgram(p.Object)
+
+	c := connect(t, func(r io.Reader, w io.Writer) *Server {
+		s := New(r, w)
+		s.Attach(pc, p, "loop.pep")
+		return s
+	})
+	c.ok("initialize", nil)
+	c.ok("attach", nil)
+	c.event("initialized")
+	c.ok("configurationDone", nil)
+
+	// Run with go test -race: the program checks breakpoints as they change.
+	for i := 0; i < 20; i++ {
+		c.ok("setBreakpoints", message{"source": message{"path": "loop.pep"}, "breakpoints": []message{}})
+	}
+	c.ok("setBreakpoints", message{"source": message{"path": "loop.pep"}, "breakpoints": []message{{"line": 1}}})
+	if stop := c.event("stopped"); stop["reason"] != "breakpoint" {
+		t.Errorf("Expected to stop at the breakpoint but got %v", stop)
+	}
+	c.ok("disconnect", nil)
+}
+
+func TestErrors(t *testing.T) {
+	c := connect(t, New)
+	c.ok("initialize", nil)
+
+	for _, r := range []struct {
+		command   string
+		arguments interface{}
+	}{
+		{"stackTrace", nil},
+		{"attach", nil},
+		{"launch", message{"program": filepath.Join(t.TempDir(), "missing.pep")}},
+		{"launch", message{"program": 3}},
+		{"flyToTheMoon", nil},
+	} {
+		if m := c.request(r.command, r.arguments); m["success"] != false || m["message"] == "" {
+			t.Errorf("%s: expected an error but got %v", r.command, m)
+		}
+	}
+}
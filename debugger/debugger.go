@@ -0,0 +1,475 @@
+package debugger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"pep9emulator/assembler"
+	"pep9emulator/computer"
+	"pep9emulator/disasm"
+	"pep9emulator/isa"
+)
+
+// StopReason says why execution paused.
+type StopReason int
+
+const (
+	StopStep        StopReason = iota // The requested instructions were executed
+	StopBreakpoint                    // A breakpoint was reached
+	StopHalt                          // The program executed STOP
+	StopError                         // An instruction failed
+	StopInterrupted                   // The context was cancelled
+	StopWatchpoint                    // An instruction triggered a watchpoint
+	StopBadReturn                     // A RET did not match the call stack
+)
+
+var stopReasons = [...]string{"step", "breakpoint", "halt", "error", "interrupted", "watchpoint", "bad return"}
+
+func (r StopReason) String() string {
+	return stopReasons[r]
+}
+
+// Stop describes where and why execution paused.
+type Stop struct {
+	Reason     StopReason
+	Breakpoint *Breakpoint         // For StopBreakpoint
+	Err        error               // For StopError, StopInterrupted and a failed condition
+	Watches    []computer.WatchHit // For StopWatchpoint
+	BadReturn  *computer.BadReturn // For StopBadReturn
+	Last       computer.StepResult // The last instruction executed, if any
+}
+
+// Breakpoint pauses execution before the instruction at Address runs, or
+// before every instruction when Anywhere is set. With a Condition it only
+// does so when the condition is nonzero. Hits counts the times it was
+// reached with its condition true, and the first Ignore of those are passed.
+// Condition, Hits and Ignore change under the debugger's lock while the
+// program runs.
+type Breakpoint struct {
+	ID        int
+	Address   uint16
+	Anywhere  bool
+	Condition *Expr // May be nil
+	Hits      int
+	Ignore    int
+}
+
+// Watch is a watchpoint set through the debugger. Watchpoints and
+// breakpoints are numbered together.
+type Watch struct {
+	ID int
+	*computer.Watchpoint
+}
+
+// Debugger controls a computer one instruction at a time.
+type Debugger struct {
+	Computer *computer.Pep9Computer
+	Symbols  assembler.SymbolTable // May be nil
+	Labels   disasm.Labels
+
+	// mu guards the fields below and the Condition, Hits and Ignore of
+	// every breakpoint, all of which may change while the program runs.
+	mu          sync.Mutex
+	breakpoints map[int]*Breakpoint
+	watches     map[int]*Watch
+	nextID      int
+	watchesSet  bool // The computer has been given the current watches
+}
+
+// New creates a debugger for a computer that is ready to run. Symbols may
+// be nil when the program has no source.
+func New(c *computer.Pep9Computer, symbols assembler.SymbolTable) *Debugger {
+	return &Debugger{
+		Computer:    c,
+		Symbols:     symbols,
+		Labels:      disasm.LabelsFrom(symbols),
+		breakpoints: map[int]*Breakpoint{},
+		watches:     map[int]*Watch{},
+		nextID:      1,
+		watchesSet:  true,
+	}
+}
+
+// Break sets a breakpoint at an address. Breakpoints may be set and
+// deleted while another goroutine runs the program.
+func (d *Debugger) Break(address uint16) *Breakpoint {
+	return d.add(&Breakpoint{Address: address})
+}
+
+// add numbers a new breakpoint and sets it.
+func (d *Debugger) add(bp *Breakpoint) *Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bp.ID = d.nextID
+	d.breakpoints[bp.ID] = bp
+	d.nextID++
+	return bp
+}
+
+// Watch sets a watchpoint over a range of addresses. The debugger owns the
+// computer's watchpoints, and hands them over before the next instruction
+// it runs.
+func (d *Debugger) Watch(r computer.AddressRange, kind computer.WatchKind) *Watch {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w := &Watch{d.nextID, &computer.Watchpoint{Range: r, Kind: kind}}
+	d.watches[w.ID] = w
+	d.nextID++
+	d.watchesSet = false
+	return w
+}
+
+// Delete removes a breakpoint or watchpoint, reporting whether it existed.
+func (d *Debugger) Delete(id int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.watches[id]; ok {
+		delete(d.watches, id)
+		d.watchesSet = false
+		return true
+	}
+	_, ok := d.breakpoints[id]
+	delete(d.breakpoints, id)
+	return ok
+}
+
+// setWatches gives the computer the watchpoints set since it last ran, so
+// they never change under an instruction.
+func (d *Debugger) setWatches() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.watchesSet {
+		return
+	}
+	ws := make([]*computer.Watchpoint, 0, len(d.watches))
+	for _, w := range d.sortedWatches() {
+		ws = append(ws, w.Watchpoint)
+	}
+	d.Computer.SetWatchpoints(ws)
+	d.watchesSet = true
+}
+
+// Breakpoints returns the breakpoints in the order they were set.
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sortedBreakpoints()
+}
+
+// sortedBreakpoints returns the breakpoints in the order they were set. The
+// caller holds mu.
+func (d *Debugger) sortedBreakpoints() []*Breakpoint {
+	bps := make([]*Breakpoint, 0, len(d.breakpoints))
+	for _, bp := range d.breakpoints {
+		bps = append(bps, bp)
+	}
+	sort.Slice(bps, func(i, j int) bool { return bps[i].ID < bps[j].ID })
+	return bps
+}
+
+// Watches returns the watchpoints in the order they were set.
+func (d *Debugger) Watches() []*Watch {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sortedWatches()
+}
+
+// sortedWatches returns the watchpoints in the order they were set. The
+// caller holds mu.
+func (d *Debugger) sortedWatches() []*Watch {
+	ws := make([]*Watch, 0, len(d.watches))
+	for _, w := range d.watches {
+		ws = append(ws, w)
+	}
+	sort.Slice(ws, func(i, j int) bool { return ws[i].ID < ws[j].ID })
+	return ws
+}
+
+// WatchID returns the number of the debugger watchpoint behind a hit.
+func (d *Debugger) WatchID(hit computer.WatchHit) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, w := range d.watches {
+		if w.Watchpoint == hit.Watchpoint {
+			return id
+		}
+	}
+	return 0
+}
+
+// setCondition changes the condition of a breakpoint, which may be nil.
+func (d *Debugger) setCondition(bp *Breakpoint, condition *Expr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bp.Condition = condition
+}
+
+// setIgnore passes the next count hits of a breakpoint.
+func (d *Debugger) setIgnore(bp *Breakpoint, count int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bp.Ignore = count
+}
+
+// copyOf returns a copy of a breakpoint that stays as it was.
+func (d *Debugger) copyOf(bp *Breakpoint) Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return *bp
+}
+
+// BreakIf sets a breakpoint that stops wherever a condition becomes true.
+func (d *Debugger) BreakIf(condition *Expr) *Breakpoint {
+	return d.add(&Breakpoint{Anywhere: true, Condition: condition})
+}
+
+// Breakpoint returns a breakpoint by number.
+func (d *Debugger) Breakpoint(id int) (*Breakpoint, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bp, ok := d.breakpoints[id]
+	return bp, ok
+}
+
+// breakpointAt returns the first breakpoint set at an address, for display.
+func (d *Debugger) breakpointAt(address uint16) *Breakpoint {
+	for _, bp := range d.Breakpoints() {
+		if !bp.Anywhere && bp.Address == address {
+			return bp
+		}
+	}
+	return nil
+}
+
+// checkBreakpoints counts every breakpoint whose address and condition
+// match the current state and returns the first one not being ignored. A
+// condition that cannot be evaluated stops execution with its error.
+func (d *Debugger) checkBreakpoints() (*Breakpoint, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.Computer
+	var found *Breakpoint
+	var failed error
+
+	for _, bp := range d.sortedBreakpoints() {
+		if !bp.Anywhere && bp.Address != c.PC {
+			continue
+		}
+		if bp.Condition != nil {
+			value, err := bp.Condition.Eval(c)
+			if err != nil {
+				if found == nil {
+					found, failed = bp, fmt.Errorf("breakpoint %d condition %s: %w", bp.ID, bp.Condition, err)
+				}
+				continue
+			}
+			if value == 0 {
+				continue
+			}
+		}
+		bp.Hits++
+		if bp.Ignore > 0 {
+			bp.Ignore--
+			continue
+		}
+		if found == nil {
+			found = bp
+		}
+	}
+	return found, failed
+}
+
+// Step executes count instructions, stopping early at a breakpoint, a
+// watchpoint, a halt or an error.
+func (d *Debugger) Step(ctx context.Context, count int) Stop {
+	return d.run(ctx, func(r computer.StepResult, steps int) bool {
+		return steps == count
+	})
+}
+
+// Next executes one instruction, running a CALL or trap until it returns.
+func (d *Debugger) Next(ctx context.Context) Stop {
+	c := d.Computer
+	opcode := c.Ram[c.PC]
+	inst, _ := isa.Decode(opcode)
+	if opcode != 0x24 && opcode != 0x25 && !isa.IsTrap(opcode) {
+		return d.Step(ctx, 1)
+	}
+
+	// The call has returned when execution is back after it with the stack
+	// no deeper than before, which also works for recursive calls.
+	after := c.PC + uint16(inst.Size())
+	sp := c.SP
+	return d.run(ctx, func(r computer.StepResult, steps int) bool {
+		return c.PC == after && c.SP >= sp
+	})
+}
+
+// Finish runs until the current function returns with RET.
+func (d *Debugger) Finish(ctx context.Context) Stop {
+	// Calls made from here return with the stack deeper than it is now.
+	sp := d.Computer.SP
+	return d.run(ctx, func(r computer.StepResult, steps int) bool {
+		return r.OpCode == 0x01 && r.Before.SP >= sp
+	})
+}
+
+// Continue runs until a breakpoint, a watchpoint, a halt or an error.
+func (d *Debugger) Continue(ctx context.Context) Stop {
+	return d.run(ctx, func(computer.StepResult, int) bool { return false })
+}
+
+// run steps until done reports true after an instruction. Breakpoints are
+// checked before every instruction but the first, so execution can resume
+// from a breakpoint.
+func (d *Debugger) run(ctx context.Context, done func(r computer.StepResult, steps int) bool) Stop {
+	c := d.Computer
+	var last computer.StepResult
+
+	for steps := 0; ; {
+		if c.HALT {
+			return Stop{Reason: StopHalt, Last: last}
+		}
+		if steps > 0 {
+			if bp, err := d.checkBreakpoints(); bp != nil {
+				return Stop{Reason: StopBreakpoint, Breakpoint: bp, Err: err, Last: last}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return Stop{Reason: StopInterrupted, Err: err, Last: last}
+		}
+		d.setWatches()
+
+		bad := 0
+		if c.CallStack != nil {
+			bad = len(c.CallStack.BadReturns)
+		}
+		r, err := c.Step()
+		last = r
+		steps++
+		if err != nil {
+			return Stop{Reason: StopError, Err: err, Last: last}
+		}
+		if len(r.Watches) > 0 {
+			return Stop{Reason: StopWatchpoint, Watches: r.Watches, Last: last}
+		}
+		if c.CallStack != nil && len(c.CallStack.BadReturns) > bad {
+			return Stop{Reason: StopBadReturn, BadReturn: &c.CallStack.BadReturns[bad], Last: last}
+		}
+		if c.HALT {
+			return Stop{Reason: StopHalt, Last: last}
+		}
+		if done(r, steps) {
+			return Stop{Reason: StopStep, Last: last}
+		}
+	}
+}
+
+// symbolReach is how far past a label an address is still named after it.
+const symbolReach = 64
+
+// Symbolize names an address with the closest label at or below it, as in
+// "loop" or "loop+3". It returns "" when there is no label within reach.
+func (d *Debugger) Symbolize(address uint16) string {
+	if name, ok := d.Labels[address]; ok {
+		return name
+	}
+	best, name := -1, ""
+	for a, n := range d.Labels {
+		if a < address && int(a) > best {
+			best, name = int(a), n
+		}
+	}
+	if best < 0 || int(address)-best >= symbolReach {
+		return ""
+	}
+	return name + "+" + strconv.Itoa(int(address)-best)
+}
+
+// WriteBacktrace writes the shadow call stack, innermost frame first, as
+//
+//	#0  0x001B <bottom> in down, called from 0x000F <down+12>, stack 0xFB7F-0xFB82
+//	#1  0x0006 <main+6>, stack 0xFB83-0xFB8E
+//
+// The innermost frame is at pc, usually the PC, or the address of an
+// instruction that failed. It fails when the computer keeps no call stack.
+func (d *Debugger) WriteBacktrace(w io.Writer, pc uint16) error {
+	c := d.Computer
+	if c.CallStack == nil {
+		return fmt.Errorf("no call stack is kept")
+	}
+	describe := func(address uint16) string {
+		if name := d.Symbolize(address); name != "" {
+			return fmt.Sprintf("0x%04X <%s>", address, name)
+		}
+		return fmt.Sprintf("0x%04X", address)
+	}
+
+	for i, frame := range c.CallStack.Backtrace(pc, c.SP) {
+		line := fmt.Sprintf("#%-2d %s", i, describe(frame.PC))
+		if call := frame.Call; call != nil {
+			function := d.Symbolize(call.Target)
+			if function == "" {
+				function = fmt.Sprintf("0x%04X", call.Target)
+			}
+			line += fmt.Sprintf(" in %s, called from %s", function, describe(call.PC))
+		}
+		if frame.High >= frame.Low {
+			line += fmt.Sprintf(", stack 0x%04X-0x%04X", frame.Low, frame.High)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Location parses an address written as a number or a symbol, optionally
+// followed by +offset, as in "loop+3".
+func (d *Debugger) Location(text string) (uint16, error) {
+	base, offset := text, ""
+	if i := strings.LastIndexByte(text, '+'); i > 0 {
+		base, offset = text[:i], text[i+1:]
+	}
+	address, err := d.Value(base)
+	if err != nil {
+		return 0, err
+	}
+	if offset != "" {
+		n, err := d.Value(offset)
+		if err != nil {
+			return 0, err
+		}
+		address += n
+	}
+	return address, nil
+}
+
+// Value parses a decimal, 0x hex or 'c' character constant, or a symbol.
+func (d *Debugger) Value(text string) (uint16, error) {
+	switch {
+	case len(text) == 3 && text[0] == '\'' && text[2] == '\'':
+		return uint16(text[1]), nil
+	case strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X"):
+		n, err := strconv.ParseUint(text[2:], 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid hex constant %q", text)
+		}
+		return uint16(n), nil
+	case text != "" && (text[0] == '-' || text[0] >= '0' && text[0] <= '9'):
+		n, err := strconv.ParseInt(text, 10, 32)
+		if err != nil || n < -32768 || n > 65535 {
+			return 0, fmt.Errorf("invalid decimal constant %q", text)
+		}
+		return uint16(n), nil
+	}
+	if sym, ok := d.Symbols[text]; ok {
+		return sym.Value, nil
+	}
+	return 0, fmt.Errorf("no symbol %q", text)
+}
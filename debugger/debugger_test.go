@@ -0,0 +1,250 @@
+package debugger
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+
+	"pep9emulator/assembler"
+	"pep9emulator/computer"
+)
+
+const program = `
+main:    LDWA    3,i
+         STWA    -2,s
+         SUBSP   2,i
+         CALL    double
+         ADDSP   2,i
+         STWA    result,d
+         STOP
+;double returns twice its argument in A
+double:  LDWA    2,s
+         ASLA
+         RET
+result:  .BLOCK  2
+         .END`
+
+func load(t *testing.T, source string) *Debugger {
+	t.Helper()
+	p, err := assembler.Assemble(source)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c := &computer.Pep9Computer{}
+	c.Initialize()
+	c.LoadProgram(p.Object)
+	return New(c, p.Symbols)
+}
+
+func TestStepAndBreak(t *testing.T) {
+	d := load(t, program)
+	ctx := context.Background()
+
+	if stop := d.Step(ctx, 2); stop.Reason != StopStep || d.Computer.PC != 0x0006 {
+		t.Errorf("Expected to step to 0x0006 but got %v at 0x%04X", stop.Reason, d.Computer.PC)
+	}
+
+	bp := d.Break(d.Symbols["double"].Value)
+	stop := d.Continue(ctx)
+	if stop.Reason != StopBreakpoint || stop.Breakpoint != bp || d.Computer.PC != bp.Address {
+		t.Errorf("Expected the breakpoint at double but got %v at 0x%04X", stop.Reason, d.Computer.PC)
+	}
+
+	// Continuing from a breakpoint executes it.
+	if stop := d.Continue(ctx); stop.Reason != StopHalt || d.Computer.A != 6 {
+		t.Errorf("Expected a halt with A=6 but got %v with A=%d", stop.Reason, d.Computer.A)
+	}
+}
+
+func TestNextStepsOverCall(t *testing.T) {
+	d := load(t, program)
+	ctx := context.Background()
+	d.Step(ctx, 3)
+
+	if stop := d.Next(ctx); stop.Reason != StopStep || d.Computer.PC != 0x000C || d.Computer.A != 6 {
+		t.Errorf("Expected to step over the CALL to 0x000C but got %v at 0x%04X", stop.Reason, d.Computer.PC)
+	}
+	if stop := d.Next(ctx); d.Computer.PC != 0x000F {
+		t.Errorf("Expected next to step once but got %v at 0x%04X", stop.Reason, d.Computer.PC)
+	}
+}
+
+func TestFinish(t *testing.T) {
+	d := load(t, program)
+	ctx := context.Background()
+	d.Break(d.Symbols["double"].Value)
+	d.Continue(ctx)
+
+	if stop := d.Finish(ctx); stop.Reason != StopStep || d.Computer.PC != 0x000C || stop.Last.OpCode != 0x01 {
+		t.Errorf("Expected finish to return to 0x000C but got %v at 0x%04X", stop.Reason, d.Computer.PC)
+	}
+}
+
+func TestDeleteBreakpoint(t *testing.T) {
+	d := load(t, program)
+	bp := d.Break(0x0009)
+	d.Break(0x0015)
+
+	if !d.Delete(bp.ID) || d.Delete(bp.ID) {
+		t.Error("Expected the breakpoint to be deleted once")
+	}
+	if bps := d.Breakpoints(); len(bps) != 1 || bps[0].Address != 0x0015 {
+		t.Errorf("Expected one breakpoint left but got %v", bps)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	d := load(t, "loop: BR loop\n .END")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if stop := d.Continue(ctx); stop.Reason != StopInterrupted {
+		t.Errorf("Expected an interrupt but got %v", stop.Reason)
+	}
+}
+
+func TestLocation(t *testing.T) {
+	d := load(t, program)
+
+	tests := map[string]uint16{"double": 0x0013, "double+1": 0x0014, "0x10": 0x10, "16": 16, "'A'": 0x41, "-1": 0xFFFF}
+	for text, expected := range tests {
+		if got, err := d.Location(text); err != nil || got != expected {
+			t.Errorf("Expected %q to be 0x%04X but got 0x%04X %v", text, expected, got, err)
+		}
+	}
+	if _, err := d.Location("nowhere"); err == nil {
+		t.Error("Expected an unknown symbol to fail")
+	}
+	if name := d.Symbolize(0x0014); name != "double+1" {
+		t.Errorf("Expected double+1 but got %q", name)
+	}
+}
+
+func TestWatchpoint(t *testing.T) {
+	d := load(t, program)
+	ctx := context.Background()
+
+	// The argument pushed at 0xFB8D is read by double.
+	w := d.Watch(computer.AddressRange{Start: 0xFB8D, End: 0xFB8D}, computer.WatchRead)
+	stop := d.Continue(ctx)
+	if stop.Reason != StopWatchpoint || len(stop.Watches) != 1 || d.WatchID(stop.Watches[0]) != w.ID {
+		t.Fatalf("Expected the watchpoint but got %v %+v", stop.Reason, stop.Watches)
+	}
+	if hit := stop.Watches[0]; hit.PC != 0x0013 || hit.Value != 3 {
+		t.Errorf("Expected LDWA at 0x0013 to read 3 but got %+v", hit)
+	}
+
+	if !d.Delete(w.ID) || len(d.Watches()) != 0 {
+		t.Error("Expected the watchpoint to be deleted")
+	}
+	if stop := d.Continue(ctx); stop.Reason != StopHalt {
+		t.Errorf("Expected a halt but got %v", stop.Reason)
+	}
+}
+
+func TestChangePointsWhileRunning(t *testing.T) {
+	d := load(t, `
+top:     LDWA    count,d
+         ADDA    1,i
+         STWA    count,d
+         BR      top
+count:   .WORD   0
+         .END`)
+	counted := d.Break(d.Symbols["top"].Value)
+	d.setIgnore(counted, 1<<30)
+	stopped := make(chan Stop)
+	go func() { stopped <- d.Continue(context.Background()) }()
+	for d.copyOf(counted).Hits == 0 {
+		runtime.Gosched()
+	}
+
+	// Run with go test -race: the program checks breakpoints and watchpoints
+	// as they change, and counts hits of a breakpoint being read here.
+	for i := 0; i < 20; i++ {
+		bp := d.Break(d.Symbols["count"].Value)
+		w := d.Watch(computer.AddressRange{Start: 0x0200, End: 0x0201}, computer.WatchAccess)
+		d.copyOf(counted)
+		d.Watches()
+		d.Delete(bp.ID)
+		d.Delete(w.ID)
+	}
+	count := d.Symbols["count"].Value
+	w := d.Watch(computer.AddressRange{Start: count, End: count + 1}, computer.WatchWrite)
+
+	stop := <-stopped
+	if stop.Reason != StopWatchpoint || d.WatchID(stop.Watches[0]) != w.ID {
+		t.Errorf("Expected to stop at the watchpoint but got %v %+v", stop.Reason, stop.Watches)
+	}
+	if c := d.copyOf(counted); c.Hits+c.Ignore != 1<<30 {
+		t.Errorf("Expected the hits to be counted off the ignores but got %d and %d", c.Hits, c.Ignore)
+	}
+}
+
+const loop = `
+         LDWX    0,i
+top:     ADDX    1,i
+         CPWX    5,i
+         BRNE    top
+         STOP
+         .END`
+
+func TestConditionalBreakpoint(t *testing.T) {
+	d := load(t, loop)
+	ctx := context.Background()
+	condition, err := d.Compile("X == 3")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	bp := d.Break(d.Symbols["top"].Value)
+	bp.Condition = condition
+
+	if stop := d.Continue(ctx); stop.Reason != StopBreakpoint || d.Computer.X != 3 || bp.Hits != 1 {
+		t.Errorf("Expected to stop at top with X=3 but got %v with X=%d after %d hits", stop.Reason, d.Computer.X, bp.Hits)
+	}
+	if stop := d.Continue(ctx); stop.Reason != StopHalt {
+		t.Errorf("Expected a halt but got %v", stop.Reason)
+	}
+}
+
+func TestBreakIf(t *testing.T) {
+	d := load(t, loop)
+	condition, err := d.Compile("x >= 2 && opcode == 0x68")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	d.BreakIf(condition)
+
+	if stop := d.Continue(context.Background()); stop.Reason != StopBreakpoint || d.Computer.X != 2 || d.Computer.PC != 0x0003 {
+		t.Errorf("Expected to stop at ADDX with X=2 but got %v at 0x%04X with X=%d", stop.Reason, d.Computer.PC, d.Computer.X)
+	}
+}
+
+func TestIgnoreCount(t *testing.T) {
+	d := load(t, loop)
+	ctx := context.Background()
+	bp := d.Break(d.Symbols["top"].Value)
+	bp.Ignore = 2
+
+	// top is first reached with X=0.
+	if stop := d.Continue(ctx); stop.Reason != StopBreakpoint || d.Computer.X != 2 {
+		t.Errorf("Expected to stop with X=2 but got %v with X=%d", stop.Reason, d.Computer.X)
+	}
+	if bp.Hits != 3 || bp.Ignore != 0 {
+		t.Errorf("Expected 3 hits and no ignores left but got %d and %d", bp.Hits, bp.Ignore)
+	}
+}
+
+func TestConditionError(t *testing.T) {
+	d := load(t, loop)
+	condition, err := d.Compile("X == 2 / (X - 2)")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	d.BreakIf(condition)
+
+	stop := d.Continue(context.Background())
+	if stop.Reason != StopBreakpoint || !errors.Is(stop.Err, errDivideByZero) || d.Computer.X != 2 {
+		t.Errorf("Expected a condition error with X=2 but got %v, %v with X=%d", stop.Reason, stop.Err, d.Computer.X)
+	}
+}
@@ -0,0 +1,408 @@
+package debugger
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"pep9emulator/assembler"
+	"pep9emulator/computer"
+	"pep9emulator/disasm"
+)
+
+// Expr is a compiled expression over the registers and memory, such as
+//
+//	X == 10 && mem.w[SP+2] < 0 && N
+//
+// Operands are decimal, 0x hex and 'c' character constants, symbols, the
+// registers A, X, SP, PC, OpCode and Operand, the status bits N, Z, V and C,
+// and memory as mem.b[addr] (or mem[addr]) and mem.w[addr]. OpCode and
+// Operand are those of the instruction at PC. A, X and words read from
+// memory are signed, everything else is unsigned. Equality compares the low
+// 16 bits, so A == 0xFFFF holds when A is -1. The operators are those of C:
+//
+//	|| && | ^ & == != < <= > >= << >> + - * / % and unary ! - ~
+//
+// Register names are not case sensitive. A symbol with the same name as a
+// register is shadowed by the register.
+type Expr struct {
+	text string
+	eval evalFunc
+}
+
+type evalFunc func(c *computer.Pep9Computer) (int, error)
+
+var errDivideByZero = errors.New("division by zero")
+
+func (e *Expr) String() string {
+	return e.text
+}
+
+// Eval evaluates the expression against the computer's current state.
+func (e *Expr) Eval(c *computer.Pep9Computer) (int, error) {
+	return e.eval(c)
+}
+
+// Compile parses an expression, resolving symbols from the debugger's
+// symbol table.
+func (d *Debugger) Compile(text string) (*Expr, error) {
+	return Compile(text, d.Symbols)
+}
+
+// Compile parses an expression. Symbols may be nil.
+func Compile(text string, symbols assembler.SymbolTable) (*Expr, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens, symbols: symbols}
+
+	eval, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return &Expr{strings.TrimSpace(text), eval}, nil
+}
+
+type tokenKind int
+
+const (
+	tokNumber tokenKind = iota
+	tokIdent
+	tokOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value int
+}
+
+// operators is ordered so longer operators match first.
+var operators = []string{
+	"||", "&&", "==", "!=", "<=", ">=", "<<", ">>",
+	"|", "^", "&", "<", ">", "+", "-", "*", "/", "%", "!", "~", "(", ")", "[", "]",
+}
+
+func tokenize(text string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(text); {
+		ch := text[i]
+		switch {
+		case ch == ' ' || ch == '\t':
+			i++
+		case ch >= '0' && ch <= '9':
+			j := i
+			for j < len(text) && isIdentChar(text[j]) {
+				j++
+			}
+			digits, base := text[i:j], 10
+			if len(digits) > 2 && (digits[:2] == "0x" || digits[:2] == "0X") {
+				digits, base = digits[2:], 16
+			}
+			value, err := strconv.ParseInt(digits, base, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q", text[i:j])
+			}
+			tokens = append(tokens, token{tokNumber, text[i:j], int(value)})
+			i = j
+		case ch == '\'':
+			j := strings.IndexByte(text[i+1:], '\'')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated character constant")
+			}
+			s, err := strconv.Unquote(`'` + text[i+1:i+1+j] + `'`)
+			runes := []rune(s)
+			if err != nil || len(runes) != 1 || runes[0] > 0xFF {
+				return nil, fmt.Errorf("invalid character constant %q", text[i:i+j+2])
+			}
+			tokens = append(tokens, token{tokNumber, text[i : i+j+2], int(runes[0])})
+			i += j + 2
+		case isIdentChar(ch):
+			j := i
+			for j < len(text) && (isIdentChar(text[j]) || text[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: text[i:j]})
+			i = j
+		default:
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(text[i:], op) {
+					tokens = append(tokens, token{kind: tokOperator, text: op})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character %q", ch)
+			}
+		}
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	return tokens, nil
+}
+
+func isIdentChar(ch byte) bool {
+	return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9'
+}
+
+type exprParser struct {
+	tokens  []token
+	pos     int
+	symbols assembler.SymbolTable
+}
+
+// precedence lists the binary operators from loosest to tightest binding.
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) peek() (token, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return token{}, false
+}
+
+// accept consumes the next token if it is one of the operators.
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	t, ok := p.peek()
+	if !ok || t.kind != tokOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		return fmt.Errorf("expected %q", op)
+	}
+	return nil
+}
+
+func (p *exprParser) binary(level int) (evalFunc, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(precedence[level]...)
+		if !ok {
+			return left, nil
+		}
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryOp(op, left, right)
+	}
+}
+
+func binaryOp(op string, left, right evalFunc) evalFunc {
+	switch op {
+	case "||", "&&": // Short circuit
+		return func(c *computer.Pep9Computer) (int, error) {
+			l, err := left(c)
+			if err != nil || (l != 0) == (op == "||") {
+				return truth(l != 0), err
+			}
+			r, err := right(c)
+			return truth(r != 0), err
+		}
+	}
+
+	apply := arithmetic[op]
+	return func(c *computer.Pep9Computer) (int, error) {
+		l, err := left(c)
+		if err != nil {
+			return 0, err
+		}
+		r, err := right(c)
+		if err != nil {
+			return 0, err
+		}
+		return apply(l, r)
+	}
+}
+
+// arithmetic applies the binary operators that evaluate both operands.
+var arithmetic = map[string]func(l, r int) (int, error){
+	"|":  func(l, r int) (int, error) { return l | r, nil },
+	"^":  func(l, r int) (int, error) { return l ^ r, nil },
+	"&":  func(l, r int) (int, error) { return l & r, nil },
+	"==": func(l, r int) (int, error) { return truth(uint16(l) == uint16(r)), nil },
+	"!=": func(l, r int) (int, error) { return truth(uint16(l) != uint16(r)), nil },
+	"<":  func(l, r int) (int, error) { return truth(l < r), nil },
+	"<=": func(l, r int) (int, error) { return truth(l <= r), nil },
+	">":  func(l, r int) (int, error) { return truth(l > r), nil },
+	">=": func(l, r int) (int, error) { return truth(l >= r), nil },
+	"<<": func(l, r int) (int, error) { return l << uint(r&0x1F), nil },
+	">>": func(l, r int) (int, error) { return l >> uint(r&0x1F), nil },
+	"+":  func(l, r int) (int, error) { return l + r, nil },
+	"-":  func(l, r int) (int, error) { return l - r, nil },
+	"*":  func(l, r int) (int, error) { return l * r, nil },
+	"/": func(l, r int) (int, error) {
+		if r == 0 {
+			return 0, errDivideByZero
+		}
+		return l / r, nil
+	},
+	"%": func(l, r int) (int, error) {
+		if r == 0 {
+			return 0, errDivideByZero
+		}
+		return l % r, nil
+	},
+}
+
+func truth(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (p *exprParser) unary() (evalFunc, error) {
+	op, ok := p.accept("!", "-", "~")
+	if !ok {
+		return p.primary()
+	}
+	operand, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(c *computer.Pep9Computer) (int, error) {
+		v, err := operand(c)
+		switch op {
+		case "!":
+			return truth(v == 0), err
+		case "-":
+			return -v, err
+		}
+		return ^v, err
+	}, nil
+}
+
+func (p *exprParser) primary() (evalFunc, error) {
+	if _, ok := p.accept("("); ok {
+		inner, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+
+	switch t.kind {
+	case tokNumber:
+		return func(*computer.Pep9Computer) (int, error) { return t.value, nil }, nil
+	case tokIdent:
+		return p.identifier(t.text)
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+func (p *exprParser) identifier(name string) (evalFunc, error) {
+	switch strings.ToLower(name) {
+	case "mem", "mem.b":
+		return p.memory(1)
+	case "mem.w":
+		return p.memory(2)
+	}
+	if reg := register(name); reg != nil {
+		return func(c *computer.Pep9Computer) (int, error) { return reg(c), nil }, nil
+	}
+	if sym, ok := p.symbols[name]; ok {
+		value := int(sym.Value)
+		return func(*computer.Pep9Computer) (int, error) { return value, nil }, nil
+	}
+	return nil, fmt.Errorf("unknown name %q", name)
+}
+
+// register returns a function reading the named register or status bit.
+func register(name string) func(c *computer.Pep9Computer) int {
+	switch strings.ToUpper(name) {
+	case "A":
+		return func(c *computer.Pep9Computer) int { return int(int16(c.A)) }
+	case "X":
+		return func(c *computer.Pep9Computer) int { return int(int16(c.X)) }
+	case "SP":
+		return func(c *computer.Pep9Computer) int { return int(c.SP) }
+	case "PC":
+		return func(c *computer.Pep9Computer) int { return int(c.PC) }
+	case "OPCODE":
+		return func(c *computer.Pep9Computer) int { return int(c.Ram[c.PC]) }
+	case "OPERAND":
+		return func(c *computer.Pep9Computer) int { return int(disasm.Decode(c.Ram[:], c.PC).Operand) }
+	case "N":
+		return func(c *computer.Pep9Computer) int { return truth(c.N) }
+	case "Z":
+		return func(c *computer.Pep9Computer) int { return truth(c.Z) }
+	case "V":
+		return func(c *computer.Pep9Computer) int { return truth(c.V) }
+	case "C":
+		return func(c *computer.Pep9Computer) int { return truth(c.C) }
+	}
+	return nil
+}
+
+// memory parses [addr] after mem.b or mem.w. Memory is read from RAM so
+// evaluating an expression never consumes device input.
+func (p *exprParser) memory(size int) (evalFunc, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	address, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+
+	return func(c *computer.Pep9Computer) (int, error) {
+		a, err := address(c)
+		if err != nil {
+			return 0, err
+		}
+		location := uint16(a)
+		if size == 1 {
+			return int(c.Ram[location]), nil
+		}
+		return int(int16(uint16(c.Ram[location])<<8 | uint16(c.Ram[location+1]))), nil
+	}, nil
+}
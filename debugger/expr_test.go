@@ -0,0 +1,78 @@
+package debugger
+
+import (
+	"testing"
+
+	"pep9emulator/assembler"
+	"pep9emulator/computer"
+)
+
+func TestExprEval(t *testing.T) {
+	c := &computer.Pep9Computer{}
+	c.Initialize()
+	c.A = 0xFFFF
+	c.X = 10
+	c.SP = 0x0100
+	c.N = true
+	c.Ram[0x0102], c.Ram[0x0103] = 0xFF, 0xFE
+	c.Ram[0x0000], c.Ram[0x0001], c.Ram[0x0002] = 0xC1, 0x12, 0x34
+	symbols := assembler.SymbolTable{"count": {Name: "count", Value: 0x0102}}
+
+	cases := []struct {
+		expr     string
+		expected int
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"7 / 2 % 3", 0},
+		{"1 << 4 | 1", 17},
+		{"-7 / 2", -3},
+		{"~0 & 0xFF", 0xFF},
+		{"!0 + !5", 1},
+		{"'A' + 1", 66},
+		{"A", -1},
+		{"A < 0", 1},
+		{"A == 0xFFFF", 1},
+		{"SP + X", 0x010A},
+		{"mem.w[SP+2]", -2},
+		{"mem.b[SP+2]", 0xFF},
+		{"mem[count + 1]", 0xFE},
+		{"mem.w[count] == -2", 1},
+		{"X == 10 && mem.w[SP+2] < 0 && N", 1},
+		{"X == 10 && Z", 0},
+		{"Z || V || C || N", 1},
+		{"0 && 1 / 0", 0},
+		{"1 || 1 / 0", 1},
+		{"opcode == 0xC1 && operand == 0x1234 && pc == 0", 1},
+		{"x >= 10 && x <= 10 && x != 11 && x > 9", 1},
+		{"010 + 08", 18},
+		{"0X1f", 31},
+	}
+	for _, tc := range cases {
+		e, err := Compile(tc.expr, symbols)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.expr, err)
+			continue
+		}
+		if value, err := e.Eval(c); err != nil || value != tc.expected {
+			t.Errorf("%s: expected %d but got %d, %v", tc.expr, tc.expected, value, err)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, text := range []string{"", "1 +", "(1", "mem.w 3", "mem[1", "nosuch", "1 2", "0x", "0b1", "0o7", "1_000", "'ab'", "X @ 1"} {
+		if _, err := Compile(text, nil); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+
+	e, err := Compile("1 % (X - X)", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c := &computer.Pep9Computer{}
+	if _, err := e.Eval(c); err != errDivideByZero {
+		t.Errorf("Expected division by zero but got %v", err)
+	}
+}
@@ -0,0 +1,614 @@
+package debugger
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"pep9emulator/computer"
+	"pep9emulator/disasm"
+	"pep9emulator/isa"
+)
+
+const prompt = "(pep9) "
+
+const help = `Commands:
+  break, b LOC [if EXPR]  set a breakpoint at an address or label
+  break if EXPR           stop at any instruction where EXPR is true
+  condition ID [EXPR]     set or remove the condition of a breakpoint
+  ignore ID N             pass a breakpoint the next N times it is reached
+  delete, d [ID]          delete a breakpoint or watchpoint, or all of them
+  watch LOC [LEN]         stop after an instruction writes LEN bytes at LOC
+  rwatch LOC [LEN]        stop after an instruction reads them
+  awatch LOC [LEN]        stop after an instruction reads or writes them
+  info breakpoints        list breakpoints and watchpoints
+  step, s [N]             execute N instructions, default 1
+  next, n                 execute one instruction, stepping over CALL and traps
+  finish, fin             run until the current function returns
+  continue, c             run until a breakpoint or the program stops
+  registers, r            print the registers and NZVC
+  print, p EXPR           evaluate an expression such as mem.w[SP+2] < 0 && N
+  x[/FMT] LOC [COUNT]     examine memory, FMT is x (hex bytes), w (hex words),
+                          d (decimal words) or c (characters)
+  set REG VALUE           set A, X, SP, PC, N, Z, V or C
+  set byte|word LOC VALUE set memory
+  list, l [LOC]           disassemble from LOC, default the PC
+  vars                    print the globals, stack frames and heap of trace tags
+  backtrace, bt           print the calls that led to the PC
+  quit, q                 leave the debugger
+An empty line repeats the last command. Numbers are decimal, 0x hex or 'c'.
+`
+
+// REPL is a line oriented command interface to a Debugger.
+type REPL struct {
+	*Debugger
+	Out io.Writer
+
+	// Context returns the context for a command that runs the program, so
+	// it can be interrupted. The default is never interrupted.
+	Context func() (context.Context, context.CancelFunc)
+
+	last string
+}
+
+// NewREPL creates a REPL writing to out.
+func NewREPL(d *Debugger, out io.Writer) *REPL {
+	return &REPL{Debugger: d, Out: out}
+}
+
+// Run reads and executes commands until quit or the end of in.
+func (r *REPL) Run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	r.where()
+	for {
+		fmt.Fprint(r.Out, prompt)
+		if !scanner.Scan() {
+			fmt.Fprintln(r.Out)
+			return scanner.Err()
+		}
+		if r.Execute(scanner.Text()) {
+			return nil
+		}
+	}
+}
+
+// Execute runs one command line, reporting whether it asked to quit.
+func (r *REPL) Execute(line string) (quit bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		line = r.last
+	}
+	r.last = line
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	cmd, args := fields[0], fields[1:]
+	format := ""
+	if i := strings.IndexByte(cmd, '/'); i >= 0 {
+		cmd, format = cmd[:i], cmd[i+1:]
+	}
+
+	var err error
+	switch cmd {
+	case "help", "h":
+		fmt.Fprint(r.Out, help)
+	case "break", "b":
+		err = r.breakCmd(args)
+	case "watch":
+		err = r.watchCmd(computer.WatchWrite, args)
+	case "rwatch":
+		err = r.watchCmd(computer.WatchRead, args)
+	case "awatch":
+		err = r.watchCmd(computer.WatchAccess, args)
+	case "condition":
+		err = r.conditionCmd(args)
+	case "ignore":
+		err = r.ignoreCmd(args)
+	case "delete", "d":
+		err = r.deleteCmd(args)
+	case "info", "i":
+		err = r.infoCmd(args)
+	case "step", "s":
+		count := 1
+		if len(args) > 0 {
+			if count, err = strconv.Atoi(args[0]); err != nil || count < 1 {
+				err = fmt.Errorf("invalid count %q", args[0])
+				break
+			}
+		}
+		r.running(func(ctx context.Context) Stop { return r.Step(ctx, count) })
+	case "next", "n":
+		r.running(r.Next)
+	case "finish", "fin":
+		r.running(r.Finish)
+	case "continue", "c":
+		r.running(r.Continue)
+	case "registers", "r":
+		r.registers()
+	case "print", "p":
+		err = r.print(args)
+	case "x":
+		err = r.examine(format, args)
+	case "set":
+		err = r.set(args)
+	case "list", "l":
+		err = r.list(args)
+	case "vars":
+		err = r.vars()
+	case "backtrace", "bt":
+		err = r.WriteBacktrace(r.Out, r.Computer.PC)
+	case "quit", "q":
+		return true
+	default:
+		err = fmt.Errorf("unknown command %q, try help", cmd)
+	}
+
+	if err != nil {
+		fmt.Fprintf(r.Out, "Error: %v\n", err)
+	}
+	return false
+}
+
+func (r *REPL) breakCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("break needs a location or a condition")
+	}
+	if args[0] == "if" {
+		condition, err := r.condition(args[1:])
+		if err != nil {
+			return err
+		}
+		bp := r.BreakIf(condition)
+		fmt.Fprintf(r.Out, "Breakpoint %d if %s\n", bp.ID, condition)
+		return nil
+	}
+
+	address, err := r.Location(args[0])
+	if err != nil {
+		return err
+	}
+	var condition *Expr
+	if len(args) > 1 {
+		if args[1] != "if" {
+			return fmt.Errorf("expected if after the location")
+		}
+		if condition, err = r.condition(args[2:]); err != nil {
+			return err
+		}
+	}
+	bp := r.add(&Breakpoint{Address: address, Condition: condition})
+	fmt.Fprintf(r.Out, "Breakpoint %d at %s\n", bp.ID, r.describe(address))
+	return nil
+}
+
+// condition compiles the words of an expression.
+func (r *REPL) condition(words []string) (*Expr, error) {
+	if len(words) == 0 {
+		return nil, fmt.Errorf("missing condition")
+	}
+	return r.Compile(strings.Join(words, " "))
+}
+
+// breakpoint finds the breakpoint numbered by an argument.
+func (r *REPL) breakpoint(arg string) (*Breakpoint, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, fmt.Errorf("no breakpoint %s", arg)
+	}
+	bp, ok := r.Breakpoint(id)
+	if !ok {
+		return nil, fmt.Errorf("no breakpoint %s", arg)
+	}
+	return bp, nil
+}
+
+func (r *REPL) conditionCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("condition needs a breakpoint number")
+	}
+	bp, err := r.breakpoint(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		if bp.Anywhere {
+			return fmt.Errorf("breakpoint %d has no location and needs its condition", bp.ID)
+		}
+		r.setCondition(bp, nil)
+		fmt.Fprintf(r.Out, "Breakpoint %d is now unconditional\n", bp.ID)
+		return nil
+	}
+	condition, err := r.condition(args[1:])
+	if err != nil {
+		return err
+	}
+	r.setCondition(bp, condition)
+	return nil
+}
+
+func (r *REPL) ignoreCmd(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("ignore needs a breakpoint number and a count")
+	}
+	bp, err := r.breakpoint(args[0])
+	if err != nil {
+		return err
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count < 0 {
+		return fmt.Errorf("invalid count %q", args[1])
+	}
+	r.setIgnore(bp, count)
+	fmt.Fprintf(r.Out, "Will ignore next %d crossings of breakpoint %d\n", count, bp.ID)
+	return nil
+}
+
+func (r *REPL) print(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("print needs an expression")
+	}
+	expr, err := r.Compile(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	value, err := expr.Eval(r.Computer)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.Out, "%d (0x%04X)\n", value, uint16(value))
+	return nil
+}
+
+func (r *REPL) watchCmd(kind computer.WatchKind, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("watch needs a location and an optional length")
+	}
+	address, err := r.Location(args[0])
+	if err != nil {
+		return err
+	}
+	length := uint16(2)
+	if len(args) == 2 {
+		if length, err = r.Value(args[1]); err != nil || length == 0 || int(address)+int(length) > 0x10000 {
+			return fmt.Errorf("invalid length %q", args[1])
+		}
+	}
+
+	w := r.Watch(computer.AddressRange{Start: address, End: address + length - 1}, kind)
+	fmt.Fprintf(r.Out, "Watchpoint %d (%s) at %s, %d bytes\n", w.ID, kind, r.describe(address), length)
+	return nil
+}
+
+func (r *REPL) deleteCmd(args []string) error {
+	if len(args) == 0 {
+		for _, bp := range r.Breakpoints() {
+			r.Delete(bp.ID)
+		}
+		for _, w := range r.Watches() {
+			r.Delete(w.ID)
+		}
+		return nil
+	}
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil || !r.Delete(id) {
+			return fmt.Errorf("no breakpoint %s", arg)
+		}
+	}
+	return nil
+}
+
+func (r *REPL) infoCmd(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("info breakpoints or info registers")
+	}
+	switch args[0] {
+	case "breakpoints", "break", "b":
+		bps, ws := r.Breakpoints(), r.Watches()
+		if len(bps) == 0 && len(ws) == 0 {
+			fmt.Fprintln(r.Out, "No breakpoints or watchpoints")
+		}
+		for _, bp := range bps {
+			r.breakpointInfo(r.copyOf(bp))
+		}
+		for _, w := range ws {
+			fmt.Fprintf(r.Out, "%-3d %-6s watch %s, %d bytes\n", w.ID, w.Kind, r.describe(w.Range.Start), int(w.Range.End)-int(w.Range.Start)+1)
+		}
+	case "registers", "r":
+		r.registers()
+	default:
+		return fmt.Errorf("info breakpoints or info registers")
+	}
+	return nil
+}
+
+func (r *REPL) breakpointInfo(bp Breakpoint) {
+	if bp.Anywhere {
+		fmt.Fprintf(r.Out, "%-3d breakpoint  anywhere\n", bp.ID)
+	} else {
+		fmt.Fprintf(r.Out, "%-3d breakpoint  %s\n", bp.ID, r.describe(bp.Address))
+	}
+	if bp.Condition != nil {
+		fmt.Fprintf(r.Out, "    stop only if %s\n", bp.Condition)
+	}
+	if bp.Hits == 1 {
+		fmt.Fprintln(r.Out, "    breakpoint already hit 1 time")
+	} else if bp.Hits > 1 {
+		fmt.Fprintf(r.Out, "    breakpoint already hit %d times\n", bp.Hits)
+	}
+	if bp.Ignore > 0 {
+		fmt.Fprintf(r.Out, "    will ignore next %d crossings\n", bp.Ignore)
+	}
+}
+
+// running runs a command that executes the program and reports the stop.
+func (r *REPL) running(command func(ctx context.Context) Stop) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if r.Context != nil {
+		ctx, cancel = r.Context()
+	}
+	stop := command(ctx)
+	cancel()
+
+	switch stop.Reason {
+	case StopBreakpoint:
+		if stop.Err != nil {
+			fmt.Fprintf(r.Out, "Error in condition: %v\n", stop.Err)
+		}
+		fmt.Fprintf(r.Out, "Breakpoint %d, %s\n", stop.Breakpoint.ID, r.describe(r.Computer.PC))
+	case StopHalt:
+		fmt.Fprintln(r.Out, "Program halted")
+		return
+	case StopError:
+		fmt.Fprintf(r.Out, "Program stopped: %v\n", stop.Err)
+		return
+	case StopInterrupted:
+		fmt.Fprintln(r.Out, "Interrupted")
+	case StopWatchpoint:
+		for _, hit := range stop.Watches {
+			r.watchHit(hit)
+		}
+	case StopBadReturn:
+		fmt.Fprintf(r.Out, "Bad return: %v\n", stop.BadReturn)
+	}
+	r.where()
+}
+
+// watchHit reports the access that triggered a watchpoint and the
+// instruction responsible.
+func (r *REPL) watchHit(hit computer.WatchHit) {
+	inst, _ := isa.Decode(hit.OpCode)
+	fmt.Fprintf(r.Out, "Watchpoint %d, %s at %s by %s at %s\n",
+		r.WatchID(hit), hit.Kind, r.describe(hit.Address), inst.Mnemonic, r.describe(hit.PC))
+	if hit.Kind == computer.WatchWrite {
+		fmt.Fprintf(r.Out, "Old value = 0x%0*X (%d)\nNew value = 0x%0*X (%d)\n",
+			hit.Size*2, hit.Old, signed(hit.Old, hit.Size), hit.Size*2, hit.Value, signed(hit.Value, hit.Size))
+	} else {
+		fmt.Fprintf(r.Out, "Value = 0x%0*X (%d)\n", hit.Size*2, hit.Value, signed(hit.Value, hit.Size))
+	}
+}
+
+// signed interprets a byte or word as two's complement.
+func signed(value uint16, size int) int {
+	if size == 1 {
+		return int(int8(value))
+	}
+	return int(int16(value))
+}
+
+// where shows the next instruction.
+func (r *REPL) where() {
+	c := r.Computer
+	if c.HALT {
+		return
+	}
+	inst := disasm.Decode(c.Ram[:], c.PC)
+	fmt.Fprintf(r.Out, "=> %s  %s\n", r.describe(c.PC), inst.Text(r.Labels))
+}
+
+func (r *REPL) registers() {
+	c := r.Computer
+	fmt.Fprintf(r.Out, "A=0x%04X (%d)  X=0x%04X (%d)  SP=0x%04X  PC=0x%04X  NZVC=%s\n",
+		c.A, int16(c.A), c.X, int16(c.X), c.SP, c.PC, flagString(c.N, c.Z, c.V, c.C))
+}
+
+func flagString(bits ...bool) string {
+	var b strings.Builder
+	for _, bit := range bits {
+		if bit {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+	return b.String()
+}
+
+// describe formats an address with its symbol, as in "0x0005 <loop>".
+func (r *REPL) describe(address uint16) string {
+	if name := r.Symbolize(address); name != "" {
+		return fmt.Sprintf("0x%04X <%s>", address, name)
+	}
+	return fmt.Sprintf("0x%04X", address)
+}
+
+func (r *REPL) examine(format string, args []string) error {
+	if format == "" {
+		format = "x"
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("x needs a location and an optional count")
+	}
+	address, err := r.Location(args[0])
+	if err != nil {
+		return err
+	}
+
+	unit, perLine, count := 1, 8, 16
+	switch format {
+	case "x", "c":
+	case "w", "d":
+		unit, perLine, count = 2, 8, 1
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	if len(args) == 2 {
+		if count, err = strconv.Atoi(args[1]); err != nil || count < 1 {
+			return fmt.Errorf("invalid count %q", args[1])
+		}
+	}
+
+	ram := &r.Computer.Ram
+	for i := 0; i < count; i++ {
+		location := address + uint16(i*unit)
+		if i%perLine == 0 {
+			if i > 0 {
+				fmt.Fprintln(r.Out)
+			}
+			fmt.Fprintf(r.Out, "%s:", r.describe(location))
+		}
+		word := uint16(ram[location])<<8 | uint16(ram[location+1])
+		switch format {
+		case "x":
+			fmt.Fprintf(r.Out, " %02X", ram[location])
+		case "c":
+			fmt.Fprintf(r.Out, " %s", charString(ram[location]))
+		case "w":
+			fmt.Fprintf(r.Out, " 0x%04X", word)
+		case "d":
+			fmt.Fprintf(r.Out, " %d", int16(word))
+		}
+	}
+	fmt.Fprintln(r.Out)
+	return nil
+}
+
+func charString(b byte) string {
+	switch {
+	case b == '\n':
+		return `\n`
+	case b >= ' ' && b <= '~':
+		return string(rune(b))
+	}
+	return fmt.Sprintf(`\x%02X`, b)
+}
+
+func (r *REPL) set(args []string) error {
+	c := r.Computer
+	if len(args) == 3 && (args[0] == "byte" || args[0] == "word") {
+		address, err := r.Location(args[1])
+		if err != nil {
+			return err
+		}
+		value, err := r.Value(args[2])
+		if err != nil {
+			return err
+		}
+		if args[0] == "byte" {
+			c.Ram[address] = uint8(value)
+		} else {
+			c.Ram[address] = uint8(value >> 8)
+			c.Ram[address+1] = uint8(value)
+		}
+		return nil
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("set REG VALUE or set byte|word LOC VALUE")
+	}
+
+	value, err := r.Value(args[1])
+	if err != nil {
+		return err
+	}
+	switch strings.ToUpper(args[0]) {
+	case "A":
+		c.A = value
+	case "X":
+		c.X = value
+	case "SP":
+		c.SP = value
+	case "PC":
+		c.PC = value
+	case "N":
+		c.N = value != 0
+	case "Z":
+		c.Z = value != 0
+	case "V":
+		c.V = value != 0
+	case "C":
+		c.C = value != 0
+	default:
+		return fmt.Errorf("unknown register %q", args[0])
+	}
+	return nil
+}
+
+func (r *REPL) list(args []string) error {
+	address := r.Computer.PC
+	if len(args) > 0 {
+		var err error
+		if address, err = r.Location(args[0]); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		inst := disasm.Decode(r.Computer.Ram[:], address)
+		marker := "  "
+		if address == r.Computer.PC {
+			marker = "=>"
+		}
+		if bp := r.breakpointAt(address); bp != nil {
+			marker = "b" + marker[1:]
+		}
+		fmt.Fprintf(r.Out, "%s %s  %s\n", marker, r.describe(address), inst.Text(r.Labels))
+		address += uint16(inst.Size())
+	}
+	return nil
+}
+
+// vars prints the typed variables of the program, the top of the stack
+// first.
+func (r *REPL) vars() error {
+	v := r.Computer.Variables
+	if v == nil {
+		return fmt.Errorf("no trace tags, debug the program's source")
+	}
+	variables := func(list []computer.Variable) {
+		for _, variable := range list {
+			fmt.Fprintf(r.Out, "  0x%04X  %-10s %-6s %s\n", variable.Address, variable.Name, variable.Tag, variable.Value(&r.Computer.Memory))
+		}
+	}
+
+	if len(v.Globals) > 0 {
+		fmt.Fprintln(r.Out, "Globals:")
+		variables(v.Globals)
+	}
+	stack := false
+	for i := len(v.Frames) - 1; i >= 0; i-- {
+		if frame := v.Frames[i]; len(frame.Variables) > 0 {
+			if !stack {
+				fmt.Fprintln(r.Out, "Stack:")
+				stack = true
+			}
+			fmt.Fprintf(r.Out, " frame of SUBSP at %s\n", r.describe(frame.PC))
+			variables(frame.Variables)
+		}
+	}
+	if len(v.Heap) > 0 {
+		fmt.Fprintln(r.Out, "Heap:")
+	}
+	for _, allocation := range v.Heap {
+		fmt.Fprintf(r.Out, " allocated by CALL at %s\n", r.describe(allocation.PC))
+		variables(allocation.Variables)
+	}
+	if len(v.Globals) == 0 && !stack && len(v.Heap) == 0 {
+		fmt.Fprintln(r.Out, "No variables")
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package debugger
+
+import (
+	"strings"
+	"testing"
+
+	"pep9emulator/assembler"
+	"pep9emulator/computer"
+)
+
+func session(t *testing.T, commands string) string {
+	t.Helper()
+	d := load(t, program)
+	var out strings.Builder
+	if err := NewREPL(d, &out).Run(strings.NewReader(commands)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return out.String()
+}
+
+func TestREPLSession(t *testing.T) {
+	out := session(t, `break double
+continue
+registers
+finish
+x/d result
+next
+next
+next
+x/d result
+info breakpoints
+quit
+`)
+
+	expected := []string{
+		"=> 0x0000 <main>  LDWA    0x0003,i",
+		"Breakpoint 1 at 0x0013 <double>",
+		"Breakpoint 1, 0x0013 <double>",
+		"A=0x0003 (3)  X=0x0000 (0)  SP=0xFB8B  PC=0x0013  NZVC=1001",
+		"=> 0x000C <main+12>  ADDSP   0x0002,i",
+		"Program halted",
+		"0x0018 <result>: 0",
+		"0x0018 <result>: 6",
+		"1   breakpoint  0x0013 <double>",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Expected %q in\n%s", e, out)
+		}
+	}
+}
+
+func TestREPLSetAndExamine(t *testing.T) {
+	out := session(t, `set a 0x1234
+set n 1
+r
+set word 0x0100 -2
+x/w 0x100
+x/d 0x100
+set byte 0x0102 'H'
+x/c 0x0102 2
+x 0x0100 3
+step 2
+s
+`)
+
+	expected := []string{
+		"A=0x1234 (4660)  X=0x0000 (0)  SP=0xFB8F  PC=0x0000  NZVC=1000",
+		"0x0100: 0xFFFE",
+		"0x0100: -2",
+		`0x0102: H \x00`,
+		"0x0100: FF FE 48",
+		"=> 0x0006 <main+6>  SUBSP   0x0002,i",
+		"=> 0x0009 <main+9>  CALL    double",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Expected %q in\n%s", e, out)
+		}
+	}
+}
+
+func TestREPLErrors(t *testing.T) {
+	out := session(t, `break
+break nowhere
+delete 7
+frobnicate
+x/q 0
+set q 1
+`)
+
+	if n := strings.Count(out, "Error: "); n != 6 {
+		t.Errorf("Expected 6 errors but got %d in\n%s", n, out)
+	}
+}
+
+func TestREPLWatch(t *testing.T) {
+	out := session(t, `watch result
+continue
+info b
+delete 1
+continue
+`)
+
+	expected := []string{
+		"Watchpoint 1 (write) at 0x0018 <result>, 2 bytes",
+		"Watchpoint 1, write at 0x0018 <result> by STWA at 0x000F <main+15>",
+		"Old value = 0x0000 (0)",
+		"New value = 0x0006 (6)",
+		"=> 0x0012 <main+18>  STOP",
+		"1   write  watch 0x0018 <result>, 2 bytes",
+		"Program halted",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Expected %q in\n%s", e, out)
+		}
+	}
+}
+
+func TestREPLConditions(t *testing.T) {
+	out := session(t, `break double if mem.w[SP+2] == 4
+break double
+condition 2 A == 3
+ignore 2 1
+break if A == 6
+continue
+info breakpoints
+print mem.w[SP+2] * 2 - 1
+p A == 6 && !N
+condition 1
+condition 9
+break double if
+quit
+`)
+
+	expected := []string{
+		"Breakpoint 1 at 0x0013 <double>",
+		"Breakpoint 2 at 0x0013 <double>",
+		"Breakpoint 3 if A == 6",
+		"Will ignore next 1 crossings of breakpoint 2",
+		"Breakpoint 3, 0x0017 <double+4>",
+		"1   breakpoint  0x0013 <double>\n    stop only if mem.w[SP+2] == 4\n",
+		"2   breakpoint  0x0013 <double>\n    stop only if A == 3\n    breakpoint already hit 1 time\n",
+		"3   breakpoint  anywhere\n    stop only if A == 6\n    breakpoint already hit 1 time\n",
+		"5 (0x0005)",
+		"1 (0x0001)",
+		"Breakpoint 1 is now unconditional",
+		"Error: no breakpoint 9",
+		"Error: missing condition",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Expected %q in\n%s", e, out)
+		}
+	}
+}
+
+func TestREPLVars(t *testing.T) {
+	p, err := assembler.Assemble(`
+main:    SUBSP   2,i         ;push #arg
+         LDWA    3,i
+         STWA    arg,s
+         CALL    double
+         ADDSP   2,i         ;pop #arg
+         STOP
+double:  LDWA    2,s
+         ASLA
+         STWA    result,d
+         RET
+arg:     .EQUATE 0           ;#2d
+result:  .BLOCK  2           ;#2h
+         .END`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c := &computer.Pep9Computer{}
+	c.Variables = computer.NewVariables(p)
+	c.Initialize()
+	c.LoadProgram(p.Object)
+
+	var out strings.Builder
+	err = NewREPL(New(c, p.Symbols), &out).Run(strings.NewReader("break double\ncontinue\nvars\ncontinue\nvars\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"Globals:\n  0x0018  result     #2h    0x0000\nStack:\n frame of SUBSP at 0x0000 <main>\n  0xFB8D  arg        #2d    3\n",
+		"Globals:\n  0x0018  result     #2h    0x0006\n(pep9)",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out.String(), e) {
+			t.Errorf("Expected %q in\n%s", e, out.String())
+		}
+	}
+}
+
+func TestREPLBacktrace(t *testing.T) {
+	p, err := assembler.Assemble(`
+main:    LDWA    2,i
+         CALL    down
+         CALL    smash
+         STOP
+down:    SUBSP   2,i
+         CPWA    0,i
+         BREQ    bottom
+         SUBA    1,i
+         CALL    down
+bottom:  ADDSP   2,i
+         RET
+smash:   STWA    0,s
+         RET
+         .END`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c := &computer.Pep9Computer{CallStack: &computer.CallStack{}}
+	c.Initialize()
+	c.LoadProgram(p.Object)
+
+	var out strings.Builder
+	err = NewREPL(New(c, p.Symbols), &out).Run(strings.NewReader("break bottom if A == 0\ncontinue\nbt\ndelete\ncontinue\nbacktrace\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"(pep9) #0  0x0019 <bottom> in down, called from 0x0016 <down+12>, stack 0xFB83-0xFB86\n" +
+			"#1  0x0019 <bottom> in down, called from 0x0016 <down+12>, stack 0xFB87-0xFB8A\n" +
+			"#2  0x0019 <bottom> in down, called from 0x0003 <main+3>, stack 0xFB8B-0xFB8E\n" +
+			"#3  0x0006 <main+6>\n(pep9)",
+		"Bad return: stack smashed: RET at 0x0020 returned to 0x0000 but CALL at 0x0006 pushed 0x0009 at 0xFB8D",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out.String(), e) {
+			t.Errorf("Expected %q in\n%s", e, out.String())
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package disasm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"pep9emulator/assembler"
+	"pep9emulator/isa"
+)
+
+// Instruction is one decoded instruction.
+type Instruction struct {
+	Address uint16
+	Bytes   []byte
+	*isa.Instruction
+	Mode    isa.Mode
+	Operand uint16
+}
+
+// Labels names addresses, usually built from an assembler symbol table.
+type Labels map[uint16]string
+
+// LabelsFrom builds the labels for every address symbol in the table.
+// Symbols defined by .EQUATE are constants rather than locations and are
+// left out. When several symbols share an address the first alphabetically
+// is used.
+func LabelsFrom(symbols assembler.SymbolTable) Labels {
+	labels := Labels{}
+	for _, sym := range symbols.Sorted() {
+		if _, ok := labels[sym.Value]; !ok && !sym.Equate {
+			labels[sym.Value] = sym.Name
+		}
+	}
+	return labels
+}
+
+// Decode decodes the instruction at address using the same unary and
+// non-unary split as the processor's fetch. Bytes past the end of mem are
+// read as zero.
+func Decode(mem []byte, address uint16) Instruction {
+	read := func(location uint16) byte {
+		if int(location) < len(mem) {
+			return mem[location]
+		}
+		return 0
+	}
+
+	opcode := read(address)
+	inst, mode := isa.Decode(opcode)
+	i := Instruction{Address: address, Instruction: inst, Mode: mode, Bytes: []byte{opcode}}
+
+	if !inst.IsUnary() { // if OpCode requires an Operand, fetch it
+		hi, lo := read(address+1), read(address+2)
+		i.Operand = uint16(hi)<<8 | uint16(lo)
+		i.Bytes = append(i.Bytes, hi, lo)
+	}
+
+	return i
+}
+
+// Disassemble decodes instructions from start up to and including end.
+func Disassemble(mem []byte, start, end uint16) []Instruction {
+	var insts []Instruction
+
+	for location := int(start); location <= int(end); {
+		inst := Decode(mem, uint16(location))
+		insts = append(insts, inst)
+		location += inst.Size()
+	}
+
+	return insts
+}
+
+// Target returns the destination of a branch or CALL with an immediate
+// operand.
+func (i Instruction) Target() (uint16, bool) {
+	if i.Format == isa.ModeA && i.Mode == isa.Immediate {
+		return i.Operand, true
+	}
+	return 0, false
+}
+
+// Text formats the mnemonic and operand, naming branch targets with labels
+// when one is known. Labels may be nil.
+func (i Instruction) Text(labels Labels) string {
+	if i.IsUnary() {
+		return i.Mnemonic
+	}
+	if target, ok := i.Target(); ok {
+		if name, ok := labels[target]; ok {
+			return fmt.Sprintf("%-8s%s", i.Mnemonic, name)
+		}
+		return fmt.Sprintf("%-8s0x%04X", i.Mnemonic, i.Operand)
+	}
+	return fmt.Sprintf("%-8s0x%04X,%s", i.Mnemonic, i.Operand, i.Mode)
+}
+
+func (i Instruction) String() string {
+	return i.Text(nil)
+}
+
+// Write prints instructions with their address, object code and label in
+// the column layout of an assembler listing.
+func Write(w io.Writer, insts []Instruction, labels Labels) error {
+	bw := bufio.NewWriter(w)
+
+	for _, inst := range insts {
+		label := ""
+		if name, ok := labels[inst.Address]; ok {
+			label = name + ":"
+		}
+		fmt.Fprintf(bw, "%04X  %-6X %-9s%s\n", inst.Address, inst.Bytes, label, inst.Text(labels))
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,63 @@
+package disasm
+
+import (
+	"strings"
+	"testing"
+
+	"pep9emulator/assembler"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		mem      []byte
+		expected string
+	}{
+		{[]byte{0x00}, "STOP"},
+		{[]byte{0x27}, "NOP1"},
+		{[]byte{0xC0, 0x12, 0x34}, "LDWA    0x1234,i"},
+		{[]byte{0xFF, 0x00, 0x02}, "STBX    0x0002,sfx"},
+		{[]byte{0x13, 0x00, 0x10}, "BR      0x0010,x"},
+		{[]byte{0x24, 0xBE, 0xEF}, "CALL    0xBEEF"},
+		{[]byte{0x31, 0x00}, "DECI    0x0000,d"}, // Truncated operand
+	}
+
+	for _, test := range tests {
+		if got := Decode(test.mem, 0).String(); got != test.expected {
+			t.Errorf("Expected %q got %q", test.expected, got)
+		}
+	}
+}
+
+func TestDisassembleWithLabels(t *testing.T) {
+	p, err := assembler.Assemble(`
+main:    LDWA    0,i
+loop:    ADDA    1,i
+         CPWA    limit,i
+         BRLT    loop
+         CALL    sub
+         STOP
+sub:     RET
+limit:   .EQUATE 3
+         .END`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var b strings.Builder
+	insts := Disassemble(p.Object, 0, uint16(len(p.Object)-1))
+	if err := Write(&b, insts, LabelsFrom(p.Symbols)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := `0000  C00000 main:    LDWA    0x0000,i
+0003  600001 loop:    ADDA    0x0001,i
+0006  A00003          CPWA    0x0003,i
+0009  160003          BRLT    loop
+000C  240010          CALL    sub
+000F  00              STOP
+0010  01     sub:     RET
+`
+	if b.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, b.String())
+	}
+}
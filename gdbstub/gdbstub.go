@@ -0,0 +1,433 @@
+// Package gdbstub serves the GDB remote serial protocol so gdb can debug a
+// program running on the emulator.
+//
+// The target has five registers, numbered as in target.xml: a, x, sp and pc
+// of 16 bits each, and nzvc, one byte with N, Z, V and C in bits 3 to 0.
+// Registers and memory are big-endian like Pep/9 itself. gdb is told the
+// register layout through qXfer:features:read.
+package gdbstub
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"pep9emulator/computer"
+	"pep9emulator/debugger"
+)
+
+// TargetXML is the target description sent to gdb.
+//
+//go:embed target.xml
+var TargetXML string
+
+// maxPacket is the largest packet gdb may send, as advertised by qSupported.
+const maxPacket = 0x1000
+
+// Signals reported in stop replies.
+const (
+	sigint  = 0x02 // gdb interrupted a running program
+	sigill  = 0x04 // The program executed an illegal instruction
+	sigtrap = 0x05 // A step, breakpoint or watchpoint finished
+	sigsegv = 0x0b // The program stored into ROM
+)
+
+// watchKey identifies a watchpoint the way gdb inserts and removes it.
+type watchKey struct {
+	kind          computer.WatchKind
+	address, size uint16
+}
+
+// Server is a gdb session on one computer. The computer must not be used
+// elsewhere while Serve runs.
+type Server struct {
+	Computer *computer.Pep9Computer
+
+	debugger    *debugger.Debugger
+	breakpoints map[uint16]*debugger.Breakpoint
+	watches     map[watchKey]*debugger.Watch
+	w           *bufio.Writer
+	noAck       bool
+	last        string // The last stop reply, for "?"
+}
+
+// New creates a server for a computer that is ready to run.
+func New(c *computer.Pep9Computer) *Server {
+	return &Server{
+		Computer:    c,
+		debugger:    debugger.New(c, nil),
+		breakpoints: map[uint16]*debugger.Breakpoint{},
+		watches:     map[watchKey]*debugger.Watch{},
+		last:        stopSignal(sigtrap),
+	}
+}
+
+// ListenAndServe waits for gdb to connect to a TCP address, such as
+// "localhost:1234", and serves that one connection. If ready is not nil it
+// is called with the listening address once connections are accepted.
+func (s *Server) ListenAndServe(address string, ready func(net.Addr)) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if ready != nil {
+		ready(l.Addr())
+	}
+	conn, err := l.Accept()
+	l.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.Serve(conn)
+}
+
+// Serve handles packets from gdb until it detaches, kills the program or
+// closes the connection. Serve reads conn from another goroutine, which
+// stops when conn is closed.
+func (s *Server) Serve(conn io.ReadWriter) error {
+	s.w = bufio.NewWriter(conn)
+	inputs, done := make(chan input), make(chan struct{})
+	defer close(done)
+	go readInputs(conn, inputs, done)
+
+	for in := range inputs {
+		if in.interrupt {
+			continue // Nothing is running
+		}
+		if !s.noAck {
+			ack := byte('+')
+			if !in.valid {
+				ack = '-'
+			}
+			s.w.WriteByte(ack)
+			if err := s.w.Flush(); err != nil {
+				return err
+			}
+			if !in.valid {
+				continue
+			}
+		}
+
+		if in.packet == "k" { // Kill has no reply
+			return s.w.Flush()
+		}
+		reply, last := s.handle(in.packet, inputs)
+		if err := writePacket(s.w, reply); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+	return nil
+}
+
+// handle answers one packet. Packets that resume the program read inputs
+// while it runs, to see interrupts. An empty reply means the packet is not
+// supported.
+func (s *Server) handle(packet string, inputs <-chan input) (reply string, done bool) {
+	if packet == "" {
+		return "", false
+	}
+	c := s.Computer
+	args := packet[1:]
+
+	switch packet[0] {
+	case '?':
+		return s.last, false
+	case 'g':
+		return s.readRegisters(), false
+	case 'G':
+		return s.writeRegisters(args), false
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || n >= numRegisters {
+			return errorReply, false
+		}
+		return encodeRegister(c, int(n)), false
+	case 'P':
+		n, value, ok := strings.Cut(args, "=")
+		r, err := strconv.ParseUint(n, 16, 8)
+		if !ok || err != nil || r >= numRegisters || !decodeRegister(c, int(r), value) {
+			return errorReply, false
+		}
+		return "OK", false
+	case 'm':
+		return s.readMemory(args), false
+	case 'M':
+		return s.writeMemory(args), false
+	case 'X':
+		return s.writeBinary(args), false
+	case 'Z', 'z':
+		return s.point(packet[0] == 'Z', args), false
+	case 'c':
+		if !s.resumeAt(args) {
+			return errorReply, false
+		}
+		return s.resume(s.debugger.Continue, inputs), false
+	case 's':
+		if !s.resumeAt(args) {
+			return errorReply, false
+		}
+		return s.resume(s.step, inputs), false
+	case 'v':
+		return s.vPacket(packet, inputs)
+	case 'q', 'Q':
+		return s.query(packet), false
+	case 'H':
+		return "OK", false // There is only one thread
+	case 'T':
+		return "OK", false // And it is alive
+	case 'D':
+		return "OK", true
+	}
+	return "", false
+}
+
+const errorReply = "E01"
+
+// resumeAt handles the optional address of c and s, where the program
+// resumes.
+func (s *Server) resumeAt(args string) bool {
+	if args == "" {
+		return true
+	}
+	address, err := strconv.ParseUint(args, 16, 16)
+	if err != nil {
+		return false
+	}
+	s.Computer.PC = uint16(address)
+	return true
+}
+
+func (s *Server) step(ctx context.Context) debugger.Stop {
+	return s.debugger.Step(ctx, 1)
+}
+
+// resume runs the program until it stops on its own or gdb interrupts it,
+// and returns the stop reply.
+func (s *Server) resume(run func(ctx context.Context) debugger.Stop, inputs <-chan input) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan debugger.Stop, 1)
+	go func() { stopped <- run(ctx) }()
+
+	for {
+		select {
+		case stop := <-stopped:
+			s.last = s.stopReply(stop)
+			return s.last
+		case in, ok := <-inputs:
+			// Packets other than an interrupt are not expected while the
+			// program runs, and are dropped.
+			if !ok || in.interrupt {
+				cancel()
+				inputs = nil
+			}
+		}
+	}
+}
+
+func (s *Server) stopReply(stop debugger.Stop) string {
+	switch stop.Reason {
+	case debugger.StopHalt:
+		return "W00"
+	case debugger.StopInterrupted:
+		return stopSignal(sigint)
+	case debugger.StopError:
+		if errors.Is(stop.Err, computer.ErrMemoryProtection) {
+			return stopSignal(sigsegv)
+		}
+		return stopSignal(sigill)
+	case debugger.StopWatchpoint:
+		hit := stop.Watches[0]
+		name := map[computer.WatchKind]string{
+			computer.WatchWrite:  "watch",
+			computer.WatchRead:   "rwatch",
+			computer.WatchAccess: "awatch",
+		}[hit.Watchpoint.Kind]
+		return fmt.Sprintf("T%02x%s:%04x;", sigtrap, name, hit.Address)
+	case debugger.StopBreakpoint:
+		return fmt.Sprintf("T%02xswbreak:;", sigtrap)
+	}
+	return stopSignal(sigtrap)
+}
+
+func stopSignal(signal int) string {
+	return fmt.Sprintf("S%02x", signal)
+}
+
+// vPacket handles the v packets, of which vCont is the only one needed.
+func (s *Server) vPacket(packet string, inputs <-chan input) (string, bool) {
+	switch {
+	case packet == "vCont?":
+		return "vCont;c;C;s;S", false
+	case strings.HasPrefix(packet, "vCont;"):
+		// With one thread the first action applies. Signals are ignored.
+		action, _, _ := strings.Cut(packet[len("vCont;"):], ";")
+		action, _, _ = strings.Cut(action, ":")
+		if action == "" {
+			return errorReply, false
+		}
+		switch action[0] {
+		case 'c', 'C':
+			return s.resume(s.debugger.Continue, inputs), false
+		case 's', 'S':
+			return s.resume(s.step, inputs), false
+		}
+		return errorReply, false
+	case packet == "vKill" || strings.HasPrefix(packet, "vKill;"):
+		return "OK", true
+	}
+	return "", false
+}
+
+func (s *Server) query(packet string) string {
+	name, args, _ := strings.Cut(packet, ":")
+	switch name {
+	case "qSupported":
+		return fmt.Sprintf("PacketSize=%x;qXfer:features:read+;QStartNoAckMode+;swbreak+;vContSupported+", maxPacket)
+	case "QStartNoAckMode":
+		s.noAck = true
+		return "OK"
+	case "qAttached":
+		return "1"
+	case "qC":
+		return "QC1"
+	case "qfThreadInfo":
+		return "m1"
+	case "qsThreadInfo":
+		return "l"
+	case "qXfer":
+		return s.features(args)
+	}
+	return ""
+}
+
+// features serves target.xml for qXfer:features:read:target.xml:offset,length.
+func (s *Server) features(args string) string {
+	object, rest, _ := strings.Cut(args, ":")
+	op, rest, _ := strings.Cut(rest, ":")
+	annex, span, _ := strings.Cut(rest, ":")
+	if object != "features" || op != "read" {
+		return ""
+	}
+	if annex != "target.xml" {
+		return "E00"
+	}
+	offset, length, ok := parseSpan(span)
+	if !ok {
+		return errorReply
+	}
+	if offset >= len(TargetXML) {
+		return "l"
+	}
+	if end := offset + length; end < len(TargetXML) {
+		return "m" + TargetXML[offset:end]
+	}
+	return "l" + TargetXML[offset:]
+}
+
+// parseSpan parses the "addr,length" that memory and qXfer packets share.
+func parseSpan(text string) (start, length int, ok bool) {
+	a, l, found := strings.Cut(text, ",")
+	s, err1 := strconv.ParseUint(a, 16, 32)
+	n, err2 := strconv.ParseUint(l, 16, 32)
+	if !found || err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return int(s), int(n), true
+}
+
+// memorySpan parses addr,length and checks it lies within memory.
+func memorySpan(text string) (start, length int, ok bool) {
+	start, length, ok = parseSpan(text)
+	if !ok || start+length > 0x10000 {
+		return 0, 0, false
+	}
+	return start, length, true
+}
+
+// readMemory reads RAM directly, so gdb looking at memory never consumes
+// device input or triggers watchpoints.
+func (s *Server) readMemory(args string) string {
+	start, length, ok := memorySpan(args)
+	if !ok {
+		return errorReply
+	}
+	return fmt.Sprintf("%x", s.Computer.Ram[start:start+length])
+}
+
+func (s *Server) writeMemory(args string) string {
+	span, data, found := strings.Cut(args, ":")
+	start, length, ok := memorySpan(span)
+	if !found || !ok || len(data) != 2*length {
+		return errorReply
+	}
+	for i := 0; i < length; i++ {
+		b, err := strconv.ParseUint(data[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return errorReply
+		}
+		s.Computer.Ram[start+i] = uint8(b)
+	}
+	return "OK"
+}
+
+func (s *Server) writeBinary(args string) string {
+	span, data, found := strings.Cut(args, ":")
+	start, length, ok := memorySpan(span)
+	if !found || !ok || len(data) != length {
+		return errorReply
+	}
+	copy(s.Computer.Ram[start:], data)
+	return "OK"
+}
+
+// point inserts or removes a breakpoint or watchpoint: Z0/Z1 are software
+// and hardware breakpoints, which are the same here, and Z2, Z3 and Z4 are
+// write, read and access watchpoints.
+func (s *Server) point(insert bool, args string) string {
+	kind, span, _ := strings.Cut(args, ",")
+	address, size, ok := memorySpan(span)
+	if !ok {
+		return errorReply
+	}
+
+	switch kind {
+	case "0", "1":
+		bp, exists := s.breakpoints[uint16(address)]
+		switch {
+		case insert && !exists:
+			s.breakpoints[uint16(address)] = s.debugger.Break(uint16(address))
+		case !insert && exists:
+			s.debugger.Delete(bp.ID)
+			delete(s.breakpoints, uint16(address))
+		}
+		return "OK"
+	case "2", "3", "4":
+		if size == 0 {
+			return errorReply
+		}
+		key := watchKey{[...]computer.WatchKind{computer.WatchWrite, computer.WatchRead, computer.WatchAccess}[kind[0]-'2'],
+			uint16(address), uint16(size)}
+		w, exists := s.watches[key]
+		switch {
+		case insert && !exists:
+			r := computer.AddressRange{Start: key.address, End: key.address + key.size - 1}
+			s.watches[key] = s.debugger.Watch(r, key.kind)
+		case !insert && exists:
+			s.debugger.Delete(w.ID)
+			delete(s.watches, key)
+		}
+		return "OK"
+	}
+	return ""
+}
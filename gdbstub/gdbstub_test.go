@@ -0,0 +1,198 @@
+package gdbstub
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"pep9emulator/assembler"
+	"pep9emulator/computer"
+)
+
+const program = `
+main:    LDWA    3,i
+         STWA    -2,s
+         SUBSP   2,i
+         CALL    double
+         ADDSP   2,i
+         STWA    result,d
+         STOP
+double:  LDWA    2,s
+         ASLA
+         RET
+result:  .BLOCK  2
+         .END`
+
+// client is the gdb end of a connection.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	ack  bool
+	done chan error
+}
+
+func connect(t *testing.T, source string) (*client, *assembler.Program) {
+	t.Helper()
+	p, err := assembler.Assemble(source)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c := &computer.Pep9Computer{}
+	c.Initialize()
+	c.LoadProgram(p.Object)
+
+	server, conn := net.Pipe()
+	cl := &client{t: t, conn: conn, r: bufio.NewReader(conn), ack: true, done: make(chan error, 1)}
+	go func() { cl.done <- New(c).Serve(server) }()
+	t.Cleanup(func() { conn.Close(); server.Close() })
+	return cl, p
+}
+
+func (c *client) send(packet string) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, "$%s#%02x", packet, checksum(packet)); err != nil {
+		c.t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.ack {
+		if b, err := c.r.ReadByte(); err != nil || b != '+' {
+			c.t.Fatalf("Expected an ack for %q but got %q, %v", packet, b, err)
+		}
+	}
+}
+
+func (c *client) reply() string {
+	c.t.Helper()
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatalf("Unexpected error: %v", err)
+	}
+	body, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatalf("Unexpected error: %v", err)
+	}
+	body = body[:len(body)-1]
+	var sum [2]byte
+	c.r.Read(sum[:])
+	if fmt.Sprintf("%02x", checksum(body)) != string(sum[:]) {
+		c.t.Errorf("Bad checksum %s for %q", sum, body)
+	}
+	return unescape(body)
+}
+
+func (c *client) call(packet string) string {
+	c.t.Helper()
+	c.send(packet)
+	return c.reply()
+}
+
+func (c *client) expect(packet, reply string) {
+	c.t.Helper()
+	if got := c.call(packet); got != reply {
+		c.t.Errorf("%s: expected %q but got %q", packet, reply, got)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	c, _ := connect(t, program)
+
+	if reply := c.call("qSupported:multiprocess+;swbreak+"); !strings.Contains(reply, "qXfer:features:read+") {
+		t.Errorf("Expected target descriptions to be supported but got %q", reply)
+	}
+	c.expect("QStartNoAckMode", "OK")
+	c.ack = false
+	c.expect("vMustReplyEmpty", "")
+	c.expect("?", "S05")
+	c.expect("qAttached", "1")
+
+	var xml strings.Builder
+	for {
+		reply := c.call(fmt.Sprintf("qXfer:features:read:target.xml:%x,40", xml.Len()))
+		xml.WriteString(reply[1:])
+		if reply[0] == 'l' {
+			break
+		}
+	}
+	if xml.String() != TargetXML {
+		t.Errorf("Expected target.xml but got %q", xml.String())
+	}
+	c.expect("qXfer:features:read:other.xml:0,40", "E00")
+}
+
+func TestRegistersAndMemory(t *testing.T) {
+	c, _ := connect(t, program)
+
+	c.expect("g", "00000000fb8f000000")
+	c.expect("P0=fffe", "OK")
+	c.expect("P4=09", "OK")
+	c.expect("p0", "fffe")
+	c.expect("g", "fffe0000fb8f000009")
+	c.expect("G00010002fb8b00100f", "OK")
+	c.expect("g", "00010002fb8b00100f")
+	c.expect("p5", "E01")
+
+	c.expect("m0,3", "c00003")
+	c.expect("M100,2:1234", "OK")
+	c.expect("m100,2", "1234")
+	c.expect("X102,2:}\x03}\x04", "OK")
+	c.expect("m102,2", "2324")
+	c.expect("mffff,2", "E01")
+}
+
+func TestBreakpointAndStep(t *testing.T) {
+	c, p := connect(t, program)
+	double := p.Symbols["double"].Value
+
+	c.expect(fmt.Sprintf("Z0,%x,1", double), "OK")
+	c.expect("c", "T05swbreak:;")
+	c.expect("p3", fmt.Sprintf("%04x", double))
+	c.expect("s", "S05")
+	c.expect("p0", "0003")
+	c.expect(fmt.Sprintf("z0,%x,1", double), "OK")
+	c.expect("vCont?", "vCont;c;C;s;S")
+	c.expect("vCont;s:1", "S05")
+	c.expect("p0", "0006")
+	c.expect("vCont;c", "W00")
+	c.expect("?", "W00")
+}
+
+func TestWatchpoint(t *testing.T) {
+	c, p := connect(t, program)
+	result := p.Symbols["result"].Value
+
+	c.expect(fmt.Sprintf("Z2,%x,2", result), "OK")
+	c.expect("c", fmt.Sprintf("T05watch:%04x;", result))
+	c.expect(fmt.Sprintf("m%x,2", result), "0006")
+	c.expect(fmt.Sprintf("z2,%x,2", result), "OK")
+	c.expect("c", "W00")
+}
+
+func TestInterrupt(t *testing.T) {
+	c, _ := connect(t, "loop: BR loop\n .END")
+
+	c.send("c")
+	c.conn.Write([]byte{interrupt})
+	if reply := c.reply(); reply != "S02" {
+		t.Errorf("Expected an interrupt but got %q", reply)
+	}
+	c.expect("?", "S02")
+}
+
+func TestIllegalInstruction(t *testing.T) {
+	c, _ := connect(t, "main: .BYTE 0xE0 ;STWA immediate\n .WORD 0\n .END")
+	c.expect("c", "S04")
+}
+
+func TestChecksumAndDetach(t *testing.T) {
+	c, _ := connect(t, program)
+
+	c.conn.Write([]byte("$g#00"))
+	if b, _ := c.r.ReadByte(); b != '-' {
+		t.Errorf("Expected a bad checksum to be refused but got %q", b)
+	}
+	c.expect("D", "OK")
+	if err := <-c.done; err != nil {
+		t.Errorf("Expected detach to end the session but got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package gdbstub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// interrupt is the byte gdb sends, outside any packet, to stop a running
+// target.
+const interrupt = 0x03
+
+// input is one thing received from gdb: a packet, or an interrupt.
+type input struct {
+	packet    string
+	valid     bool // The checksum matched
+	interrupt bool
+}
+
+// readInputs reads from gdb until an error or done is closed, sending
+// everything received except acknowledgements. It closes inputs when it
+// returns.
+func readInputs(r io.Reader, inputs chan<- input, done <-chan struct{}) {
+	defer close(inputs)
+	br := bufio.NewReader(r)
+
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return
+		}
+		var in input
+		switch b {
+		case interrupt:
+			in.interrupt = true
+		case '$':
+			if in, err = readPacket(br); err != nil {
+				return
+			}
+		default:
+			// Acknowledgements are dropped, and so is anything between
+			// packets. Nothing is retransmitted on a reliable connection.
+			continue
+		}
+		select {
+		case inputs <- in:
+		case <-done:
+			return
+		}
+	}
+}
+
+// readPacket reads the body of a packet after its '$'.
+func readPacket(br *bufio.Reader) (input, error) {
+	body, err := br.ReadString('#')
+	if err != nil {
+		return input{}, err
+	}
+	body = body[:len(body)-1]
+
+	var sum [2]byte
+	if _, err := io.ReadFull(br, sum[:]); err != nil {
+		return input{}, err
+	}
+	var expected uint8
+	_, err = fmt.Sscanf(string(sum[:]), "%02x", &expected)
+	return input{packet: unescape(body), valid: err == nil && checksum(body) == expected}, nil
+}
+
+// unescape removes the binary escapes gdb uses in packets such as X, where
+// '}' is followed by the escaped byte XOR 0x20.
+func unescape(body string) string {
+	out := make([]byte, 0, len(body))
+	for i := 0; i < len(body); i++ {
+		if body[i] == '}' && i+1 < len(body) {
+			i++
+			out = append(out, body[i]^0x20)
+		} else {
+			out = append(out, body[i])
+		}
+	}
+	return string(out)
+}
+
+func checksum(body string) uint8 {
+	var sum uint8
+	for i := 0; i < len(body); i++ {
+		sum += body[i]
+	}
+	return sum
+}
+
+// writePacket frames a reply, escaping the characters that would end it.
+func writePacket(w *bufio.Writer, body string) error {
+	var escaped []byte
+	for i := 0; i < len(body); i++ {
+		switch b := body[i]; b {
+		case '$', '#', '}', '*':
+			escaped = append(escaped, '}', b^0x20)
+		default:
+			escaped = append(escaped, b)
+		}
+	}
+	fmt.Fprintf(w, "$%s#%02x", escaped, checksum(string(escaped)))
+	return w.Flush()
+}
@@ -0,0 +1,96 @@
+package gdbstub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"pep9emulator/computer"
+)
+
+// numRegisters is the number of registers in target.xml.
+const numRegisters = 5
+
+// registerSizes is the size in bytes of each register.
+var registerSizes = [numRegisters]int{2, 2, 2, 2, 1}
+
+// Bits of the nzvc register.
+const (
+	flagC = 1 << iota
+	flagV
+	flagZ
+	flagN
+)
+
+func (s *Server) readRegisters() string {
+	var b strings.Builder
+	for n := 0; n < numRegisters; n++ {
+		b.WriteString(encodeRegister(s.Computer, n))
+	}
+	return b.String()
+}
+
+func (s *Server) writeRegisters(data string) string {
+	for n := 0; n < numRegisters; n++ {
+		width := 2 * registerSizes[n]
+		if len(data) < width || !decodeRegister(s.Computer, n, data[:width]) {
+			return errorReply
+		}
+		data = data[width:]
+	}
+	return "OK"
+}
+
+// encodeRegister formats a register as big-endian hex.
+func encodeRegister(c *computer.Pep9Computer, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%04x", c.A)
+	case 1:
+		return fmt.Sprintf("%04x", c.X)
+	case 2:
+		return fmt.Sprintf("%04x", c.SP)
+	case 3:
+		return fmt.Sprintf("%04x", c.PC)
+	}
+
+	var flags uint8
+	for _, f := range []struct {
+		set bool
+		bit uint8
+	}{{c.N, flagN}, {c.Z, flagZ}, {c.V, flagV}, {c.C, flagC}} {
+		if f.set {
+			flags |= f.bit
+		}
+	}
+	return fmt.Sprintf("%02x", flags)
+}
+
+// decodeRegister sets a register from big-endian hex, reporting whether the
+// value was valid.
+func decodeRegister(c *computer.Pep9Computer, n int, hex string) bool {
+	if len(hex) != 2*registerSizes[n] {
+		return false
+	}
+	value, err := strconv.ParseUint(hex, 16, 16)
+	if err != nil {
+		return false
+	}
+
+	switch n {
+	case 0:
+		c.A = uint16(value)
+	case 1:
+		c.X = uint16(value)
+	case 2:
+		c.SP = uint16(value)
+	case 3:
+		c.PC = uint16(value)
+	default:
+		c.N = value&flagN != 0
+		c.Z = value&flagZ != 0
+		c.V = value&flagV != 0
+		c.C = value&flagC != 0
+	}
+	return true
+}
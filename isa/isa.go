@@ -0,0 +1,213 @@
+package isa
+
+import "strings"
+
+// Mode is a Pep/9 addressing mode. The value is the aaa field of the
+// instruction specifier.
+type Mode uint8
+
+const (
+	Immediate            Mode = iota // i
+	Direct                           // d
+	Indirect                         // n
+	StackRelative                    // s
+	StackDeferred                    // sf
+	Indexed                          // x
+	StackIndexed                     // sx
+	StackDeferredIndexed             // sfx
+)
+
+var modeNames = [...]string{"i", "d", "n", "s", "sf", "x", "sx", "sfx"}
+
+func (m Mode) String() string {
+	if int(m) < len(modeNames) {
+		return modeNames[m]
+	}
+	return "?"
+}
+
+// ParseMode returns the addressing mode for a suffix such as "sfx".
+func ParseMode(s string) (Mode, bool) {
+	s = strings.ToLower(s)
+	for i, name := range modeNames {
+		if name == s {
+			return Mode(i), true
+		}
+	}
+	return 0, false
+}
+
+// ModeSet is a bit set of the addressing modes an instruction accepts.
+type ModeSet uint8
+
+const (
+	AllModes ModeSet = 0xFF
+	// BranchModes are the modes of the one bit 'a' field.
+	BranchModes ModeSet = 1<<Immediate | 1<<Indexed
+	// StoreModes excludes immediate, which has nowhere to store to.
+	StoreModes ModeSet = AllModes &^ (1 << Immediate)
+	StroModes  ModeSet = 1<<Direct | 1<<Indirect | 1<<StackRelative | 1<<StackDeferred | 1<<Indexed
+)
+
+func (s ModeSet) Has(m Mode) bool {
+	return s&(1<<m) != 0
+}
+
+// Format describes how the addressing mode is encoded in the instruction
+// specifier.
+type Format uint8
+
+const (
+	Unary   Format = iota // No operand, one byte.
+	ModeA                 // One bit addressing mode field (i or x).
+	ModeAAA               // Three bit addressing mode field.
+)
+
+type Instruction struct {
+	Mnemonic string
+	Opcode   uint8 // Instruction specifier with a zeroed mode field
+	Format   Format
+	Modes    ModeSet
+}
+
+// Size is the number of bytes the instruction occupies in memory.
+func (i *Instruction) Size() int {
+	if i.Format == Unary {
+		return 1
+	}
+	return 3
+}
+
+// IsUnary reports whether the instruction has no operand specifier.
+func (i *Instruction) IsUnary() bool {
+	return i.Format == Unary
+}
+
+// Encode returns the instruction specifier for the given addressing mode.
+func (i *Instruction) Encode(m Mode) uint8 {
+	switch i.Format {
+	case ModeA:
+		if m == Indexed {
+			return i.Opcode | 0x01
+		}
+		return i.Opcode
+	case ModeAAA:
+		return i.Opcode | uint8(m)
+	}
+	return i.Opcode
+}
+
+var Instructions = []*Instruction{
+	{"STOP", 0x00, Unary, 0},
+	{"RET", 0x01, Unary, 0},
+	{"RETTR", 0x02, Unary, 0},
+	{"MOVSPA", 0x03, Unary, 0},
+	{"MOVFLGA", 0x04, Unary, 0},
+	{"MOVAFLG", 0x05, Unary, 0},
+	{"NOTA", 0x06, Unary, 0},
+	{"NOTX", 0x07, Unary, 0},
+	{"NEGA", 0x08, Unary, 0},
+	{"NEGX", 0x09, Unary, 0},
+	{"ASLA", 0x0A, Unary, 0},
+	{"ASLX", 0x0B, Unary, 0},
+	{"ASRA", 0x0C, Unary, 0},
+	{"ASRX", 0x0D, Unary, 0},
+	{"ROLA", 0x0E, Unary, 0},
+	{"ROLX", 0x0F, Unary, 0},
+	{"RORA", 0x10, Unary, 0},
+	{"RORX", 0x11, Unary, 0},
+	{"BR", 0x12, ModeA, BranchModes},
+	{"BRLE", 0x14, ModeA, BranchModes},
+	{"BRLT", 0x16, ModeA, BranchModes},
+	{"BREQ", 0x18, ModeA, BranchModes},
+	{"BRNE", 0x1A, ModeA, BranchModes},
+	{"BRGE", 0x1C, ModeA, BranchModes},
+	{"BRGT", 0x1E, ModeA, BranchModes},
+	{"BRV", 0x20, ModeA, BranchModes},
+	{"BRC", 0x22, ModeA, BranchModes},
+	{"CALL", 0x24, ModeA, BranchModes},
+	{"NOP0", 0x26, Unary, 0},
+	{"NOP1", 0x27, Unary, 0},
+	{"NOP", 0x28, ModeAAA, 1 << Immediate},
+	{"DECI", 0x30, ModeAAA, StoreModes},
+	{"DECO", 0x38, ModeAAA, AllModes},
+	{"HEXO", 0x40, ModeAAA, AllModes},
+	{"STRO", 0x48, ModeAAA, StroModes},
+	{"ADDSP", 0x50, ModeAAA, AllModes},
+	{"SUBSP", 0x58, ModeAAA, AllModes},
+	{"ADDA", 0x60, ModeAAA, AllModes},
+	{"ADDX", 0x68, ModeAAA, AllModes},
+	{"SUBA", 0x70, ModeAAA, AllModes},
+	{"SUBX", 0x78, ModeAAA, AllModes},
+	{"ANDA", 0x80, ModeAAA, AllModes},
+	{"ANDX", 0x88, ModeAAA, AllModes},
+	{"ORA", 0x90, ModeAAA, AllModes},
+	{"ORX", 0x98, ModeAAA, AllModes},
+	{"CPWA", 0xA0, ModeAAA, AllModes},
+	{"CPWX", 0xA8, ModeAAA, AllModes},
+	{"CPBA", 0xB0, ModeAAA, AllModes},
+	{"CPBX", 0xB8, ModeAAA, AllModes},
+	{"LDWA", 0xC0, ModeAAA, AllModes},
+	{"LDWX", 0xC8, ModeAAA, AllModes},
+	{"LDBA", 0xD0, ModeAAA, AllModes},
+	{"LDBX", 0xD8, ModeAAA, AllModes},
+	{"STWA", 0xE0, ModeAAA, StoreModes},
+	{"STWX", 0xE8, ModeAAA, StoreModes},
+	{"STBA", 0xF0, ModeAAA, StoreModes},
+	{"STBX", 0xF8, ModeAAA, StoreModes},
+}
+
+var (
+	byMnemonic = map[string]*Instruction{}
+	byOpcode   [256]*Instruction
+)
+
+func init() {
+	for _, inst := range Instructions {
+		byMnemonic[inst.Mnemonic] = inst
+		switch inst.Format {
+		case Unary:
+			byOpcode[inst.Opcode] = inst
+		case ModeA:
+			byOpcode[inst.Opcode] = inst
+			byOpcode[inst.Opcode|0x01] = inst
+		case ModeAAA:
+			for m := 0; m < 8; m++ {
+				byOpcode[int(inst.Opcode)+m] = inst
+			}
+		}
+	}
+}
+
+// Lookup finds an instruction by its (case insensitive) mnemonic.
+func Lookup(mnemonic string) (*Instruction, bool) {
+	inst, ok := byMnemonic[strings.ToUpper(mnemonic)]
+	return inst, ok
+}
+
+// Decode returns the instruction and addressing mode encoded by an
+// instruction specifier. Every one of the 256 specifiers decodes in Pep/9.
+func Decode(opcode uint8) (*Instruction, Mode) {
+	inst := byOpcode[opcode]
+	switch inst.Format {
+	case ModeA:
+		if opcode&0x01 != 0 {
+			return inst, Indexed
+		}
+		return inst, Immediate
+	case ModeAAA:
+		return inst, Mode(opcode & 0x07)
+	}
+	return inst, Immediate
+}
+
+// IsUnary reports whether an instruction specifier is a one byte instruction.
+func IsUnary(opcode uint8) bool {
+	return byOpcode[opcode].Format == Unary
+}
+
+// IsTrap reports whether an instruction specifier is serviced by the
+// operating system trap handler.
+func IsTrap(opcode uint8) bool {
+	return opcode >= 0x26 && opcode < 0x50
+}
@@ -0,0 +1,35 @@
+package isa
+
+import "testing"
+
+func TestDecodeEveryOpcode(t *testing.T) {
+	for op := 0; op < 256; op++ {
+		inst, mode := Decode(uint8(op))
+		if inst == nil {
+			t.Fatalf("Expected opcode 0x%02X to decode", op)
+		}
+		if inst.Encode(mode) != uint8(op) {
+			t.Errorf("Expected %s,%s to encode to 0x%02X got 0x%02X", inst.Mnemonic, mode, op, inst.Encode(mode))
+		}
+	}
+}
+
+func TestIsUnary(t *testing.T) {
+	for op := 0; op < 256; op++ {
+		expected := op < 0x12 || op == 0x26 || op == 0x27
+		if IsUnary(uint8(op)) != expected {
+			t.Errorf("Expected IsUnary(0x%02X) to be %t", op, expected)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	mode, ok := ParseMode("SFX")
+	if !ok || mode != StackDeferredIndexed {
+		t.Errorf("Expected sfx got %s", mode)
+	}
+
+	if _, ok := ParseMode("q"); ok {
+		t.Error("Expected q to be an invalid addressing mode")
+	}
+}
@@ -0,0 +1,335 @@
+package microcode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"pep9emulator/assembler"
+	"pep9emulator/computer"
+)
+
+// buses are the data buses every program is run on.
+var buses = []Bus{OneByte, TwoByte}
+
+// timings are the models of the buses in package computer, which must count
+// the same cycles as the microcode.
+var timings = map[Bus]*computer.Timing{OneByte: computer.OneByteBus, TwoByte: computer.TwoByteBus}
+
+// run assembles source and runs it on a Pep9Computer and on the microcode
+// computer with the same input, failing unless both end in the same state
+// after the same number of cycles.
+func run(t *testing.T, bus Bus, source, input string) (*computer.Pep9Computer, *Computer) {
+	t.Helper()
+	program, err := assembler.Assemble(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want, got bytes.Buffer
+	p := &computer.Pep9Computer{Timing: timings[bus]}
+	p.CharIn.Reader = strings.NewReader(input)
+	p.CharOut.Writer = &want
+	p.Initialize()
+	p.LoadProgram(program.Object)
+	wantErr := p.Run(context.Background(), 100000)
+
+	c := New(bus)
+	c.CharIn.Reader = strings.NewReader(input)
+	c.CharOut.Writer = &got
+	c.Initialize()
+	c.LoadProgram(program.Object)
+	gotErr := c.Run(context.Background(), 100000)
+
+	if fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+		t.Errorf("error %v, Pep9Computer %v", gotErr, wantErr)
+	}
+	same(t, p, c)
+	if c.Cycles != p.Cycles {
+		t.Errorf("%d cycles, Pep9Computer %d", c.Cycles, p.Cycles)
+	}
+	if got.String() != want.String() {
+		t.Errorf("output %q, Pep9Computer %q", got.String(), want.String())
+	}
+	return p, c
+}
+
+// same fails unless the registers and memory of both computers match.
+func same(t *testing.T, p *computer.Pep9Computer, c *Computer) {
+	t.Helper()
+	if got := c.Processor(); got != p.Processor {
+		t.Errorf("processor %+v, Pep9Computer %+v", got, p.Processor)
+	}
+	if c.Ram != p.Ram {
+		for i := range c.Ram {
+			if c.Ram[i] != p.Ram[i] {
+				t.Errorf("memory at 0x%04X is 0x%02X, Pep9Computer 0x%02X", i, c.Ram[i], p.Ram[i])
+				break
+			}
+		}
+	}
+}
+
+func TestPrograms(t *testing.T) {
+	tests := []struct {
+		name, source, input string
+	}{
+		{"sum", `
+         LDWX    0,i
+         LDWA    0,i
+loop:    ADDA    table,x
+         ADDX    2,i
+         CPWX    8,i
+         BRNE    loop
+         STWA    sum,d
+         STOP
+table:   .WORD   1
+         .WORD   -2
+         .WORD   0x7FFF
+         .WORD   40
+sum:     .BLOCK  2
+         .END`, ""},
+		{"call", `
+         SUBSP   4,i         ;push #a #b
+         LDWA    7,i
+         STWA    0,s
+         LDWA    -3,i
+         STWA    2,s
+         CALL    mul
+         ADDSP   4,i
+         STWA    result,d
+         STOP
+; A = 0,s * 2,s by repeated addition, with the stack frame below the return address
+mul:     LDWA    0,i
+         LDWX    4,s
+         BREQ    done
+next:    ADDA    2,s
+         SUBX    1,i
+         BRNE    next
+done:    RET
+result:  .BLOCK  2
+         .END`, ""},
+		{"modes", `
+         LDWX    2,i
+         LDWA    ptr,n
+         LDBA    ptr,n
+         SUBSP   4,i
+         LDWA    ptr,d
+         STWA    0,s
+         LDWA    0,sf
+         LDWA    0,sfx
+         LDBA    0,sx
+         STBA    1,sfx
+         STWA    vec,x
+         CPBA    0x41,i
+         BRGT    over
+         NOTA
+over:    MOVSPA
+         MOVFLGA
+         ORA     0x0100,i
+         ANDA    0x0F0F,i
+         NEGA
+         ASLA
+         ASRA
+         ROLA
+         RORA
+         NEGX
+         ASRX
+         MOVAFLG
+         STOP
+ptr:     .ADDRSS words
+words:   .WORD   0x8001
+         .WORD   0x41FF
+vec:     .BLOCK  4
+         .END`, ""},
+		{"branches", `
+         LDWA    -1,i
+         BRLT    lt
+         STOP
+lt:      BRLE    le
+         STOP
+le:      LDWX    jumps,i
+         LDWX    2,i
+         BR      jumps,x
+         STOP
+ge:      BRGE    1,i
+         BRV     1,i
+         BRC     1,i
+         CPWA    0x7FFF,i
+         BRV     v
+         STOP
+v:       CALL    subs,x
+         STOP
+subs:    .ADDRSS sub
+sub:     ADDA    1,i
+         RET
+jumps:   .WORD   0
+         .ADDRSS ge
+         .END`, ""},
+		{"traps", `
+         DECI    num,d
+         DECI    num2,d
+         LDWA    num,d
+         ADDA    num2,d
+         STWA    num,d
+         DECO    num,d
+         LDBA    '\n',i
+         STBA    0xFC16,d
+         HEXO    num,d
+         STRO    msg,d
+         NOP0
+         LDBA    0xFC15,d
+         STBA    0xFC16,d
+         STOP
+num:     .BLOCK  2
+num2:    .BLOCK  2
+msg:     .ASCII  " done\x00"
+         .END`, "123 -200 x"},
+		{"protected", `
+         LDWA    0x1234,i
+         STWA    0xFFFE,d
+         STOP
+         .END`, ""},
+		{"illegal mode", `
+         LDWA    0x1234,i
+         .BYTE   0xE0        ;STWA immediate
+         .WORD   0
+         STOP
+         .END`, ""},
+	}
+	for _, test := range tests {
+		for _, bus := range buses {
+			t.Run(test.name+"/"+bus.String(), func(t *testing.T) {
+				run(t, bus, test.source, test.input)
+			})
+		}
+	}
+}
+
+// TestEveryInstruction runs each instruction specifier from many random
+// states, at even and odd addresses, comparing the microcode with
+// Pep9Computer and its cycles with the bus timing after each one.
+func TestEveryInstruction(t *testing.T) {
+	for _, bus := range buses {
+		t.Run(bus.String(), func(t *testing.T) {
+			everyInstruction(t, bus)
+		})
+	}
+}
+
+func everyInstruction(t *testing.T, bus Bus) {
+	const trials = 12
+	random := rand.New(rand.NewSource(9))
+	p := &computer.Pep9Computer{Timing: timings[bus]}
+	c := New(bus)
+	p.Initialize()
+	c.Initialize()
+
+	for opcode := 0; opcode < 256; opcode++ {
+		for trial := 0; trial < trials; trial++ {
+			window := make([]byte, 0x400)
+			random.Read(window)
+			pc := uint16(trial / 2 % 2)
+			window[pc] = uint8(opcode)
+
+			state := computer.Processor{}
+			state.PC = pc
+			state.A = uint16(random.Intn(0x10000))
+			state.X = uint16(random.Intn(0x10000))
+			state.SP = uint16(0x0200 + random.Intn(0x100))
+			state.N, state.Z, state.V, state.C = random.Intn(2) == 0, random.Intn(2) == 0, random.Intn(2) == 0, random.Intn(2) == 0
+			if trial%2 == 0 { // Keep most addresses inside the window
+				state.X &= 0x00FF
+				window[pc+1], window[pc+2] = 0, uint8(random.Intn(0x100))
+			}
+
+			p.Initialize()
+			c.Initialize()
+			copy(p.Ram[:], window)
+			copy(c.Ram[:], window)
+			p.Processor = state
+			c.SetProcessor(state)
+
+			before := p.Cycles
+			_, wantErr := p.Step()
+			gotErr := c.Step()
+			if fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+				t.Errorf("opcode 0x%02X from %+v: error %v, Pep9Computer %v", opcode, state, gotErr, wantErr)
+			}
+			if got := c.Processor(); got != p.Processor || c.Ram != p.Ram {
+				t.Errorf("opcode 0x%02X from %+v", opcode, state)
+				same(t, p, c)
+			}
+			if p.Cycles-before != c.Cycles {
+				t.Errorf("opcode 0x%02X from %+v: %d cycles, Pep9Computer %d", opcode, state, c.Cycles, p.Cycles-before)
+			}
+		}
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	c := New(OneByte)
+	c.Initialize()
+	c.LoadProgram([]byte{0x12, 0x00, 0x00}) // BR 0
+	err := c.Run(context.Background(), 10)
+	if err == nil || !strings.Contains(err.Error(), computer.ErrStepLimit.Error()) {
+		t.Errorf("got %v, want a step limit", err)
+	}
+}
+
+func TestCyclesPerInstruction(t *testing.T) {
+	// A unary fetch is 4 cycles on either bus. A nonunary one is 10 on the
+	// one-byte bus, and 8 on the two-byte bus from an odd address, where the
+	// operand specifier is a whole word.
+	tests := map[Bus][]uint64{
+		OneByte: {4 + 2, 10 + 2, 4 + 1},
+		TwoByte: {4 + 2, 8 + 2, 4 + 1},
+	}
+	for bus, want := range tests {
+		c := New(bus)
+		c.Initialize()
+		c.LoadProgram([]byte{0x06, 0xC0, 0x12, 0x34, 0x00}) // NOTA; LDWA 0x1234,i; STOP
+
+		var cycles []uint64
+		for !c.HALT {
+			before := c.Cycles
+			if err := c.Step(); err != nil {
+				t.Fatal(err)
+			}
+			cycles = append(cycles, c.Cycles-before)
+		}
+		if fmt.Sprint(cycles) != fmt.Sprint(want) {
+			t.Errorf("%v bus: cycles %v, want %v", bus, cycles, want)
+		}
+		if got := c.Word(RegA); got != 0x1234 {
+			t.Errorf("%v bus: A = 0x%04X", bus, got)
+		}
+	}
+}
+
+// TestBusCycles runs the same program on both buses, which must agree with
+// Pep9Computer, and checks the two-byte bus takes fewer cycles.
+func TestBusCycles(t *testing.T) {
+	source := `
+         LDWX    0,i
+loop:    LDWA    from,x
+         STWA    to,x
+         ADDX    2,i
+         CPWX    16,i
+         BRLT    loop
+         STOP
+from:    .BLOCK  16
+to:      .BLOCK  16
+         .END`
+	cycles := map[Bus]uint64{}
+	for _, bus := range buses {
+		_, c := run(t, bus, source, "")
+		cycles[bus] = c.Cycles
+	}
+	if cycles[TwoByte] >= cycles[OneByte] {
+		t.Errorf("two-byte bus %d cycles, one-byte bus %d", cycles[TwoByte], cycles[OneByte])
+	}
+}
@@ -0,0 +1,237 @@
+package microcode
+
+import (
+	"context"
+	"fmt"
+
+	"pep9emulator/computer"
+	"pep9emulator/isa"
+)
+
+// Branch selects the microinstruction that follows a cycle. Conditions are
+// tested after the cycle's clocks, so a microinstruction can branch on the
+// status bits it sets.
+type Branch uint8
+
+const (
+	Next     Branch = iota // The following microinstruction
+	Goto                   // Target
+	IfN                    // Target when N is set, otherwise the following
+	IfZ                    // Target when Z is set, otherwise the following
+	IfV                    // Target when V is set, otherwise the following
+	IfC                    // Target when C is set, otherwise the following
+	IfS                    // Target when S is set, otherwise the following
+	IfMAROdd               // Target when MAR holds an odd address, otherwise the following
+	IfUnary                // Decode when IR holds a unary instruction, otherwise the following
+	Decode                 // The routine for the instruction specifier in IR, from Program.Decode
+	Execute                // The routine executing the instruction in IR, from Program.Execute
+	End                    // The instruction is done, fetch the next from 0
+	Stop                   // Halt
+)
+
+var branchNames = [...]string{"", "goto", "if N", "if Z", "if V", "if C", "if S", "if MAR odd", "if unary", "decode", "execute", "end", "stop"}
+
+func (b Branch) String() string {
+	if int(b) < len(branchNames) {
+		return branchNames[b]
+	}
+	return fmt.Sprintf("Branch(%d)", int(b))
+}
+
+// Microinstruction is one word of the control store: the control signals
+// for a cycle and the branch to the next microinstruction.
+type Microinstruction struct {
+	Code
+	Branch Branch
+	Target int
+}
+
+// Program is the microcode for the instruction set. Decode and Execute
+// are indexed by instruction specifier and hold addresses in Code.
+type Program struct {
+	Code []Microinstruction
+	// Decode is where an instruction continues after its fetch: the routine
+	// forming its operand address, or its Execute routine when it needs no
+	// address. It is -1 for an addressing mode the instruction does not
+	// allow.
+	Decode [256]int
+	// Execute is the routine carrying out each instruction, reached from its
+	// address routine.
+	Execute [256]int
+}
+
+// Computer runs ISA programs on the datapath. Its memory, operating system
+// and devices are set up the same way as a computer.Pep9Computer's, so the
+// two can run the same programs and be compared.
+type Computer struct {
+	CPU
+	Program *Program
+	HALT    bool
+	Cycles  uint64 // Cycles run since Initialize
+
+	// MicroPC is the address in Program.Code of the next microinstruction.
+	// It is 0 between instructions.
+	MicroPC int
+
+	instruction uint16 // Address of the instruction being executed
+}
+
+// New creates a computer with a data bus of the given width, running the
+// built-in microcode for it.
+func New(bus Bus) *Computer {
+	c := &Computer{Program: oneByteProgram}
+	if bus == TwoByte {
+		c.Program = twoByteProgram
+	}
+	c.Bus = bus
+	c.Reset()
+	return c
+}
+
+// Initialize burns the operating system into ROM, attaches the character
+// devices and prepares to run a program from 0x0000 on the user stack, as
+// Pep9Computer.Initialize does. Traps are always serviced by the operating
+// system's handler.
+func (c *Computer) Initialize() {
+	c.BurnOS()
+	c.AttachCharIO()
+	c.ResetDevices()
+
+	c.Reset()
+	c.SetWord(RegSP, uint16(c.LoadWord(computer.UserStackVector)))
+	c.HALT = false
+	c.Cycles = 0
+	c.MicroPC = 0
+}
+
+// LoadProgram copies object code into memory from 0x0000.
+func (c *Computer) LoadProgram(program []byte) {
+	copy(c.Ram[:], program)
+}
+
+// Processor returns the ISA level registers and status bits.
+func (c *Computer) Processor() computer.Processor {
+	var p computer.Processor
+	p.A = c.Word(RegA)
+	p.X = c.Word(RegX)
+	p.SP = c.Word(RegSP)
+	p.PC = c.Word(RegPC)
+	p.OpCode = c.Registers[RegIR]
+	p.Operand = c.Word(RegIR + 1)
+	p.N, p.Z, p.V, p.C = c.N, c.Z, c.V, c.C
+	return p
+}
+
+// SetProcessor sets the ISA level registers and status bits.
+func (c *Computer) SetProcessor(p computer.Processor) {
+	c.SetWord(RegA, p.A)
+	c.SetWord(RegX, p.X)
+	c.SetWord(RegSP, p.SP)
+	c.SetWord(RegPC, p.PC)
+	c.Registers[RegIR] = p.OpCode
+	c.SetWord(RegIR+1, p.Operand)
+	c.N, c.Z, c.V, c.C = p.N, p.Z, p.V, p.C
+}
+
+// Cycle runs one microinstruction and reports whether it finished an
+// instruction. A faulting instruction halts the computer and returns an
+// ExecutionError.
+func (c *Computer) Cycle() (bool, error) {
+	if c.HALT {
+		return false, computer.ErrHalted
+	}
+	if c.MicroPC == 0 {
+		c.instruction = c.Word(RegPC)
+	}
+	if c.MicroPC < 0 || c.MicroPC >= len(c.Program.Code) {
+		c.HALT = true
+		return false, fmt.Errorf("microinstruction %d is outside the control store", c.MicroPC)
+	}
+
+	mi := c.Program.Code[c.MicroPC]
+	if err := c.CPU.Cycle(mi.Code); err != nil {
+		c.HALT = true
+		return false, fmt.Errorf("microinstruction %d: %w", c.MicroPC, err)
+	}
+	c.Cycles++
+
+	opcode := c.Registers[RegIR]
+	next := c.MicroPC + 1
+	switch mi.Branch {
+	case Goto:
+		next = mi.Target
+	case IfN, IfZ, IfV, IfC, IfS:
+		if []bool{c.N, c.Z, c.V, c.C, c.S}[mi.Branch-IfN] {
+			next = mi.Target
+		}
+	case IfMAROdd:
+		if c.MARB&1 != 0 {
+			next = mi.Target
+		}
+	case IfUnary:
+		if isa.IsUnary(opcode) {
+			next = c.Program.Decode[opcode]
+		}
+	case Decode:
+		next = c.Program.Decode[opcode]
+	case Execute:
+		next = c.Program.Execute[opcode]
+	case End:
+		next = 0
+	case Stop:
+		c.HALT = true
+		next = 0
+	}
+	var err *computer.ExecutionError
+	if next < 0 {
+		err = &computer.ExecutionError{Err: computer.ErrIllegalAddressingMode}
+		next = 0
+	}
+	c.MicroPC = next
+	if next != 0 {
+		return false, nil
+	}
+
+	if err == nil {
+		err, c.fault = c.fault, nil
+	}
+	if err != nil {
+		err.PC = c.instruction
+		err.OpCode = opcode
+		c.HALT = true
+		return true, err
+	}
+	return true, nil
+}
+
+// Step runs the cycles of one instruction, or the rest of the current one
+// when it is part way through.
+func (c *Computer) Step() error {
+	for {
+		done, err := c.Cycle()
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// Run executes instructions until the computer halts, limit instructions
+// have executed or ctx is cancelled, with the results of
+// Pep9Computer.Run. A limit of zero is no limit.
+func (c *Computer) Run(ctx context.Context, limit int) error {
+	for steps := 0; !c.HALT; steps++ {
+		if limit > 0 && steps == limit {
+			pc := c.Word(RegPC)
+			return &computer.ExecutionError{Err: computer.ErrStepLimit, PC: pc, OpCode: c.Ram[pc]}
+		}
+		if steps%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if err := c.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+// Package microcode simulates the Pep/9 CPU of chapter 12 of the textbook
+// cycle by cycle: a datapath of 32 byte registers, an ALU and the memory
+// address and data registers, driven by one control word per cycle. The
+// data bus is one byte wide, or two bytes wide with MDRE and MDRO as in the
+// textbook's second design.
+// Microprograms run on the bare datapath, and a Computer runs ISA programs
+// with built-in microcode so its results can be compared with
+// computer.Pep9Computer.
+package microcode
+
+import (
+	"errors"
+	"fmt"
+
+	"pep9emulator/computer"
+)
+
+// The register bank. Words are held high byte first in two registers.
+const (
+	RegA     = 0  // Accumulator, 0-1
+	RegX     = 2  // Index register, 2-3
+	RegSP    = 4  // Stack pointer, 4-5
+	RegPC    = 6  // Program counter, 6-7
+	RegIR    = 8  // Instruction specifier, followed by the operand specifier in 9-10
+	RegT1    = 11 // Temporary byte
+	RegT2    = 12 // Temporary words T2 to T6, 12-21
+	RegT3    = 14
+	RegT4    = 16
+	RegT5    = 18
+	RegT6    = 20
+	RegConst = 22 // First of the read only constants, 22-31
+
+	registerCount = 32
+)
+
+// constants are the values of the read only registers from RegConst.
+var constants = [registerCount - RegConst]uint8{0x00, 0x01, 0x02, 0x03, 0x04, 0x08, 0xF0, 0xF6, 0xFE, 0xFF}
+
+// Bus is the width of the data bus between the CPU and memory.
+type Bus int
+
+const (
+	// OneByte moves a byte per memory access through MDR.
+	OneByte Bus = iota
+	// TwoByte moves the even and odd bytes of the word at MAR through MDRE
+	// and MDRO, so a word at an even address takes one access.
+	TwoByte
+)
+
+func (b Bus) String() string {
+	switch b {
+	case OneByte:
+		return "one-byte"
+	case TwoByte:
+		return "two-byte"
+	}
+	return fmt.Sprintf("Bus(%d)", int(b))
+}
+
+// CPU is the datapath. Each call to Cycle is one clock cycle: the A and B
+// buses read the register bank, the ALU computes, and at the end of the
+// cycle every clocked register is loaded at once. Memory reads and writes
+// use MAR and the data registers as they were when the cycle started.
+//
+// On the two-byte bus MemRead reads only the halves being clocked into
+// MDRE and MDRO, and MemWrite writes only the halves loaded from the C bus
+// since the last write, like the byte enables of a real word-wide memory. A byte access
+// therefore touches only its own byte, as it does in Pep9Computer, so a
+// character device beside it is left alone.
+type CPU struct {
+	Bus        Bus
+	Registers  [registerCount]uint8
+	MARA, MARB uint8 // High and low bytes of the memory address register
+	MDR        uint8 // Data register of the one-byte bus
+	MDRE, MDRO uint8 // Data registers of the two-byte bus for the even and odd bytes
+	N, Z, V, C bool
+	S          bool // Carry saved between the bytes of a word
+	computer.Memory
+
+	loaded [2]bool                  // MDRE and MDRO loaded from the C bus since the last MemWrite
+	fault  *computer.ExecutionError // First store into ROM
+}
+
+// Reset clears the registers and status bits and sets the constants. Memory
+// is left alone.
+func (cpu *CPU) Reset() {
+	cpu.Registers = [registerCount]uint8{}
+	copy(cpu.Registers[RegConst:], constants[:])
+	cpu.MARA, cpu.MARB, cpu.MDR = 0, 0, 0
+	cpu.MDRE, cpu.MDRO, cpu.loaded = 0, 0, [2]bool{}
+	cpu.N, cpu.Z, cpu.V, cpu.C, cpu.S = false, false, false, false, false
+	cpu.fault = nil
+}
+
+// Word returns the word held in register r and the one after it.
+func (cpu *CPU) Word(r int) uint16 {
+	return uint16(cpu.Registers[r])<<8 | uint16(cpu.Registers[r+1])
+}
+
+// SetWord stores a word in register r and the one after it.
+func (cpu *CPU) SetWord(r int, value uint16) {
+	cpu.Registers[r] = uint8(value >> 8)
+	cpu.Registers[r+1] = uint8(value)
+}
+
+// MAR returns the memory address register as a word.
+func (cpu *CPU) MAR() uint16 {
+	return uint16(cpu.MARA)<<8 | uint16(cpu.MARB)
+}
+
+// flags packs the status bits into the low nibble of a byte, as CMux=0
+// puts them on the C bus.
+func (cpu *CPU) flags() uint8 {
+	var nzvc uint8
+	for _, bit := range []bool{cpu.N, cpu.Z, cpu.V, cpu.C} {
+		nzvc <<= 1
+		if bit {
+			nzvc |= 1
+		}
+	}
+	return nzvc
+}
+
+// Cycle runs one clock cycle. A control word that is inconsistent, such as
+// LoadCk without a C register or an ALU without its inputs, is rejected
+// before anything changes.
+func (cpu *CPU) Cycle(code Code) error {
+	if err := cpu.check(code); err != nil {
+		return err
+	}
+	v := code.values
+
+	var aBus, bBus uint8
+	if code.Has(A) {
+		aBus = cpu.Registers[v[A]]
+	}
+	if code.Has(B) {
+		bBus = cpu.Registers[v[B]]
+	}
+
+	var out alu
+	if code.Has(ALU) {
+		left := cpu.MDR
+		switch {
+		case v[AMux] == 1:
+			left = aBus
+		case cpu.Bus == TwoByte && v[EOMux] == 0:
+			left = cpu.MDRE
+		case cpu.Bus == TwoByte:
+			left = cpu.MDRO
+		}
+		carry := cpu.C
+		if code.is(CSMux, 1) {
+			carry = cpu.S
+		}
+		out = compute(v[ALU], left, bBus, carry)
+	}
+	cBus := out.result
+	if code.is(CMux, 0) {
+		cBus = cpu.flags()
+	}
+
+	// The bytes read from memory, and for the two-byte bus the even and odd
+	// bytes of the word at MAR, read in that order.
+	var data, even, odd uint8
+	read := func(clock, mux Signal) bool {
+		return code.Has(MemRead) && code.Has(clock) && v[mux] == 0
+	}
+	if read(MDRCk, MDRMux) {
+		data = uint8(cpu.LoadByte(cpu.MAR()))
+	}
+	if read(MDRECk, MDREMux) {
+		even = uint8(cpu.LoadByte(cpu.MAR() &^ 1))
+	}
+	if read(MDROCk, MDROMux) {
+		odd = uint8(cpu.LoadByte(cpu.MAR() | 1))
+	}
+	if code.Has(MemWrite) {
+		if cpu.Bus == OneByte {
+			cpu.store(cpu.MAR(), cpu.MDR)
+		}
+		if cpu.loaded[0] {
+			cpu.store(cpu.MAR()&^1, cpu.MDRE)
+		}
+		if cpu.loaded[1] {
+			cpu.store(cpu.MAR()|1, cpu.MDRO)
+		}
+		cpu.loaded = [2]bool{}
+	}
+
+	if code.Has(LoadCk) {
+		cpu.Registers[v[C]] = cBus
+	}
+	if code.Has(MARCk) {
+		if cpu.Bus == TwoByte && v[MARMux] == 0 {
+			cpu.MARA, cpu.MARB = cpu.MDRE, cpu.MDRO
+		} else {
+			cpu.MARA, cpu.MARB = aBus, bBus
+		}
+	}
+	if code.Has(MDRCk) {
+		if v[MDRMux] == 0 {
+			cpu.MDR = data
+		} else {
+			cpu.MDR = cBus
+		}
+	}
+	if code.Has(MDRECk) {
+		if v[MDREMux] == 0 {
+			cpu.MDRE = even
+		} else {
+			cpu.MDRE = cBus
+		}
+		cpu.loaded[0] = v[MDREMux] == 1
+	}
+	if code.Has(MDROCk) {
+		if v[MDROMux] == 0 {
+			cpu.MDRO = odd
+		} else {
+			cpu.MDRO = cBus
+		}
+		cpu.loaded[1] = v[MDROMux] == 1
+	}
+	if code.Has(NCk) {
+		cpu.N = out.n
+	}
+	if code.Has(ZCk) {
+		cpu.Z = out.z && (cpu.Z || !code.is(AndZ, 1))
+	}
+	if code.Has(VCk) {
+		cpu.V = out.v
+	}
+	if code.Has(CCk) {
+		cpu.C = out.c
+	}
+	if code.Has(SCk) {
+		cpu.S = out.c
+	}
+	return nil
+}
+
+// store writes a byte to memory. A store into ROM is dropped and remembered
+// as a fault, which ends the instruction like it does in Pep9Computer.
+func (cpu *CPU) store(location uint16, value uint8) {
+	_, _, device := cpu.DeviceAt(location)
+	if !device && cpu.ROMStart != 0 && location >= cpu.ROMStart {
+		if cpu.fault == nil {
+			cpu.fault = &computer.ExecutionError{Err: computer.ErrMemoryProtection, Address: location}
+		}
+		return
+	}
+	cpu.StoreByte(uint16(value), location)
+}
+
+// busSignals are the signals only found on each bus.
+var busSignals = map[Bus][]Signal{
+	OneByte: {MDRMux, MDRCk},
+	TwoByte: {MARMux, MDREMux, MDROMux, EOMux, MDRECk, MDROCk},
+}
+
+// check rejects control words whose clocks use a value nothing drives, or
+// that use signals of the other bus.
+func (cpu *CPU) check(code Code) error {
+	for s := Signal(0); s < numSignals; s++ {
+		if value, ok := code.Get(s); ok && value > s.Max() {
+			return fmt.Errorf("%v=%d is out of range", s, value)
+		}
+	}
+	for bus, signals := range busSignals {
+		for _, s := range signals {
+			if _, ok := code.Get(s); ok && bus != cpu.Bus {
+				return fmt.Errorf("%v is not on the %v bus", s, cpu.Bus)
+			}
+		}
+	}
+
+	var needs []Signal
+	if code.Has(MemRead) && code.Has(MemWrite) {
+		return errors.New("MemRead and MemWrite are both asserted")
+	}
+	if code.Has(LoadCk) {
+		needs = append(needs, C, CMux)
+		if value, ok := code.Get(C); ok && value >= RegConst {
+			return fmt.Errorf("register %d is read only", value)
+		}
+	}
+	if code.Has(MARCk) {
+		if cpu.Bus == TwoByte {
+			needs = append(needs, MARMux)
+		}
+		if cpu.Bus == OneByte || code.is(MARMux, 1) {
+			needs = append(needs, A, B)
+		}
+	}
+	for _, data := range [][2]Signal{{MDRCk, MDRMux}, {MDRECk, MDREMux}, {MDROCk, MDROMux}} {
+		if clock, mux := data[0], data[1]; code.Has(clock) {
+			needs = append(needs, mux)
+			if code.is(mux, 0) {
+				needs = append(needs, MemRead)
+			} else {
+				needs = append(needs, CMux)
+			}
+		}
+	}
+	if code.is(CMux, 1) || code.Has(NCk) || code.Has(ZCk) || code.Has(VCk) || code.Has(CCk) || code.Has(SCk) {
+		needs = append(needs, ALU)
+	}
+	if fn, ok := code.Get(ALU); ok {
+		needs = append(needs, AMux)
+		if code.is(AMux, 1) {
+			needs = append(needs, A)
+		} else if cpu.Bus == TwoByte {
+			needs = append(needs, EOMux)
+		}
+		if fn >= 1 && fn <= 9 {
+			needs = append(needs, B)
+		}
+		if usesCarry(fn) {
+			needs = append(needs, CSMux)
+		}
+	}
+
+	for _, s := range needs {
+		if _, ok := code.Get(s); !ok {
+			return fmt.Errorf("%v is needed but not set", s)
+		}
+	}
+	return nil
+}
+
+// alu is the output of the ALU: a result and the status bits it would
+// clock into N, Z, V and C (or S).
+type alu struct {
+	result     uint8
+	n, z, v, c bool
+}
+
+// usesCarry reports whether an ALU function takes a carry in, selected by
+// CSMux.
+func usesCarry(fn uint8) bool {
+	return fn == 2 || fn == 4 || fn == 12 || fn == 14
+}
+
+// compute applies ALU function fn:
+//
+//	0 A           4 A plus ~B plus Cin   8 ~(A or B)   12 ROL A
+//	1 A plus B    5 A and B              9 A xor B     13 ASR A
+//	2 A plus B    6 ~(A and B)          10 ~A          14 ROR A
+//	  plus Cin    7 A or B              11 ASL A       15 0, NZVC from A<4..7>
+//	3 A plus ~B plus 1
+//
+// Additions set V and C, shifts left set V to a change of sign and C to the
+// bit shifted out, shifts right set C to the bit shifted out.
+func compute(fn, a, b uint8, carry bool) alu {
+	var cin uint8
+	if carry {
+		cin = 1
+	}
+
+	var out alu
+	switch fn {
+	case 0:
+		out.result = a
+	case 1:
+		out = add(a, b, 0)
+	case 2:
+		out = add(a, b, cin)
+	case 3:
+		out = add(a, ^b, 1)
+	case 4:
+		out = add(a, ^b, cin)
+	case 5:
+		out.result = a & b
+	case 6:
+		out.result = ^(a & b)
+	case 7:
+		out.result = a | b
+	case 8:
+		out.result = ^(a | b)
+	case 9:
+		out.result = a ^ b
+	case 10:
+		out.result = ^a
+	case 11, 12:
+		out.result = a << 1
+		if fn == 12 {
+			out.result |= cin
+		}
+		out.v = (a^a<<1)&0x80 != 0
+		out.c = a&0x80 != 0
+	case 13, 14:
+		out.result = a >> 1
+		if fn == 13 {
+			out.result |= a & 0x80
+		} else {
+			out.result |= cin << 7
+		}
+		out.c = a&0x01 != 0
+	case 15:
+		return alu{n: a&0x08 != 0, z: a&0x04 != 0, v: a&0x02 != 0, c: a&0x01 != 0}
+	}
+	out.n = out.result&0x80 != 0
+	out.z = out.result == 0
+	return out
+}
+
+func add(a, b, cin uint8) alu {
+	sum := uint16(a) + uint16(b) + uint16(cin)
+	result := uint8(sum)
+	return alu{
+		result: result,
+		v:      (a^result)&(b^result)&0x80 != 0,
+		c:      sum > 0xFF,
+	}
+}
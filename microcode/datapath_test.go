@@ -0,0 +1,204 @@
+package microcode
+
+import (
+	"strings"
+	"testing"
+)
+
+func cycle(t *testing.T, cpu *CPU, text string) {
+	t.Helper()
+	code, err := ParseCode(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Cycle(code); err != nil {
+		t.Fatalf("%s: %v", text, err)
+	}
+}
+
+func TestParseCode(t *testing.T) {
+	code, err := ParseCode("memread, A=7, B=23, AMux=1, ALU=1, CMux=1, C=0x07, MDRMux=0; MDRCk, SCk, LoadCk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "A=7, B=23, C=7, AMux=1, CMux=1, ALU=1, MDRMux=0, MemRead; LoadCk, MDRCk, SCk"
+	if got := code.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if v, ok := code.Get(C); !ok || v != 7 {
+		t.Errorf("C = %d, %t", v, ok)
+	}
+	if code.Has(MemWrite) || !code.Has(MemRead) || !code.Has(SCk) || code.Has(NCk) {
+		t.Errorf("wrong signals in %v", code)
+	}
+	if late, err := ParseCode("memread, A=7, B=23, AMux=1, CMux=1, C=7, MDRMux=0; MDRCk, SCk, ALU=1, LoadCk"); err != nil || late != code {
+		t.Errorf("signal after the semicolon: got %v, %v", late, err)
+	}
+
+	for _, text := range []string{"A=32", "ALU=16", "Foo=1", "A", "A=1, A=2", "MARCk", "A=1; B", "; MARCk, MARCk"} {
+		if _, err := ParseCode(text); err == nil {
+			t.Errorf("%q parsed", text)
+		}
+	}
+}
+
+func TestALU(t *testing.T) {
+	tests := []struct {
+		fn, a, b uint8
+		carry    bool
+		want     alu
+	}{
+		{0, 0x80, 0x01, false, alu{result: 0x80, n: true}},
+		{1, 0x7F, 0x01, false, alu{result: 0x80, n: true, v: true}},
+		{1, 0xFF, 0x01, false, alu{result: 0x00, z: true, c: true}},
+		{2, 0x01, 0x01, true, alu{result: 0x03}},
+		{3, 0x05, 0x03, false, alu{result: 0x02, c: true}},
+		{3, 0x03, 0x05, false, alu{result: 0xFE, n: true}},
+		{4, 0x05, 0x05, false, alu{result: 0xFF, n: true}},
+		{5, 0xF0, 0x3C, false, alu{result: 0x30}},
+		{6, 0xF0, 0x3C, false, alu{result: 0xCF, n: true}},
+		{7, 0xF0, 0x0C, false, alu{result: 0xFC, n: true}},
+		{8, 0xF0, 0x0F, false, alu{result: 0x00, z: true}},
+		{9, 0xFF, 0x0F, false, alu{result: 0xF0, n: true}},
+		{10, 0x0F, 0, false, alu{result: 0xF0, n: true}},
+		{11, 0xC1, 0, false, alu{result: 0x82, n: true, c: true}},
+		{11, 0x41, 0, false, alu{result: 0x82, n: true, v: true}},
+		{12, 0x01, 0, true, alu{result: 0x03}},
+		{13, 0x81, 0, false, alu{result: 0xC0, n: true, c: true}},
+		{14, 0x02, 0, true, alu{result: 0x81, n: true}},
+		{15, 0x0A, 0, false, alu{n: true, v: true}},
+	}
+	for _, test := range tests {
+		if got := compute(test.fn, test.a, test.b, test.carry); got != test.want {
+			t.Errorf("ALU %d on 0x%02X, 0x%02X: got %+v, want %+v", test.fn, test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// TestFetch runs the start of the textbook's fetch, reading the instruction
+// specifier into IR and incrementing PC.
+func TestFetch(t *testing.T) {
+	var cpu CPU
+	cpu.Reset()
+	cpu.SetWord(RegPC, 0x00FF)
+	cpu.Ram[0x00FF] = 0xAB
+
+	cycle(t, &cpu, "A=6, B=7; MARCk")
+	cycle(t, &cpu, "MemRead, MDRMux=0, A=7, B=23, AMux=1, ALU=1, CMux=1, C=7; MDRCk, SCk, LoadCk")
+	cycle(t, &cpu, "A=6, B=22, AMux=1, CSMux=1, ALU=2, CMux=1, C=6; LoadCk")
+	cycle(t, &cpu, "AMux=0, ALU=0, CMux=1, C=8; LoadCk")
+
+	if cpu.Registers[RegIR] != 0xAB || cpu.Word(RegPC) != 0x0100 || cpu.MAR() != 0x00FF {
+		t.Errorf("IR = 0x%02X, PC = 0x%04X, MAR = 0x%04X", cpu.Registers[RegIR], cpu.Word(RegPC), cpu.MAR())
+	}
+}
+
+// TestStatusBits checks that Z covers a word with AndZ and that CMux=0 puts
+// the status bits on the C bus.
+func TestStatusBits(t *testing.T) {
+	var cpu CPU
+	cpu.Reset()
+	cpu.SetWord(RegA, 0x0100)
+
+	cycle(t, &cpu, "A=1, AMux=1, ALU=0; ZCk")
+	cycle(t, &cpu, "A=0, AMux=1, ALU=0, AndZ=1; NCk, ZCk")
+	if cpu.Z || cpu.N {
+		t.Errorf("Z = %t, N = %t for 0x0100", cpu.Z, cpu.N)
+	}
+
+	cpu.N, cpu.C = true, true
+	cycle(t, &cpu, "CMux=0, C=11; LoadCk")
+	if got := cpu.Registers[RegT1]; got != 0x09 {
+		t.Errorf("status bits 0x%02X, want 0x09", got)
+	}
+}
+
+func TestMemoryWrite(t *testing.T) {
+	var cpu CPU
+	cpu.Reset()
+	cpu.SetWord(RegT2, 0x1234)
+	cpu.Registers[RegT1] = 0x5A
+
+	cycle(t, &cpu, "A=11, AMux=1, ALU=0, CMux=1, MDRMux=1; MDRCk")
+	cycle(t, &cpu, "A=12, B=13; MARCk")
+	cycle(t, &cpu, "MemWrite")
+	if cpu.Ram[0x1234] != 0x5A {
+		t.Errorf("memory 0x%02X, want 0x5A", cpu.Ram[0x1234])
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := map[string]string{
+		"MemRead, MemWrite":                        "both asserted",
+		"A=1, AMux=1, ALU=0, CMux=1; LoadCk":       "C is needed",
+		"A=1, AMux=1, ALU=0, CMux=1, C=22; LoadCk": "read only",
+		"A=1; MARCk":                   "B is needed",
+		"MDRMux=0; MDRCk":              "MemRead is needed",
+		"A=1, B=2, AMux=1, ALU=2; SCk": "CSMux is needed",
+		"A=1, AMux=1, ALU=1; NCk":      "B is needed",
+		"AMux=1, ALU=0; ZCk":           "A is needed",
+		"C=1, CMux=1; LoadCk":          "ALU is needed",
+	}
+	for text, want := range tests {
+		code, err := ParseCode(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cpu CPU
+		cpu.Reset()
+		if err := cpu.Cycle(code); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want %q", text, err, want)
+		}
+	}
+}
+
+// TestTwoByteBus reads a word at an even address in one access, writes a
+// single byte without touching the other half of its word and loads MAR
+// from the data registers.
+func TestTwoByteBus(t *testing.T) {
+	cpu := CPU{Bus: TwoByte}
+	cpu.Reset()
+	cpu.SetWord(RegT2, 0x1234)
+	cpu.Ram[0x1234], cpu.Ram[0x1235] = 0x00, 0x42
+
+	cycle(t, &cpu, "A=12, B=13, MARMux=1; MARCk")
+	cycle(t, &cpu, "MemRead, MDREMux=0, MDROMux=0; MDRECk, MDROCk")
+	if cpu.MDRE != 0x00 || cpu.MDRO != 0x42 {
+		t.Errorf("MDRE = 0x%02X, MDRO = 0x%02X", cpu.MDRE, cpu.MDRO)
+	}
+
+	cycle(t, &cpu, "A=13, AMux=1, ALU=0, CMux=1, MDROMux=1; MDROCk")
+	cycle(t, &cpu, "MemWrite")
+	if cpu.Ram[0x1234] != 0x00 || cpu.Ram[0x1235] != 0x34 {
+		t.Errorf("memory 0x%02X 0x%02X, want 0x00 0x34", cpu.Ram[0x1234], cpu.Ram[0x1235])
+	}
+
+	cycle(t, &cpu, "MARMux=0; MARCk")
+	if cpu.MAR() != 0x0034 {
+		t.Errorf("MAR = 0x%04X, want 0x0034", cpu.MAR())
+	}
+}
+
+func TestCheckBus(t *testing.T) {
+	tests := []struct {
+		bus        Bus
+		text, want string
+	}{
+		{OneByte, "A=1, B=2, MARMux=1; MARCk", "not on the one-byte bus"},
+		{TwoByte, "MemRead, MDRMux=0; MDRCk", "not on the two-byte bus"},
+		{TwoByte, "A=1, B=2; MARCk", "MARMux is needed"},
+		{TwoByte, "MDROMux=0; MDROCk", "MemRead is needed"},
+		{TwoByte, "AMux=0, ALU=0, CMux=1, C=1; LoadCk", "EOMux is needed"},
+	}
+	for _, test := range tests {
+		code, err := ParseCode(test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cpu := CPU{Bus: test.bus}
+		cpu.Reset()
+		if err := cpu.Cycle(code); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v bus %q: got %v, want %q", test.bus, test.text, err, test.want)
+		}
+	}
+}
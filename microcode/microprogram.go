@@ -0,0 +1,551 @@
+package microcode
+
+import (
+	"fmt"
+
+	"pep9emulator/isa"
+)
+
+// The microcode below carries out every instruction as the textbook defines
+// it, which computer.Pep9Computer must match register for register and
+// cycle for cycle.
+
+var (
+	oneByteProgram = build(OneByte)
+	twoByteProgram = build(TwoByte)
+)
+
+// word names the registers holding a word, which for a byte operand is a
+// constant zero and the byte.
+type word struct{ hi, lo int }
+
+func pair(r int) word { return word{r, r + 1} }
+
+var (
+	operand = pair(RegIR + 1)
+	noWord  = word{-1, -1}
+)
+
+// Constants of the register bank.
+const (
+	zero = RegConst + iota
+	one
+	two
+	_
+	_
+	_
+	_
+	xF6
+	xFE
+	xFF
+)
+
+// builder assembles a Program for a bus, resolving branches to labels at
+// the end.
+type builder struct {
+	bus    Bus
+	code   []Microinstruction
+	labels map[string]int
+	fixups map[int]string
+
+	// exits are the last microinstructions of what was emitted last: the
+	// last one, or one for each path of an aligned access.
+	exits []int
+}
+
+func newBuilder(bus Bus) *builder {
+	return &builder{bus: bus, labels: map[string]int{}, fixups: map[int]string{}}
+}
+
+// add appends a microinstruction written as for ParseCode.
+func (b *builder) add(format string, args ...interface{}) {
+	code, err := ParseCode(fmt.Sprintf(format, args...))
+	if err != nil {
+		panic(fmt.Sprintf("microcode %d: %v", len(b.code), err))
+	}
+	b.code = append(b.code, Microinstruction{Code: code})
+	b.exits = []int{len(b.code) - 1}
+}
+
+// then sets the branch of the last microinstruction, or of each path's last
+// after an aligned access, to a label when the branch has a target.
+func (b *builder) then(branch Branch, label string) {
+	for _, at := range b.exits {
+		b.code[at].Branch = branch
+		delete(b.fixups, at)
+		if label != "" {
+			b.fixups[at] = label
+		}
+	}
+}
+
+// label names the next microinstruction.
+func (b *builder) label(name string) {
+	b.labels[name] = len(b.code)
+}
+
+func (b *builder) program() *Program {
+	for at, name := range b.fixups {
+		target, ok := b.labels[name]
+		if !ok {
+			panic("microcode: no label " + name)
+		}
+		b.code[at].Target = target
+	}
+	p := &Program{Code: b.code}
+	for i := range p.Decode {
+		p.Decode[i], p.Execute[i] = -1, -1
+	}
+	return p
+}
+
+// copyByte copies one register to another through the ALU.
+func (b *builder) copyByte(from, to int) {
+	b.add("A=%d, AMux=1, ALU=0, CMux=1, C=%d; LoadCk", from, to)
+}
+
+func (b *builder) copyWord(from, to word) {
+	b.copyByte(from.lo, to.lo)
+	b.copyByte(from.hi, to.hi)
+}
+
+// arith computes to = x fn y a byte at a time, the low byte with function
+// lo and the high byte with function hi, carrying between them through S.
+// flags lists the status bits set from the word: Z from both bytes, N, V
+// and C from the high byte. A negative to only sets the status bits, and a
+// negative y is an ALU function with one input.
+func (b *builder) arith(lo, hi int, x, y, to word, flags string) {
+	clocks := func(s string) string {
+		if to.hi >= 0 {
+			s += ", LoadCk"
+		}
+		if s == "" {
+			return ""
+		}
+		return "; " + s[2:]
+	}
+	signals := func(fn, x, y, to int) string {
+		s := fmt.Sprintf("A=%d", x)
+		if y >= 0 {
+			s += fmt.Sprintf(", B=%d", y)
+		}
+		s += ", AMux=1"
+		if usesCarry(uint8(fn)) {
+			s += ", CSMux=1"
+		}
+		s += fmt.Sprintf(", ALU=%d", fn)
+		if to >= 0 {
+			s += fmt.Sprintf(", CMux=1, C=%d", to)
+		}
+		return s
+	}
+	has := func(flag rune) bool {
+		for _, f := range flags {
+			if f == flag {
+				return true
+			}
+		}
+		return false
+	}
+
+	var loClocks, hiClocks, andZ string
+	if usesCarry(uint8(hi)) {
+		loClocks += ", SCk"
+	}
+	if has('Z') {
+		loClocks += ", ZCk"
+		hiClocks += ", ZCk"
+		andZ = ", AndZ=1"
+	}
+	for _, flag := range "NVC" {
+		if has(flag) {
+			hiClocks += fmt.Sprintf(", %cCk", flag)
+		}
+	}
+	b.add(signals(lo, x.lo, y.lo, to.lo) + clocks(loClocks))
+	b.add(signals(hi, x.hi, y.hi, to.hi) + andZ + clocks(hiClocks))
+}
+
+// readByte loads the byte at the address in a word of registers.
+func (b *builder) readByte(address word, to int) {
+	if b.bus == TwoByte {
+		b.readByteWide(address, to)
+		return
+	}
+	b.add("A=%d, B=%d; MARCk", address.hi, address.lo)
+	b.add("MemRead, MDRMux=0; MDRCk")
+	b.add("AMux=0, ALU=0, CMux=1, C=%d; LoadCk", to)
+}
+
+// readWord loads the word at the address in a word of registers, using T2
+// for the address of its second byte. The address and the destination may
+// be the same registers.
+func (b *builder) readWord(address, to word) {
+	if b.bus == TwoByte {
+		b.readWordWide(address, to)
+		return
+	}
+	b.add("A=%d, B=%d; MARCk", address.hi, address.lo)
+	b.add("MemRead, MDRMux=0, A=%d, B=%d, AMux=1, ALU=1, CMux=1, C=%d; MDRCk, SCk, LoadCk", address.lo, one, RegT2+1)
+	b.add("A=%d, B=%d, AMux=1, CSMux=1, ALU=2, CMux=1, C=%d; LoadCk", address.hi, zero, RegT2)
+	b.add("A=%d, B=%d, AMux=0, ALU=0, CMux=1, C=%d; MARCk, LoadCk", RegT2, RegT2+1, to.hi)
+	b.add("MemRead, MDRMux=0; MDRCk")
+	b.add("AMux=0, ALU=0, CMux=1, C=%d; LoadCk", to.lo)
+}
+
+// writeByte stores a register at the address in a word of registers.
+func (b *builder) writeByte(address word, from int) {
+	if b.bus == TwoByte {
+		b.writeByteWide(address, from)
+		return
+	}
+	b.add("A=%d, AMux=1, ALU=0, CMux=1, MDRMux=1; MDRCk", from)
+	b.add("A=%d, B=%d; MARCk", address.hi, address.lo)
+	b.add("MemWrite")
+}
+
+// writeWord stores a word of registers at the address in another, using
+// T2 for the address of its second byte.
+func (b *builder) writeWord(address, from word) {
+	if b.bus == TwoByte {
+		b.writeWordWide(address, from)
+		return
+	}
+	b.add("A=%d, AMux=1, ALU=0, CMux=1, MDRMux=1; MDRCk", from.hi)
+	b.add("A=%d, B=%d; MARCk", address.hi, address.lo)
+	b.add("MemWrite, A=%d, B=%d, AMux=1, ALU=1, CMux=1, C=%d; SCk, LoadCk", address.lo, one, RegT2+1)
+	b.add("A=%d, B=%d, AMux=1, CSMux=1, ALU=2, CMux=1, C=%d; LoadCk", address.hi, zero, RegT2)
+	b.add("A=%d, AMux=1, ALU=0, CMux=1, MDRMux=1; MDRCk", from.lo)
+	b.add("A=%d, B=%d; MARCk", RegT2, RegT2+1)
+	b.add("MemWrite")
+}
+
+// writeFlags stores the status bits as 0000NZVC at the address in a word
+// of registers.
+func (b *builder) writeFlags(address word) {
+	if b.bus == TwoByte {
+		b.writeFlagsWide(address)
+		return
+	}
+	b.add("A=%d, B=%d, CMux=0, MDRMux=1; MARCk, MDRCk", address.hi, address.lo)
+	b.add("MemWrite")
+}
+
+// fetch loads the instruction specifier, and the operand specifier of a
+// nonunary instruction, into IR, incrementing PC past them. Each byte is
+// read while PC is incremented.
+func (b *builder) fetch() {
+	if b.bus == TwoByte {
+		b.fetchWide()
+		return
+	}
+	read := func() {
+		b.add("MemRead, MDRMux=0, A=%d, B=%d, AMux=1, ALU=1, CMux=1, C=%d; MDRCk, SCk, LoadCk", RegPC+1, one, RegPC+1)
+		b.add("A=%d, B=%d, AMux=1, CSMux=1, ALU=2, CMux=1, C=%d; LoadCk", RegPC, zero, RegPC)
+	}
+
+	b.add("A=%d, B=%d; MARCk", RegPC, RegPC+1)
+	read()
+	b.add("A=%d, B=%d, AMux=0, ALU=0, CMux=1, C=%d; MARCk, LoadCk", RegPC, RegPC+1, RegIR)
+	b.then(IfUnary, "")
+	read()
+	b.add("A=%d, B=%d, AMux=0, ALU=0, CMux=1, C=%d; MARCk, LoadCk", RegPC, RegPC+1, RegIR+1)
+	read()
+	b.add("AMux=0, ALU=0, CMux=1, C=%d; LoadCk", RegIR+2)
+	b.then(Decode, "")
+}
+
+// build assembles the microcode for a data bus.
+func build(bus Bus) *Program {
+	b := newBuilder(bus)
+	b.fetch()
+
+	// A shared microinstruction ending instructions that do nothing more,
+	// such as a branch not taken.
+	b.label("done")
+	b.add("")
+	b.then(End, "")
+
+	// The address routines leave the address of the operand in T3.
+	t3 := pair(RegT3)
+	modes := map[isa.Mode]int{}
+	addressRoutine := func(mode isa.Mode, emit func()) {
+		modes[mode] = len(b.code)
+		emit()
+		b.then(Execute, "")
+	}
+	addressRoutine(isa.Direct, func() { b.copyWord(operand, t3) })
+	addressRoutine(isa.Indirect, func() { b.readWord(operand, t3) })
+	addressRoutine(isa.StackRelative, func() { b.arith(1, 2, pair(RegSP), operand, t3, "") })
+	addressRoutine(isa.StackDeferred, func() {
+		b.arith(1, 2, pair(RegSP), operand, t3, "")
+		b.readWord(t3, t3)
+	})
+	addressRoutine(isa.Indexed, func() { b.arith(1, 2, operand, pair(RegX), t3, "") })
+	addressRoutine(isa.StackIndexed, func() {
+		b.arith(1, 2, pair(RegSP), operand, t3, "")
+		b.arith(1, 2, t3, pair(RegX), t3, "")
+	})
+	addressRoutine(isa.StackDeferredIndexed, func() {
+		b.arith(1, 2, pair(RegSP), operand, t3, "")
+		b.readWord(t3, t3)
+		b.arith(1, 2, t3, pair(RegX), t3, "")
+	})
+
+	trap := len(b.code)
+	b.trap()
+
+	// Instruction routines, one for each mnemonic and, for nonunary
+	// instructions, for an immediate operand and one in memory.
+	decode := map[int]int{}
+	execute := map[int]int{}
+	for _, inst := range isa.Instructions {
+		for mode := isa.Immediate; mode <= isa.StackDeferredIndexed; mode++ {
+			opcode := int(inst.Encode(mode))
+			if inst.Format == isa.Unary && mode != isa.Immediate || inst.Format == isa.ModeA && mode != isa.Immediate && mode != isa.Indexed {
+				continue
+			}
+			switch {
+			case isa.IsTrap(uint8(opcode)):
+				decode[opcode], execute[opcode] = trap, trap
+			case inst.Format != isa.Unary && !inst.Modes.Has(mode):
+				decode[opcode] = -1
+			case mode == isa.Immediate:
+				decode[opcode] = len(b.code)
+				execute[opcode] = len(b.code)
+				b.instruction(inst, opcode, true)
+			case inst.Format == isa.ModeA:
+				decode[opcode] = modes[mode]
+				execute[opcode] = len(b.code)
+				b.instruction(inst, opcode, false)
+			case mode == isa.Direct:
+				decode[opcode] = modes[mode]
+				execute[opcode] = len(b.code)
+				b.instruction(inst, opcode, false)
+			default: // The routine for an operand in memory is shared by every mode
+				decode[opcode] = modes[mode]
+				execute[opcode] = execute[int(inst.Encode(isa.Direct))]
+			}
+		}
+	}
+
+	program := b.program()
+	for opcode, at := range decode {
+		program.Decode[opcode] = at
+	}
+	for opcode, at := range execute {
+		program.Execute[opcode] = at
+	}
+	return program
+}
+
+// register is the word register named by bit r of an instruction
+// specifier: A when it is clear and X when it is set.
+func register(opcode int, r uint) word {
+	if opcode&(1<<r) == 0 {
+		return pair(RegA)
+	}
+	return pair(RegX)
+}
+
+// instruction emits the routine of an instruction, for an operand in IR
+// when immediate and otherwise at the address in T3.
+func (b *builder) instruction(inst *isa.Instruction, opcode int, immediate bool) {
+	name := fmt.Sprintf("%s,%v", inst.Mnemonic, immediate)
+
+	// value is where the operand is once it has been read.
+	value := func(byteOperand bool) word {
+		switch {
+		case immediate && byteOperand:
+			return word{zero, RegIR + 2}
+		case immediate:
+			return operand
+		case byteOperand:
+			b.readByte(pair(RegT3), RegT4+1)
+			return word{zero, RegT4 + 1}
+		}
+		b.readWord(pair(RegT3), pair(RegT4))
+		return pair(RegT4)
+	}
+
+	switch inst.Mnemonic {
+	case "STOP":
+		b.add("")
+		b.then(Stop, "")
+		return
+	case "RET":
+		b.readWord(pair(RegSP), pair(RegPC))
+		b.arith(1, 2, pair(RegSP), word{zero, two}, pair(RegSP), "")
+	case "RETTR":
+		b.returnFromTrap()
+	case "MOVSPA":
+		b.copyWord(pair(RegSP), pair(RegA))
+	case "MOVFLGA":
+		b.add("CMux=0, C=%d; LoadCk", RegA+1)
+	case "MOVAFLG":
+		b.add("A=%d, AMux=1, ALU=15; NCk, ZCk, VCk, CCk", RegA+1)
+	case "NOTA", "NOTX":
+		r := register(opcode, 0)
+		b.arith(10, 10, r, noWord, r, "NZ")
+	case "NEGA", "NEGX":
+		r := register(opcode, 0)
+		b.arith(3, 4, word{zero, zero}, r, r, "NZV")
+	case "ASLA", "ASLX":
+		r := register(opcode, 0)
+		b.arith(11, 12, r, noWord, r, "NZVC")
+	case "ASRA", "ASRX":
+		r := register(opcode, 0)
+		b.add("A=%d, AMux=1, ALU=13, CMux=1, C=%d; NCk, ZCk, SCk, LoadCk", r.hi, r.hi)
+		b.add("A=%d, AMux=1, CSMux=1, ALU=14, AndZ=1, CMux=1, C=%d; ZCk, CCk, LoadCk", r.lo, r.lo)
+	case "ROLA", "ROLX":
+		// C comes in at bit 0 and bit 15 goes out to C.
+		r := register(opcode, 0)
+		b.add("A=%d, AMux=1, CSMux=0, ALU=12, CMux=1, C=%d; SCk, LoadCk", r.lo, r.lo)
+		b.add("A=%d, AMux=1, CSMux=1, ALU=12, CMux=1, C=%d; CCk, LoadCk", r.hi, r.hi)
+	case "RORA", "RORX":
+		// C comes in at bit 15 and bit 0 goes out to C.
+		r := register(opcode, 0)
+		b.add("A=%d, AMux=1, CSMux=0, ALU=14, CMux=1, C=%d; SCk, LoadCk", r.hi, r.hi)
+		b.add("A=%d, AMux=1, CSMux=1, ALU=14, CMux=1, C=%d; CCk, LoadCk", r.lo, r.lo)
+	case "BR", "BRLE", "BRLT", "BREQ", "BRNE", "BRGE", "BRGT", "BRV", "BRC", "CALL":
+		target := operand
+		if !immediate {
+			target = pair(RegT4)
+			b.readWord(pair(RegT3), target)
+		}
+		// A test can only share the read's last cycle when it has one.
+		b.branch(inst.Mnemonic, name, target, !immediate && len(b.exits) == 1)
+	case "ADDSP", "SUBSP", "ADDA", "ADDX", "SUBA", "SUBX", "ANDA", "ANDX", "ORA", "ORX":
+		r := register(opcode, 3)
+		if inst.Mnemonic == "ADDSP" || inst.Mnemonic == "SUBSP" {
+			r = pair(RegSP)
+		}
+		y := value(false)
+		switch inst.Mnemonic[:2] {
+		case "AD":
+			b.arith(1, 2, r, y, r, "NZVC")
+		case "SU":
+			b.arith(3, 4, r, y, r, "NZVC")
+		case "AN":
+			b.arith(5, 5, r, y, r, "NZ")
+		case "OR":
+			b.arith(7, 7, r, y, r, "NZ")
+		}
+	case "CPWA", "CPWX":
+		b.arith(3, 4, register(opcode, 3), value(false), noWord, "NZVC")
+		b.signOfDifference()
+	case "CPBA", "CPBX":
+		r, y := register(opcode, 3), value(true)
+		b.add("A=%d, B=%d, AMux=1, ALU=3; NCk, ZCk", r.lo, y.lo)
+		b.add("A=%d, AMux=1, ALU=0; VCk, CCk", zero)
+	case "LDWA", "LDWX":
+		b.arith(0, 0, value(false), noWord, register(opcode, 3), "NZ")
+	case "LDBA", "LDBX":
+		// Only the low byte of the register is loaded, and N is cleared.
+		y := value(true)
+		b.add("A=%d, AMux=1, ALU=0, CMux=1, C=%d; ZCk, LoadCk", y.lo, register(opcode, 3).lo)
+		b.add("A=%d, AMux=1, ALU=0; NCk", zero)
+	case "STWA", "STWX":
+		b.writeWord(pair(RegT3), register(opcode, 3))
+	case "STBA", "STBX":
+		b.writeByte(pair(RegT3), register(opcode, 3).lo)
+	}
+	b.then(End, "")
+}
+
+// branch ends a branch or call routine, jumping to target if it is taken.
+// Each test of the status bits is a cycle of its own, except that the first
+// shares the last cycle of reading the target from memory.
+func (b *builder) branch(mnemonic, name string, target word, shared bool) {
+	take := name + ",take"
+	test := func(branch Branch, label string) {
+		if !shared {
+			b.add("")
+		}
+		shared = false
+		b.then(branch, label)
+	}
+
+	switch mnemonic {
+	case "BRLE":
+		test(IfN, take)
+		test(IfZ, take)
+		test(Goto, "done")
+	case "BRLT":
+		test(IfN, take)
+		test(Goto, "done")
+	case "BREQ":
+		test(IfZ, take)
+		test(Goto, "done")
+	case "BRNE":
+		test(IfZ, "done")
+	case "BRGE":
+		test(IfN, "done")
+	case "BRGT":
+		test(IfN, "done")
+		test(IfZ, "done")
+	case "BRV":
+		test(IfV, take)
+		test(Goto, "done")
+	case "BRC":
+		test(IfC, take)
+		test(Goto, "done")
+	case "CALL":
+		b.arith(3, 4, pair(RegSP), word{zero, two}, pair(RegSP), "")
+		b.writeWord(pair(RegSP), pair(RegPC))
+	}
+
+	b.label(take)
+	b.copyWord(target, pair(RegPC))
+}
+
+// signOfDifference sets N to N xor V, the sign of a difference that
+// overflowed, from 0000NZVC in T1 and V moved under N in T2.
+func (b *builder) signOfDifference() {
+	b.add("CMux=0, C=%d; LoadCk", RegT1)
+	b.add("A=%d, AMux=1, ALU=11, CMux=1, C=%d; LoadCk", RegT1, RegT2)
+	b.add("A=%d, AMux=1, ALU=11, CMux=1, C=%d; LoadCk", RegT2, RegT2)
+	b.add("A=%d, B=%d, AMux=1, ALU=9, CMux=1, C=%d; LoadCk", RegT1, RegT2, RegT1)
+	b.add("A=%d, AMux=1, ALU=15; NCk", RegT1)
+}
+
+// trap saves the processor state on the system stack and jumps to the
+// operating system's trap handler:
+//
+//	T ← Mem[FFF6]; Mem[T-1] ← IR<0..7>; Mem[T-3] ← SP; Mem[T-5] ← PC;
+//	Mem[T-7] ← X; Mem[T-9] ← A; Mem[T-10]<4..7> ← NZVC; SP ← T-10;
+//	PC ← Mem[FFFE]
+//
+// T is kept in T3 and the address being written in T4.
+func (b *builder) trap() {
+	t, at := pair(RegT3), pair(RegT4)
+	b.readWord(word{xFF, xF6}, t)
+	b.arith(3, 4, t, word{zero, one}, at, "")
+	b.writeByte(at, RegIR)
+	for _, r := range []int{RegSP, RegPC, RegX, RegA} {
+		b.arith(3, 4, at, word{zero, two}, at, "")
+		b.writeWord(at, pair(r))
+	}
+	b.arith(3, 4, at, word{zero, one}, at, "")
+	b.writeFlags(at)
+	b.copyWord(at, pair(RegSP))
+	b.readWord(word{xFF, xFE}, pair(RegPC))
+	b.then(End, "")
+}
+
+// returnFromTrap restores the state saved by a trap (RETTR):
+//
+//	NZVC ← Mem[SP]<4..7>; A ← Mem[SP+1]; X ← Mem[SP+3]; PC ← Mem[SP+5];
+//	SP ← Mem[SP+7]
+func (b *builder) returnFromTrap() {
+	sp, at := pair(RegSP), pair(RegT4)
+	b.readByte(sp, RegT1)
+	b.add("A=%d, AMux=1, ALU=15; NCk, ZCk, VCk, CCk", RegT1)
+	b.arith(1, 2, sp, word{zero, one}, at, "")
+	for _, r := range []int{RegA, RegX, RegPC, RegSP} {
+		b.readWord(at, pair(r))
+		if r != RegSP {
+			b.arith(1, 2, at, word{zero, two}, at, "")
+		}
+	}
+}
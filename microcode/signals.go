@@ -0,0 +1,219 @@
+package microcode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Signal is a control line of the datapath. Selectors and multiplexers
+// carry a value, the memory lines and the clocks are asserted or not.
+type Signal int
+
+const (
+	A        Signal = iota // Register put on the A bus
+	B                      // Register put on the B bus
+	C                      // Register written from the C bus by LoadCk
+	AMux                   // ALU left input: 0 MDR (EOMux on the two-byte bus), 1 the A bus
+	CMux                   // C bus: 0 the status bits as 0000NZVC, 1 the ALU
+	ALU                    // ALU function, 0-15
+	CSMux                  // ALU carry in: 0 the C bit, 1 the S bit
+	AndZ                   // ZCk loads: 0 the ALU's Z, 1 the ALU's Z and Z
+	MDRMux                 // MDR input: 0 the system bus, 1 the C bus
+	MARMux                 // Two-byte bus MAR input: 0 MDRE and MDRO, 1 the A and B buses
+	MDREMux                // Two-byte bus MDRE input: 0 the system bus, 1 the C bus
+	MDROMux                // Two-byte bus MDRO input: 0 the system bus, 1 the C bus
+	EOMux                  // Two-byte bus AMux input: 0 MDRE, 1 MDRO
+	MemRead                // Put the byte, or the word, at MAR on the system bus
+	MemWrite               // Write MDR, or MDRE and MDRO, to memory at MAR
+	LoadCk                 // Clocks the C bus into register C
+	MARCk                  // Clocks MAR from the A and B buses, or MARMux
+	MDRCk                  // Clocks the MDRMux output into MDR
+	MDRECk                 // Clocks the MDREMux output into MDRE
+	MDROCk                 // Clocks the MDROMux output into MDRO
+	NCk
+	ZCk
+	VCk
+	CCk
+	SCk
+	numSignals
+)
+
+var signalNames = [numSignals]string{
+	"A", "B", "C", "AMux", "CMux", "ALU", "CSMux", "AndZ", "MDRMux", "MARMux", "MDREMux", "MDROMux", "EOMux",
+	"MemRead", "MemWrite", "LoadCk", "MARCk", "MDRCk", "MDRECk", "MDROCk", "NCk", "ZCk", "VCk", "CCk", "SCk",
+}
+
+func (s Signal) String() string {
+	if s >= 0 && s < numSignals {
+		return signalNames[s]
+	}
+	return fmt.Sprintf("Signal(%d)", int(s))
+}
+
+// IsClock reports whether the signal is a clock, written after the
+// semicolon of a microinstruction.
+func (s Signal) IsClock() bool {
+	return s >= LoadCk
+}
+
+// isLine reports whether the signal is a memory line, which is written
+// without a value.
+func (s Signal) isLine() bool {
+	return s == MemRead || s == MemWrite
+}
+
+// Max is the largest value the signal can take.
+func (s Signal) Max() uint8 {
+	switch s {
+	case A, B, C:
+		return registerCount - 1
+	case ALU:
+		return 15
+	}
+	return 1
+}
+
+// lookupSignal finds a signal by its case insensitive name.
+func lookupSignal(name string) (Signal, bool) {
+	for s, n := range signalNames {
+		if strings.EqualFold(n, name) {
+			return Signal(s), true
+		}
+	}
+	return 0, false
+}
+
+// Code is the control word of one cycle. Signals that are not set are not
+// asserted, or for selectors, not used.
+type Code struct {
+	set    uint32
+	values [numSignals]uint8
+}
+
+// Set sets a signal. Clocks and memory lines are asserted with 1.
+func (c *Code) Set(s Signal, value uint8) {
+	c.set |= 1 << s
+	c.values[s] = value
+}
+
+// Get returns the value of a signal and whether it is set.
+func (c Code) Get(s Signal) (uint8, bool) {
+	return c.values[s], c.set&(1<<s) != 0
+}
+
+// Has reports whether a signal is set, which for a clock or a memory line
+// means it is asserted.
+func (c Code) Has(s Signal) bool {
+	value, ok := c.Get(s)
+	return ok && (value != 0 || !s.IsClock() && !s.isLine())
+}
+
+// is reports whether a signal is set to value.
+func (c Code) is(s Signal, value uint8) bool {
+	v, ok := c.Get(s)
+	return ok && v == value
+}
+
+// String formats the code the way ParseCode reads it, such as
+//
+//	A=6, B=7; MARCk
+func (c Code) String() string {
+	var signals, clocks []string
+	for s := Signal(0); s < numSignals; s++ {
+		value, ok := c.Get(s)
+		switch {
+		case !ok:
+		case s.IsClock():
+			if value != 0 {
+				clocks = append(clocks, s.String())
+			}
+		case s.isLine():
+			if value != 0 {
+				signals = append(signals, s.String())
+			}
+		default:
+			signals = append(signals, fmt.Sprintf("%v=%d", s, value))
+		}
+	}
+	text := strings.Join(signals, ", ")
+	if len(clocks) > 0 {
+		text += "; " + strings.Join(clocks, ", ")
+	}
+	return text
+}
+
+// ParseCode reads a control word written as in the textbook: signals with
+// their values, then a semicolon and the clocks, such as
+//
+//	MemRead, A=7, B=23, AMux=1, ALU=1, CMux=1, C=7, MDRMux=0; MDRCk, SCk, LoadCk
+//
+// Either part may be empty, and signals with values may also follow the
+// semicolon. Names are not case sensitive.
+func ParseCode(text string) (Code, error) {
+	var code Code
+	signals, clocks, _ := strings.Cut(text, ";")
+
+	signal := func(field string) error {
+		name, value, hasValue := strings.Cut(field, "=")
+		name = strings.TrimSpace(name)
+		s, ok := lookupSignal(name)
+		if !ok {
+			return fmt.Errorf("unknown signal %q", name)
+		}
+		if s.IsClock() {
+			return fmt.Errorf("clock %v before the semicolon", s)
+		}
+		v := uint64(1)
+		switch {
+		case hasValue:
+			var err error
+			v, err = strconv.ParseUint(strings.TrimSpace(value), 0, 8)
+			if err != nil || uint8(v) > s.Max() {
+				return fmt.Errorf("invalid value %q for %v", strings.TrimSpace(value), s)
+			}
+		case !s.isLine():
+			return fmt.Errorf("signal %v needs a value", s)
+		}
+		if _, ok := code.Get(s); ok {
+			return fmt.Errorf("signal %v is set twice", s)
+		}
+		code.Set(s, uint8(v))
+		return nil
+	}
+
+	for _, field := range splitList(signals) {
+		if err := signal(field); err != nil {
+			return Code{}, err
+		}
+	}
+
+	for _, name := range splitList(clocks) {
+		if strings.Contains(name, "=") {
+			if err := signal(name); err != nil {
+				return Code{}, err
+			}
+			continue
+		}
+		s, ok := lookupSignal(name)
+		if !ok || !s.IsClock() {
+			return Code{}, fmt.Errorf("unknown clock %q", name)
+		}
+		if code.Has(s) {
+			return Code{}, fmt.Errorf("clock %v is set twice", s)
+		}
+		code.Set(s, 1)
+	}
+	return code, nil
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(text string) []string {
+	var items []string
+	for _, item := range strings.Split(text, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,276 @@
+package microcode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Source is a microprogram read from the text of a .pepcpu file: a control
+// word per line, run one per cycle, with the conditions of its UnitPre and
+// UnitPost lines. A file such as
+//
+//	// ADDA this,i
+//	UnitPre: IR=0x700FF0, A=0x0F11, N=1, Z=1, V=1, C=0
+//	UnitPost: A=0x1F01, N=0, Z=0, V=0, C=0
+//	A=1, B=10, AMux=1, ALU=1, CMux=1, C=1; SCk, LoadCk
+//	A=0, B=9, AMux=1, CSMux=1, ALU=2, AndZ=1, CMux=1, C=0; NCk, ZCk, VCk, CCk, LoadCk
+//
+// is a unit test of the microcode for an instruction.
+type Source struct {
+	Cycles []Statement
+	Pre    []Assertion // Set before the first cycle
+	Post   []Assertion // Checked after the last cycle
+}
+
+// Statement is a control word and the line it was read from.
+type Statement struct {
+	Line int
+	Code Code
+}
+
+// Assertion is one condition of a UnitPre or UnitPost line. It names a
+// register of the bank (A, X, SP, PC, IR, T1 to T6), a status bit (N, Z,
+// V, C, S), MARA, MARB, MDR, MDRE, MDRO or Mem[address]. A memory value
+// written with more than two hex digits, or larger than a byte, is a word.
+type Assertion struct {
+	Line  int
+	Name  string
+	Value uint32
+	field field
+}
+
+// field is the part of the CPU an assertion names: bytes held high byte
+// first, or a status bit.
+type field struct {
+	size   int // Bytes, 0 for a status bit
+	byteAt func(cpu *CPU, i int) *uint8
+	bit    func(cpu *CPU) *bool
+}
+
+func (f field) get(cpu *CPU) uint32 {
+	if f.size == 0 {
+		if *f.bit(cpu) {
+			return 1
+		}
+		return 0
+	}
+	var value uint32
+	for i := 0; i < f.size; i++ {
+		value = value<<8 | uint32(*f.byteAt(cpu, i))
+	}
+	return value
+}
+
+func (f field) set(cpu *CPU, value uint32) {
+	if f.size == 0 {
+		*f.bit(cpu) = value != 0
+		return
+	}
+	for i := f.size - 1; i >= 0; i-- {
+		*f.byteAt(cpu, i) = uint8(value)
+		value >>= 8
+	}
+}
+
+// format prints a value with the digits of the field.
+func (f field) format(value uint32) string {
+	if f.size == 0 {
+		return strconv.Itoa(int(value))
+	}
+	return fmt.Sprintf("0x%0*X", 2*f.size, value)
+}
+
+// registerFields are the fields of the register bank by name, first
+// register and size.
+var registerFields = map[string][2]int{
+	"A": {RegA, 2}, "X": {RegX, 2}, "SP": {RegSP, 2}, "PC": {RegPC, 2}, "IR": {RegIR, 3},
+	"T1": {RegT1, 1}, "T2": {RegT2, 2}, "T3": {RegT3, 2}, "T4": {RegT4, 2}, "T5": {RegT5, 2}, "T6": {RegT6, 2},
+}
+
+var bitFields = map[string]func(cpu *CPU) *bool{
+	"N": func(cpu *CPU) *bool { return &cpu.N },
+	"Z": func(cpu *CPU) *bool { return &cpu.Z },
+	"V": func(cpu *CPU) *bool { return &cpu.V },
+	"C": func(cpu *CPU) *bool { return &cpu.C },
+	"S": func(cpu *CPU) *bool { return &cpu.S },
+}
+
+var byteFields = map[string]func(cpu *CPU) *uint8{
+	"MARA": func(cpu *CPU) *uint8 { return &cpu.MARA },
+	"MARB": func(cpu *CPU) *uint8 { return &cpu.MARB },
+	"MDR":  func(cpu *CPU) *uint8 { return &cpu.MDR },
+	"MDRE": func(cpu *CPU) *uint8 { return &cpu.MDRE },
+	"MDRO": func(cpu *CPU) *uint8 { return &cpu.MDRO },
+}
+
+// parseAssertion reads name=value.
+func parseAssertion(line int, text string) (Assertion, error) {
+	name, valueText, ok := strings.Cut(text, "=")
+	name, valueText = strings.TrimSpace(name), strings.TrimSpace(valueText)
+	if !ok || name == "" || valueText == "" {
+		return Assertion{}, fmt.Errorf("expected name=value but got %q", text)
+	}
+	value, err := strconv.ParseUint(valueText, 0, 32)
+	if err != nil {
+		return Assertion{}, fmt.Errorf("invalid value %q for %s", valueText, name)
+	}
+
+	a := Assertion{Line: line, Name: name, Value: uint32(value)}
+	upper := strings.ToUpper(name)
+	if r, ok := registerFields[upper]; ok {
+		a.field = field{size: r[1], byteAt: func(cpu *CPU, i int) *uint8 { return &cpu.Registers[r[0]+i] }}
+	} else if bit, ok := bitFields[upper]; ok {
+		a.field = field{bit: bit}
+	} else if b, ok := byteFields[upper]; ok {
+		a.field = field{size: 1, byteAt: func(cpu *CPU, _ int) *uint8 { return b(cpu) }}
+	} else if strings.HasPrefix(upper, "MEM[") && strings.HasSuffix(upper, "]") {
+		address, err := strconv.ParseUint(strings.TrimSpace(name[4:len(name)-1]), 0, 16)
+		if err != nil {
+			return Assertion{}, fmt.Errorf("invalid address in %s", name)
+		}
+		size := 1
+		if lower := strings.ToLower(valueText); value > 0xFF || strings.HasPrefix(lower, "0x") && len(lower) > 4 {
+			size = 2
+		}
+		a.field = field{size: size, byteAt: func(cpu *CPU, i int) *uint8 { return &cpu.Ram[uint16(int(address)+i)] }}
+	} else {
+		return Assertion{}, fmt.Errorf("unknown register %q", name)
+	}
+
+	max := uint64(1)
+	if a.field.size > 0 {
+		max = 1<<(8*a.field.size) - 1
+	}
+	if value > max {
+		return Assertion{}, fmt.Errorf("value %s does not fit in %s", valueText, name)
+	}
+	return a, nil
+}
+
+// Error reports a problem with a single line of microcode source.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// ErrorList is every error found in microcode source, in line order.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+// ParseSource reads microcode source. Comments start with // and run to
+// the end of the line. Every error is reported, as an ErrorList.
+func ParseSource(text string) (*Source, error) {
+	var (
+		source Source
+		errs   ErrorList
+	)
+	for i, line := range strings.Split(text, "\n") {
+		number := i + 1
+		if comment := strings.Index(line, "//"); comment >= 0 {
+			line = line[:comment]
+		}
+		line = strings.TrimSpace(line)
+
+		var list *[]Assertion
+		if rest, ok := cutPrefixFold(line, "UnitPre:"); ok {
+			list, line = &source.Pre, rest
+		} else if rest, ok := cutPrefixFold(line, "UnitPost:"); ok {
+			list, line = &source.Post, rest
+		}
+		switch {
+		case list != nil:
+			for _, item := range splitList(line) {
+				a, err := parseAssertion(number, item)
+				if err != nil {
+					errs = append(errs, &Error{Line: number, Msg: err.Error()})
+					continue
+				}
+				*list = append(*list, a)
+			}
+		case line != "":
+			code, err := ParseCode(line)
+			if err != nil {
+				errs = append(errs, &Error{Line: number, Msg: err.Error()})
+				continue
+			}
+			source.Cycles = append(source.Cycles, Statement{Line: number, Code: code})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return &source, nil
+}
+
+// cutPrefixFold is strings.CutPrefix ignoring case.
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+		return s[len(prefix):], true
+	}
+	return s, false
+}
+
+// Failure is a UnitPost condition that did not hold, or a control word the
+// datapath rejected.
+type Failure struct {
+	Line  int // Line of the condition or control word
+	Cycle int // The cycle that failed, or the last to change the value, 0 for none
+	Msg   string
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("line %d, cycle %d: %s", f.Line, f.Cycle, f.Msg)
+}
+
+// Test runs the microprogram as a unit test on cpu, usually just Reset: it
+// sets the UnitPre conditions, runs a cycle for each control word and
+// checks the UnitPost conditions, returning the failures. A failed
+// condition reports the last cycle that changed the value it checks. A
+// control word the datapath rejects ends the run.
+func (s *Source) Test(cpu *CPU) []*Failure {
+	for _, a := range s.Pre {
+		a.field.set(cpu, a.Value)
+	}
+
+	changed := make([]int, len(s.Post))
+	for i, statement := range s.Cycles {
+		before := make([]uint32, len(s.Post))
+		for j, a := range s.Post {
+			before[j] = a.field.get(cpu)
+		}
+		if err := cpu.Cycle(statement.Code); err != nil {
+			return []*Failure{{Line: statement.Line, Cycle: i + 1, Msg: err.Error()}}
+		}
+		for j, a := range s.Post {
+			if a.field.get(cpu) != before[j] {
+				changed[j] = i + 1
+			}
+		}
+	}
+
+	var failures []*Failure
+	for i, a := range s.Post {
+		if got := a.field.get(cpu); got != a.Value {
+			failures = append(failures, &Failure{
+				Line:  a.Line,
+				Cycle: changed[i],
+				Msg:   fmt.Sprintf("%s is %s, expected %s", a.Name, a.field.format(got), a.field.format(a.Value)),
+			})
+		}
+	}
+	return failures
+}
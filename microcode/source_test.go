@@ -0,0 +1,98 @@
+package microcode
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// adda is the textbook's ADDA this,i with its unit test.
+const adda = `// ADDA this,i
+// RTL: A <- A + Oprnd; N <- A<0, Z <- A=0, V <- {overflow}, C <- {carry}
+
+UnitPre: IR=0x700FF0, A=0x0F11, N=1, Z=1, V=1, C=0
+UnitPost: A=0x1F01, N=0, Z=0, V=0, C=0
+
+// A<low> <- A<low> plus Oprnd<low>, save the carry
+A=1, B=10, AMux=1, ALU=1, CMux=1, C=1; SCk, LoadCk
+// A<high> <- A<high> plus Oprnd<high> plus saved carry
+A=0, B=9, AMux=1, CSMux=1, ALU=2, AndZ=1, CMux=1, C=0; NCk, ZCk, VCk, CCk, LoadCk
+`
+
+func test(t *testing.T, bus Bus, text string) []*Failure {
+	t.Helper()
+	source, err := ParseSource(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := CPU{Bus: bus}
+	cpu.Reset()
+	return source.Test(&cpu)
+}
+
+func TestSourcePasses(t *testing.T) {
+	source, err := ParseSource(adda)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(source.Cycles) != 2 || len(source.Pre) != 6 || len(source.Post) != 5 || source.Cycles[1].Line != 10 {
+		t.Errorf("parsed %+v", source)
+	}
+	if failures := test(t, OneByte, adda); len(failures) != 0 {
+		t.Errorf("failures %v", failures)
+	}
+}
+
+func TestSourceFailures(t *testing.T) {
+	// Without saving the carry the high byte is 0x1E rather than 0x1F.
+	failures := test(t, OneByte, `UnitPre: IR=0x700FF0, A=0x0F11
+UnitPost: A=0x1F01, X=0x0000, C=0
+A=1, B=10, AMux=1, ALU=1, CMux=1, C=1; LoadCk
+A=0, B=9, AMux=1, ALU=1, CMux=1, C=0; CCk, LoadCk`)
+	if got := fmt.Sprint(failures); got != "[line 2, cycle 2: A is 0x1E01, expected 0x1F01]" {
+		t.Errorf("got %s", got)
+	}
+
+	failures = test(t, OneByte, `UnitPost: A=1
+A=1, AMux=1, ALU=0, CMux=1, C=1; LoadCk
+MDRMux=0; MDRCk
+A=1, AMux=1, ALU=0, CMux=1, C=1; LoadCk`)
+	if got := fmt.Sprint(failures); got != "[line 3, cycle 2: MemRead is needed but not set]" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestSourceMemory(t *testing.T) {
+	// Copies the word at 0x0A3E to 0x0A40 in one access each way on the
+	// two-byte bus.
+	failures := test(t, TwoByte, `
+UnitPre: Mem[0x0A3E]=0x12AB, T2=0x0A3E, T3=0x0A40
+UnitPost: Mem[0x0A40]=0x12AB, Mem[0x0A42]=0x00, MDRE=0x12
+A=12, B=13, MARMux=1; MARCk
+MemRead, MDREMux=0, MDROMux=0; MDRECk, MDROCk
+A=14, B=15, MARMux=1, AMux=0, EOMux=0, ALU=0, CMux=1, MDREMux=1; MARCk, MDRECk
+AMux=0, EOMux=1, ALU=0, CMux=1, MDROMux=1; MDROCk
+MemWrite`)
+	if len(failures) != 0 {
+		t.Errorf("failures %v", failures)
+	}
+}
+
+func TestSourceErrors(t *testing.T) {
+	_, err := ParseSource(`UnitPre: A=0x10000, Q=1, N=2, Mem[0x10000]=1
+// fine
+A=1, B=2; MARCk
+A=32
+UnitPost: A`)
+	var list ErrorList
+	if !errors.As(err, &list) {
+		t.Fatalf("got %v, want an ErrorList", err)
+	}
+	var lines []int
+	for _, e := range list {
+		lines = append(lines, e.Line)
+	}
+	if fmt.Sprint(lines) != "[1 1 1 1 4 5]" {
+		t.Errorf("errors on lines %v: %v", lines, list)
+	}
+}
@@ -0,0 +1,125 @@
+package microcode
+
+// The memory routines of the two-byte data bus. MAR is clocked first and
+// its parity decides the path: a word at an even address is read or
+// written in one access, a word at an odd address straddles two words of
+// memory and takes two, with the address of the second kept in T2.
+
+// aligned clocks the address into MAR and continues with even when it is
+// even and odd when it is odd. The even path jumps past the odd one, and
+// both are left as the exits for then.
+func (b *builder) aligned(address word, even, odd func()) {
+	b.add("A=%d, B=%d, MARMux=1; MARCk", address.hi, address.lo)
+	test := len(b.code) - 1
+	b.code[test].Branch = IfMAROdd
+
+	even()
+	exits := append([]int(nil), b.exits...)
+	b.code[test].Target = len(b.code)
+	odd()
+	for _, at := range exits {
+		b.code[at].Branch, b.code[at].Target = Goto, len(b.code)
+	}
+	b.exits = append(exits, b.exits...)
+}
+
+// nextAddress puts the address one past the odd address in a word of
+// registers into T2, alongside reading the odd byte of the word at MAR
+// when read is set.
+func (b *builder) nextAddress(address word, read bool) {
+	memory, clock := "", ""
+	if read {
+		memory, clock = "MemRead, MDROMux=0, ", "MDROCk, "
+	}
+	b.add("%sA=%d, B=%d, AMux=1, ALU=1, CMux=1, C=%d; %sSCk, LoadCk", memory, address.lo, one, RegT2+1, clock)
+	b.add("A=%d, B=%d, AMux=1, CSMux=1, ALU=2, CMux=1, C=%d; LoadCk", address.hi, zero, RegT2)
+}
+
+func (b *builder) readByteWide(address word, to int) {
+	b.aligned(address, func() {
+		b.add("MemRead, MDREMux=0; MDRECk")
+		b.add("AMux=0, EOMux=0, ALU=0, CMux=1, C=%d; LoadCk", to)
+	}, func() {
+		b.add("MemRead, MDROMux=0; MDROCk")
+		b.add("AMux=0, EOMux=1, ALU=0, CMux=1, C=%d; LoadCk", to)
+	})
+}
+
+func (b *builder) readWordWide(address, to word) {
+	b.aligned(address, func() {
+		b.add("MemRead, MDREMux=0, MDROMux=0; MDRECk, MDROCk")
+		b.add("AMux=0, EOMux=0, ALU=0, CMux=1, C=%d; LoadCk", to.hi)
+		b.add("AMux=0, EOMux=1, ALU=0, CMux=1, C=%d; LoadCk", to.lo)
+	}, func() {
+		b.nextAddress(address, true)
+		b.add("A=%d, B=%d, MARMux=1, AMux=0, EOMux=1, ALU=0, CMux=1, C=%d; MARCk, LoadCk", RegT2, RegT2+1, to.hi)
+		b.add("MemRead, MDREMux=0; MDRECk")
+		b.add("AMux=0, EOMux=0, ALU=0, CMux=1, C=%d; LoadCk", to.lo)
+	})
+}
+
+func (b *builder) writeByteWide(address word, from int) {
+	b.aligned(address, func() {
+		b.add("A=%d, AMux=1, ALU=0, CMux=1, MDREMux=1; MDRECk", from)
+		b.add("MemWrite")
+	}, func() {
+		b.add("A=%d, AMux=1, ALU=0, CMux=1, MDROMux=1; MDROCk", from)
+		b.add("MemWrite")
+	})
+}
+
+func (b *builder) writeWordWide(address, from word) {
+	b.aligned(address, func() {
+		b.add("A=%d, AMux=1, ALU=0, CMux=1, MDREMux=1; MDRECk", from.hi)
+		b.add("A=%d, AMux=1, ALU=0, CMux=1, MDROMux=1; MDROCk", from.lo)
+		b.add("MemWrite")
+	}, func() {
+		b.add("A=%d, AMux=1, ALU=0, CMux=1, MDROMux=1; MDROCk", from.hi)
+		b.add("MemWrite")
+		b.nextAddress(address, false)
+		b.add("A=%d, B=%d, MARMux=1; MARCk", RegT2, RegT2+1)
+		b.add("A=%d, AMux=1, ALU=0, CMux=1, MDREMux=1; MDRECk", from.lo)
+		b.add("MemWrite")
+	})
+}
+
+func (b *builder) writeFlagsWide(address word) {
+	b.aligned(address, func() {
+		b.add("CMux=0, MDREMux=1; MDRECk")
+		b.add("MemWrite")
+	}, func() {
+		b.add("CMux=0, MDROMux=1; MDROCk")
+		b.add("MemWrite")
+	})
+}
+
+// fetchWide is fetch on the two-byte bus. At an even PC the instruction
+// specifier and the first operand byte share a word and the second operand
+// byte is read with MAR left at PC+3, which selects the same even byte. At
+// an odd PC the operand specifier is a whole word.
+func (b *builder) fetchWide() {
+	// increment adds a constant to PC, reading memory alongside with the
+	// signals and clocks given.
+	increment := func(by int, read, clocks string) {
+		b.add("MemRead, %s, A=%d, B=%d, AMux=1, ALU=1, CMux=1, C=%d; %s, SCk, LoadCk", read, RegPC+1, by, RegPC+1, clocks)
+		b.add("A=%d, B=%d, AMux=1, CSMux=1, ALU=2, CMux=1, C=%d; LoadCk", RegPC, zero, RegPC)
+	}
+
+	b.aligned(pair(RegPC), func() {
+		increment(one, "MDREMux=0", "MDRECk")
+		b.add("AMux=0, EOMux=0, ALU=0, CMux=1, C=%d; LoadCk", RegIR)
+		b.then(IfUnary, "")
+		increment(two, "MDROMux=0", "MDROCk")
+		b.add("A=%d, B=%d, MARMux=1, AMux=0, EOMux=1, ALU=0, CMux=1, C=%d; MARCk, LoadCk", RegPC, RegPC+1, RegIR+1)
+		b.add("MemRead, MDREMux=0; MDRECk")
+		b.add("AMux=0, EOMux=0, ALU=0, CMux=1, C=%d; LoadCk", RegIR+2)
+	}, func() {
+		increment(one, "MDROMux=0", "MDROCk")
+		b.add("A=%d, B=%d, MARMux=1, AMux=0, EOMux=1, ALU=0, CMux=1, C=%d; MARCk, LoadCk", RegPC, RegPC+1, RegIR)
+		b.then(IfUnary, "")
+		increment(two, "MDREMux=0, MDROMux=0", "MDRECk, MDROCk")
+		b.add("AMux=0, EOMux=0, ALU=0, CMux=1, C=%d; LoadCk", RegIR+1)
+		b.add("AMux=0, EOMux=1, ALU=0, CMux=1, C=%d; LoadCk", RegIR+2)
+	})
+	b.then(Decode, "")
+}
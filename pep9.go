@@ -1,12 +1,730 @@
 package main
 
-import "pep9emulator/computer"
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"pep9emulator/assembler"
+	"pep9emulator/computer"
+	"pep9emulator/dap"
+	"pep9emulator/debugger"
+	"pep9emulator/disasm"
+	"pep9emulator/gdbstub"
+	"pep9emulator/microcode"
+	"pep9emulator/trace"
+)
+
+// Exit codes, so scripts can tell a clean STOP from a crash.
+const (
+	exitHalt       = 0 // The program executed STOP
+	exitError      = 1 // A file could not be read, written or assembled
+	exitUsage      = 2 // The command line was invalid
+	exitIllegal    = 3 // The program executed an illegal instruction
+	exitStepLimit  = 4 // The program did not stop within the step limit
+	exitProtection = 5 // The program stored into the operating system ROM
+	exitFailed     = 6 // A microcode unit test failed
+)
+
+const usage = `usage: pep9 <command> [arguments]
+
+Commands:
+  asm     prog.pep [-o prog.pepo] [-l prog.pepl]   assemble source to an object file
+  run     prog.pepo [-input in.txt] [-limit n]      run a program, -trace file logs each instruction
+  disasm  prog.pepo [-base addr]                    disassemble an object file
+  dump    prog.pepo -range 0000-00FF [-format f]    run a program then dump memory
+  debug   prog.pep [-input in.txt]                  debug a program interactively
+  gdbserver prog.pep [-listen addr]                 wait for gdb to debug a program
+  dap     [-attach prog.pep] [-input in.txt]        serve the Debug Adapter Protocol on stdio
+  cpu     test.pepcpu [-bus two-byte]               run microcode and check its UnitPre/UnitPost test
+
+Programs may be given as object files (.pepo) or source (.pep).
+`
 
 func main() {
-	p := computer.Pep9Computer{}
-	program := []byte{0x00}
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// cli holds the standard streams so commands can be run from tests.
+type cli struct {
+	stdin          io.Reader
+	stdout, stderr io.Writer
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	c := &cli{stdin, stdout, stderr}
+
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "asm":
+		return c.asm(args[1:])
+	case "run":
+		return c.run(args[1:])
+	case "disasm":
+		return c.disasm(args[1:])
+	case "dump":
+		return c.dump(args[1:])
+	case "debug":
+		return c.debug(args[1:])
+	case "gdbserver":
+		return c.gdbserver(args[1:])
+	case "dap":
+		return c.dap(args[1:])
+	case "cpu":
+		return c.cpu(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return exitHalt
+	}
+
+	fmt.Fprintf(stderr, "pep9: unknown command %q\n\n%s", args[0], usage)
+	return exitUsage
+}
+
+func (c *cli) errorf(format string, args ...interface{}) {
+	fmt.Fprintf(c.stderr, "pep9: "+format+"\n", args...)
+}
+
+func (c *cli) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("pep9 "+name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	return fs
+}
+
+// parse parses flags that may be mixed with positional arguments, as in
+// "pep9 asm prog.pep -o prog.pepo", and checks the number of positionals.
+func (c *cli) parse(fs *flag.FlagSet, args []string, positionals int) ([]string, bool) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, false
+		}
+		if args = fs.Args(); len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	if len(positional) != positionals {
+		c.errorf("%s expects %d file argument(s) but got %d", fs.Name(), positionals, len(positional))
+		return nil, false
+	}
+	return positional, true
+}
+
+func (c *cli) asm(args []string) int {
+	fs := c.flags("asm")
+	output := fs.String("o", "", "object file to write, default the source with a .pepo extension")
+	listing := fs.String("l", "", "listing file to write")
+	files, ok := c.parse(fs, args, 1)
+	if !ok {
+		return exitUsage
+	}
+
+	program, err := c.assemble(files[0])
+	if err != nil {
+		return exitError
+	}
+
+	if *output == "" {
+		*output = strings.TrimSuffix(files[0], filepath.Ext(files[0])) + ".pepo"
+	}
+	if err := writeFile(*output, program.WriteObject); err != nil {
+		c.errorf("%v", err)
+		return exitError
+	}
+	if *listing != "" {
+		err := writeFile(*listing, func(w io.Writer) error {
+			_, err := program.Listing().WriteTo(w)
+			return err
+		})
+		if err != nil {
+			c.errorf("%v", err)
+			return exitError
+		}
+	}
+
+	return exitHalt
+}
+
+// runFlags are shared by the commands that run a program.
+type runFlags struct {
+	input, output *string
+	limit         *int
+
+	trace, traceFormat, traceRange *string
+	traceSkip, traceLimit          *int
+
+	timing *string
+}
+
+func (c *cli) runFlags(fs *flag.FlagSet) runFlags {
+	return runFlags{
+		input:       fs.String("input", "", "file to read as charIn, default standard input"),
+		output:      fs.String("output", "", "file to write charOut to"),
+		limit:       fs.Int("limit", 0, "stop after this many instructions, 0 for no limit"),
+		trace:       fs.String("trace", "", "file to write an instruction trace to, - for standard error"),
+		traceFormat: fs.String("trace-format", "text", "trace format: text or jsonl"),
+		traceRange:  fs.String("trace-range", "", "only trace instructions in these address ranges, e.g. 0000-00FF"),
+		traceSkip:   fs.Int("trace-skip", 0, "instructions to execute before tracing starts"),
+		traceLimit:  fs.Int("trace-limit", 0, "most instructions to trace, 0 for no limit"),
+		timing:      fs.String("timing", "", "count cycles on a one-byte or two-byte data bus and report them"),
+	}
+}
+
+// timing returns the cycle model named by -timing, nil for none.
+func timing(name string) (*computer.Timing, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "one-byte":
+		return computer.OneByteBus, nil
+	case "two-byte":
+		return computer.TwoByteBus, nil
+	}
+	return nil, fmt.Errorf("unknown timing %q, use one-byte or two-byte", name)
+}
+
+// tracer creates the tracer the flags ask for, or nil for none. The
+// returned function closes its file.
+func (c *cli) tracer(rf runFlags) (*trace.Tracer, func() error, error) {
+	if *rf.trace == "" {
+		return nil, func() error { return nil }, nil
+	}
+	format, err := trace.ParseFormat(*rf.traceFormat)
+	if err != nil {
+		return nil, nil, err
+	}
+	ranges, err := parseRanges(*rf.traceRange)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var w io.Writer = c.stderr
+	closeFile := func() error { return nil }
+	if *rf.trace != "-" {
+		f, err := os.Create(*rf.trace)
+		if err != nil {
+			return nil, nil, err
+		}
+		bw := bufio.NewWriter(f)
+		w = bw
+		closeFile = func() error {
+			if err := bw.Flush(); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		}
+	}
+
+	t := trace.New(w, format)
+	t.Ranges, t.Skip, t.Limit = ranges, *rf.traceSkip, *rf.traceLimit
+	return t, closeFile, nil
+}
+
+func (c *cli) run(args []string) int {
+	fs := c.flags("run")
+	rf := c.runFlags(fs)
+	files, ok := c.parse(fs, args, 1)
+	if !ok {
+		return exitUsage
+	}
+
+	_, code := c.execute(files[0], rf, c.stdout)
+	return code
+}
+
+func (c *cli) dump(args []string) int {
+	fs := c.flags("dump")
+	rf := c.runFlags(fs)
+	ranges := fs.String("range", "", "comma separated address ranges to dump, e.g. 0000-00FF,FB00-FB8F")
+	format := fs.String("format", "hex", "dump format: hex, ihex or srec")
+	files, ok := c.parse(fs, args, 1)
+	if !ok {
+		return exitUsage
+	}
+
+	var dump func(m *computer.Memory, w io.Writer, ranges ...computer.AddressRange) error
+	switch *format {
+	case "hex":
+		dump = (*computer.Memory).Dump
+	case "ihex":
+		dump = (*computer.Memory).DumpIntelHex
+	case "srec":
+		dump = (*computer.Memory).DumpSRecord
+	default:
+		c.errorf("unknown dump format %q", *format)
+		return exitUsage
+	}
+	rs, err := parseRanges(*ranges)
+	if err != nil {
+		c.errorf("%v", err)
+		return exitUsage
+	}
+
+	// The program's own output is only kept when asked for, so it does not
+	// mix with the dump.
+	p, code := c.execute(files[0], rf, io.Discard)
+	if p == nil {
+		return code
+	}
+	if err := dump(&p.Memory, c.stdout, rs...); err != nil {
+		c.errorf("%v", err)
+		return exitError
+	}
+	return code
+}
+
+// promptReader flushes the program's output before waiting for input, so
+// a prompt is written out before the program reads the answer.
+type promptReader struct {
+	io.Reader
+	out *bufio.Writer
+}
+
+func (r promptReader) Read(b []byte) (int, error) {
+	r.out.Flush() // An error is kept by out and reported after the run
+	return r.Reader.Read(b)
+}
 
+// execute loads and runs a program, returning the computer and the exit
+// code for how it ended. The computer is nil if the program never ran.
+func (c *cli) execute(file string, rf runFlags, stdout io.Writer) (*computer.Pep9Computer, int) {
+	object, origin, symbols, err := c.load(file)
+	if err != nil {
+		return nil, exitError
+	}
+	model, err := timing(*rf.timing)
+	if err != nil {
+		c.errorf("%v", err)
+		return nil, exitUsage
+	}
+
+	p := &computer.Pep9Computer{CallStack: &computer.CallStack{}}
+	p.CharIn.Reader = c.stdin
+	if *rf.input != "" {
+		f, err := os.Open(*rf.input)
+		if err != nil {
+			c.errorf("%v", err)
+			return nil, exitError
+		}
+		defer f.Close()
+		p.CharIn.Reader = f
+	}
+
+	out := stdout
+	if *rf.output != "" {
+		f, err := os.Create(*rf.output)
+		if err != nil {
+			c.errorf("%v", err)
+			return nil, exitError
+		}
+		defer f.Close()
+		out = f
+	}
+	bw := bufio.NewWriter(out)
+	p.CharIn.Reader = bufio.NewReader(promptReader{p.CharIn.Reader, bw})
+	p.CharOut.Writer = bw
+
+	tracer, closeTrace, err := c.tracer(rf)
+	if err != nil {
+		c.errorf("%v", err)
+		return nil, exitError
+	}
+
+	p.Initialize()
+	copy(p.Ram[origin:], object)
+	if tracer != nil {
+		tracer.Labels = disasm.LabelsFrom(symbols)
+		tracer.Attach(p)
+	}
+	p.Timing = model
+	runErr := p.Run(context.Background(), *rf.limit)
+	if model != nil {
+		c.errorf("%d cycles on the %s", p.Cycles, model.Name)
+	}
+	// A return that did not match its call is reported however the run
+	// ended, since a smashed stack can still reach STOP.
+	for _, bad := range p.CallStack.BadReturns {
+		c.errorf("%v", bad)
+	}
+
+	traceErr := closeTrace()
+	if traceErr == nil && tracer != nil {
+		traceErr = tracer.Err()
+	}
+	if traceErr != nil {
+		c.errorf("writing trace: %v", traceErr)
+		return p, exitError
+	}
+
+	if err := bw.Flush(); err != nil && p.CharOut.Err() == nil {
+		c.errorf("writing output: %v", err)
+		return p, exitError
+	}
+	if err := p.CharOut.Err(); err != nil {
+		c.errorf("writing output: %v", err)
+		return p, exitError
+	}
+	if err := p.CharIn.Err(); err != nil {
+		c.errorf("reading input: %v", err)
+		return p, exitError
+	}
+
+	switch {
+	case runErr == nil:
+		return p, exitHalt
+	case errors.Is(runErr, computer.ErrStepLimit):
+		c.errorf("%v after %d instructions", runErr, *rf.limit)
+		c.backtrace(p, symbols, runErr)
+		return p, exitStepLimit
+	case errors.Is(runErr, computer.ErrMemoryProtection):
+		c.errorf("%v", runErr)
+		c.backtrace(p, symbols, runErr)
+		return p, exitProtection
+	}
+	c.errorf("%v", runErr)
+	c.backtrace(p, symbols, runErr)
+	return p, exitIllegal
+}
+
+// backtrace reports how a program that crashed, or ran too long, got where
+// it was: the calls still active from the instruction that failed.
+func (c *cli) backtrace(p *computer.Pep9Computer, symbols assembler.SymbolTable, runErr error) {
+	pc := p.PC
+	var execErr *computer.ExecutionError
+	if errors.As(runErr, &execErr) {
+		pc = execErr.PC
+	}
+	debugger.New(p, symbols).WriteBacktrace(c.stderr, pc)
+}
+
+func (c *cli) debug(args []string) int {
+	fs := c.flags("debug")
+	input := fs.String("input", "", "file to read as charIn, default no input")
+	files, ok := c.parse(fs, args, 1)
+	if !ok {
+		return exitUsage
+	}
+
+	// Source gives the debugger the trace tags of its variables.
+	var program *assembler.Program
+	var object []byte
+	var origin uint16
+	var symbols assembler.SymbolTable
+	var err error
+	if filepath.Ext(files[0]) == ".pep" {
+		if program, err = c.assemble(files[0]); err != nil {
+			return exitError
+		}
+		object, origin, symbols = program.Object, program.Origin, program.Symbols
+	} else if object, origin, symbols, err = c.load(files[0]); err != nil {
+		return exitError
+	}
+
+	// Standard input holds the debugger commands, so the program only gets
+	// input from a file.
+	p := &computer.Pep9Computer{CallStack: &computer.CallStack{}}
+	if program != nil {
+		p.Variables = computer.NewVariables(program)
+	}
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			c.errorf("%v", err)
+			return exitError
+		}
+		defer f.Close()
+		p.CharIn.Reader = bufio.NewReader(f)
+	}
+	p.CharOut.Writer = c.stdout
+	p.Initialize()
+	copy(p.Ram[origin:], object)
+
+	repl := debugger.NewREPL(debugger.New(p, symbols), c.stdout)
+	repl.Context = func() (context.Context, context.CancelFunc) {
+		return signal.NotifyContext(context.Background(), os.Interrupt)
+	}
+	if err := repl.Run(c.stdin); err != nil {
+		c.errorf("%v", err)
+		return exitError
+	}
+	return exitHalt
+}
+
+func (c *cli) gdbserver(args []string) int {
+	fs := c.flags("gdbserver")
+	listen := fs.String("listen", "localhost:1234", "TCP address to wait for gdb on")
+	input := fs.String("input", "", "file to read as charIn, default standard input")
+	files, ok := c.parse(fs, args, 1)
+	if !ok {
+		return exitUsage
+	}
+
+	object, origin, _, err := c.load(files[0])
+	if err != nil {
+		return exitError
+	}
+
+	p := &computer.Pep9Computer{}
+	p.CharIn.Reader = c.stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			c.errorf("%v", err)
+			return exitError
+		}
+		defer f.Close()
+		p.CharIn.Reader = f
+	}
+	p.CharIn.Reader = bufio.NewReader(p.CharIn.Reader)
+	p.CharOut.Writer = c.stdout
 	p.Initialize()
-	p.LoadProgram(program)
-	p.ExecuteVonNeumann()
+	copy(p.Ram[origin:], object)
+
+	err = gdbstub.New(p).ListenAndServe(*listen, func(addr net.Addr) {
+		c.errorf("waiting for gdb on %s", addr)
+	})
+	if err != nil {
+		c.errorf("%v", err)
+		return exitError
+	}
+	return exitHalt
+}
+
+// dap serves an editor on the standard streams. Launch requests name their
+// own program, -attach loads one for attach requests.
+func (c *cli) dap(args []string) int {
+	fs := c.flags("dap")
+	attach := fs.String("attach", "", "program for attach requests")
+	input := fs.String("input", "", "file to read as charIn for the attached program, default no input")
+	if _, ok := c.parse(fs, args, 0); !ok {
+		return exitUsage
+	}
+
+	server := dap.New(c.stdin, c.stdout)
+	if *attach != "" {
+		var program *assembler.Program
+		var object []byte
+		var origin uint16
+		var err error
+		if filepath.Ext(*attach) == ".pep" {
+			if program, err = c.assemble(*attach); err != nil {
+				return exitError
+			}
+			object, origin = program.Object, program.Origin
+		} else if object, origin, _, err = c.load(*attach); err != nil {
+			return exitError
+		}
+
+		p := &computer.Pep9Computer{}
+		if *input != "" {
+			f, err := os.Open(*input)
+			if err != nil {
+				c.errorf("%v", err)
+				return exitError
+			}
+			defer f.Close()
+			p.CharIn.Reader = bufio.NewReader(f)
+		}
+		p.Initialize()
+		copy(p.Ram[origin:], object)
+		server.Attach(p, program, *attach)
+	}
+
+	if err := server.Serve(); err != nil {
+		c.errorf("%v", err)
+		return exitError
+	}
+	return exitHalt
+}
+
+// cpu runs a microcode source file on the datapath as a unit test,
+// printing each failed condition with the cycle that set its value.
+func (c *cli) cpu(args []string) int {
+	fs := c.flags("cpu")
+	busName := fs.String("bus", "one-byte", "data bus: one-byte or two-byte")
+	files, ok := c.parse(fs, args, 1)
+	if !ok {
+		return exitUsage
+	}
+	var bus microcode.Bus
+	switch *busName {
+	case "one-byte":
+		bus = microcode.OneByte
+	case "two-byte":
+		bus = microcode.TwoByte
+	default:
+		c.errorf("unknown bus %q, use one-byte or two-byte", *busName)
+		return exitUsage
+	}
+
+	text, err := os.ReadFile(files[0])
+	if err != nil {
+		c.errorf("%v", err)
+		return exitError
+	}
+	source, err := microcode.ParseSource(string(text))
+	if err != nil {
+		var list microcode.ErrorList
+		if errors.As(err, &list) {
+			for _, e := range list {
+				fmt.Fprintf(c.stderr, "%s:%d: %s\n", files[0], e.Line, e.Msg)
+			}
+		} else {
+			c.errorf("%s: %v", files[0], err)
+		}
+		return exitError
+	}
+
+	cpu := microcode.CPU{Bus: bus}
+	cpu.Reset()
+	failures := source.Test(&cpu)
+	for _, f := range failures {
+		fmt.Fprintf(c.stdout, "%s:%d: cycle %d: %s\n", files[0], f.Line, f.Cycle, f.Msg)
+	}
+	if len(failures) > 0 {
+		fmt.Fprintf(c.stdout, "FAIL %s\n", files[0])
+		return exitFailed
+	}
+	fmt.Fprintf(c.stdout, "ok %s, %d cycles\n", files[0], len(source.Cycles))
+	return exitHalt
+}
+
+func (c *cli) disasm(args []string) int {
+	fs := c.flags("disasm")
+	base := fs.String("base", "", "address the object code is loaded at, in hex")
+	files, ok := c.parse(fs, args, 1)
+	if !ok {
+		return exitUsage
+	}
+
+	object, origin, symbols, err := c.load(files[0])
+	if err != nil {
+		return exitError
+	}
+	if *base != "" {
+		value, err := strconv.ParseUint(*base, 16, 16)
+		if err != nil {
+			c.errorf("invalid base address %q", *base)
+			return exitUsage
+		}
+		origin = uint16(value)
+	}
+	if len(object) == 0 || int(origin)+len(object) > 0x10000 {
+		c.errorf("%d bytes of object code do not fit at 0x%04X", len(object), origin)
+		return exitError
+	}
+
+	var mem [0x10000]byte
+	copy(mem[origin:], object)
+	insts := disasm.Disassemble(mem[:], origin, origin+uint16(len(object)-1))
+
+	if err := disasm.Write(c.stdout, insts, disasm.LabelsFrom(symbols)); err != nil {
+		c.errorf("%v", err)
+		return exitError
+	}
+	return exitHalt
+}
+
+// load reads a program from an object file, or assembles it when the file
+// is source. Errors are reported before returning.
+func (c *cli) load(file string) (object []byte, origin uint16, symbols assembler.SymbolTable, err error) {
+	if filepath.Ext(file) == ".pep" {
+		program, err := c.assemble(file)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return program.Object, program.Origin, program.Symbols, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		c.errorf("%v", err)
+		return nil, 0, nil, err
+	}
+	defer f.Close()
+
+	if object, err = computer.ReadObjectFile(f); err != nil {
+		c.errorf("%s: %v", file, err)
+		return nil, 0, nil, err
+	}
+	return object, 0, nil, nil
+}
+
+// assemble assembles a source file, reporting every error.
+func (c *cli) assemble(file string) (*assembler.Program, error) {
+	source, err := os.ReadFile(file)
+	if err != nil {
+		c.errorf("%v", err)
+		return nil, err
+	}
+
+	program, err := assembler.Assemble(string(source))
+	if err != nil {
+		var list assembler.ErrorList
+		if errors.As(err, &list) {
+			for _, e := range list {
+				fmt.Fprintf(c.stderr, "%s:%d: %s\n", file, e.Line, e.Msg)
+			}
+		} else {
+			c.errorf("%s: %v", file, err)
+		}
+		return nil, err
+	}
+	for _, w := range program.Warnings {
+		fmt.Fprintf(c.stderr, "%s:%d: warning: %s\n", file, w.Line, w.Msg)
+	}
+	return program, nil
+}
+
+// parseRanges parses comma separated hex address ranges such as
+// "0000-00FF,FC15". An empty string is every address.
+func parseRanges(text string) ([]computer.AddressRange, error) {
+	var ranges []computer.AddressRange
+	if text == "" {
+		return ranges, nil
+	}
+
+	for _, part := range strings.Split(text, ",") {
+		start, end, found := strings.Cut(strings.TrimSpace(part), "-")
+		if !found {
+			end = start
+		}
+		s, err1 := strconv.ParseUint(start, 16, 16)
+		e, err2 := strconv.ParseUint(end, 16, 16)
+		if err1 != nil || err2 != nil || e < s {
+			return nil, fmt.Errorf("invalid address range %q", part)
+		}
+		ranges = append(ranges, computer.AddressRange{Start: uint16(s), End: uint16(e)})
+	}
+	return ranges, nil
+}
+
+// writeFile creates a file and fills it with write.
+func writeFile(name string, write func(io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const echoSource = `;Echo the input until NUL
+loop:    LDBA    0xFC15,d
+         BREQ    done
+         STBA    0xFC16,d
+         BR      loop
+done:    STOP
+         .END
+`
+
+func writeTemp(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func runCLI(stdin string, args ...string) (code int, stdout, stderr string) {
+	var out, errs strings.Builder
+	code = run(args, strings.NewReader(stdin), &out, &errs)
+	return code, out.String(), errs.String()
+}
+
+func TestAsmAndRun(t *testing.T) {
+	source := writeTemp(t, "echo.pep", echoSource)
+	object := filepath.Join(filepath.Dir(source), "out.pepo")
+	listing := filepath.Join(filepath.Dir(source), "echo.pepl")
+
+	if code, _, stderr := runCLI("", "asm", source, "-o", object, "-l", listing); code != exitHalt {
+		t.Fatalf("Expected asm to succeed but got %d: %s", code, stderr)
+	}
+	if text, err := os.ReadFile(object); err != nil || !strings.HasPrefix(string(text), "D1 FC 15 18") {
+		t.Errorf("Expected an object file but got %q %v", text, err)
+	}
+	if _, err := os.Stat(listing); err != nil {
+		t.Errorf("Expected a listing: %v", err)
+	}
+
+	code, stdout, _ := runCLI("hello", "run", object)
+	if code != exitHalt || stdout != "hello" {
+		t.Errorf("Expected exit %d and hello but got %d and %q", exitHalt, code, stdout)
+	}
+
+	input := writeTemp(t, "in.txt", "from a file")
+	code, stdout, _ = runCLI("", "run", "-input", input, source)
+	if code != exitHalt || stdout != "from a file" {
+		t.Errorf("Expected the input file to be echoed but got %d and %q", code, stdout)
+	}
+}
+
+// answerer is input that records the output written before it is read.
+type answerer struct {
+	stdout *strings.Builder
+	answer string
+	prompt string
+}
+
+func (a *answerer) Read(b []byte) (int, error) {
+	if a.answer == "" {
+		return 0, io.EOF
+	}
+	a.prompt = a.stdout.String()
+	n := copy(b, a.answer)
+	a.answer = a.answer[n:]
+	return n, nil
+}
+
+func TestRunFlushesPrompt(t *testing.T) {
+	source := writeTemp(t, "prompt.pep", `
+         STRO    prompt,d
+         DECI    num,d
+         DECO    num,d
+         STOP
+prompt:  .ASCII  "Number? \x00"
+num:     .BLOCK  2
+         .END
+`)
+
+	var out, errs strings.Builder
+	in := &answerer{stdout: &out, answer: "42\n"}
+	if code := run([]string{"run", source}, in, &out, &errs); code != exitHalt {
+		t.Fatalf("Expected exit %d but got %d: %s", exitHalt, code, errs.String())
+	}
+	if in.prompt != "Number? " || out.String() != "Number? 42" {
+		t.Errorf("Expected the prompt before the input but got %q then %q", in.prompt, out.String())
+	}
+}
+
+func TestAsmErrors(t *testing.T) {
+	source := writeTemp(t, "bad.pep", "         LDWA    1,q\n         FOO\n         .END\n")
+
+	code, _, stderr := runCLI("", "asm", source)
+	if code != exitError {
+		t.Errorf("Expected exit %d but got %d", exitError, code)
+	}
+	if !strings.Contains(stderr, "bad.pep:1:") || !strings.Contains(stderr, "bad.pep:2:") {
+		t.Errorf("Expected both errors located but got %q", stderr)
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	loop := writeTemp(t, "loop.pepo", "12 00 00 zz")
+	if code, _, _ := runCLI("", "run", loop, "-limit", "1000"); code != exitStepLimit {
+		t.Errorf("Expected exit %d but got %d", exitStepLimit, code)
+	}
+
+	illegal := writeTemp(t, "illegal.pepo", "E0 00 00 00 zz") // STWA 0,i
+	if code, _, stderr := runCLI("", "run", illegal); code != exitIllegal || !strings.Contains(stderr, "0x0000") {
+		t.Errorf("Expected exit %d but got %d: %s", exitIllegal, code, stderr)
+	}
+
+	rom := writeTemp(t, "rom.pepo", "E1 FF FE 00 zz") // STWA 0xFFFE,d
+	if code, _, stderr := runCLI("", "run", rom); code != exitProtection || !strings.Contains(stderr, "0xFFFE") {
+		t.Errorf("Expected exit %d but got %d: %s", exitProtection, code, stderr)
+	}
+
+	if code, _, _ := runCLI("", "run", filepath.Join(t.TempDir(), "missing.pepo")); code != exitError {
+		t.Errorf("Expected exit %d but got %d", exitError, code)
+	}
+	if code, _, _ := runCLI("", "run"); code != exitUsage {
+		t.Errorf("Expected exit %d but got %d", exitUsage, code)
+	}
+	if code, _, _ := runCLI("", "frobnicate"); code != exitUsage {
+		t.Errorf("Expected exit %d but got %d", exitUsage, code)
+	}
+}
+
+func TestDisasm(t *testing.T) {
+	source := writeTemp(t, "echo.pep", echoSource)
+
+	code, stdout, _ := runCLI("", "disasm", source)
+	if code != exitHalt {
+		t.Fatalf("Expected exit %d but got %d", exitHalt, code)
+	}
+	if !strings.Contains(stdout, "0003  18000C          BREQ    done") {
+		t.Errorf("Expected labelled branches but got\n%s", stdout)
+	}
+
+	object := writeTemp(t, "stop.pepo", "00 zz")
+	if _, stdout, _ = runCLI("", "disasm", object, "-base", "0100"); !strings.HasPrefix(stdout, "0100  00") {
+		t.Errorf("Expected the code at 0x0100 but got\n%s", stdout)
+	}
+}
+
+func TestDump(t *testing.T) {
+	object := writeTemp(t, "store.pepo", "D0 00 41 F1 00 10 00 zz") // LDWA 0x41,i; STBA 0x10,d; STOP
+
+	code, stdout, _ := runCLI("", "dump", object, "-range", "0010-0011")
+	if code != exitHalt {
+		t.Fatalf("Expected exit %d but got %d", exitHalt, code)
+	}
+	if !strings.HasPrefix(stdout, "0010  41 00") {
+		t.Errorf("Expected the stored byte but got\n%s", stdout)
+	}
+
+	if code, stdout, _ = runCLI("", "dump", object, "-range", "0010-0011", "-format", "ihex"); !strings.HasPrefix(stdout, ":020010004100AD") {
+		t.Errorf("Expected an Intel HEX record but got %d\n%s", code, stdout)
+	}
+	if code, _, _ = runCLI("", "dump", object, "-range", "00FF-0000"); code != exitUsage {
+		t.Errorf("Expected exit %d for a bad range but got %d", exitUsage, code)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	source := writeTemp(t, "echo.pep", echoSource)
+	input := writeTemp(t, "in.txt", "ok")
+
+	code, stdout, _ := runCLI("break done\ncontinue\nregisters\nquit\n", "debug", source, "-input", input)
+	if code != exitHalt {
+		t.Fatalf("Expected exit %d but got %d", exitHalt, code)
+	}
+	for _, e := range []string{"Breakpoint 1 at 0x000C <done>", "ok", "Breakpoint 1, 0x000C <done>", "PC=0x000C"} {
+		if !strings.Contains(stdout, e) {
+			t.Errorf("Expected %q in\n%s", e, stdout)
+		}
+	}
+}
+
+func TestDebugVars(t *testing.T) {
+	source := writeTemp(t, "tags.pep", `         LDWA    5,i
+         STWA    total,d
+         STOP
+total:   .BLOCK  2           ;#2d
+digit:   .BLOCK  1           ;#2d
+         .END
+`)
+
+	code, stdout, stderr := runCLI("step 2\nvars\nquit\n", "debug", source)
+	if code != exitHalt {
+		t.Fatalf("Expected exit %d but got %d", exitHalt, code)
+	}
+	if !strings.Contains(stdout, "Globals:\n  0x0007  total      #2d    5\n") {
+		t.Errorf("Expected the global total in\n%s", stdout)
+	}
+	if !strings.Contains(stderr, "tags.pep:5: warning: trace tags take 2 bytes but .BLOCK reserves 1") {
+		t.Errorf("Expected a warning for digit in %q", stderr)
+	}
+}
+
+func TestRunBacktrace(t *testing.T) {
+	// down recurses twice, then executes an illegal STWA 0,i.
+	source := writeTemp(t, "down.pep", `main:    LDWA    2,i
+         CALL    down
+         STOP
+down:    CPWA    0,i
+         BREQ    crash
+         SUBA    1,i
+         CALL    down
+         RET
+crash:   .BYTE   0xE0
+         .WORD   0
+         .END
+`)
+
+	code, _, stderr := runCLI("", "run", source)
+	if code != exitIllegal {
+		t.Fatalf("Expected exit %d but got %d: %s", exitIllegal, code, stderr)
+	}
+	expected := `#0  0x0014 <crash> in down, called from 0x0010 <down+9>, stack 0xFB89-0xFB8A
+#1  0x0013 <down+12> in down, called from 0x0010 <down+9>, stack 0xFB8B-0xFB8C
+#2  0x0013 <down+12> in down, called from 0x0003 <main+3>, stack 0xFB8D-0xFB8E
+#3  0x0006 <main+6>
+`
+	if !strings.HasSuffix(stderr, expected) {
+		t.Errorf("Expected the backtrace\n%s\nin\n%s", expected, stderr)
+	}
+}
+
+func TestRunReportsBadReturnOnHalt(t *testing.T) {
+	// smash overwrites its return address with done, which then halts.
+	source := writeTemp(t, "smash.pep", `main:    CALL    smash
+         STOP
+smash:   LDWA    done,i
+         STWA    0,s
+         RET
+done:    STOP
+         .END
+`)
+
+	code, _, stderr := runCLI("", "run", source)
+	if code != exitHalt {
+		t.Fatalf("Expected exit %d but got %d: %s", exitHalt, code, stderr)
+	}
+	expected := "stack smashed: RET at 0x000A returned to 0x000B but CALL at 0x0000 pushed 0x0003 at 0xFB8D"
+	if !strings.Contains(stderr, expected) {
+		t.Errorf("Expected %q in %q", expected, stderr)
+	}
+}
+
+func TestGDBServerListenError(t *testing.T) {
+	source := writeTemp(t, "echo.pep", echoSource)
+
+	code, _, stderr := runCLI("", "gdbserver", source, "-listen", "localhost:-1")
+	if code != exitError || !strings.Contains(stderr, "pep9: ") {
+		t.Errorf("Expected exit %d with an error but got %d: %s", exitError, code, stderr)
+	}
+}
+
+func TestDAP(t *testing.T) {
+	source := writeTemp(t, "echo.pep", echoSource)
+	input := writeTemp(t, "in.txt", "hi")
+
+	request := `{"seq":1,"type":"request","command":"attach","arguments":{}}`
+	stdin := fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(request), request)
+	code, stdout, stderr := runCLI(stdin, "dap", "-attach", source, "-input", input)
+	if code != exitHalt || !strings.Contains(stdout, `"command":"attach"`) || !strings.Contains(stdout, `"event":"initialized"`) {
+		t.Errorf("Expected an attach response but got %d: %s%s", code, stdout, stderr)
+	}
+}
+
+func TestRunTrace(t *testing.T) {
+	source := writeTemp(t, "echo.pep", echoSource)
+
+	code, stdout, stderr := runCLI("hi", "run", source, "-trace", "-", "-trace-format", "jsonl", "-trace-limit", "2")
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if code != exitHalt || stdout != "hi" || len(lines) != 2 || !strings.Contains(lines[0], `"instruction":"LDBA 0xFC15,d"`) {
+		t.Errorf("Expected two JSON lines but got %d: %s", code, stderr)
+	}
+
+	file := filepath.Join(t.TempDir(), "trace.txt")
+	if code, _, stderr := runCLI("hi", "run", source, "-trace", file, "-trace-range", "000C"); code != exitHalt {
+		t.Fatalf("Expected exit %d but got %d: %s", exitHalt, code, stderr)
+	}
+	if text, _ := os.ReadFile(file); !strings.HasPrefix(string(text), "000C  00      STOP") || strings.Count(string(text), "\n") != 1 {
+		t.Errorf("Expected only STOP to be traced but got\n%s", text)
+	}
+
+	if code, _, _ := runCLI("", "run", source, "-trace", "-", "-trace-format", "xml"); code != exitError {
+		t.Errorf("Expected exit %d but got %d", exitError, code)
+	}
+}
+
+func TestRunTiming(t *testing.T) {
+	source := writeTemp(t, "echo.pep", echoSource)
+
+	code, _, stderr := runCLI("hi", "run", source, "-timing", "one-byte")
+	if code != exitHalt || !strings.Contains(stderr, "cycles on the one-byte bus") {
+		t.Errorf("Expected a cycle count but got %d: %s", code, stderr)
+	}
+	if code, _, _ := runCLI("", "run", source, "-timing", "three-byte"); code != exitUsage {
+		t.Errorf("Expected exit %d but got %d", exitUsage, code)
+	}
+}
+
+func TestCPU(t *testing.T) {
+	source := writeTemp(t, "adda.pepcpu", `// ADDA 0x0FF0,i
+UnitPre: IR=0x700FF0, A=0x0F11
+UnitPost: A=0x1F01, C=0
+A=1, B=10, AMux=1, ALU=1, CMux=1, C=1; SCk, LoadCk
+A=0, B=9, AMux=1, CSMux=1, ALU=2, AndZ=1, CMux=1, C=0; NCk, ZCk, VCk, CCk, LoadCk
+`)
+	code, stdout, stderr := runCLI("", "cpu", source)
+	if code != exitHalt || !strings.HasPrefix(stdout, "ok ") {
+		t.Errorf("Expected the test to pass but got %d: %s%s", code, stdout, stderr)
+	}
+
+	failing := writeTemp(t, "fail.pepcpu", "UnitPost: A=0x0001\nA=0, AMux=1, ALU=0, CMux=1, C=1; LoadCk\n")
+	code, stdout, _ = runCLI("", "cpu", failing, "-bus", "two-byte")
+	if code != exitFailed || !strings.Contains(stdout, "fail.pepcpu:1: cycle 0: A is 0x0000, expected 0x0001") {
+		t.Errorf("Expected a failure but got %d: %s", code, stdout)
+	}
+
+	broken := writeTemp(t, "broken.pepcpu", "// comment\nA=1, Foo=2\n")
+	if code, _, stderr := runCLI("", "cpu", broken); code != exitError || !strings.Contains(stderr, "broken.pepcpu:2: unknown signal") {
+		t.Errorf("Expected a syntax error but got %d: %s", code, stderr)
+	}
+	if code, _, _ := runCLI("", "cpu", source, "-bus", "wide"); code != exitUsage {
+		t.Errorf("Expected exit %d but got %d", exitUsage, code)
+	}
+}
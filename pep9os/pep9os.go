@@ -0,0 +1,63 @@
+package pep9os
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+	"sync"
+
+	"pep9emulator/assembler"
+)
+
+// Source is the assembly language source of the Pep/9 operating system,
+// with its ROM padding left empty for Program to size.
+//
+//go:embed pep9os.pep
+var Source string
+
+// memoryMap is where the standard Pep/9 memory map places the operating
+// system's RAM, which the machine vectors point to.
+var memoryMap = map[string]uint16{
+	"osRAM":    0xFB8F,
+	"wordTemp": 0xFC0F,
+	"charIn":   0xFC15,
+	"charOut":  0xFC16,
+}
+
+// padLine is the line of Source that pads the ROM.
+const padLine = "romPad:  .BLOCK  0\n"
+
+var (
+	once    sync.Once
+	program *assembler.Program
+)
+
+// Program returns the assembled operating system. Its object code belongs
+// at Origin and runs to 0xFFFF, ending with the machine vectors.
+//
+// The ROM is padded by however far its RAM lands above the memory map
+// without padding, so the map does not depend on the size of the code.
+func Program() *assembler.Program {
+	once.Do(func() {
+		program = assemble(Source)
+		pad := int(program.Symbols["charIn"].Value) - int(memoryMap["charIn"])
+		if pad < 0 {
+			panic(fmt.Sprintf("pep9os: the ROM is %d bytes too large for the memory map", -pad))
+		}
+		program = assemble(strings.Replace(Source, padLine, fmt.Sprintf("romPad:  .BLOCK  %d\n", pad), 1))
+		for name, value := range memoryMap {
+			if sym := program.Symbols[name]; sym.Value != value {
+				panic(fmt.Sprintf("pep9os: %s is at 0x%04X rather than 0x%04X", name, sym.Value, value))
+			}
+		}
+	})
+	return program
+}
+
+func assemble(source string) *assembler.Program {
+	p, err := assembler.Assemble(source)
+	if err != nil {
+		panic(fmt.Sprintf("pep9os: the operating system does not assemble: %v", err))
+	}
+	return p
+}
@@ -0,0 +1,39 @@
+package pep9os
+
+import "testing"
+
+func TestMemoryMap(t *testing.T) {
+	p := Program()
+
+	if int(p.Origin)+len(p.Object) != 0x10000 {
+		t.Errorf("Expected the ROM to end at 0xFFFF but it ends at 0x%04X", int(p.Origin)+len(p.Object)-1)
+	}
+
+	expected := map[string]uint16{
+		"osRAM":    0xFB8F,
+		"wordTemp": 0xFC0F,
+		"charIn":   0xFC15,
+		"charOut":  0xFC16,
+	}
+	for name, value := range expected {
+		if sym := p.Symbols[name]; sym.Value != value {
+			t.Errorf("Expected %s at 0x%04X but got 0x%04X", name, value, sym.Value)
+		}
+	}
+	if p.Origin != 0xFC17 {
+		t.Errorf("Expected the ROM to start at 0xFC17 but got 0x%04X", p.Origin)
+	}
+}
+
+func TestVectors(t *testing.T) {
+	p := Program()
+	vectors := p.Object[len(p.Object)-12:]
+	word := func(i int) uint16 { return uint16(vectors[i])<<8 | uint16(vectors[i+1]) }
+
+	if word(0) != 0xFB8F || word(2) != 0xFC0F || word(4) != 0xFC15 || word(6) != 0xFC16 {
+		t.Errorf("Expected the memory map vectors but got % X", vectors)
+	}
+	if word(8) != p.Symbols["loader"].Value || word(10) != p.Symbols["trap"].Value {
+		t.Errorf("Expected the loader and trap vectors but got % X", vectors[8:])
+	}
+}
@@ -0,0 +1,207 @@
+// Package trace logs every instruction a computer executes, as text for
+// people or as JSON Lines for tools.
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"pep9emulator/computer"
+	"pep9emulator/disasm"
+	"pep9emulator/isa"
+)
+
+// Format selects how instructions are written.
+type Format int
+
+const (
+	Text  Format = iota // One aligned line per instruction
+	JSONL               // One JSON Record per line
+)
+
+// ParseFormat returns the format named "text" or "jsonl".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return Text, nil
+	case "jsonl":
+		return JSONL, nil
+	}
+	return 0, fmt.Errorf("unknown trace format %q", name)
+}
+
+// Record is one traced instruction. Registers are those after it executed.
+type Record struct {
+	Step        int     `json:"step"` // 1 for the first instruction executed
+	PC          uint16  `json:"pc"`
+	Bytes       string  `json:"bytes"` // Hex, e.g. "C10012"
+	Instruction string  `json:"instruction"`
+	Address     *uint16 `json:"ea,omitempty"`     // Effective address
+	Loaded      *uint16 `json:"loaded,omitempty"` // Operand read from Address
+	Stored      *uint16 `json:"stored,omitempty"` // Operand written to Address
+	A           uint16  `json:"a"`
+	X           uint16  `json:"x"`
+	SP          uint16  `json:"sp"`
+	NextPC      uint16  `json:"nextPC"`
+	NZVC        string  `json:"nzvc"`
+}
+
+// Tracer writes the instructions passed to Trace. Filters are applied in
+// order: Ranges, then Skip, then Limit.
+type Tracer struct {
+	Format Format
+	Labels disasm.Labels // Names used in the disassembly, may be nil
+
+	// Ranges limits tracing to instructions whose address is in one of
+	// them. No ranges traces every address.
+	Ranges []computer.AddressRange
+	// Skip is how many instructions that pass Ranges are not written
+	// before tracing starts.
+	Skip int
+	// Limit is how many instructions are written, 0 for no limit.
+	Limit int
+
+	w       io.Writer
+	steps   int // Instructions seen, for Record.Step
+	matched int // Instructions that passed Ranges
+	written int
+	err     error
+}
+
+// New creates a tracer writing to w.
+func New(w io.Writer, format Format) *Tracer {
+	return &Tracer{Format: format, w: w}
+}
+
+// Attach makes the tracer trace every instruction the computer executes.
+func (t *Tracer) Attach(c *computer.Pep9Computer) {
+	c.Trace = t.Trace
+}
+
+// Err returns the first error writing the trace. Nothing is written after
+// an error.
+func (t *Tracer) Err() error {
+	return t.err
+}
+
+// Trace writes one executed instruction if it passes the filters.
+func (t *Tracer) Trace(r computer.StepResult) {
+	t.steps++
+	if t.err != nil || !t.inRange(r.Address) {
+		return
+	}
+	t.matched++
+	if t.matched <= t.Skip || (t.Limit > 0 && t.written >= t.Limit) {
+		return
+	}
+	t.written++
+
+	rec := NewRecord(t.steps, r, t.Labels)
+	if t.Format == JSONL {
+		t.err = json.NewEncoder(t.w).Encode(rec)
+	} else {
+		_, t.err = fmt.Fprintln(t.w, rec.String())
+	}
+}
+
+func (t *Tracer) inRange(address uint16) bool {
+	if len(t.Ranges) == 0 {
+		return true
+	}
+	for _, r := range t.Ranges {
+		if r.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRecord describes an executed instruction, numbered step.
+func NewRecord(step int, r computer.StepResult, labels disasm.Labels) Record {
+	inst := disasm.Instruction{Address: r.Address, Bytes: []byte{r.OpCode}, Instruction: r.Instruction, Mode: r.Mode, Operand: r.Operand}
+	if !r.Instruction.IsUnary() {
+		inst.Bytes = append(inst.Bytes, uint8(r.Operand>>8), uint8(r.Operand))
+	}
+
+	after := r.After
+	rec := Record{
+		Step:        step,
+		PC:          r.Address,
+		Bytes:       fmt.Sprintf("%X", inst.Bytes),
+		Instruction: strings.Join(strings.Fields(inst.Text(labels)), " "),
+		A:           after.A,
+		X:           after.X,
+		SP:          after.SP,
+		NextPC:      after.PC,
+		NZVC:        bits(after.N, after.Z, after.V, after.C),
+	}
+
+	// Branches read their target from the table at the effective address
+	// rather than loading an operand, so only the address is shown.
+	if r.HasEffectiveAddress {
+		address := r.EffectiveAddress
+		rec.Address = &address
+		if r.Instruction.Format != isa.ModeA {
+			rec.Loaded = operand(r.Reads, address)
+			rec.Stored = operand(stores(r.Writes), address)
+		}
+	}
+	return rec
+}
+
+// operand finds the byte or word accessed at address: the last access
+// there, together with the next access if it is to the following byte.
+func operand(accesses []computer.MemoryRead, address uint16) *uint16 {
+	for i := len(accesses) - 1; i >= 0; i-- {
+		if accesses[i].Address != address {
+			continue
+		}
+		result := uint16(accesses[i].Value)
+		if i+1 < len(accesses) && accesses[i+1].Address == address+1 {
+			result = result<<8 | uint16(accesses[i+1].Value)
+		}
+		return &result
+	}
+	return nil
+}
+
+// stores lists the bytes written by an instruction as the values they left.
+func stores(writes []computer.MemoryWrite) []computer.MemoryRead {
+	accesses := make([]computer.MemoryRead, len(writes))
+	for i, w := range writes {
+		accesses[i] = computer.MemoryRead{Address: w.Address, Value: w.Value}
+	}
+	return accesses
+}
+
+func bits(flags ...bool) string {
+	var b strings.Builder
+	for _, f := range flags {
+		if f {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+	return b.String()
+}
+
+// String formats a record as one line of the text trace, such as
+//
+//	0003  C10012  LDWA 0x0012,d     ea=0012 ld=1234  A=1234 X=0000 SP=FB8F PC=0006 NZVC=0000
+func (r Record) String() string {
+	var access string
+	if r.Address != nil {
+		access = fmt.Sprintf("ea=%04X", *r.Address)
+		if r.Loaded != nil {
+			access += fmt.Sprintf(" ld=%04X", *r.Loaded)
+		}
+		if r.Stored != nil {
+			access += fmt.Sprintf(" st=%04X", *r.Stored)
+		}
+	}
+	return fmt.Sprintf("%04X  %-6s  %-17s %-16s  A=%04X X=%04X SP=%04X PC=%04X NZVC=%s",
+		r.PC, r.Bytes, r.Instruction, access, r.A, r.X, r.SP, r.NextPC, r.NZVC)
+}
@@ -0,0 +1,113 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"pep9emulator/assembler"
+	"pep9emulator/computer"
+	"pep9emulator/disasm"
+)
+
+const program = `
+main:    LDWA    0x1234,i
+         STWA    value,d
+         LDBX    value,d
+         CALL    sub
+         STOP
+sub:     RET
+value:   .BLOCK  2
+         .END`
+
+func run(t *testing.T, tracer *Tracer) {
+	t.Helper()
+	p, err := assembler.Assemble(program)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tracer.Labels = disasm.LabelsFrom(p.Symbols)
+	c := &computer.Pep9Computer{}
+	c.Initialize()
+	c.LoadProgram(p.Object)
+	tracer.Attach(c)
+	if err := c.Run(context.Background(), 100); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tracer.Err(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestText(t *testing.T) {
+	var out strings.Builder
+	run(t, New(&out, Text))
+
+	expected := []string{
+		"0000  C01234  LDWA 0x1234,i                       A=1234 X=0000 SP=FB8F PC=0003 NZVC=0000",
+		"0003  E1000E  STWA 0x000E,d     ea=000E st=1234   A=1234 X=0000 SP=FB8F PC=0006 NZVC=0000",
+		"0006  D9000E  LDBX 0x000E,d     ea=000E ld=0012   A=1234 X=0012 SP=FB8F PC=0009 NZVC=0000",
+		"0009  24000D  CALL sub                            A=1234 X=0012 SP=FB8D PC=000D NZVC=0000",
+		"000D  01      RET                                 A=1234 X=0012 SP=FB8F PC=000C NZVC=0000",
+		"000C  00      STOP                                A=1234 X=0012 SP=FB8F PC=000D NZVC=0000",
+	}
+	if got := out.String(); got != strings.Join(expected, "\n")+"\n" {
+		t.Errorf("Expected\n%s\nbut got\n%s", strings.Join(expected, "\n"), got)
+	}
+}
+
+func TestJSONL(t *testing.T) {
+	var out strings.Builder
+	run(t, New(&out, JSONL))
+
+	var records []Record
+	scanner := bufio.NewScanner(strings.NewReader(out.String()))
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Invalid line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 6 {
+		t.Fatalf("Expected 6 records but got %d", len(records))
+	}
+	store := records[1]
+	if store.Step != 2 || store.Bytes != "E1000E" || store.Address == nil || *store.Address != 0x0E ||
+		store.Stored == nil || *store.Stored != 0x1234 || store.Loaded != nil {
+		t.Errorf("Unexpected store record %+v", store)
+	}
+	if records[0].Address != nil || records[5].Instruction != "STOP" {
+		t.Errorf("Unexpected records %+v and %+v", records[0], records[5])
+	}
+}
+
+func TestFilters(t *testing.T) {
+	var out strings.Builder
+	tracer := New(&out, JSONL)
+	tracer.Ranges = []computer.AddressRange{{Start: 0x0003, End: 0x000C}}
+	tracer.Skip = 1
+	tracer.Limit = 2
+	run(t, tracer)
+
+	var steps []int
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var r Record
+		json.Unmarshal([]byte(line), &r)
+		steps = append(steps, r.Step)
+	}
+	if len(steps) != 2 || steps[0] != 3 || steps[1] != 4 {
+		t.Errorf("Expected steps 3 and 4 but got %v", steps)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if f, err := ParseFormat("JSONL"); err != nil || f != JSONL {
+		t.Errorf("Expected JSONL but got %v, %v", f, err)
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}